@@ -50,7 +50,29 @@ lint() {
 
 test() {
   echo "Running 'go test'..."
-  go test ./internal/... -cover
+  go test ./... -cover
+}
+
+e2e() {
+  echo "Starting fake-gcs-server and the Firestore emulator..."
+  # NOTE(joel): The containers are removed again however the tests end.
+  trap 'docker rm -f lfs-e2e-gcs lfs-e2e-firestore >/dev/null 2>&1' EXIT
+  docker run -d --rm --name lfs-e2e-gcs -p 4443:4443 \
+    fsouza/fake-gcs-server -scheme http -port 4443 >/dev/null
+  docker run -d --rm --name lfs-e2e-firestore -p 8081:8081 \
+    gcr.io/google.com/cloudsdktool/google-cloud-cli:emulators \
+    gcloud emulators firestore start --host-port=0.0.0.0:8081 >/dev/null
+  for i in $(seq 1 60); do
+    if curl -sf http://localhost:4443/storage/v1/b >/dev/null &&
+      curl -sf http://localhost:8081/ >/dev/null; then
+      break
+    fi
+    sleep 1
+  done
+
+  echo "Running 'go test -tags e2e'..."
+  LFS_E2E_GCS=localhost:4443 LFS_E2E_FIRESTORE=localhost:8081 \
+    go test -tags e2e -count=1 -v ./e2e/...
 }
 
 validate() {
@@ -72,6 +94,7 @@ help() {
   echo "  format                Format code"
   echo "  lint                  Lint code"
   echo "  test                  Run tests"
+  echo "  e2e                   Run end-to-end tests (needs docker)"
   echo "  validate              Validate code"
   echo "  install_dependencies  Install dependencies"
   echo "  help                  Show help"
@@ -0,0 +1,4 @@
+// Package e2e holds end-to-end tests that run the local-file-sync binary
+// against fake-gcs-server and the Firestore emulator. They are built with the
+// e2e tag only; `./Taskfile.sh e2e` starts the emulators and runs them.
+package e2e
@@ -0,0 +1,303 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// NOTE(joel): The emulators are started by `./Taskfile.sh e2e`, which
+// exports their addresses. The Google client libraries talk to them (without
+// credentials) when STORAGE_EMULATOR_HOST and FIRESTORE_EMULATOR_HOST are set.
+var (
+	gcsHost       = os.Getenv("LFS_E2E_GCS")
+	firestoreHost = os.Getenv("LFS_E2E_FIRESTORE")
+	binary        = os.Getenv("LFS_E2E_BINARY")
+)
+
+const project = "e2e"
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestMain builds the binary unless LFS_E2E_BINARY names one.
+func TestMain(m *testing.M) {
+	if gcsHost == "" || firestoreHost == "" {
+		fmt.Println("e2e: LFS_E2E_GCS and LFS_E2E_FIRESTORE not set; run ./Taskfile.sh e2e")
+		os.Exit(0)
+	}
+	if binary != "" {
+		os.Exit(m.Run())
+	}
+	dir, err := os.MkdirTemp("", "lfs-e2e-")
+	if err != nil {
+		fmt.Println("e2e:", err)
+		os.Exit(1)
+	}
+	binary = filepath.Join(dir, "local-file-sync")
+	build := exec.Command("go", "build", "-o", binary, "../cmd/local-file-sync")
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	code := 1
+	if err := build.Run(); err != nil {
+		fmt.Println("e2e: build:", err)
+	} else {
+		code = m.Run()
+	}
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestPipeline verifies a run uploads triggered folders, writes their
+// Firestore records and marks them processed, so the next run does nothing.
+func TestPipeline(t *testing.T) {
+	bucket := newBucket(t)
+	proxy := newFaultProxy(t, gcsHost)
+	root := t.TempDir()
+	writeFolder(t, root, "ORDER1", map[string]string{"a.txt": "a", "b.txt": "bb"})
+	writeFolder(t, root, "ORDER2", map[string]string{"c.txt": "ccc"})
+	coll := "uploads-" + bucket
+
+	if out, err := runBinary(t, proxy, root, "-gcs-bucket", bucket, "-firestore", project+":"+coll); err != nil {
+		t.Fatalf("run: %v\n%s", err, out)
+	}
+	want := []string{"ORDER1/a.txt", "ORDER1/b.txt", "ORDER2/c.txt"}
+	if got := listObjects(t, bucket); !slices.Equal(got, want) {
+		t.Fatalf("expected objects %v, got %v", want, got)
+	}
+	if n := countDocuments(t, coll); n != 2 {
+		t.Fatalf("expected 2 records, got %d", n)
+	}
+
+	requests := proxy.count()
+	if out, err := runBinary(t, proxy, root, "-gcs-bucket", bucket, "-firestore", project+":"+coll); err != nil {
+		t.Fatalf("second run: %v\n%s", err, out)
+	}
+	if proxy.count() != requests {
+		t.Fatalf("expected no requests for processed folders, got %d more", proxy.count()-requests)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestTransientFailures verifies failed uploads are retried with
+// -file-failure retry, and that a folder failing for good fails the run
+// (non-zero exit) and is uploaded by the next one.
+func TestTransientFailures(t *testing.T) {
+	bucket := newBucket(t)
+	proxy := newFaultProxy(t, gcsHost)
+	root := t.TempDir()
+	writeFolder(t, root, "ORDER1", map[string]string{"a.txt": "a"})
+	writeFolder(t, root, "ORDER2", map[string]string{"b.txt": "b"})
+
+	// NOTE(joel): The first upload of a.txt fails; the retry succeeds.
+	proxy.fail("a.txt", 1)
+	// NOTE(joel): b.txt fails more often than it is retried.
+	proxy.fail("b.txt", 10)
+	out, err := runBinary(t, proxy, root, "-gcs-bucket", bucket,
+		"-file-failure", "retry", "-file-retries", "1", "-file-retry-backoff", "10ms")
+	if err == nil {
+		t.Fatalf("expected the run to fail\n%s", out)
+	}
+	if got := listObjects(t, bucket); !slices.Equal(got, []string{"ORDER1/a.txt"}) {
+		t.Fatalf("expected only the retried folder uploaded, got %v\n%s", got, out)
+	}
+
+	proxy.fail("b.txt", 0)
+	if out, err := runBinary(t, proxy, root, "-gcs-bucket", bucket); err != nil {
+		t.Fatalf("second run: %v\n%s", err, out)
+	}
+	if got := listObjects(t, bucket); !slices.Equal(got, []string{"ORDER1/a.txt", "ORDER2/b.txt"}) {
+		t.Fatalf("expected the failed folder uploaded by the next run, got %v", got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// runBinary runs local-file-sync on root with args, its state and lock file
+// in root, talking to GCS through proxy. It returns the combined output.
+func runBinary(t *testing.T, proxy *faultProxy, root string, args ...string) (string, error) {
+	t.Helper()
+	args = append([]string{
+		"-dir", root,
+		"-state-file", filepath.Join(root, "state.json"),
+		"-lock-file", filepath.Join(root, "lock"),
+		"-progress", "never",
+	}, args...)
+	cmd := exec.Command(binary, args...)
+	cmd.Env = append(os.Environ(),
+		"STORAGE_EMULATOR_HOST="+proxy.URL,
+		"FIRESTORE_EMULATOR_HOST="+firestoreHost,
+	)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// faultProxy forwards requests to fake-gcs-server and fails uploads of
+// chosen objects with 503 Service Unavailable.
+type faultProxy struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures map[string]int
+	requests int
+}
+
+// newFaultProxy starts a proxy for the emulator at target (host:port).
+func newFaultProxy(t *testing.T, target string) *faultProxy {
+	t.Helper()
+	u, err := url.Parse("http://" + target)
+	if err != nil {
+		t.Fatalf("parse emulator address: %v", err)
+	}
+	p := &faultProxy{failures: make(map[string]int)}
+	rp := httputil.NewSingleHostReverseProxy(u)
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.injectFailure(r) {
+			http.Error(w, "injected failure", http.StatusServiceUnavailable)
+			return
+		}
+		rp.ServeHTTP(w, r)
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+// fail fails the next n uploads of objects whose name ends in suffix.
+func (p *faultProxy) fail(suffix string, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures[suffix] = n
+}
+
+// count returns the number of requests received.
+func (p *faultProxy) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.requests
+}
+
+// injectFailure reports whether r is an upload that should fail. The object
+// name of uploads is in the `name` query parameter of simple uploads and in
+// the JSON metadata of multipart and resumable ones, so the body is read (and
+// restored for the proxy) as well.
+func (p *faultProxy) injectFailure(r *http.Request) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests++
+	if !strings.HasPrefix(r.URL.Path, "/upload/") {
+		return false
+	}
+	name := r.URL.Query().Get("name")
+	var body []byte
+	if r.Body != nil {
+		body, _ = io.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	for suffix, n := range p.failures {
+		if n <= 0 {
+			continue
+		}
+		if (name != "" && strings.HasSuffix(name, suffix)) || bytes.Contains(body, []byte(suffix+`"`)) {
+			p.failures[suffix] = n - 1
+			return true
+		}
+	}
+	return false
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// newBucket creates a bucket named after the test in fake-gcs-server.
+func newBucket(t *testing.T) string {
+	t.Helper()
+	name := strings.ToLower(strings.ReplaceAll(t.Name(), "/", "-"))
+	body, _ := json.Marshal(map[string]string{"name": name})
+	resp, err := http.Post("http://"+gcsHost+"/storage/v1/b?project="+project, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("create bucket: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		b, _ := io.ReadAll(resp.Body)
+		t.Fatalf("create bucket: %s %s", resp.Status, b)
+	}
+	return name
+}
+
+// listObjects returns the sorted object names of bucket.
+func listObjects(t *testing.T, bucket string) []string {
+	t.Helper()
+	var list struct {
+		Items []struct {
+			Name string `json:"name"`
+		} `json:"items"`
+	}
+	getJSON(t, "http://"+gcsHost+"/storage/v1/b/"+bucket+"/o", &list)
+	var names []string
+	for _, o := range list.Items {
+		names = append(names, o.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// countDocuments returns the number of documents in the Firestore collection
+// coll of the emulator.
+func countDocuments(t *testing.T, coll string) int {
+	t.Helper()
+	var list struct {
+		Documents []json.RawMessage `json:"documents"`
+	}
+	getJSON(t, "http://"+firestoreHost+"/v1/projects/"+project+"/databases/(default)/documents/"+coll, &list)
+	return len(list.Documents)
+}
+
+// getJSON decodes the JSON response of a GET request to u into v.
+func getJSON(t *testing.T, u string, v any) {
+	t.Helper()
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatalf("get %s: %v", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		t.Fatalf("get %s: %s %s", u, resp.Status, b)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("decode %s: %v", u, err)
+	}
+}
+
+// writeFolder creates the folder name with files and its trigger in root.
+func writeFolder(t *testing.T, root, name string, files map[string]string) {
+	t.Helper()
+	if err := os.Mkdir(filepath.Join(root, name), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for f, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name, f), []byte(content), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, name+".RDY"), nil, 0o644); err != nil {
+		t.Fatalf("write trigger: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// predefinedACLs maps the -object-acl names (as known from gsutil) to the
+// predefined ACLs of the GCS JSON API.
+var predefinedACLs = map[string]string{
+	"authenticated-read":        "authenticatedRead",
+	"bucket-owner-full-control": "bucketOwnerFullControl",
+	"bucket-owner-read":         "bucketOwnerRead",
+	"private":                   "private",
+	"project-private":           "projectPrivate",
+	"public-read":               "publicRead",
+}
+
+// ObjectACL assigns a predefined ACL to the objects of files whose name
+// matches Pattern.
+type ObjectACL struct {
+	// ACL is the predefined ACL of the JSON API, e.g. "publicRead".
+	ACL string
+	// Pattern is a path.Match pattern for the file name (without folder);
+	// empty matches every file.
+	Pattern string
+}
+
+// ObjectACLs are the -object-acl rules; the first matching rule wins. The
+// zero value sets no ACL, so objects get the bucket's default ACL or, with
+// uniform bucket-level access, only the bucket's IAM policy applies.
+type ObjectACLs []ObjectACL
+
+////////////////////////////////////////////////////////////////////////////////
+
+// For returns the predefined ACL of the object of the file named name, or ""
+// if no rule matches.
+func (a ObjectACLs) For(name string) string {
+	base := path.Base(name)
+	for _, rule := range a {
+		if rule.Pattern == "" {
+			return rule.ACL
+		}
+		if ok, _ := path.Match(rule.Pattern, base); ok {
+			return rule.ACL
+		}
+	}
+	return ""
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// parseObjectACLs parses -object-acl: comma separated rules `ACL` or
+// `ACL:PATTERN`, e.g. `public-read:*.jpg,private`. Blank items are dropped.
+func parseObjectACLs(s string) (ObjectACLs, error) {
+	var acls ObjectACLs
+	for item := range strings.SplitSeq(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, pattern, _ := strings.Cut(item, ":")
+		acl, ok := predefinedACLs[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("invalid -object-acl %q: unknown ACL %q (want authenticated-read, bucket-owner-full-control, bucket-owner-read, private, project-private or public-read)", s, name)
+		}
+		pattern = strings.TrimSpace(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid -object-acl %q: pattern %q: %w", s, pattern, err)
+		}
+		acls = append(acls, ObjectACL{ACL: acl, Pattern: pattern})
+	}
+	return acls, nil
+}
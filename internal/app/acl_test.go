@@ -0,0 +1,57 @@
+package app
+
+import (
+	"slices"
+	"testing"
+)
+
+// TestParseObjectACLs verifies rules are parsed with optional patterns and
+// that unknown ACLs and malformed patterns are rejected.
+func TestParseObjectACLs(t *testing.T) {
+	acls, err := parseObjectACLs(" public-read:*.jpg, Bucket-Owner-Read:report-?.pdf ,,private")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := ObjectACLs{
+		{ACL: "publicRead", Pattern: "*.jpg"},
+		{ACL: "bucketOwnerRead", Pattern: "report-?.pdf"},
+		{ACL: "private"},
+	}
+	if !slices.Equal(acls, want) {
+		t.Fatalf("expected %v, got %v", want, acls)
+	}
+	if acls, err := parseObjectACLs(""); err != nil || acls != nil {
+		t.Fatalf("expected no rules, got %v %v", acls, err)
+	}
+	for _, bad := range []string{"public", "public-read:[", "world-writable:*"} {
+		if _, err := parseObjectACLs(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestObjectACLs_For verifies the first matching rule wins, patterns match the
+// file name without its directory, and no rule means no ACL.
+func TestObjectACLs_For(t *testing.T) {
+	acls := ObjectACLs{
+		{ACL: "publicRead", Pattern: "*.jpg"},
+		{ACL: "private", Pattern: "*"},
+	}
+	for name, want := range map[string]string{
+		"a.jpg":     "publicRead",
+		"sub/b.jpg": "publicRead",
+		"c.pdf":     "private",
+	} {
+		if got := acls.For(name); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+	if got := (ObjectACLs{{ACL: "publicRead", Pattern: "*.jpg"}}).For("c.pdf"); got != "" {
+		t.Fatalf("expected no ACL, got %q", got)
+	}
+	if got := ObjectACLs(nil).For("a.jpg"); got != "" {
+		t.Fatalf("expected no ACL, got %q", got)
+	}
+}
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"local-file-sync/internal/naming"
+)
+
+// collectionPlaceholders are the placeholders of record collection templates
+// available besides the -path-labels names. Date placeholders use the UTC
+// time the folder's upload started.
+var collectionPlaceholders = []string{"date", "year", "month", "day", "agent"}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ParseCollectionTemplate parses the collection of -firestore, which may be a
+// path of nested collections with placeholders, e.g. `sites/{site}/uploads`
+// or `uploads/{date}/folders`. The path must name a collection (an odd number
+// of segments) and use only the collectionPlaceholders or label names.
+func ParseCollectionTemplate(s string, labels naming.Labels) (naming.Template, error) {
+	tmpl, err := naming.NewTemplate(s)
+	if err != nil {
+		return naming.Template{}, err
+	}
+	segs := strings.Split(s, "/")
+	if len(segs)%2 == 0 || slices.Contains(segs, "") {
+		return naming.Template{}, fmt.Errorf("%q is not a collection path COLLECTION[/DOCUMENT/COLLECTION...]", s)
+	}
+	for _, name := range tmpl.Names() {
+		if !slices.Contains(collectionPlaceholders, name) && !slices.Contains(labels.Names(), name) {
+			return naming.Template{}, fmt.Errorf("unknown placeholder {%s}, expected one of %s or a -path-labels group", name, strings.Join(collectionPlaceholders, ", "))
+		}
+	}
+	return tmpl, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// RecordCollection expands the record collection template of cfg for a folder
+// with the given labels whose upload started at t. It fails if a placeholder
+// has no value for the folder, e.g. a label its path didn't match.
+func RecordCollection(cfg *Config, labels map[string]string, t time.Time) (string, error) {
+	tmpl, err := ParseCollectionTemplate(cfg.FirestoreCollection, cfg.PathLabels)
+	if err != nil {
+		return "", fmt.Errorf("record collection: %w", err)
+	}
+	if len(tmpl.Names()) == 0 {
+		return cfg.FirestoreCollection, nil
+	}
+	t = t.UTC()
+	values := map[string]string{
+		"date":  t.Format(time.DateOnly),
+		"year":  t.Format("2006"),
+		"month": t.Format("01"),
+		"day":   t.Format("02"),
+		"agent": cfg.AgentID,
+	}
+	// NOTE(joel): The built-in placeholders take precedence over labels of
+	// the same name.
+	for name, v := range labels {
+		if _, ok := values[name]; !ok {
+			values[name] = v
+		}
+	}
+	coll, err := tmpl.Expand(values)
+	if err != nil {
+		return "", fmt.Errorf("record collection: %w", err)
+	}
+	return coll, nil
+}
@@ -0,0 +1,36 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"local-file-sync/internal/naming"
+)
+
+// TestRecordCollection verifies collection templates are validated and
+// expanded with the date, agent and path labels of a folder.
+func TestRecordCollection(t *testing.T) {
+	labels, err := naming.NewLabels(`^(?P<site>[^/]+)/`)
+	if err != nil {
+		t.Fatalf("NewLabels: %v", err)
+	}
+	for _, s := range []string{"sites/{site}", "a//b", "uploads/{customer}/x", "uploads/{"} {
+		if _, err := ParseCollectionTemplate(s, labels); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+
+	cfg := &Config{FirestoreCollection: "sites/{site}/uploads/{date}/{agent}", PathLabels: labels, AgentID: "host1"}
+	at := time.Date(2025, 9, 30, 23, 30, 0, 0, time.FixedZone("X", -2*3600))
+	got, err := RecordCollection(cfg, map[string]string{"site": "S1", "date": "label"}, at)
+	if err != nil || got != "sites/S1/uploads/2025-10-01/host1" {
+		t.Fatalf("RecordCollection = %q, %v", got, err)
+	}
+	if _, err := RecordCollection(cfg, nil, at); err == nil {
+		t.Fatalf("expected error for folder without site label")
+	}
+	cfg.FirestoreCollection = "uploads"
+	if got, err := RecordCollection(cfg, nil, at); err != nil || got != "uploads" {
+		t.Fatalf("RecordCollection = %q, %v", got, err)
+	}
+}
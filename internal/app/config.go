@@ -6,26 +6,380 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
+
+	"local-file-sync/internal/events"
+	"local-file-sync/internal/naming"
+	"local-file-sync/internal/notify"
+	"local-file-sync/internal/report"
+	"local-file-sync/internal/scanner"
+
+	"github.com/google/uuid"
+)
+
+// Subcommands given before the flags. CommandHistory prints the run history
+// recorded in the state file, CommandSchema the JSON schema of the output,
+// CommandStateAudit a report of state entries that drifted from the
+// filesystem or the bucket and CommandBackfill processes a large backlog in
+// resumable chunks. CommandRecords lists the folder records of the local
+// record index and CommandRecordsVerify checks them against Firestore.
+// CommandExport writes the upload history as CSV. CommandLockStatus shows
+// the owner of the lock file and CommandLockBreak removes it.
+const (
+	CommandHistory       = "history"
+	CommandSchema        = "schema"
+	CommandStateAudit    = "state audit"
+	CommandBackfill      = "backfill"
+	CommandRecords       = "records"
+	CommandRecordsVerify = "records verify"
+	CommandExport        = "export"
+	CommandLockStatus    = "lock status"
+	CommandLockBreak     = "lock break"
+)
+
+// DefaultClaimTTL is the default -claim-ttl: long enough for the upload of a
+// large folder, short enough that a crashed claimant's folders are uploaded
+// by another agent the same day.
+const DefaultClaimTTL = time.Hour
+
+// Export data (-export-data): what the export command writes.
+const (
+	// ExportRuns exports the run history of the state file.
+	ExportRuns = "runs"
+	// ExportRecords exports the folder records of the local record index.
+	ExportRecords = "records"
+)
+
+// State update policies (-state-policy): whether a triggered folder is marked
+// processed once its files are uploaded, or only once its Firestore record was
+// written as well.
+const (
+	StatePolicyUpload   = "upload"
+	StatePolicyMetadata = "metadata"
+)
+
+// Empty folder policies (-empty-folder): how a triggered folder without
+// uploadable files is handled.
+const (
+	// EmptyFolderRecord processes the folder as usual (an empty file list is
+	// recorded) and marks it processed.
+	EmptyFolderRecord = "record"
+	// EmptyFolderRetry skips the folder without marking it processed, so it is
+	// picked up once the producer wrote files.
+	EmptyFolderRetry = "retry"
+	// EmptyFolderMarker uploads a marker object for the folder.
+	EmptyFolderMarker = "marker"
+)
+
+// File failure policies (-file-failure): what happens to the remaining files
+// of a folder once one of its files failed to upload.
+const (
+	// FileFailureContinue uploads the other files best effort.
+	FileFailureContinue = "continue"
+	// FileFailureCancel stops uploading the folder's remaining files.
+	FileFailureCancel = "cancel"
+	// FileFailureRetry retries the failed file (-file-retries times) before
+	// giving up on it; the other files are uploaded best effort.
+	FileFailureRetry = "retry"
+)
+
+// Existing object policies (-if-exists): what an upload does if its object
+// already exists, e.g. because another agent uploaded the same folder.
+const (
+	// IfExistsOverwrite overwrites the object (unconditional upload).
+	IfExistsOverwrite = "overwrite"
+	// IfExistsSkip uploads create-only and keeps an existing object,
+	// recording it in place of the local file.
+	IfExistsSkip = "skip"
+	// IfExistsConflict uploads create-only and fails the file if the object
+	// exists.
+	IfExistsConflict = "conflict"
+)
+
+// Re-upload policies (-reupload-versions): where a folder that was delivered
+// before (e.g. a re-touched trigger) is uploaded to.
+const (
+	// ReuploadOverwrite uploads to the same prefix, replacing the earlier
+	// delivery.
+	ReuploadOverwrite = "overwrite"
+	// ReuploadCounter uploads below a numbered version (`<folder>/v2/...`).
+	ReuploadCounter = "counter"
+	// ReuploadTimestamp uploads below a UTC timestamp version
+	// (`<folder>/20250930T123456Z/...`).
+	ReuploadTimestamp = "timestamp"
+)
+
+// Name collision policies (-name-collisions): what happens to folders of a
+// run uploaded to the same destination prefix, e.g. `a/ORDER1` and
+// `b/ORDER1` of a recursive scan.
+const (
+	// CollisionFail uploads none of the colliding folders and fails them.
+	CollisionFail = "fail"
+	// CollisionNamespace places the objects of colliding folders below their
+	// directory relative to the root (`a/ORDER1/...`).
+	CollisionNamespace = "namespace"
+	// CollisionIgnore uploads colliding folders over each other.
+	CollisionIgnore = "ignore"
+)
+
+// Snapshot policies (-snapshot): how uploads treat files that changed after
+// the scan listed them.
+const (
+	// SnapshotLenient uploads the listed files with their content at upload
+	// time; files that vanished meanwhile are skipped.
+	SnapshotLenient = "lenient"
+	// SnapshotStrict fails files that vanished or changed (size or
+	// modification time) since they were listed, or while they were uploaded,
+	// so the folder is retried with a new listing on the next run.
+	SnapshotStrict = "strict"
+)
+
+// Firestore document ID strategies (-doc-id): how the ID of a folder's record
+// (and claim) document is derived.
+const (
+	// DocIDHash hashes the record folder path (the default).
+	DocIDHash = "hash"
+	// DocIDPath uses the record folder path with `/` escaped
+	// (`in%2Fa%2FORDER1`).
+	DocIDPath = "path"
+	// DocIDReady uses the trigger's name without extension (`ORDER1` for
+	// `ORDER1.RDY`).
+	DocIDReady = "ready"
+	// DocIDProducer uses the ID announced by an `id=ID` line in the trigger
+	// file.
+	DocIDProducer = "producer"
+)
+
+// GCS client APIs (-gcs-api).
+const (
+	// GCSAPIJSON uses the JSON API over HTTP (the default).
+	GCSAPIJSON = "json"
+	// GCSAPIGRPC uses the gRPC API.
+	GCSAPIGRPC = "grpc"
 )
 
 // Config centralizes all runtime options for local-file-sync.
 type Config struct {
-	RootDir             string
-	Recursive           bool
-	FollowSymlinks      bool
-	StateFile           string
-	DisableState        bool
-	LockFile            string
-	GCSBucket           string
+	// Command is the optional subcommand given before the flags (e.g.
+	// "history"); empty runs a scan.
+	Command        string
+	RootDir        string
+	Recursive      bool
+	FollowSymlinks bool
+	StateFile      string
+	DisableState   bool
+	// TrackChanges records a content fingerprint per processed folder in state
+	// and re-emits folders whose contents changed even if their trigger
+	// didn't.
+	TrackChanges bool
+	// ScanOnly reads state to filter matches but never writes anything: no
+	// lock, state, uploads, Firestore records or notifications.
+	ScanOnly bool
+	// Fix makes the state audit command remove drifted entries from state,
+	// so their folders are processed again on the next run.
+	Fix bool
+	// Confirm lists the folders about to be uploaded and asks for
+	// confirmation on Stdin before uploading; Yes answers it up front.
+	Confirm bool
+	Yes     bool
+	// FromStdin reads the folders to process from Stdin instead of scanning
+	// RootDir.
+	FromStdin bool
+	// BackfillChunk is the number of folders the backfill command processes
+	// (and checkpoints in state) at a time.
+	BackfillChunk int
+	LockFile      string
+	// LockCollection, if set, replaces the lock file with a lease document in
+	// this Firestore collection, keyed by LockKey (default: RootDir), so
+	// agents on several hosts coordinate.
+	LockCollection string
+	LockKey        string
+	GCSBucket      string
+	// DestPrefix is the object prefix of -dest; empty means none.
+	DestPrefix          string
 	FirestoreProjectId  string
 	FirestoreCollection string
-	FolderConcurrency   int
-	FileConcurrency     int
-	Logger              *log.Logger
-	Stdout              *os.File
+	ClaimCollection     string
+	// ClaimTTL is how long a claim whose upload didn't complete blocks other
+	// agents (see -claim-ttl); zero means DefaultClaimTTL.
+	ClaimTTL          time.Duration
+	BatchCollection   string
+	FolderConcurrency int
+	FileConcurrency   int
+	Progress          string
+	SimulateFailures  float64
+	FolderNameRules   naming.Rules
+	PathLabels        naming.Labels
+	NormalizeUnicode  bool
+	StateRelativeKeys bool
+	AgentID           string
+	// RunID identifies this invocation (a random UUID) in logs, object
+	// metadata, Firestore records, error reports and the run history.
+	RunID       string
+	HistorySize int
+	Reporter    *report.Sentry
+	// Events receives the structured event stream of -events-file; nil
+	// discards events.
+	Events             *events.Writer
+	Notifier           notify.Notifier
+	NotifyOrphans      int
+	NotifyInterval     time.Duration
+	MaxFoldersPerRun   int
+	MaxBytesPerRun     int64
+	Order              string
+	IncludeHidden      bool
+	FollowFileSymlinks bool
+	DedupeHardlinks    bool
+	CompressSparse     bool
+	BundleSmallFiles   int64
+	// LargeFileThreshold, if > 0, schedules files of at least this many bytes
+	// on a quarter of the file upload workers (see
+	// uploader.GCSUploader.LargeFileThreshold).
+	LargeFileThreshold int64
+	Triggers           []scanner.Trigger
+	RequireCount       bool
+	SkipUnreadable     bool
+	// ScanTimeout, if > 0, limits each stat and directory read of the scan
+	// (retried ScanRetries times); timed out subtrees and folders are skipped
+	// and recorded in the run history.
+	ScanTimeout   time.Duration
+	ScanRetries   int
+	EntryPageSize int
+	ReadyPreview  int
+	// ReadySymlinks is the scanner.ReadySymlink* policy for symlinked
+	// triggers.
+	ReadySymlinks string
+	// MaxEntriesInOutput limits the folder entries per match in JSON output:
+	// negative means unlimited, 0 omits them.
+	MaxEntriesInOutput int
+	// Pretty indents JSON output; Fields, if set, limits each emitted match
+	// to these JSON fields (see scanner.MatchFields).
+	Pretty           bool
+	Fields           []string
+	SkipExisting     bool
+	FirestoreRetries int
+	FirestoreBackoff time.Duration
+	PendingFile      string
+	RecordIndex      string
+	Strict           bool
+	StatePolicy      string
+	EmptyFolder      string
+	// FileFailure is the -file-failure policy; FileRetries and
+	// FileRetryBackoff configure its retry policy.
+	FileFailure      string
+	FileRetries      int
+	FileRetryBackoff time.Duration
+	// FolderDeadline, if > 0, bounds the upload of each folder; folders not
+	// done by then fail and the run continues with the others.
+	FolderDeadline time.Duration
+	// IfExists is the -if-exists policy for objects that already exist.
+	IfExists string
+	// ReuploadVersions is the -reupload-versions policy for folders that were
+	// delivered before.
+	ReuploadVersions string
+	// NameCollisions is the -name-collisions policy for folders of a run
+	// sharing a destination prefix.
+	NameCollisions string
+	// RelativeObjectNames names the objects of folders below RootDir after
+	// their relative path instead of their base name.
+	RelativeObjectNames bool
+	// DocIDStrategy is the -doc-id strategy for record and claim document
+	// IDs; empty means DocIDHash.
+	DocIDStrategy string
+	// GCSAPI is the -gcs-api of the storage client; empty means GCSAPIJSON.
+	GCSAPI string
+	// GCSProxy, if set, is the URL of the HTTP proxy JSON API requests are
+	// sent through instead of the one from the environment.
+	GCSProxy string
+	// GCSUserAgent, if set, replaces the user agent of the storage client.
+	GCSUserAgent string
+	// GCSBillingProject, if set, is the project billed for GCS requests
+	// (-billing-project), required to access requester pays buckets.
+	GCSBillingProject string
+	// AutoConcurrency is the heuristic for concurrencies of 0 (auto); main
+	// installs it with SetAutoConcurrency.
+	AutoConcurrency AutoConcurrency
+	// ArchiveDir, if set, is where uploaded folders and their triggers are
+	// moved to, below their path relative to RootDir.
+	ArchiveDir string
+	// InProgress holds the heuristics for files still being written; folders
+	// with such files are deferred to the next run.
+	InProgress InProgress
+	// Snapshot is the -snapshot policy for files that changed between the
+	// scan and their upload.
+	Snapshot string
+	// RescanBeforeUpload lists each folder again right before its upload.
+	RescanBeforeUpload bool
+	// ExportData is what the export command writes (ExportRuns or
+	// ExportRecords).
+	ExportData string
+	// Partition is the share of triggers this process handles when several
+	// processes work on the same directory (-partition).
+	Partition Partition
+	// Env is the clock and filesystem the run, its lock and state file go
+	// through; the zero value uses the real ones.
+	Env Env
+	// Warnings logs warnings, limited to -warning-limit of a kind per run and
+	// in full to -warnings-file; see Warnf.
+	Warnings *Warnings
+	// ContentTypes maps lower case file extensions (with dot) to the content
+	// type of their objects, loaded from -content-types; they take precedence
+	// over the built-in types.
+	ContentTypes map[string]string
+	// PreserveOwnership records the mode and owner of each file as object
+	// metadata next to its modification time.
+	PreserveOwnership bool
+	// ObjectACLs are the -object-acl rules assigning predefined ACLs to
+	// uploaded objects by file name.
+	ObjectACLs ObjectACLs
+	// ObjectHold is the -object-hold (HoldTemporary or HoldEventBased)
+	// placed on uploaded objects; empty places none.
+	ObjectHold string
+	// ObjectRetention is the -object-retention of uploaded objects.
+	ObjectRetention ObjectRetention
+	// FolderManifest (-folder-manifest) writes the folder record as a
+	// __metadata.json object into the prefix of each uploaded folder.
+	FolderManifest bool
+	// Only limits the run to the triggers whose name matches a pattern
+	// (-only).
+	Only NameFilter
+	// SkipListFile is the skip list of triggers never processed (-skip-list,
+	// see LoadSkipList). It is read at the start of every run.
+	SkipListFile string
+	// WaveSize and WaveBudget, if > 0, split an uploading run into waves of
+	// at most WaveSize folders and WaveBudget of upload time each, every one
+	// taking the lock and saving the state on its own (-wave-size,
+	// -wave-budget).
+	WaveSize   int
+	WaveBudget time.Duration
+	// Mirrors are further destinations (-mirror) receiving every upload along
+	// with GCSBucket, each below its own prefix.
+	Mirrors []Destination
+	// AgeSLA, if > 0, is the age (-rdy-age-sla) after which an unprocessed
+	// trigger is overdue; overdue triggers are warned about and notified.
+	AgeSLA time.Duration
+	// NiceIO (-nice-io) lowers the I/O priority of the process and paces
+	// the reads of uploaded files to NiceIORate bytes per second (0 only
+	// lowers the priority and hints the kernel).
+	NiceIO     bool
+	NiceIORate int64
+	// ReadBack (-read-back) is the fraction of uploaded objects read back
+	// from the destination and compared with the local files (1 = all).
+	ReadBack float64
+	// LogPrefix is a static prefix of every log line (before the agent and
+	// run IDs) and LogTime the timestamp format (see NewLogger) Logger was
+	// created with.
+	LogPrefix string
+	LogTime   string
+	Logger    *log.Logger
+	Stdin     *os.File
+	Stdout    *os.File
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -38,32 +392,599 @@ func ParseFlags() (*Config, error) {
 		followLinks  bool
 		stateFile    string
 		disableState bool
+		trackChanges bool
+		scanOnly     bool
+		fix          bool
+		confirm      bool
+		yes          bool
+		fromStdin    bool
+		backfillSize int
 		lockFile     string
+		lockColl     string
+		lockKey      string
 		gcsBucket    string
+		dest         string
 		fsString     string
+		claimColl    string
+		claimTTL     time.Duration
+		batchColl    string
+		docID        string
+		gcsAPI       string
+		gcsProxy     string
+		gcsUA        string
+		gcsBilling   string
 		folderConc   int
 		fileConc     int
+		autoMult     float64
+		autoMax      int
+		archiveDir   string
+		inProgSuffix string
+		inProgEmpty  time.Duration
+		inProgSettle time.Duration
+		snapshot     string
+		rescan       bool
+		exportData   string
+		partitionStr string
+		warnLimit    int
+		warnFile     string
+		typesFile    string
+		keepOwner    bool
+		objectACL    string
+		objectHold   string
+		retention    string
+		manifest     bool
+		only         string
+		skipList     string
+		waveSize     int
+		waveBudget   time.Duration
+		mirrors      []Destination
+		ageSLA       time.Duration
+		niceIO       bool
+		niceIORate   int64
+		readBack     float64
+		progressMode string
+		simFailures  float64
+		namePattern  string
+		nameMaxLen   int
+		nameForbid   string
+		nameNorm     string
+		nameAction   string
+		pathLabels   string
+		normUnicode  bool
+		relKeys      bool
+		agentID      string
+		logPrefix    string
+		logTime      string
+		historySize  int
+		reportDSN    string
+		eventsFile   string
+		slackHook    string
+		smtpAddr     string
+		mailFrom     string
+		mailTo       string
+		notifyOrph   int
+		notifyIval   time.Duration
+		maxFolders   int
+		maxBytes     int64
+		order        string
+		inclHidden   bool
+		followFiles  bool
+		dedupeLinks  bool
+		compSparse   bool
+		bundleSmall  int64
+		largeFile    int64
+		dirTriggers  bool
+		triggerNames string
+		manifestName string
+		triggerAge   time.Duration
+		batchPrefix  string
+		requireCount bool
+		skipUnread   bool
+		scanTimeout  time.Duration
+		scanRetries  int
+		pageSize     int
+		readyPreview int
+		readyLinks   string
+		maxEntries   int
+		pretty       bool
+		fields       string
+		skipExisting bool
+		fsRetries    int
+		fsBackoff    time.Duration
+		pendingFile  string
+		recordIndex  string
+		strict       bool
+		statePolicy  string
+		emptyFolder  string
+		fileFailure  string
+		fileRetries  int
+		fileBackoff  time.Duration
+		folderLimit  time.Duration
+		collisions   string
+		relNames     bool
+		ifExists     string
+		reupload     string
 	)
 	flag.StringVar(&dir, "dir", ".", "Directory to scan")
 	flag.BoolVar(&recursive, "recursive", false, "Recursively scan for *.RDY files")
 	flag.BoolVar(&followLinks, "follow-symlinks", false, "Follow directory symlinks when recursive")
 	flag.StringVar(&stateFile, "state-file", "", "Path to persistent state file (default: <dir>/.local-file-sync_state.json)")
 	flag.BoolVar(&disableState, "no-state", false, "Disable state persistence entirely (no reading or writing state file)")
+	flag.BoolVar(&trackChanges, "track-changes", false, "Record a content fingerprint (names, sizes, modification times) per processed folder in state and re-emit folders whose contents changed even if the *.RDY file didn't")
+	flag.BoolVar(&confirm, "confirm", false, "List the folders about to be uploaded and ask for confirmation before uploading (fails if stdin is not a terminal, unless -yes)")
+	flag.BoolVar(&yes, "yes", false, "Answer the -confirm prompt with yes, e.g. for non-interactive runs")
+	flag.IntVar(&backfillSize, "backfill-chunk", 100, "With the backfill command: number of folders processed and checkpointed in state at a time")
+	flag.BoolVar(&fromStdin, "stdin", false, "Read the folders to process from stdin instead of scanning -dir: one path per line, or the JSON match array printed by a run")
+	flag.BoolVar(&fix, "fix", false, "With the state audit command: remove drifted entries from the state file so their folders are processed again on the next run")
+	flag.BoolVar(&scanOnly, "scan-only", false, "Inspect only: filter matches using the state file and emit them as JSON, but never write anything (no lock file, state, uploads, Firestore records or notifications)")
 	flag.StringVar(&lockFile, "lock-file", "", "Path to lock file (default: per-directory hash in /tmp)")
+	flag.StringVar(&lockColl, "lock-collection", "", "If set, hold the run lock as a lease document in this Firestore collection instead of a local lock file, coordinating agents on several hosts (requires -firestore)")
+	flag.StringVar(&lockKey, "lock-key", "", "Key of the lease document with -lock-collection; agents using the same key exclude each other (default: absolute -dir)")
+	flag.StringVar(&dest, "dest", "", "Upload destination URL gs://BUCKET[/PREFIX]; objects are stored below PREFIX (alternative to -gcs-bucket)")
 	flag.StringVar(&gcsBucket, "gcs-bucket", "", "If set, upload each newly emitted matched folder's files to the given GCS bucket (requires GOOGLE_APPLICATION_CREDENTIALS or ADC)")
-	flag.StringVar(&fsString, "firestore", "", "If set, write a Firestore document per successfully uploaded folder in the format PROJECT_ID:COLLECTION (requires -gcs-bucket)")
+	flag.StringVar(&gcsAPI, "gcs-api", GCSAPIJSON, "API of the GCS client: json (HTTP) or grpc")
+	flag.StringVar(&gcsProxy, "gcs-proxy", "", "URL of the HTTP proxy GCS requests are sent through, e.g. http://proxy.local:3128 (default: HTTPS_PROXY from the environment; requires -gcs-api json)")
+	flag.StringVar(&gcsUA, "gcs-user-agent", "", "User agent of GCS requests (default: the client library's)")
+	flag.StringVar(&gcsBilling, "billing-project", "", "Google Cloud project billed for GCS requests, required for requester pays buckets (applies to -gcs-bucket and gs:// mirrors)")
+	flag.StringVar(&fsString, "firestore", "", "If set, write a Firestore document per successfully uploaded folder in the format PROJECT_ID:COLLECTION; COLLECTION may be a nested path with placeholders, e.g. sites/{site}/uploads or uploads/{date}/folders (requires -gcs-bucket)")
+	flag.BoolVar(&strict, "strict", false, "Abort the run with a non-zero exit if the GCS or Firestore client can't be initialized (default: log a warning and continue)")
+	flag.StringVar(&statePolicy, "state-policy", StatePolicyUpload, "When a folder is marked processed: upload (files uploaded; failed Firestore records are queued) or metadata (Firestore record written too; otherwise the folder is retried next run)")
+	flag.IntVar(&fsRetries, "firestore-retries", 3, "Retries of failed Firestore record writes (with exponential backoff) before the record is queued in -pending-records-file")
+	flag.DurationVar(&fsBackoff, "firestore-backoff", 500*time.Millisecond, "Initial delay between Firestore write retries; doubled per retry")
+	flag.StringVar(&pendingFile, "pending-records-file", "", "Path to the queue of Firestore records that failed to write, flushed on the next run (default: <dir>/.local-file-sync_pending.jsonl)")
+	flag.StringVar(&recordIndex, "record-index", "", "If set, remember every Firestore record written (document ID, folder path, checksum) in this local file, so the records command can list them offline and verify them against Firestore")
+	flag.StringVar(&claimColl, "claim-collection", "", "If set, agents claim each folder in this Firestore collection before uploading; only the first claimant uploads (requires -firestore)")
+	flag.DurationVar(&claimTTL, "claim-ttl", DefaultClaimTTL, "With -claim-collection, how long a claim whose upload didn't complete (e.g. the claimant crashed) blocks other agents before they may take the folder over")
+	flag.StringVar(&batchColl, "batch-collection", "", "If set, also write one document per run summarizing all uploaded folders to this Firestore collection (requires -firestore)")
+	flag.StringVar(&docID, "doc-id", DocIDHash, "How Firestore record and claim document IDs are derived: hash (of the record folder path), path (the record folder path with / escaped), ready (the trigger name without extension) or producer (an id=ID line in the trigger file)")
 	flag.IntVar(&folderConc, "folder-concurrency", 0, "Max concurrent folder uploads (0=auto)")
 	flag.IntVar(&fileConc, "file-concurrency", 0, "Max concurrent file uploads within a folder (0=auto)")
-	flag.Parse()
+	flag.Float64Var(&autoMult, "auto-concurrency-multiplier", DefaultAutoConcurrency.Multiplier, "Automatic -folder-concurrency/-file-concurrency: NumCPU times this value (uploads are I/O bound, so values above 1 often pay off)")
+	flag.IntVar(&autoMax, "auto-concurrency-max", DefaultAutoConcurrency.Max, "Upper limit of the automatic -folder-concurrency/-file-concurrency")
+	flag.StringVar(&archiveDir, "archive-dir", "", "If set, move uploaded folders and their triggers to this directory, keeping their path relative to -dir; across filesystems they are copied, verified and only then removed (requires -gcs-bucket)")
+	flag.StringVar(&inProgSuffix, "in-progress-suffixes", "", "Comma separated file name suffixes of files still being written, e.g. .part,.tmp,.crdownload; folders with such files are deferred to the next run")
+	flag.DurationVar(&inProgEmpty, "in-progress-empty-age", 0, "Defer folders with empty files modified less than this long ago (0=off)")
+	flag.DurationVar(&inProgSettle, "in-progress-settle", 0, "Stat the files of matched folders twice this far apart and defer folders whose files changed in between (0=off)")
+	flag.StringVar(&snapshot, "snapshot", SnapshotLenient, "How uploads treat files that changed after the scan listed them: lenient (upload their current content, skip vanished ones) or strict (fail them, so the folder is retried with a new listing)")
+	flag.BoolVar(&rescan, "rescan-before-upload", false, "List each folder again right before uploading it, so files added since the scan are uploaded too (applies only when -gcs-bucket)")
+	flag.StringVar(&exportData, "export-data", ExportRuns, "What the export command writes as CSV: runs (the run history of the state file) or records (the folder records of -record-index)")
+	flag.StringVar(&partitionStr, "partition", "", "Handle only a share of the triggers, as INDEX/COUNT (e.g. 1/4), so COUNT processes with the indexes 0 to COUNT-1 can work on the same -dir in parallel; each derives its own lock, state and pending file")
+	flag.IntVar(&warnLimit, "warning-limit", DefaultWarningLimit, "Log at most this many warnings of a kind (e.g. stat failures) per run and only count the rest; 0 logs all")
+	flag.StringVar(&warnFile, "warnings-file", "", "Append every warning, including those beyond -warning-limit, to this file")
+	flag.StringVar(&typesFile, "content-types", "", "File mapping extensions to content types in the mime.types format (`type/subtype ext...` per line), extending and overriding the built-in types; files of other unknown extensions are sniffed")
+	flag.BoolVar(&keepOwner, "preserve-ownership", false, "Also record each file's permission bits and numeric owner (uid, gid) as object metadata next to its modification time (applies only when -gcs-bucket)")
+	flag.StringVar(&objectHold, "object-hold", "", "Hold placed on uploaded objects so they can't be deleted or overwritten until released: temporary or event-based (see \"Holds & Retention\")")
+	flag.StringVar(&retention, "object-retention", "", "Retain uploaded objects for this period after the upload, as [locked:|unlocked:]PERIOD with a duration or days (e.g. locked:2555d); requires object retention enabled on the bucket")
+	flag.StringVar(&only, "only", "", "Process only the triggers whose name, with or without extension (e.g. ORDER123.RDY or ORDER123), matches this glob, or regular expression prefixed with re:; the others are left untouched for later runs")
+	flag.IntVar(&waveSize, "wave-size", 0, "Upload in waves of at most this many folders, each saving the state and releasing the lock before the next, so long runs persist their progress (0=one wave; requires -gcs-bucket)")
+	flag.DurationVar(&waveBudget, "wave-budget", 0, "Stop starting folders in a wave after this long and continue with the rest in the next wave (0=unlimited; requires -gcs-bucket)")
+	flag.StringVar(&skipList, "skip-list", "", "File listing triggers that are never processed, one path or glob per line (# comments); re-read at the start of every run")
+	flag.BoolVar(&manifest, "folder-manifest", false, "Write the folder record (as stored in Firestore) as a __metadata.json object into each uploaded folder prefix, for consumers without Firestore access (requires -gcs-bucket)")
+	flag.StringVar(&objectACL, "object-acl", "", "Comma separated predefined ACLs for uploaded objects, as ACL or ACL:PATTERN matched against the file name, first match wins (e.g. public-read:*.jpg,private); ACLs: authenticated-read, bucket-owner-full-control, bucket-owner-read, private, project-private, public-read. Not allowed for buckets with uniform bucket-level access")
+	flag.Func("mirror", "Further upload destination gs://BUCKET[/PREFIX] or file:///DIR receiving every folder along with -gcs-bucket, e.g. the old bucket during a migration; a folder only counts as uploaded once every destination has it (repeatable)", func(s string) error {
+		d, err := ParseMirror(s)
+		if err == nil {
+			mirrors = append(mirrors, d)
+		}
+		return err
+	})
+	flag.DurationVar(&ageSLA, "rdy-age-sla", 0, "Maximum age of an unprocessed *.RDY file (since its modification time) before it is reported as overdue: logged as a warning and sent with the failure digest (0=disabled)")
+	flag.BoolVar(&niceIO, "nice-io", false, "Yield disk I/O to producers writing to the same disk: lower the I/O priority of the agent (Linux: best-effort class, lowest level), hint the kernel to drop uploaded files from the page cache and pace file reads to -nice-io-rate (applies only when -gcs-bucket)")
+	flag.Int64Var(&niceIORate, "nice-io-rate", 25_000_000, "Maximum read throughput of uploaded files in bytes per second with -nice-io, shared by all uploads (0=unpaced)")
+	flag.Float64Var(&readBack, "read-back", 0, "Fraction of uploaded objects (0 to 1, 1=all) to read back from the destination after their upload and compare byte for byte with the local files; mismatching files fail (requires -gcs-bucket)")
+	flag.StringVar(&progressMode, "progress", "auto", "Upload progress display: auto (only if stdout is a terminal), always or never (applies only when -gcs-bucket)")
+	flag.Float64Var(&simFailures, "simulate-failures", 0, "Randomly fail uploads and Firestore writes with the given rate 0..1 (staging only)")
+	flag.StringVar(&namePattern, "folder-name-pattern", "", "Regular expression matched folder names (after normalization) must match")
+	flag.IntVar(&nameMaxLen, "folder-name-max-length", 0, "Maximum matched folder name length in characters (0=unlimited)")
+	flag.StringVar(&nameForbid, "folder-name-forbidden", "", "Characters that must not appear in matched folder names")
+	flag.StringVar(&nameNorm, "folder-name-normalize", "", "Comma separated folder name normalizations applied to object prefixes and Firestore paths: upper, lower, trim, strip-spaces")
+	flag.StringVar(&nameAction, "invalid-folder-action", naming.ActionReject, "What to do with folders whose names fail validation: reject (skip) or quarantine (upload under the quarantine/ prefix)")
+	flag.StringVar(&pathLabels, "path-labels", "", "Regular expression matched against each folder path relative to -dir; named groups become labels in object metadata and Firestore records (e.g. '^(?P<customer>[^/]+)/(?P<line>[^/]+)/')")
+	flag.BoolVar(&normUnicode, "normalize-unicode", false, "Normalize paths to Unicode NFC for state keys, object names and Firestore paths, and match NFD/NFC variants of sibling folders")
+	flag.BoolVar(&relKeys, "state-relative-keys", false, "Key state entries relative to -dir so state survives moving the intake directory (existing absolute keys are migrated)")
+	flag.StringVar(&logPrefix, "log-prefix", "", "Static prefix of every log line, e.g. a site or fleet name")
+	flag.StringVar(&logTime, "log-time", LogTimeLocal, "Log timestamp format: local (local date and time), utc (ISO 8601 in UTC with milliseconds) or none")
+	flag.StringVar(&agentID, "agent-id", "", "Agent ID attached to logs, Firestore records, object metadata and the lock file (default: hostname)")
+	flag.IntVar(&historySize, "history-size", 20, "Number of run summaries kept in the state file (0=disable run history)")
+	flag.StringVar(&eventsFile, "events-file", "", "Append a JSON lines event stream (scan_start, match_found, upload_start, upload_done, folder_done, run_done) to this file, or fd:N to write to an open file descriptor")
+	flag.StringVar(&reportDSN, "error-report-dsn", os.Getenv("SENTRY_DSN"), "Sentry DSN to report fatal errors and failed folders to (default: $SENTRY_DSN)")
+	flag.StringVar(&slackHook, "notify-slack-webhook", "", "Slack incoming webhook URL to send failure digests to")
+	flag.StringVar(&smtpAddr, "notify-smtp", "", "SMTP server host:port to send failure digests through (auth via $SMTP_USERNAME/$SMTP_PASSWORD)")
+	flag.StringVar(&mailFrom, "notify-email-from", "", "Sender address of failure digest emails (requires -notify-smtp)")
+	flag.StringVar(&mailTo, "notify-email-to", "", "Comma separated recipients of failure digest emails (requires -notify-smtp)")
+	flag.IntVar(&notifyOrph, "notify-orphans", 0, "Also send a digest if at least this many *.RDY files have no matching folder (0=disabled)")
+	flag.DurationVar(&notifyIval, "notify-interval", time.Hour, "Minimum time between two failure digests")
+	flag.IntVar(&maxFolders, "max-folders-per-run", 0, "Process at most this many matched folders per run; the rest is carried to the next run (0=unlimited)")
+	flag.Int64Var(&maxBytes, "max-bytes-per-run", 0, "Process matched folders up to this many bytes per run; the rest is carried to the next run (0=unlimited)")
+	flag.StringVar(&order, "order", scanner.OrderPath, "Processing order of matches: path (sorted by path), oldest or newest (by *.RDY modification time)")
+	flag.BoolVar(&inclHidden, "include-hidden", false, "Include hidden and system files (dotfiles, desktop.ini, Thumbs.db, NTFS alternate data streams) in folder entries and uploads")
+	flag.BoolVar(&followFiles, "follow-file-symlinks", false, "Upload the target content of symlinked files in matched folders instead of skipping them")
+	flag.BoolVar(&dedupeLinks, "dedupe-hardlinks", false, "Upload hard-linked files of a folder only once and record the other names as links in the folder record")
+	flag.BoolVar(&skipExisting, "skip-existing", false, "List each folder's destination prefix once and skip files whose object already exists with the same SHA256")
+	flag.BoolVar(&compSparse, "compress-sparse", false, "Upload sparse files gzip compressed (Content-Encoding: gzip)")
+	flag.Int64Var(&largeFile, "large-file-threshold", 0, "Upload files of at least this many bytes on a quarter of the -file-concurrency workers so huge files don't starve small ones (0=upload in listing order)")
+	flag.Int64Var(&bundleSmall, "bundle-small-files", 0, "Upload files smaller than this many bytes together as tar bundle objects instead of one object each (0=disabled)")
+	flag.BoolVar(&dirTriggers, "dir-triggers", false, "Also treat directories named *.RDY (e.g. an empty ORDER123.RDY/ marker) as triggers (same as adding rdy-dir to -trigger)")
+	flag.BoolVar(&skipUnread, "skip-unreadable", false, "Log and skip unreadable subdirectories during a recursive scan (recorded in the run history) instead of failing the run")
+	flag.DurationVar(&scanTimeout, "scan-timeout", 0, "Give up on a stat or directory read of the scan after this long, e.g. on a hung SMB/NFS mount, skipping the affected subtree or folder (recorded in the run history; 0=wait indefinitely)")
+	flag.IntVar(&scanRetries, "scan-retries", 1, "Retries of a timed out stat or directory read before skipping it (see -scan-timeout)")
+	flag.IntVar(&pageSize, "entry-page-size", 0, "Stream matched folder entries from disk in pages of this size instead of listing them up front, keeping memory flat for huge folders (entries are omitted from JSON output; 0=list up front)")
+	flag.IntVar(&maxEntries, "max-entries-in-output", -1, "Maximum folder entries per match in JSON output; truncated matches are flagged with entriesTruncated and entryCount (-1=unlimited, 0=omit entries)")
+	flag.BoolVar(&pretty, "pretty", false, "Indent JSON output for humans instead of printing a single line")
+	flag.StringVar(&fields, "fields", "", "Comma separated JSON fields of each match to print, e.g. readyFile,folder,totalSize (default: all)")
+	flag.StringVar(&readyLinks, "ready-symlinks", scanner.ReadySymlinkFollow, "How triggers that are symlinks are handled: follow (treat like the target; its modification time decides whether the trigger changed) or skip (ignore them)")
+	flag.IntVar(&readyPreview, "ready-preview", 0, "Include up to this many bytes of each trigger file's content as readyPreview in JSON output (0=none)")
+	flag.StringVar(&triggerNames, "trigger", scanner.TriggerRDY, "Comma separated trigger strategies tried in order: rdy (NAME.RDY files), rdy-dir (NAME.RDY/ directories), manifest (folders containing -manifest-name), age (folders unchanged for -trigger-min-age), batch (-batch-prefix*.RDY files listing folders)")
+	flag.StringVar(&manifestName, "manifest-name", "MANIFEST", "File name marking a folder as ready with the manifest trigger")
+	flag.DurationVar(&triggerAge, "trigger-min-age", 15*time.Minute, "Time a folder must be unchanged before the age trigger considers it ready")
+	flag.StringVar(&batchPrefix, "batch-prefix", "BATCH", "Name prefix of *.RDY files listing the folders of a batch with the batch trigger")
+	flag.BoolVar(&requireCount, "require-count", false, "Only treat a folder as ready once its entry count matches the count in NAME.CNT or the *.RDY file")
+	flag.StringVar(&fileFailure, "file-failure", FileFailureContinue, "What a failed file upload means for the rest of its folder: continue (upload the other files best effort), cancel (stop the folder's remaining uploads) or retry (retry the file -file-retries times, then continue)")
+	flag.IntVar(&fileRetries, "file-retries", 3, "Retries of a failed file upload with -file-failure=retry")
+	flag.DurationVar(&fileBackoff, "file-retry-backoff", time.Second, "Initial delay between file upload retries with -file-failure=retry; doubled per retry")
+	flag.DurationVar(&folderLimit, "folder-deadline", 0, "Fail a folder whose upload takes longer than this (remaining files are not started; retried on the next run) so one pathological folder can't consume the whole run (0=no deadline)")
+	flag.BoolVar(&relNames, "relative-object-names", false, "Name objects after the folder path relative to -dir (<prefix>/a/b/ORDER1/...) instead of the folder's base name, preserving the intake hierarchy of recursive scans")
+	flag.StringVar(&collisions, "name-collisions", CollisionFail, "What happens to folders of a run uploaded to the same prefix, e.g. a/ORDER1 and b/ORDER1 of a recursive scan: fail (upload none of them), namespace (prefix them with their directory relative to -dir) or ignore (upload over each other)")
+	flag.StringVar(&ifExists, "if-exists", IfExistsOverwrite, "What an upload does if its object already exists: overwrite, skip (keep and record the existing object) or conflict (fail the file); skip and conflict upload create-only so concurrent agents never overwrite each other")
+	flag.StringVar(&reupload, "reupload-versions", ReuploadOverwrite, "Where a folder delivered before is uploaded again: overwrite (same prefix), counter (<folder>/v2/...) or timestamp (<folder>/<UTC timestamp>/...); earlier deliveries are kept and listed in the Firestore record (requires state)")
+	flag.StringVar(&emptyFolder, "empty-folder", EmptyFolderRecord, "How to handle matched folders without uploadable files: record (process and mark processed), retry (skip until files appear) or marker (upload a marker object; applies only when -gcs-bucket)")
+
+	// NOTE(joel): An optional subcommand precedes the flags, e.g.
+	// `local-file-sync history -dir /path`. The state and lock commands take
+	// an action as second word (`local-file-sync state audit`, `lock status`),
+	// the records command an optional one (`local-file-sync records verify`).
+	args := os.Args[1:]
+	var command string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+		if (command == "state" || command == "lock" || command == CommandRecords) && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			command, args = command+" "+args[0], args[1:]
+		}
+	}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return nil, err
+	}
+	switch command {
+	case "", CommandHistory, CommandSchema, CommandStateAudit, CommandBackfill, CommandRecords, CommandRecordsVerify, CommandExport, CommandLockStatus, CommandLockBreak:
+	default:
+		return nil, fmt.Errorf("unknown command %q", command)
+	}
 
 	abs, err := filepath.Abs(dir)
 	if err != nil {
 		return nil, fmt.Errorf("resolve dir: %w", err)
 	}
 
+	// NOTE(joel): -dest is an alternative to -gcs-bucket that also carries an
+	// object prefix; the checks below refer to -gcs-bucket for both.
+	var destPrefix string
+	if dest != "" {
+		if gcsBucket != "" {
+			return nil, fmt.Errorf("-dest and -gcs-bucket are mutually exclusive")
+		}
+		d, err := ParseDestination(dest)
+		if err != nil {
+			return nil, err
+		}
+		gcsBucket, destPrefix = d.Bucket, d.Prefix
+	}
+
+	if len(mirrors) > 0 && gcsBucket == "" {
+		return nil, fmt.Errorf("-mirror requires -gcs-bucket")
+	}
+	for _, m := range mirrors {
+		if m.Scheme == SchemeGCS && m.Bucket == gcsBucket && m.Prefix == destPrefix {
+			return nil, fmt.Errorf("-mirror %s is the upload destination itself", m)
+		}
+	}
 	if fsString != "" && gcsBucket == "" {
 		return nil, fmt.Errorf("-firestore requires -gcs-bucket")
 	}
+	if readBack > 0 && gcsBucket == "" {
+		return nil, fmt.Errorf("-read-back requires -gcs-bucket")
+	}
+	if manifest && gcsBucket == "" {
+		return nil, fmt.Errorf("-folder-manifest requires -gcs-bucket")
+	}
+	if claimColl != "" && fsString == "" {
+		return nil, fmt.Errorf("-claim-collection requires -firestore")
+	}
+	if claimTTL <= 0 {
+		return nil, fmt.Errorf("-claim-ttl must be positive")
+	}
+	if (command == CommandRecords || command == CommandRecordsVerify) && recordIndex == "" {
+		return nil, fmt.Errorf("%s requires -record-index", command)
+	}
+	switch exportData {
+	case ExportRuns:
+	case ExportRecords:
+		if command == CommandExport && recordIndex == "" {
+			return nil, fmt.Errorf("export of records requires -record-index")
+		}
+	default:
+		return nil, fmt.Errorf("invalid -export-data value %q, expected runs or records", exportData)
+	}
+	if command == CommandRecordsVerify && fsString == "" {
+		return nil, fmt.Errorf("records verify requires -firestore")
+	}
+	if batchColl != "" && fsString == "" {
+		return nil, fmt.Errorf("-batch-collection requires -firestore")
+	}
+	if (command == CommandLockStatus || command == CommandLockBreak) && lockColl != "" {
+		return nil, fmt.Errorf("%s inspects the lock file and can't be used with -lock-collection", command)
+	}
+	if lockColl != "" && fsString == "" {
+		return nil, fmt.Errorf("-lock-collection requires -firestore")
+	}
+	partition, err := parsePartition(partitionStr)
+	if err != nil {
+		return nil, err
+	}
+	onlyFilter, err := ParseNameFilter(only)
+	if err != nil {
+		return nil, err
+	}
+	objectACLs, err := parseObjectACLs(objectACL)
+	if err != nil {
+		return nil, err
+	}
+	switch objectHold {
+	case "", HoldTemporary, HoldEventBased:
+	default:
+		return nil, fmt.Errorf("invalid -object-hold value %q, expected temporary or event-based", objectHold)
+	}
+	objectRetention, err := parseObjectRetention(retention)
+	if err != nil {
+		return nil, err
+	}
+	if (objectHold != "" || retention != "") && gcsBucket == "" {
+		return nil, fmt.Errorf("-object-hold and -object-retention require -gcs-bucket")
+	}
+	var contentTypes map[string]string
+	if typesFile != "" {
+		if contentTypes, err = LoadContentTypes(typesFile); err != nil {
+			return nil, err
+		}
+	}
+	// NOTE(joel): Partitions exclude each other only per partition; their
+	// lease keys have to differ like their lock files.
+	if lockKey == "" {
+		lockKey = abs
+		if partition.Enabled() {
+			lockKey += "#" + partition.String()
+		}
+	}
+	if archiveDir != "" {
+		if gcsBucket == "" {
+			return nil, fmt.Errorf("-archive-dir requires -gcs-bucket")
+		}
+		if archiveDir, err = filepath.Abs(archiveDir); err != nil {
+			return nil, fmt.Errorf("resolve -archive-dir: %w", err)
+		}
+		// NOTE(joel): Archived folders below -dir would be scanned again.
+		if rel, err := filepath.Rel(abs, archiveDir); err == nil && filepath.IsLocal(rel) {
+			return nil, fmt.Errorf("-archive-dir must not be inside -dir")
+		}
+	}
+
+	switch progressMode {
+	case "auto", "always", "never":
+	default:
+		return nil, fmt.Errorf("invalid -progress value %q, expected auto, always or never", progressMode)
+	}
+
+	switch statePolicy {
+	case StatePolicyUpload, StatePolicyMetadata:
+	default:
+		return nil, fmt.Errorf("invalid -state-policy value %q, expected upload or metadata", statePolicy)
+	}
+
+	switch emptyFolder {
+	case EmptyFolderRecord, EmptyFolderRetry, EmptyFolderMarker:
+	default:
+		return nil, fmt.Errorf("invalid -empty-folder value %q, expected record, retry or marker", emptyFolder)
+	}
+
+	switch fileFailure {
+	case FileFailureContinue, FileFailureCancel, FileFailureRetry:
+	default:
+		return nil, fmt.Errorf("invalid -file-failure value %q, expected continue, cancel or retry", fileFailure)
+	}
+	if fileRetries < 0 || fileBackoff < 0 {
+		return nil, fmt.Errorf("-file-retries and -file-retry-backoff must not be negative")
+	}
+	if folderLimit < 0 {
+		return nil, fmt.Errorf("-folder-deadline must not be negative")
+	}
+	switch collisions {
+	case CollisionFail, CollisionNamespace, CollisionIgnore:
+	default:
+		return nil, fmt.Errorf("invalid -name-collisions value %q, expected fail, namespace or ignore", collisions)
+	}
+	switch ifExists {
+	case IfExistsOverwrite, IfExistsSkip, IfExistsConflict:
+	default:
+		return nil, fmt.Errorf("invalid -if-exists value %q, expected overwrite, skip or conflict", ifExists)
+	}
+	switch reupload {
+	case ReuploadOverwrite, ReuploadCounter, ReuploadTimestamp:
+	default:
+		return nil, fmt.Errorf("invalid -reupload-versions value %q, expected overwrite, counter or timestamp", reupload)
+	}
+
+	if fsRetries < 0 || fsBackoff < 0 {
+		return nil, fmt.Errorf("-firestore-retries and -firestore-backoff must not be negative")
+	}
+
+	if pageSize < 0 {
+		return nil, fmt.Errorf("-entry-page-size must not be negative")
+	}
+	if scanTimeout < 0 || scanRetries < 0 {
+		return nil, fmt.Errorf("-scan-timeout and -scan-retries must not be negative")
+	}
+	if bundleSmall < 0 {
+		return nil, fmt.Errorf("-bundle-small-files must not be negative")
+	}
+	if largeFile < 0 {
+		return nil, fmt.Errorf("-large-file-threshold must not be negative")
+	}
+	if readyPreview < 0 {
+		return nil, fmt.Errorf("-ready-preview must not be negative")
+	}
+	if ageSLA < 0 {
+		return nil, fmt.Errorf("-rdy-age-sla must not be negative")
+	}
+	if niceIORate < 0 {
+		return nil, fmt.Errorf("-nice-io-rate must not be negative")
+	}
+	if readBack < 0 || readBack > 1 {
+		return nil, fmt.Errorf("-read-back must be between 0 and 1")
+	}
+	switch readyLinks {
+	case scanner.ReadySymlinkFollow, scanner.ReadySymlinkSkip:
+	default:
+		return nil, fmt.Errorf("invalid -ready-symlinks value %q, expected follow or skip", readyLinks)
+	}
+	// NOTE(joel): With -stdin, stdin holds the folders and can't answer the
+	// prompt.
+	if fromStdin && confirm && !yes {
+		return nil, fmt.Errorf("-stdin can't be combined with -confirm unless -yes is set")
+	}
+	// NOTE(joel): A backfill resumes from its checkpoint in state, so it
+	// needs a writable state and scans -dir itself.
+	if command == CommandBackfill {
+		if backfillSize <= 0 {
+			return nil, fmt.Errorf("-backfill-chunk must be positive")
+		}
+		if disableState || scanOnly || fromStdin {
+			return nil, fmt.Errorf("backfill can't be combined with -no-state, -scan-only or -stdin")
+		}
+	}
+	var fieldList []string
+	if fields != "" {
+		known := scanner.MatchFields()
+		for f := range strings.SplitSeq(fields, ",") {
+			f = strings.TrimSpace(f)
+			if !slices.Contains(known, f) {
+				return nil, fmt.Errorf("invalid -fields value %q, expected some of %s", f, strings.Join(known, ","))
+			}
+			fieldList = append(fieldList, f)
+		}
+	}
+
+	if maxFolders < 0 || maxBytes < 0 {
+		return nil, fmt.Errorf("-max-folders-per-run and -max-bytes-per-run must not be negative")
+	}
+	// NOTE(joel): Every wave scans again and would read stdin or prompt once
+	// more; scan-only runs upload nothing.
+	if waveSize < 0 || waveBudget < 0 {
+		return nil, fmt.Errorf("-wave-size and -wave-budget must not be negative")
+	}
+	if waveSize > 0 || waveBudget > 0 {
+		if gcsBucket == "" {
+			return nil, fmt.Errorf("-wave-size and -wave-budget require -gcs-bucket")
+		}
+		if fromStdin || scanOnly || (confirm && !yes) {
+			return nil, fmt.Errorf("-wave-size and -wave-budget can't be combined with -stdin, -scan-only or -confirm without -yes")
+		}
+	}
+
+	switch order {
+	case scanner.OrderPath, scanner.OrderOldest, scanner.OrderNewest:
+	default:
+		return nil, fmt.Errorf("invalid -order value %q, expected path, oldest or newest", order)
+	}
+
+	// NOTE(joel): Build trigger strategies. -dir-triggers predates -trigger and
+	// is kept as a shorthand for adding rdy-dir.
+	names := strings.Split(triggerNames, ",")
+	if dirTriggers && !slices.Contains(names, scanner.TriggerRDYDir) {
+		names = append(names, scanner.TriggerRDYDir)
+	}
+	triggers, err := scanner.NewTriggers(names, manifestName, triggerAge, batchPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -trigger: %w", err)
+	}
+	switch docID {
+	case DocIDHash, DocIDPath:
+	case DocIDReady, DocIDProducer:
+		// NOTE(joel): The folders of a batch share their trigger, and so would
+		// their documents; the same goes for the manifest name with ready.
+		for _, t := range triggers {
+			_, batch := t.(scanner.BatchTrigger)
+			_, manifest := t.(scanner.Manifest)
+			if batch {
+				return nil, fmt.Errorf("-doc-id %s can't be used with the batch trigger", docID)
+			}
+			if manifest && docID == DocIDReady {
+				return nil, fmt.Errorf("-doc-id ready can't be used with the manifest trigger")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid -doc-id value %q, expected hash, path, ready or producer", docID)
+	}
+	if autoMult <= 0 {
+		return nil, fmt.Errorf("-auto-concurrency-multiplier must be positive")
+	}
+	if autoMax < DefaultAutoConcurrency.Min {
+		return nil, fmt.Errorf("-auto-concurrency-max must be at least %d", DefaultAutoConcurrency.Min)
+	}
+	switch gcsAPI {
+	case GCSAPIJSON, GCSAPIGRPC:
+	default:
+		return nil, fmt.Errorf("invalid -gcs-api value %q, expected json or grpc", gcsAPI)
+	}
+	if gcsProxy != "" {
+		// NOTE(joel): The gRPC client dials on its own and only honors the
+		// proxy of the environment.
+		if gcsAPI == GCSAPIGRPC {
+			return nil, fmt.Errorf("-gcs-proxy requires -gcs-api json; the gRPC API uses HTTPS_PROXY from the environment")
+		}
+		u, err := url.Parse(gcsProxy)
+		if err != nil || u.Host == "" || !slices.Contains([]string{"http", "https", "socks5"}, u.Scheme) {
+			return nil, fmt.Errorf("invalid -gcs-proxy %q, expected an http, https or socks5 URL", gcsProxy)
+		}
+	}
+
+	switch snapshot {
+	case SnapshotLenient, SnapshotStrict:
+	default:
+		return nil, fmt.Errorf("invalid -snapshot value %q, expected lenient or strict", snapshot)
+	}
+	if inProgEmpty < 0 || inProgSettle < 0 {
+		return nil, fmt.Errorf("-in-progress-empty-age and -in-progress-settle must not be negative")
+	}
+
+	if simFailures < 0 || simFailures > 1 {
+		return nil, fmt.Errorf("invalid -simulate-failures value %v, expected 0..1", simFailures)
+	}
+
+	// NOTE(joel): Build folder name rules.
+	nameRules := naming.Rules{
+		MaxLength: nameMaxLen,
+		Forbidden: nameForbid,
+		Action:    nameAction,
+	}
+	if namePattern != "" {
+		if nameRules.Pattern, err = regexp.Compile(namePattern); err != nil {
+			return nil, fmt.Errorf("invalid -folder-name-pattern: %w", err)
+		}
+	}
+	if nameRules.Normalize, err = naming.ParseNormalize(nameNorm); err != nil {
+		return nil, fmt.Errorf("invalid -folder-name-normalize: %w", err)
+	}
+	switch nameAction {
+	case naming.ActionReject, naming.ActionQuarantine:
+	default:
+		return nil, fmt.Errorf("invalid -invalid-folder-action %q, expected reject or quarantine", nameAction)
+	}
+	var labels naming.Labels
+	if pathLabels != "" {
+		// NOTE(joel): Labels must not replace metadata set by the tool itself.
+		if labels, err = naming.NewLabels(pathLabels, "agent", "run", "sha256"); err != nil {
+			return nil, fmt.Errorf("invalid -path-labels: %w", err)
+		}
+	}
 
 	// NOTE(joel): Parse the firestore string if provided.
 	// Expected format: PROJECT_ID:COLLECTION
@@ -74,21 +995,182 @@ func ParseFlags() (*Config, error) {
 		if !ok || fsProjectId == "" || fsCollection == "" {
 			return nil, fmt.Errorf("invalid -firestore format, expected PROJECT_ID:COLLECTION")
 		}
+		if _, err := ParseCollectionTemplate(fsCollection, labels); err != nil {
+			return nil, fmt.Errorf("invalid -firestore collection: %w", err)
+		}
+	}
+
+	reporter, err := report.NewSentry(reportDSN)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -error-report-dsn: %w", err)
+	}
+
+	// NOTE(joel): Build notifiers. Each configured channel receives the same
+	// digest.
+	var notifiers notify.Multi
+	if slackHook != "" {
+		notifiers = append(notifiers, notify.NewSlack(slackHook))
+	}
+	if smtpAddr != "" {
+		if mailFrom == "" || mailTo == "" {
+			return nil, fmt.Errorf("-notify-smtp requires -notify-email-from and -notify-email-to")
+		}
+		notifiers = append(notifiers, &notify.SMTP{
+			Addr:     smtpAddr,
+			From:     mailFrom,
+			To:       strings.Split(mailTo, ","),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		})
+	}
+	var notifier notify.Notifier
+	if len(notifiers) > 0 {
+		notifier = notifiers
+	}
+
+	// NOTE(joel): Default the agent ID to the hostname so data from many sites
+	// sharing one bucket/collection can be attributed.
+	if agentID == "" {
+		agentID = defaultAgentID()
+	}
+	runID := uuid.NewString()
+	if reporter != nil {
+		reporter.ServerName = agentID
+	}
+
+	// NOTE(joel): Every log line carries the agent and run IDs, after the
+	// optional static -log-prefix.
+	prefix := "agent=" + agentID + " run=" + runID + " "
+	if logPrefix != "" {
+		prefix = logPrefix + " " + prefix
+	}
+	logger, err := NewLogger(os.Stderr, logTime, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// NOTE(joel): Opened last so no validation error leaks the file.
+	ev, err := events.Open(eventsFile)
+	if err != nil {
+		return nil, err
+	}
+	if ev != nil {
+		ev.Agent, ev.RunID = agentID, runID
+	}
+	warnings, err := OpenWarnings(logger, warnLimit, warnFile, logTime, prefix)
+	if err != nil {
+		ev.Close()
+		return nil, err
 	}
 
 	cfg := &Config{
+		Command:             command,
 		RootDir:             abs,
 		Recursive:           recursive,
 		FollowSymlinks:      followLinks,
 		StateFile:           stateFile,
 		DisableState:        disableState,
+		ScanOnly:            scanOnly,
+		Fix:                 fix,
+		Confirm:             confirm,
+		Yes:                 yes,
+		FromStdin:           fromStdin,
+		BackfillChunk:       backfillSize,
+		TrackChanges:        trackChanges,
 		LockFile:            lockFile,
+		LockCollection:      lockColl,
+		LockKey:             lockKey,
 		GCSBucket:           gcsBucket,
+		DestPrefix:          destPrefix,
 		FirestoreProjectId:  fsProjectId,
 		FirestoreCollection: fsCollection,
+		ClaimCollection:     claimColl,
+		ClaimTTL:            claimTTL,
+		BatchCollection:     batchColl,
+		DocIDStrategy:       docID,
+		GCSAPI:              gcsAPI,
+		GCSProxy:            gcsProxy,
+		GCSUserAgent:        gcsUA,
+		GCSBillingProject:   gcsBilling,
 		FolderConcurrency:   folderConc,
 		FileConcurrency:     fileConc,
-		Logger:              log.New(os.Stderr, "", log.LstdFlags),
+		AutoConcurrency:     AutoConcurrency{Multiplier: autoMult, Min: DefaultAutoConcurrency.Min, Max: autoMax},
+		ArchiveDir:          archiveDir,
+		Snapshot:            snapshot,
+		RescanBeforeUpload:  rescan,
+		ExportData:          exportData,
+		Partition:           partition,
+		InProgress:          InProgress{Suffixes: parseSuffixes(inProgSuffix), EmptyAge: inProgEmpty, Settle: inProgSettle},
+		Progress:            progressMode,
+		SimulateFailures:    simFailures,
+		FolderNameRules:     nameRules,
+		PathLabels:          labels,
+		NormalizeUnicode:    normUnicode,
+		StateRelativeKeys:   relKeys,
+		AgentID:             agentID,
+		RunID:               runID,
+		HistorySize:         historySize,
+		Reporter:            reporter,
+		Events:              ev,
+		Notifier:            notifier,
+		NotifyOrphans:       notifyOrph,
+		NotifyInterval:      notifyIval,
+		MaxFoldersPerRun:    maxFolders,
+		MaxBytesPerRun:      maxBytes,
+		Order:               order,
+		IncludeHidden:       inclHidden,
+		FollowFileSymlinks:  followFiles,
+		DedupeHardlinks:     dedupeLinks,
+		CompressSparse:      compSparse,
+		BundleSmallFiles:    bundleSmall,
+		LargeFileThreshold:  largeFile,
+		Triggers:            triggers,
+		RequireCount:        requireCount,
+		SkipUnreadable:      skipUnread,
+		ScanTimeout:         scanTimeout,
+		ScanRetries:         scanRetries,
+		EntryPageSize:       pageSize,
+		ReadyPreview:        readyPreview,
+		ReadySymlinks:       readyLinks,
+		MaxEntriesInOutput:  maxEntries,
+		Pretty:              pretty,
+		Fields:              fieldList,
+		SkipExisting:        skipExisting,
+		FirestoreRetries:    fsRetries,
+		FirestoreBackoff:    fsBackoff,
+		PendingFile:         pendingFile,
+		RecordIndex:         recordIndex,
+		Strict:              strict,
+		StatePolicy:         statePolicy,
+		EmptyFolder:         emptyFolder,
+		FileFailure:         fileFailure,
+		FileRetries:         fileRetries,
+		FileRetryBackoff:    fileBackoff,
+		FolderDeadline:      folderLimit,
+		IfExists:            ifExists,
+		NameCollisions:      collisions,
+		RelativeObjectNames: relNames,
+		ReuploadVersions:    reupload,
+		LogPrefix:           logPrefix,
+		LogTime:             logTime,
+		Logger:              logger,
+		Warnings:            warnings,
+		ContentTypes:        contentTypes,
+		PreserveOwnership:   keepOwner,
+		ObjectACLs:          objectACLs,
+		ObjectHold:          objectHold,
+		ObjectRetention:     objectRetention,
+		FolderManifest:      manifest,
+		Only:                onlyFilter,
+		SkipListFile:        skipList,
+		WaveSize:            waveSize,
+		WaveBudget:          waveBudget,
+		Mirrors:             mirrors,
+		AgeSLA:              ageSLA,
+		NiceIO:              niceIO,
+		NiceIORate:          niceIORate,
+		ReadBack:            readBack,
+		Stdin:               os.Stdin,
 		Stdout:              os.Stdout,
 	}
 
@@ -96,10 +1178,23 @@ func ParseFlags() (*Config, error) {
 	if cfg.LockFile == "" {
 		h := sha256.Sum256([]byte(cfg.RootDir))
 		short := hex.EncodeToString(h[:8])
-		cfg.LockFile = filepath.Join(os.TempDir(), fmt.Sprintf("local-file-sync-%s.lock", short))
+		cfg.LockFile = filepath.Join(os.TempDir(), fmt.Sprintf("local-file-sync-%s%s.lock", short, partition.suffix()))
 	}
 	if cfg.StateFile == "" {
-		cfg.StateFile = filepath.Join(cfg.RootDir, ".local-file-sync_state.json")
+		cfg.StateFile = filepath.Join(cfg.RootDir, ".local-file-sync_state"+partition.suffix()+".json")
+	}
+	if cfg.PendingFile == "" {
+		cfg.PendingFile = filepath.Join(cfg.RootDir, ".local-file-sync_pending"+partition.suffix()+".jsonl")
 	}
 	return cfg, nil
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// defaultAgentID returns the hostname, or "unknown" if it can't be determined.
+func defaultAgentID() string {
+	if h, err := os.Hostname(); err == nil && h != "" {
+		return h
+	}
+	return "unknown"
+}
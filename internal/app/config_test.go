@@ -2,10 +2,16 @@ package app
 
 import (
 	"flag"
+	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
+
+	"local-file-sync/internal/notify"
+	"local-file-sync/internal/scanner"
 )
 
 // resetFlags resets the default flag.CommandLine for tests that re-use
@@ -53,3 +59,1175 @@ func TestParseFlags_Overrides(t *testing.T) {
 		t.Fatalf("overrides not applied: %+v", cfg)
 	}
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_Progress verifies the -progress default and validation.
+func TestParseFlags_Progress(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.Progress != "auto" {
+		t.Fatalf("expected auto progress default, got %q", cfg.Progress)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-progress", "sometimes"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for invalid -progress value")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_SimulateFailures verifies the failure rate is range checked.
+func TestParseFlags_SimulateFailures(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-simulate-failures", "0.25"}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.SimulateFailures != 0.25 {
+		t.Fatalf("unexpected rate %v", cfg.SimulateFailures)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-simulate-failures", "1.5"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for rate > 1")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_ClaimCollection verifies -claim-collection requires
+// -firestore.
+func TestParseFlags_ClaimCollection(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-gcs-bucket", "b", "-claim-collection", "claims"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error without -firestore")
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-gcs-bucket", "b", "-firestore", "p:c", "-claim-collection", "claims"}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.ClaimCollection != "claims" || cfg.ClaimTTL != time.Hour {
+		t.Fatalf("unexpected claim collection %q ttl %s", cfg.ClaimCollection, cfg.ClaimTTL)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-gcs-bucket", "b", "-firestore", "p:c", "-claim-collection", "claims", "-claim-ttl", "0"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for -claim-ttl 0")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_BatchCollection verifies -batch-collection requires
+// -firestore.
+func TestParseFlags_BatchCollection(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-gcs-bucket", "b", "-batch-collection", "runs"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error without -firestore")
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-gcs-bucket", "b", "-firestore", "p:c", "-batch-collection", "runs"}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.BatchCollection != "runs" {
+		t.Fatalf("unexpected batch collection %q", cfg.BatchCollection)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_LockCollection verifies -lock-collection requires -firestore
+// and the lease key defaults to the scanned directory.
+func TestParseFlags_LockCollection(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-gcs-bucket", "b", "-lock-collection", "locks"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error without -firestore")
+	}
+
+	dir := t.TempDir()
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", dir, "-gcs-bucket", "b", "-firestore", "p:c", "-lock-collection", "locks"}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.LockCollection != "locks" || cfg.LockKey != cfg.RootDir {
+		t.Fatalf("unexpected lock collection %q key %q", cfg.LockCollection, cfg.LockKey)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", dir, "-gcs-bucket", "b", "-firestore", "p:c", "-lock-collection", "locks", "-lock-key", "share-1"}
+	if cfg, err = ParseFlags(); err != nil || cfg.LockKey != "share-1" {
+		t.Fatalf("expected lock key share-1, got %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_Dest verifies -dest sets bucket and prefix and excludes
+// -gcs-bucket.
+func TestParseFlags_Dest(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-dest", "gs://bucket/intake/", "-firestore", "p:c"}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.GCSBucket != "bucket" || cfg.DestPrefix != "intake" {
+		t.Fatalf("unexpected bucket %q prefix %q", cfg.GCSBucket, cfg.DestPrefix)
+	}
+
+	for _, args := range [][]string{
+		{"-dest", "gs://bucket", "-gcs-bucket", "other"},
+		{"-dest", "s3://bucket"},
+	} {
+		resetFlags()
+		os.Args = append([]string{"cmd", "-dir", t.TempDir()}, args...)
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_FolderNameRules verifies folder name rule flags are parsed
+// and validated.
+func TestParseFlags_FolderNameRules(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-folder-name-pattern", "^ORDER", "-folder-name-normalize", "upper,strip-spaces", "-invalid-folder-action", "quarantine"}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	r := cfg.FolderNameRules
+	if r.Pattern == nil || len(r.Normalize) != 2 || r.Action != "quarantine" {
+		t.Fatalf("rules not applied: %+v", r)
+	}
+
+	for _, args := range [][]string{
+		{"-folder-name-pattern", "("},
+		{"-folder-name-normalize", "shout"},
+		{"-invalid-folder-action", "delete"},
+	} {
+		resetFlags()
+		os.Args = append([]string{"cmd", "-dir", t.TempDir()}, args...)
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_AgentID verifies the agent ID defaults to the hostname and is
+// used as the logger prefix.
+func TestParseFlags_AgentID(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.AgentID != defaultAgentID() {
+		t.Fatalf("expected hostname agent ID, got %q", cfg.AgentID)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-agent-id", "scanner-7"}
+	cfg, err = ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.AgentID != "scanner-7" {
+		t.Fatalf("expected agent ID override, got %q", cfg.AgentID)
+	}
+	if len(cfg.RunID) != 36 {
+		t.Fatalf("expected UUID run ID, got %q", cfg.RunID)
+	}
+	if cfg.Logger.Prefix() != "agent=scanner-7 run="+cfg.RunID+" " {
+		t.Fatalf("unexpected logger prefix %q", cfg.Logger.Prefix())
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_LogFormat verifies the static log prefix, the timestamp
+// format and its validation.
+func TestParseFlags_LogFormat(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-agent-id", "a", "-log-prefix", "[eu1]", "-log-time", "utc"}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.LogPrefix != "[eu1]" || cfg.LogTime != LogTimeUTC {
+		t.Fatalf("unexpected log config %q %q", cfg.LogPrefix, cfg.LogTime)
+	}
+	if cfg.Logger.Prefix() != "[eu1] agent=a run="+cfg.RunID+" " || cfg.Logger.Flags() != log.Lmsgprefix {
+		t.Fatalf("unexpected logger prefix %q flags %d", cfg.Logger.Prefix(), cfg.Logger.Flags())
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-log-time", "zulu"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for unknown log time format")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_Command verifies an optional subcommand before the flags.
+func TestParseFlags_Command(t *testing.T) {
+	resetFlags()
+	dir := t.TempDir()
+	os.Args = []string{"cmd", "history", "-dir", dir}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.Command != CommandHistory || cfg.RootDir != dir {
+		t.Fatalf("unexpected command %q dir %q", cfg.Command, cfg.RootDir)
+	}
+	if cfg.HistorySize != 20 {
+		t.Fatalf("expected default history size 20, got %d", cfg.HistorySize)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "schema"}
+	if cfg, err := ParseFlags(); err != nil || cfg.Command != CommandSchema {
+		t.Fatalf("expected schema command, got %v", err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "state", "audit", "-fix"}
+	if cfg, err := ParseFlags(); err != nil || cfg.Command != CommandStateAudit || !cfg.Fix {
+		t.Fatalf("expected state audit command with fix, got %v", err)
+	}
+
+	for _, args := range [][]string{{"cmd", "bogus"}, {"cmd", "state"}, {"cmd", "state", "bogus"}} {
+		resetFlags()
+		os.Args = args
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for unknown command %v", args[1:])
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_ErrorReportDSN verifies the DSN flag, its environment
+// fallback and validation.
+func TestParseFlags_ErrorReportDSN(t *testing.T) {
+	t.Setenv("SENTRY_DSN", "")
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.Reporter != nil {
+		t.Fatalf("expected no reporter by default")
+	}
+
+	t.Setenv("SENTRY_DSN", "https://key@sentry.example.com/1")
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-agent-id", "a1"}
+	cfg, err = ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.Reporter == nil || cfg.Reporter.ServerName != "a1" {
+		t.Fatalf("expected reporter from $SENTRY_DSN, got %+v", cfg.Reporter)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-error-report-dsn", "not-a-dsn"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for invalid DSN")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_Notify verifies notifier flags build a notifier and SMTP
+// requires sender and recipients.
+func TestParseFlags_Notify(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.Notifier != nil || cfg.NotifyInterval != time.Hour {
+		t.Fatalf("unexpected notify defaults %v %v", cfg.Notifier, cfg.NotifyInterval)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-notify-smtp", "mail:25"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error without sender and recipients")
+	}
+
+	resetFlags()
+	os.Args = []string{
+		"cmd", "-dir", t.TempDir(), "-notify-slack-webhook", "https://hooks.example.com/x",
+		"-notify-smtp", "mail:25", "-notify-email-from", "a@example.com", "-notify-email-to", "b@example.com",
+	}
+	cfg, err = ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if m, ok := cfg.Notifier.(notify.Multi); !ok || len(m) != 2 {
+		t.Fatalf("expected two notifiers, got %#v", cfg.Notifier)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_Triggers verifies trigger strategies are built from -trigger
+// and -dir-triggers, and unknown strategies are rejected.
+func TestParseFlags_Triggers(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if len(cfg.Triggers) != 1 || cfg.Triggers[0] != (scanner.SuffixFile{}) {
+		t.Fatalf("unexpected default triggers %#v", cfg.Triggers)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-trigger", "manifest", "-manifest-name", "_SUCCESS", "-dir-triggers"}
+	cfg, err = ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if len(cfg.Triggers) != 2 || cfg.Triggers[0] != (scanner.Manifest{Name: "_SUCCESS"}) || cfg.Triggers[1] != (scanner.MarkerDir{}) {
+		t.Fatalf("unexpected triggers %#v", cfg.Triggers)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-trigger", "rdy,bogus"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for unknown trigger")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_EmptyFolder verifies the -empty-folder default and
+// validation.
+func TestParseFlags_EmptyFolder(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.EmptyFolder != EmptyFolderRecord {
+		t.Fatalf("unexpected default policy %q", cfg.EmptyFolder)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-empty-folder", "marker"}
+	if cfg, err = ParseFlags(); err != nil || cfg.EmptyFolder != EmptyFolderMarker {
+		t.Fatalf("unexpected policy %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-empty-folder", "ignore"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for invalid policy")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_FileFailure verifies the file failure policy, its retry
+// settings and validation.
+func TestParseFlags_FileFailure(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.FileFailure != FileFailureContinue || cfg.FileRetries != 3 || cfg.FileRetryBackoff != time.Second {
+		t.Fatalf("unexpected defaults %q %d %s", cfg.FileFailure, cfg.FileRetries, cfg.FileRetryBackoff)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-file-failure", "retry", "-file-retries", "5"}
+	if cfg, err = ParseFlags(); err != nil || cfg.FileFailure != FileFailureRetry || cfg.FileRetries != 5 {
+		t.Fatalf("unexpected policy %v %v", cfg, err)
+	}
+
+	for _, args := range [][]string{{"-file-failure", "abort"}, {"-file-retries", "-1"}} {
+		resetFlags()
+		os.Args = append([]string{"cmd", "-dir", t.TempDir()}, args...)
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_IfExists verifies the existing object policy defaults to
+// overwrite and is validated.
+func TestParseFlags_IfExists(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil || cfg.IfExists != IfExistsOverwrite {
+		t.Fatalf("unexpected default %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-if-exists", "conflict"}
+	if cfg, err = ParseFlags(); err != nil || cfg.IfExists != IfExistsConflict {
+		t.Fatalf("unexpected policy %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-if-exists", "replace"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for invalid policy")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_Fields verifies -fields is split and checked against the
+// match fields.
+func TestParseFlags_Fields(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-pretty", "-fields", "readyFile, folder"}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if !cfg.Pretty || !slices.Equal(cfg.Fields, []string{"readyFile", "folder"}) {
+		t.Fatalf("unexpected output options %v %v", cfg.Pretty, cfg.Fields)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-fields", "readyFile,bogus"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for unknown field")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_PathLabels verifies -path-labels is compiled and reserved
+// label names are rejected.
+func TestParseFlags_PathLabels(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-path-labels", `^(?P<customer>[^/]+)/`}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if got := cfg.PathLabels.Derive("ACME/ORDER1"); got["customer"] != "ACME" {
+		t.Fatalf("unexpected labels %v", got)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-path-labels", `^(?P<sha256>[^/]+)/`}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for reserved label name")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_ScanTimeout verifies scan timeouts are disabled by default
+// and validated.
+func TestParseFlags_ScanTimeout(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.ScanTimeout != 0 || cfg.ScanRetries != 1 {
+		t.Fatalf("unexpected defaults %s %d", cfg.ScanTimeout, cfg.ScanRetries)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-scan-timeout", "5s", "-scan-retries", "3"}
+	if cfg, err = ParseFlags(); err != nil || cfg.ScanTimeout != 5*time.Second || cfg.ScanRetries != 3 {
+		t.Fatalf("unexpected scan timeout %v %v", cfg, err)
+	}
+
+	for _, args := range [][]string{{"-scan-timeout", "-1s"}, {"-scan-retries", "-1"}} {
+		resetFlags()
+		os.Args = append([]string{"cmd", "-dir", t.TempDir()}, args...)
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_Backfill verifies the backfill command and its chunk size,
+// and that it requires a writable state.
+func TestParseFlags_Backfill(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "backfill", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.Command != CommandBackfill || cfg.BackfillChunk != 100 {
+		t.Fatalf("unexpected command %q chunk %d", cfg.Command, cfg.BackfillChunk)
+	}
+
+	for _, args := range [][]string{{"-backfill-chunk", "0"}, {"-no-state"}, {"-scan-only"}, {"-stdin"}} {
+		resetFlags()
+		os.Args = append([]string{"cmd", "backfill", "-dir", t.TempDir()}, args...)
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_FolderDeadline verifies the folder deadline is disabled by
+// default and validated.
+func TestParseFlags_FolderDeadline(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-folder-deadline", "10m"}
+	cfg, err := ParseFlags()
+	if err != nil || cfg.FolderDeadline != 10*time.Minute {
+		t.Fatalf("unexpected folder deadline %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-folder-deadline", "-1s"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for negative deadline")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_NameCollisions verifies colliding folders fail by default and
+// the policy is validated.
+func TestParseFlags_NameCollisions(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil || cfg.NameCollisions != CollisionFail {
+		t.Fatalf("unexpected default %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-name-collisions", "rename"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for unknown policy")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_AutoConcurrency verifies the auto concurrency heuristic
+// flags and their validation.
+func TestParseFlags_AutoConcurrency(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil || cfg.AutoConcurrency != DefaultAutoConcurrency {
+		t.Fatalf("unexpected default %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-auto-concurrency-multiplier", "4", "-auto-concurrency-max", "32"}
+	cfg, err = ParseFlags()
+	if err != nil || cfg.AutoConcurrency != (AutoConcurrency{Multiplier: 4, Min: 2, Max: 32}) {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+
+	for _, args := range [][]string{
+		{"-auto-concurrency-multiplier", "0"},
+		{"-auto-concurrency-max", "1"},
+	} {
+		resetFlags()
+		os.Args = append([]string{"cmd", "-dir", t.TempDir()}, args...)
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_ReadySymlinks verifies symlinked triggers are followed by
+// default and the policy is validated.
+func TestParseFlags_ReadySymlinks(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil || cfg.ReadySymlinks != scanner.ReadySymlinkFollow {
+		t.Fatalf("unexpected default %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-ready-symlinks", "skip"}
+	if cfg, err := ParseFlags(); err != nil || cfg.ReadySymlinks != scanner.ReadySymlinkSkip {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-ready-symlinks", "lstat"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for unknown policy")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_GCSTransport verifies the GCS client API, proxy, user agent
+// and billing project options and their validation.
+func TestParseFlags_GCSTransport(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil || cfg.GCSAPI != GCSAPIJSON || cfg.GCSProxy != "" || cfg.GCSUserAgent != "" || cfg.GCSBillingProject != "" {
+		t.Fatalf("unexpected defaults %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-gcs-proxy", "http://proxy.local:3128", "-gcs-user-agent", "plant-7", "-billing-project", "billing-1"}
+	if cfg, err := ParseFlags(); err != nil || cfg.GCSProxy != "http://proxy.local:3128" || cfg.GCSUserAgent != "plant-7" || cfg.GCSBillingProject != "billing-1" {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+
+	for _, args := range [][]string{
+		{"-gcs-api", "rest"},
+		{"-gcs-proxy", "proxy.local:3128"},
+		{"-gcs-proxy", "ftp://proxy.local"},
+		{"-gcs-api", "grpc", "-gcs-proxy", "http://proxy.local:3128"},
+	} {
+		resetFlags()
+		os.Args = append([]string{"cmd", "-dir", t.TempDir()}, args...)
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_DocID verifies -doc-id values and the triggers they can't be
+// combined with.
+func TestParseFlags_DocID(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil || cfg.DocIDStrategy != DocIDHash {
+		t.Fatalf("unexpected default %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-doc-id", "producer"}
+	if cfg, err := ParseFlags(); err != nil || cfg.DocIDStrategy != DocIDProducer {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+
+	for _, args := range [][]string{
+		{"-doc-id", "uuid"},
+		{"-doc-id", "ready", "-trigger", "manifest"},
+		{"-doc-id", "producer", "-trigger", "rdy,batch"},
+	} {
+		resetFlags()
+		os.Args = append([]string{"cmd", "-dir", t.TempDir()}, args...)
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_Records verifies the records commands and their
+// requirements.
+func TestParseFlags_Records(t *testing.T) {
+	index := filepath.Join(t.TempDir(), "records.jsonl")
+	resetFlags()
+	os.Args = []string{"cmd", "records", "verify", "-dir", t.TempDir(), "-record-index", index, "-gcs-bucket", "b", "-firestore", "p:c"}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if cfg.Command != CommandRecordsVerify || cfg.RecordIndex != index {
+		t.Fatalf("unexpected command %q index %q", cfg.Command, cfg.RecordIndex)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "records", "-record-index", index, "-dir", t.TempDir()}
+	if cfg, err := ParseFlags(); err != nil || cfg.Command != CommandRecords {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+
+	for _, args := range [][]string{{"records"}, {"records", "verify", "-record-index", index}, {"records", "purge", "-record-index", index}} {
+		resetFlags()
+		os.Args = append([]string{"cmd"}, args...)
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_ArchiveDir verifies -archive-dir is resolved to an absolute
+// path and rejected without -gcs-bucket or inside -dir.
+func TestParseFlags_ArchiveDir(t *testing.T) {
+	dir, archiveDir := t.TempDir(), t.TempDir()
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", dir, "-gcs-bucket", "b", "-archive-dir", archiveDir}
+	if cfg, err := ParseFlags(); err != nil || cfg.ArchiveDir != archiveDir {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+
+	for _, args := range [][]string{
+		{"-archive-dir", archiveDir},
+		{"-gcs-bucket", "b", "-archive-dir", filepath.Join(dir, "archive")},
+		{"-gcs-bucket", "b", "-archive-dir", dir},
+	} {
+		resetFlags()
+		os.Args = append([]string{"cmd", "-dir", dir}, args...)
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_InProgress verifies the in-progress heuristics flags.
+func TestParseFlags_InProgress(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil || cfg.InProgress.Enabled() {
+		t.Fatalf("unexpected default %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-in-progress-suffixes", ".part,.CRDOWNLOAD", "-in-progress-empty-age", "30s", "-in-progress-settle", "2s"}
+	cfg, err = ParseFlags()
+	want := InProgress{Suffixes: []string{".part", ".crdownload"}, EmptyAge: 30 * time.Second, Settle: 2 * time.Second}
+	if err != nil || !slices.Equal(cfg.InProgress.Suffixes, want.Suffixes) || cfg.InProgress.EmptyAge != want.EmptyAge || cfg.InProgress.Settle != want.Settle {
+		t.Fatalf("unexpected result %+v %v", cfg.InProgress, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-in-progress-settle", "-1s"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for negative settle time")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_Snapshot verifies the -snapshot policy and its validation.
+func TestParseFlags_Snapshot(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil || cfg.Snapshot != SnapshotLenient {
+		t.Fatalf("unexpected default %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-snapshot", "strict"}
+	if cfg, err := ParseFlags(); err != nil || cfg.Snapshot != SnapshotStrict {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-snapshot", "frozen"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for unknown policy")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_RescanBeforeUpload verifies -rescan-before-upload.
+func TestParseFlags_RescanBeforeUpload(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	if cfg, err := ParseFlags(); err != nil || cfg.RescanBeforeUpload {
+		t.Fatalf("unexpected default %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-rescan-before-upload"}
+	if cfg, err := ParseFlags(); err != nil || !cfg.RescanBeforeUpload {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_Export verifies the export command and -export-data.
+func TestParseFlags_Export(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "export", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil || cfg.Command != CommandExport || cfg.ExportData != ExportRuns {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "export", "-dir", t.TempDir(), "-export-data", "records", "-record-index", "records.jsonl"}
+	if cfg, err := ParseFlags(); err != nil || cfg.ExportData != ExportRecords {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+
+	for _, args := range [][]string{
+		{"-export-data", "records"},
+		{"-export-data", "parquet"},
+	} {
+		resetFlags()
+		os.Args = append([]string{"cmd", "export", "-dir", t.TempDir()}, args...)
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_Lock verifies the lock commands parse and can't be used with
+// a lease lock.
+func TestParseFlags_Lock(t *testing.T) {
+	for _, want := range []string{CommandLockStatus, CommandLockBreak} {
+		resetFlags()
+		os.Args = append([]string{"cmd"}, append(strings.Fields(want), "-dir", t.TempDir())...)
+		cfg, err := ParseFlags()
+		if err != nil || cfg.Command != want || cfg.LockFile == "" {
+			t.Fatalf("unexpected result %v %v", cfg, err)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"lock"},
+		{"lock", "steal"},
+		{"lock", "status", "-firestore", "p", "-lock-collection", "locks"},
+	} {
+		resetFlags()
+		os.Args = append(append([]string{"cmd"}, args...), "-dir", t.TempDir())
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_Partition verifies -partition derives lock, state, pending
+// file and lease key per partition.
+func TestParseFlags_Partition(t *testing.T) {
+	dir := t.TempDir()
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", dir}
+	whole, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", dir, "-partition", "1/4"}
+	cfg, err := ParseFlags()
+	if err != nil || cfg.Partition != (Partition{Index: 1, Count: 4}) {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+	if cfg.StateFile != filepath.Join(dir, ".local-file-sync_state.p1of4.json") || cfg.PendingFile != filepath.Join(dir, ".local-file-sync_pending.p1of4.jsonl") {
+		t.Fatalf("unexpected state/pending file %s %s", cfg.StateFile, cfg.PendingFile)
+	}
+	if cfg.LockFile == whole.LockFile || !strings.HasSuffix(cfg.LockFile, ".p1of4.lock") || cfg.LockKey != whole.LockKey+"#1/4" {
+		t.Fatalf("unexpected lock %s %s", cfg.LockFile, cfg.LockKey)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", dir, "-partition", "4/4"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for index out of range")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_Only verifies -only parses globs and regular expressions.
+func TestParseFlags_Only(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-only", "re:^ORDER1$"}
+	cfg, err := ParseFlags()
+	if err != nil || !cfg.Only.Enabled() || !cfg.Only.Match("/x/ORDER1.RDY") || cfg.Only.Match("/x/ORDER2.RDY") {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-only", "ORDER["}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for malformed glob")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_Waves verifies -wave-size and -wave-budget and their
+// conflicts.
+func TestParseFlags_Waves(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-gcs-bucket", "b", "-wave-size", "50", "-wave-budget", "10m"}
+	cfg, err := ParseFlags()
+	if err != nil || cfg.WaveSize != 50 || cfg.WaveBudget != 10*time.Minute {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+
+	for _, args := range [][]string{
+		{"-wave-size", "50"},
+		{"-gcs-bucket", "b", "-wave-size", "-1"},
+		{"-gcs-bucket", "b", "-wave-budget", "1m", "-stdin"},
+		{"-gcs-bucket", "b", "-wave-size", "5", "-confirm"},
+	} {
+		resetFlags()
+		os.Args = append([]string{"cmd", "-dir", t.TempDir()}, args...)
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_Warnings verifies -warning-limit and -warnings-file.
+func TestParseFlags_Warnings(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil || cfg.Warnings == nil || cfg.Warnings.Limit != DefaultWarningLimit || cfg.Warnings.Detail != nil {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+
+	file := filepath.Join(t.TempDir(), "warnings.log")
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-warning-limit", "0", "-warnings-file", file}
+	cfg, err = ParseFlags()
+	if err != nil || cfg.Warnings.Limit != 0 || cfg.Warnings.Detail == nil {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+	defer cfg.Warnings.Close()
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("expected warnings file created: %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_ContentTypes verifies -content-types loads the mapping file
+// and fails the parse for unreadable or malformed files.
+func TestParseFlags_ContentTypes(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "types")
+	if err := os.WriteFile(file, []byte("application/dicom dcm\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", dir, "-content-types", file}
+	cfg, err := ParseFlags()
+	if err != nil || cfg.ContentTypes[".dcm"] != "application/dicom" {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", dir, "-content-types", filepath.Join(dir, "missing")}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for missing file")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_ObjectACL verifies -object-acl is parsed into rules and
+// unknown ACLs are rejected.
+func TestParseFlags_ObjectACL(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-object-acl", "public-read:*.jpg"}
+	cfg, err := ParseFlags()
+	if err != nil || cfg.ObjectACLs.For("a.jpg") != "publicRead" || cfg.ObjectACLs.For("a.pdf") != "" {
+		t.Fatalf("unexpected result %v %v", cfg, err)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-object-acl", "world-writable"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for unknown ACL")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_Mirror verifies -mirror is repeatable, requires an upload
+// destination and can't repeat it.
+func TestParseFlags_Mirror(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-dest", "gs://new/in", "-mirror", "gs://old/in", "-mirror", "file:///srv/mirror"}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := []Destination{{Scheme: SchemeGCS, Bucket: "old", Prefix: "in"}, {Scheme: SchemeFile, Dir: "/srv/mirror"}}
+	if !slices.Equal(cfg.Mirrors, want) {
+		t.Fatalf("expected mirrors %v, got %v", want, cfg.Mirrors)
+	}
+
+	for _, args := range [][]string{
+		{"-mirror", "gs://old"},
+		{"-gcs-bucket", "new", "-mirror", "gs://new"},
+	} {
+		resetFlags()
+		os.Args = append([]string{"cmd", "-dir", t.TempDir()}, args...)
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseFlags_AgeSLA verifies -rdy-age-sla is parsed and must not be
+// negative.
+func TestParseFlags_AgeSLA(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-rdy-age-sla", "4h"}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if cfg.AgeSLA != 4*time.Hour {
+		t.Fatalf("expected 4h SLA, got %s", cfg.AgeSLA)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-rdy-age-sla", "-1h"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for negative SLA")
+	}
+}
+
+// TestParseFlags_NiceIO verifies -nice-io and its read rate.
+func TestParseFlags_NiceIO(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir()}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if cfg.NiceIO || cfg.NiceIORate != 25_000_000 {
+		t.Fatalf("expected nice-io off with default rate, got %v %d", cfg.NiceIO, cfg.NiceIORate)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-nice-io", "-nice-io-rate", "0"}
+	cfg, err = ParseFlags()
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if !cfg.NiceIO || cfg.NiceIORate != 0 {
+		t.Fatalf("expected unpaced nice-io, got %v %d", cfg.NiceIO, cfg.NiceIORate)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-nice-io-rate", "-1"}
+	if _, err := ParseFlags(); err == nil {
+		t.Fatalf("expected error for negative rate")
+	}
+}
+
+// TestParseFlags_ReadBack verifies -read-back and its bounds.
+func TestParseFlags_ReadBack(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-gcs-bucket", "b", "-read-back", "0.25"}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if cfg.ReadBack != 0.25 {
+		t.Fatalf("expected read-back 0.25, got %v", cfg.ReadBack)
+	}
+
+	for _, args := range [][]string{
+		{"-gcs-bucket", "b", "-read-back", "1.5"},
+		{"-gcs-bucket", "b", "-read-back", "-0.1"},
+		{"-read-back", "1"},
+	} {
+		resetFlags()
+		os.Args = append([]string{"cmd", "-dir", t.TempDir()}, args...)
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+// TestParseFlags_HoldsAndRetention verifies -object-hold, -object-retention
+// and -folder-manifest and their validation.
+func TestParseFlags_HoldsAndRetention(t *testing.T) {
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-gcs-bucket", "b", "-object-hold", "event-based", "-object-retention", "locked:30d"}
+	cfg, err := ParseFlags()
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if cfg.ObjectHold != HoldEventBased || cfg.ObjectRetention != (ObjectRetention{Period: 30 * 24 * time.Hour, Locked: true}) {
+		t.Fatalf("unexpected hold %q and retention %+v", cfg.ObjectHold, cfg.ObjectRetention)
+	}
+
+	resetFlags()
+	os.Args = []string{"cmd", "-dir", t.TempDir(), "-gcs-bucket", "b", "-folder-manifest"}
+	if cfg, err := ParseFlags(); err != nil || !cfg.FolderManifest {
+		t.Fatalf("expected -folder-manifest, got %v %v", cfg, err)
+	}
+
+	for _, args := range [][]string{
+		{"-folder-manifest"},
+		{"-gcs-bucket", "b", "-object-hold", "legal"},
+		{"-gcs-bucket", "b", "-object-retention", "forever"},
+		{"-object-hold", "temporary"},
+	} {
+		resetFlags()
+		os.Args = append([]string{"cmd", "-dir", t.TempDir()}, args...)
+		if _, err := ParseFlags(); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LoadContentTypes reads a file extension to content type mapping in the
+// mime.types format: one content type per line followed by its extensions
+// (with or without the leading dot), separated by white space. Blank lines and
+// lines starting with `#` are ignored. Extensions are returned lower case with
+// their dot, e.g. `.dcm` -> `application/dicom`; a later line wins.
+func LoadContentTypes(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read content types: %w", err)
+	}
+	types := make(map[string]string)
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.Contains(fields[0], "/") {
+			return nil, fmt.Errorf("content types %s:%d: expected `type/subtype ext...`, got %q", path, i+1, line)
+		}
+		for _, ext := range fields[1:] {
+			types["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = fields[0]
+		}
+	}
+	return types, nil
+}
@@ -0,0 +1,44 @@
+package app
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestLoadContentTypes verifies the mime.types format is parsed with
+// comments, optional dots and case-insensitive extensions, and that malformed
+// lines are rejected.
+func TestLoadContentTypes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "types")
+	content := "# custom types\n\napplication/dicom dcm .DICOM\n  text/x-order   ord\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	types, err := LoadContentTypes(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	want := map[string]string{
+		".dcm":   "application/dicom",
+		".dicom": "application/dicom",
+		".ord":   "text/x-order",
+	}
+	if !maps.Equal(types, want) {
+		t.Fatalf("expected %v, got %v", want, types)
+	}
+
+	for _, bad := range []string{"application/dicom\n", "dcm application/dicom\n"} {
+		if err := os.WriteFile(path, []byte(bad), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, err := LoadContentTypes(path); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+	if _, err := LoadContentTypes(filepath.Join(dir, "missing")); err == nil {
+		t.Fatalf("expected error for missing file")
+	}
+}
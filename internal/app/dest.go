@@ -0,0 +1,94 @@
+package app
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Destination schemes accepted by ParseDestination.
+const (
+	SchemeGCS = "gs"
+	// SchemeFile is a local directory, accepted for mirrors only (see
+	// ParseMirror).
+	SchemeFile = "file"
+)
+
+// Destination is an upload destination given as a single URL (-dest), e.g.
+// `gs://bucket/prefix`.
+type Destination struct {
+	Scheme string
+	Bucket string
+	// Prefix is prepended to all object names; empty means none. It never
+	// starts or ends with a slash.
+	Prefix string
+	// Dir is the absolute local directory of SchemeFile destinations.
+	Dir string
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ParseDestination parses a destination URL of the form
+// `<scheme>://<bucket>[/<prefix>]`. Only the gs scheme is supported for now;
+// other schemes (e.g. s3) are rejected until they have a backend, and local
+// directories only receive copies (see ParseMirror).
+func ParseDestination(s string) (Destination, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return Destination{}, fmt.Errorf("parse destination %q: %w", s, err)
+	}
+	if u.Scheme == "" || u.Opaque != "" {
+		return Destination{}, fmt.Errorf("destination %q: expected <scheme>://<bucket>[/<prefix>]", s)
+	}
+	if u.Scheme != SchemeGCS {
+		return Destination{}, fmt.Errorf("destination %q: unsupported scheme %q", s, u.Scheme)
+	}
+	if u.Host == "" || u.User != nil || u.Port() != "" || u.RawQuery != "" || u.Fragment != "" {
+		return Destination{}, fmt.Errorf("destination %q: expected <scheme>://<bucket>[/<prefix>]", s)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		for seg := range strings.SplitSeq(prefix, "/") {
+			if seg == "" || seg == "." || seg == ".." {
+				return Destination{}, fmt.Errorf("destination %q: invalid prefix %q", s, prefix)
+			}
+		}
+		prefix = path.Clean(prefix)
+	}
+	return Destination{Scheme: u.Scheme, Bucket: u.Host, Prefix: prefix}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ParseMirror parses the URL of a -mirror destination: a GCS destination as
+// accepted by ParseDestination or a local directory as `file:///<path>`.
+func ParseMirror(s string) (Destination, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != SchemeFile {
+		return ParseDestination(s)
+	}
+	if u.Host != "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return Destination{}, fmt.Errorf("destination %q: expected file:///<path>", s)
+	}
+	dir := filepath.Clean(filepath.FromSlash(u.Path))
+	if !filepath.IsAbs(dir) {
+		return Destination{}, fmt.Errorf("destination %q: expected an absolute path", s)
+	}
+	return Destination{Scheme: SchemeFile, Dir: dir}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// String returns the destination as URL.
+func (d Destination) String() string {
+	if d.Scheme == SchemeFile {
+		return "file://" + filepath.ToSlash(d.Dir)
+	}
+	s := d.Scheme + "://" + d.Bucket
+	if d.Prefix != "" {
+		s += "/" + d.Prefix
+	}
+	return s
+}
@@ -0,0 +1,61 @@
+package app
+
+import "testing"
+
+// TestParseDestination verifies destination URLs are split into scheme,
+// bucket and prefix and invalid ones are rejected.
+func TestParseDestination(t *testing.T) {
+	for in, want := range map[string]Destination{
+		"gs://bucket":             {Scheme: "gs", Bucket: "bucket"},
+		"gs://bucket/":            {Scheme: "gs", Bucket: "bucket"},
+		"gs://bucket/intake/2025": {Scheme: "gs", Bucket: "bucket", Prefix: "intake/2025"},
+		"gs://bucket/intake/":     {Scheme: "gs", Bucket: "bucket", Prefix: "intake"},
+	} {
+		got, err := ParseDestination(in)
+		if err != nil {
+			t.Fatalf("ParseDestination(%q): %v", in, err)
+		}
+		if got != want {
+			t.Fatalf("ParseDestination(%q) = %+v, want %+v", in, got, want)
+		}
+	}
+	if got := (Destination{Scheme: "gs", Bucket: "b", Prefix: "p"}).String(); got != "gs://b/p" {
+		t.Fatalf("unexpected string %q", got)
+	}
+
+	for _, in := range []string{"bucket", "gs:bucket", "gs:///prefix", "s3://bucket", "file:///tmp", "gs://bucket/a//b", "gs://bucket/../x", "gs://bucket?x=1", "gs://u@bucket"} {
+		if _, err := ParseDestination(in); err == nil {
+			t.Fatalf("expected error for %q", in)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParseMirror verifies mirrors accept GCS destinations and absolute local
+// directories.
+func TestParseMirror(t *testing.T) {
+	for in, want := range map[string]Destination{
+		"gs://bucket/copy":     {Scheme: "gs", Bucket: "bucket", Prefix: "copy"},
+		"file:///srv/mirror":   {Scheme: "file", Dir: "/srv/mirror"},
+		"file:///srv/mirror/":  {Scheme: "file", Dir: "/srv/mirror"},
+		"file:///srv/a/../b/.": {Scheme: "file", Dir: "/srv/b"},
+	} {
+		got, err := ParseMirror(in)
+		if err != nil {
+			t.Fatalf("ParseMirror(%q): %v", in, err)
+		}
+		if got != want {
+			t.Fatalf("ParseMirror(%q) = %+v, want %+v", in, got, want)
+		}
+	}
+	if got := (Destination{Scheme: "file", Dir: "/srv/mirror"}).String(); got != "file:///srv/mirror" {
+		t.Fatalf("unexpected string %q", got)
+	}
+
+	for _, in := range []string{"file://host/srv", "file:relative", "file:///srv?x=1", "s3://bucket"} {
+		if _, err := ParseMirror(in); err == nil {
+			t.Fatalf("expected error for %q", in)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package app
+
+import (
+	"time"
+
+	"local-file-sync/internal/sys"
+)
+
+// Clock, ClockFunc, FileSystem and OSFileSystem make up an Env; see the sys
+// package.
+type (
+	Clock        = sys.Clock
+	ClockFunc    = sys.ClockFunc
+	FileSystem   = sys.FileSystem
+	OSFileSystem = sys.OSFileSystem
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Env is the clock and filesystem a run, its lock and its state go through,
+// so tests and embedders can simulate staleness, modification times and
+// failures deterministically. The zero value uses the real ones. Folder data
+// (uploads, archiving) and upload durations stay on the real ones.
+type Env struct {
+	// Clock, if set, replaces time.Now.
+	Clock Clock
+	// FS, if set, replaces OSFileSystem.
+	FS FileSystem
+}
+
+// Now returns the current time of e's clock.
+func (e Env) Now() time.Time {
+	if e.Clock == nil {
+		return time.Now()
+	}
+	return e.Clock.Now()
+}
+
+// Files returns e's filesystem.
+func (e Env) Files() FileSystem {
+	return sys.Files(e.FS)
+}
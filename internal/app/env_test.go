@@ -0,0 +1,61 @@
+package app
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestEnv_Lock verifies locks go through the clock and filesystem of an Env:
+// staleness follows the clock and filesystem errors are returned.
+func TestEnv_Lock(t *testing.T) {
+	lock := filepath.Join(t.TempDir(), "test.lock")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	env := Env{Clock: ClockFunc(func() time.Time { return now })}
+
+	release, ok, err := env.AcquireLock(lock, "first")
+	if err != nil || !ok {
+		t.Fatalf("acquire: ok=%v err=%v", ok, err)
+	}
+	defer release()
+	info, held, err := env.ReadLock(lock)
+	if err != nil || !held || !info.Acquired.Equal(now) {
+		t.Fatalf("expected lock acquired at the env's time, got %+v %v %v", info, held, err)
+	}
+	if err := os.Chtimes(lock, now, now); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if _, ok, _ := env.AcquireLock(lock, "second"); ok {
+		t.Fatalf("expected fresh lock to be held")
+	}
+	now = now.Add(LockTTL + time.Minute)
+	release2, ok, err := env.AcquireLock(lock, "second")
+	if err != nil || !ok {
+		t.Fatalf("expected stale lock reclaimed by the clock, got ok=%v err=%v", ok, err)
+	}
+	release2()
+
+	failing := Env{FS: failingFS{err: fs.ErrPermission}}
+	if _, _, err := failing.AcquireLock(lock, "third"); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected filesystem error, got %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// failingFS is an OSFileSystem whose writes fail with err.
+type failingFS struct {
+	OSFileSystem
+	err error
+}
+
+func (f failingFS) CreateExclusive(name string, data []byte, perm fs.FileMode) error {
+	return &fs.PathError{Op: "create", Path: name, Err: f.err}
+}
+
+func (f failingFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return &fs.PathError{Op: "write", Path: name, Err: f.err}
+}
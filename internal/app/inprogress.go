@@ -0,0 +1,56 @@
+package app
+
+import (
+	"strings"
+	"time"
+)
+
+// InProgress holds the heuristics for files that are still being written,
+// e.g. by a slow producer that creates the trigger too early. The zero value
+// detects nothing.
+type InProgress struct {
+	// Suffixes are lower case file name suffixes of partial files, e.g.
+	// `.part`; names are matched case-insensitively.
+	Suffixes []string
+	// EmptyAge, if > 0, flags empty files modified less than this long ago.
+	EmptyAge time.Duration
+	// Settle, if > 0, is the time between two stats of the files; files whose
+	// size or modification time changed in between are flagged.
+	Settle time.Duration
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Enabled reports whether any heuristic is configured.
+func (p InProgress) Enabled() bool {
+	return len(p.Suffixes) > 0 || p.EmptyAge > 0 || p.Settle > 0
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Partial reports whether a file named name of size bytes, last modified at
+// modTime, looks in progress at now by its name or as a fresh empty file.
+// Changes over time are checked by the caller (see Settle).
+func (p InProgress) Partial(name string, size int64, modTime, now time.Time) bool {
+	lower := strings.ToLower(name)
+	for _, s := range p.Suffixes {
+		if strings.HasSuffix(lower, s) {
+			return true
+		}
+	}
+	return p.EmptyAge > 0 && size == 0 && now.Sub(modTime) < p.EmptyAge
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// parseSuffixes parses a comma separated list of file name suffixes for
+// InProgress.Suffixes. Blank items are dropped.
+func parseSuffixes(list string) []string {
+	var suffixes []string
+	for s := range strings.SplitSeq(list, ",") {
+		if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+			suffixes = append(suffixes, s)
+		}
+	}
+	return suffixes
+}
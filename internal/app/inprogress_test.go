@@ -0,0 +1,39 @@
+package app
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestInProgress_Partial verifies files are flagged by their suffix
+// (case-insensitively) and as fresh empty files.
+func TestInProgress_Partial(t *testing.T) {
+	now := time.Now()
+	var zero InProgress
+	if zero.Enabled() || zero.Partial("a.part", 0, now, now) {
+		t.Fatalf("expected zero value to detect nothing")
+	}
+
+	p := InProgress{Suffixes: parseSuffixes(" .PART, .tmp,,"), EmptyAge: time.Minute}
+	if !slices.Equal(p.Suffixes, []string{".part", ".tmp"}) {
+		t.Fatalf("unexpected suffixes %v", p.Suffixes)
+	}
+	for _, tc := range []struct {
+		name string
+		size int64
+		age  time.Duration
+		want bool
+	}{
+		{"scan.part", 10, time.Hour, true},
+		{"SCAN.TMP", 10, time.Hour, true},
+		{"scan.tiff", 10, time.Hour, false},
+		{"empty.txt", 0, time.Second, true},
+		{"empty.txt", 0, time.Hour, false},
+		{"new.txt", 1, time.Second, false},
+	} {
+		if got := p.Partial(tc.name, tc.size, now.Add(-tc.age), now); got != tc.want {
+			t.Fatalf("Partial(%s, %d, -%s) = %v, want %v", tc.name, tc.size, tc.age, got, tc.want)
+		}
+	}
+}
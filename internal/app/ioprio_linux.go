@@ -0,0 +1,45 @@
+//go:build linux
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// NOTE(joel): Constants of ioprio_set(2), see linux/ioprio.h.
+const (
+	ioprioWhoProcess = 1
+	ioprioClassBE    = 2
+	ioprioClassShift = 13
+	// ioprioLowest is the lowest priority level within a class.
+	ioprioLowest = 7
+)
+
+// LowerIOPriority moves every thread of the process to the lowest priority of
+// the best-effort I/O scheduling class, like `ionice -c2 -n7`; threads
+// started later inherit it. It only has an effect with I/O schedulers that
+// support priorities (BFQ, CFQ).
+func LowerIOPriority() error {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return fmt.Errorf("list threads: %w", err)
+	}
+	prio := uintptr(ioprioClassBE<<ioprioClassShift | ioprioLowest)
+	var errs []error
+	for _, t := range tasks {
+		tid, err := strconv.Atoi(t.Name())
+		if err != nil {
+			continue
+		}
+		// NOTE(joel): Threads may exit meanwhile.
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), prio); errno != 0 && errno != unix.ESRCH {
+			errs = append(errs, fmt.Errorf("ioprio_set thread %d: %w", tid, errno))
+		}
+	}
+	return errors.Join(errs...)
+}
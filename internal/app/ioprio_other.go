@@ -0,0 +1,13 @@
+//go:build !linux
+
+package app
+
+import (
+	"errors"
+	"fmt"
+)
+
+// LowerIOPriority is not supported on this platform.
+func LowerIOPriority() error {
+	return fmt.Errorf("I/O priority: %w", errors.ErrUnsupported)
+}
@@ -3,25 +3,243 @@ package app
 import (
 	"errors"
 	"fmt"
+	"log"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// LockTTL is the age after which an existing lock file is considered stale
+// and may be reclaimed. Owners keep their lock fresh with HeartbeatLock.
+const LockTTL = 30 * time.Minute
+
+// LockHeartbeatInterval is how often HeartbeatLock refreshes the lock file.
+// It is well below LockTTL so a few missed beats (e.g. a stalled file system)
+// don't let another process take the lock over.
+const LockHeartbeatInterval = LockTTL / 6
+
 // AcquireLock attempts to create a lock file exclusively. It always returns a
 // release function that is safe to call even if the lock wasn't acquired. The
 // boolean 'acquired' indicates whether this process created (and owns) the
 // lock. If the file already exists and is not stale, acquired=false. If it is
 // stale (older than the TTL) we attempt a single reclaim.
 // `release()` will remove the lock file only if we acquired it. It never panics
-// and may be called multiple times idempotently.
-func AcquireLock(path string) (release func(), acquired bool, err error) {
-	return acquireLockWith(path, 30*time.Minute, time.Now)
+// and may be called multiple times idempotently. The owner (agent ID) is
+// recorded in the lock file for diagnostics.
+func AcquireLock(path, owner string) (release func(), acquired bool, err error) {
+	return Env{}.AcquireLock(path, owner)
+}
+
+// AcquireLock is like the AcquireLock function within e.
+func (e Env) AcquireLock(path, owner string) (release func(), acquired bool, err error) {
+	return acquireLockWith(e, path, owner, LockTTL)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// RemoveOrphanedLock removes the lock file at path if it was written by a
+// process on this host that no longer exists, e.g. a run that crashed, so the
+// next run doesn't have to wait for LockTTL. It returns the PID of the dead
+// owner, or 0 if nothing was removed: no lock, a lock of another host (e.g.
+// on a shared mount), of a live process or without host and PID (written by
+// an older version).
+func RemoveOrphanedLock(path string) (pid int, err error) {
+	return Env{}.RemoveOrphanedLock(path)
+}
+
+// RemoveOrphanedLock is like the RemoveOrphanedLock function within e.
+func (e Env) RemoveOrphanedLock(path string) (pid int, err error) {
+	info, held, err := e.ReadLock(path)
+	if err != nil || !held {
+		return 0, err
+	}
+	if alive, known := info.OwnerAlive(); !known || alive {
+		return 0, nil
+	}
+	if err := e.BreakLock(path, info); err != nil {
+		return 0, err
+	}
+	return info.PID, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// LockInfo describes the owner of a lock file as recorded by AcquireLock.
+// Fields missing in the file (e.g. the host of locks written by older
+// versions) are empty.
+type LockInfo struct {
+	PID      int
+	Host     string
+	Agent    string
+	Acquired time.Time
+	// Refreshed is the modification time of the lock file, i.e. the last
+	// heartbeat of its owner.
+	Refreshed time.Time
+
+	content string
+}
+
+// ReadLock reads the lock file at path. held is false if there is none.
+func ReadLock(path string) (info LockInfo, held bool, err error) {
+	return Env{}.ReadLock(path)
+}
+
+// ReadLock is like the ReadLock function within e.
+func (e Env) ReadLock(path string) (info LockInfo, held bool, err error) {
+	fi, err := e.Files().Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return info, false, nil
+	}
+	if err != nil {
+		return info, false, fmt.Errorf("stat lock file: %w", err)
+	}
+	b, err := e.Files().ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return info, false, nil
+	}
+	if err != nil {
+		return info, false, fmt.Errorf("read lock file: %w", err)
+	}
+	info.content = string(b)
+	info.Refreshed = fi.ModTime()
+	for f := range strings.FieldsSeq(info.content) {
+		k, v, _ := strings.Cut(f, "=")
+		switch k {
+		case "pid":
+			info.PID, _ = strconv.Atoi(v)
+		case "host":
+			info.Host = v
+		case "agent":
+			info.Agent = v
+		case "time":
+			info.Acquired, _ = time.Parse(time.RFC3339Nano, v)
+		}
+	}
+	return info, true, nil
+}
+
+// Stale reports whether the lock wasn't refreshed within LockTTL at now, so
+// the next run reclaims it.
+func (l LockInfo) Stale(now time.Time) bool {
+	return now.Sub(l.Refreshed) > LockTTL
+}
+
+// heldBy reports whether the lock was written by this process for owner.
+func (l LockInfo) heldBy(owner string) bool {
+	host, _ := os.Hostname()
+	return l.PID == os.Getpid() && l.Host == host && l.Agent == owner
+}
+
+// OwnerAlive reports whether the owning process still exists. known is false
+// if that can't be told: for locks of other hosts, without PID or on
+// platforms without process checks.
+func (l LockInfo) OwnerAlive() (alive, known bool) {
+	host, err := os.Hostname()
+	if err != nil || l.PID <= 0 || l.Host != host {
+		return false, false
+	}
+	return processAlive(l.PID), processChecks
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// acquireLockWith allows tests to inject TTL and clock.
-func acquireLockWith(path string, ttl time.Duration, now func() time.Time) (func(), bool, error) {
+// BreakLock removes the lock file at path described by info, regardless of
+// its owner. A lock that changed since info was read (e.g. was reclaimed by
+// another run meanwhile) is kept and reported as error.
+func BreakLock(path string, info LockInfo) error {
+	return Env{}.BreakLock(path, info)
+}
+
+// BreakLock is like the BreakLock function within e.
+func (e Env) BreakLock(path string, info LockInfo) error {
+	cur, err := e.Files().ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read lock file: %w", err)
+	}
+	if string(cur) != info.content {
+		return fmt.Errorf("lock file %s changed meanwhile; not removed", path)
+	}
+	if err := e.Files().Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove lock file: %w", err)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// HeartbeatLock refreshes the modification time of a lock file acquired by
+// this process for owner every interval until stop is called, so runs taking
+// longer than LockTTL keep their lock. Failed refreshes are logged and retried
+// on the next beat. Once the lock file is gone or belongs to someone else
+// (e.g. it was broken and reclaimed), refreshing stops with a warning. stop
+// waits for the background goroutine and may be called multiple times; call
+// it before releasing the lock.
+func HeartbeatLock(path, owner string, interval time.Duration, logger *log.Logger) (stop func()) {
+	return Env{}.HeartbeatLock(path, owner, interval, logger)
+}
+
+// HeartbeatLock is like the HeartbeatLock function within e. The interval
+// is measured in real time; the refreshed modification time is e's.
+func (e Env) HeartbeatLock(path, owner string, interval time.Duration, logger *log.Logger) (stop func()) {
+	lost := false
+	return Heartbeat(interval, logger, func() error {
+		if lost {
+			return nil
+		}
+		info, held, err := e.ReadLock(path)
+		if err != nil {
+			return err
+		}
+		if !held || !info.heldBy(owner) {
+			lost = true
+			return fmt.Errorf("lock file %s is no longer held by this run (pid=%d host=%s agent=%s); stopped refreshing", path, info.PID, info.Host, info.Agent)
+		}
+		now := e.Now()
+		return e.Files().Chtimes(path, now, now)
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Heartbeat calls beat every interval until stop is called, e.g. to renew a
+// lease. Errors are logged as lock heartbeat warnings. stop waits for the
+// background goroutine and may be called multiple times.
+func Heartbeat(interval time.Duration, logger *log.Logger, beat func() error) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := beat(); err != nil {
+					logger.Printf("lock heartbeat warning: %v", err)
+				}
+			}
+		}
+	})
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// acquireLockWith allows tests to inject TTL besides e.
+func acquireLockWith(e Env, path, owner string, ttl time.Duration) (func(), bool, error) {
+	fsys := e.Files()
 	owned := false
 	// NOTE(joel): We define safe release upfront; closure captures owned flag
 	// which will be set true only after successful acquisition. Multiple calls
@@ -30,28 +248,28 @@ func acquireLockWith(path string, ttl time.Duration, now func() time.Time) (func
 		if !owned {
 			return
 		}
-		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		if err := fsys.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
 			fmt.Printf("warning: remove lock file %s failed: %v\n", path, err)
 		}
 		owned = false
 	}
 
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	host, _ := os.Hostname()
+	content := []byte(fmt.Sprintf("pid=%d host=%s agent=%s time=%s\n", os.Getpid(), host, owner, e.Now().Format(time.RFC3339Nano)))
+	err := fsys.CreateExclusive(path, content, 0o600)
 	if err != nil {
 		if !errors.Is(err, os.ErrExist) {
 			return release, false, fmt.Errorf("create lock file: %w", err)
 		}
 
 		// NOTE(joel): File exists; check staleness.
-		if info, statErr := os.Stat(path); statErr == nil {
-			if now().Sub(info.ModTime()) > ttl {
+		if info, statErr := fsys.Stat(path); statErr == nil {
+			if e.Now().Sub(info.ModTime()) > ttl {
 				// NOTE(joel): Stale; remove and retry once.
-				_ = os.Remove(path)
-				f2, err2 := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
-				if err2 != nil {
+				_ = fsys.Remove(path)
+				if err := fsys.CreateExclusive(path, content, 0o600); err != nil {
 					return release, false, nil
 				}
-				f = f2
 			} else {
 				return release, false, nil
 			}
@@ -61,11 +279,7 @@ func acquireLockWith(path string, ttl time.Duration, now func() time.Time) (func
 		}
 	}
 
-	// NOTE(joel): At this point we have the file handle `f` and own the lock.
+	// NOTE(joel): At this point the lock file is ours.
 	owned = true
-	_, _ = fmt.Fprintf(f, "pid=%d time=%s\n", os.Getpid(), now().Format(time.RFC3339Nano))
-	if err := f.Close(); err != nil {
-		fmt.Printf("warning: close lock file %s failed: %v\n", path, err)
-	}
 	return release, true, nil
 }
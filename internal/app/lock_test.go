@@ -1,8 +1,13 @@
 package app
 
 import (
+	"fmt"
+	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -23,7 +28,7 @@ func TestAcquireLock_Concurrent(t *testing.T) {
 	workers := 10
 	for range workers {
 		wg.Go(func() {
-			rel, ok, err := AcquireLock(lock)
+			rel, ok, err := AcquireLock(lock, "test")
 			if err != nil {
 				mu.Lock()
 				t.Errorf("unexpected error: %v", err)
@@ -45,7 +50,7 @@ func TestAcquireLock_Concurrent(t *testing.T) {
 			// NOTE(joel): Depending on scheduling, the winner may release before
 			// losers try. Ensure lock file existed at some point by attempting second
 			// acquire.
-			rel, ok, err := AcquireLock(lock)
+			rel, ok, err := AcquireLock(lock, "test")
 			if err != nil {
 				t.Fatalf("second stage acquire fail: %v", err)
 			}
@@ -69,7 +74,7 @@ func TestAcquireLock_Stale(t *testing.T) {
 	lock := filepath.Join(dir, "test.lock")
 
 	// NOTE(joel): Acquire first time
-	release, ok, err := acquireLockWith(lock, 10*time.Second, time.Now)
+	release, ok, err := acquireLockWith(Env{Clock: ClockFunc(time.Now)}, lock, "test", 10*time.Second)
 	if err != nil || !ok {
 		if err != nil {
 			t.Fatalf("initial acquire: %v", err)
@@ -96,7 +101,7 @@ func TestAcquireLock_Stale(t *testing.T) {
 
 	// NOTE(joel): Now acquiring with small TTL should treat existing file as
 	// stale and succeed.
-	release2, ok2, err2 := acquireLockWith(lock, 30*time.Minute, func() time.Time { return time.Now() })
+	release2, ok2, err2 := acquireLockWith(Env{Clock: ClockFunc(func() time.Time { return time.Now() })}, lock, "test", 30*time.Minute)
 	if err2 != nil {
 		t.Fatalf("second acquire: %v", err2)
 	}
@@ -105,3 +110,161 @@ func TestAcquireLock_Stale(t *testing.T) {
 	}
 	release2()
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestAcquireLock_Owner verifies the owner is recorded in the lock file.
+func TestAcquireLock_Owner(t *testing.T) {
+	lock := filepath.Join(t.TempDir(), "test.lock")
+	release, ok, err := AcquireLock(lock, "scanner-7")
+	if err != nil || !ok {
+		t.Fatalf("acquire: ok=%v err=%v", ok, err)
+	}
+	defer release()
+	b, err := os.ReadFile(lock)
+	if err != nil {
+		t.Fatalf("read lock: %v", err)
+	}
+	if !strings.Contains(string(b), "agent=scanner-7 ") {
+		t.Fatalf("expected agent in lock file, got %q", b)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestHeartbeatLock verifies a heartbeated lock isn't taken over once it's
+// older than the TTL, and becomes stale again after the heartbeat stops.
+func TestHeartbeatLock(t *testing.T) {
+	lock := filepath.Join(t.TempDir(), "test.lock")
+	ttl := 200 * time.Millisecond
+	release, ok, err := acquireLockWith(Env{Clock: ClockFunc(time.Now)}, lock, "first", ttl)
+	if err != nil || !ok {
+		t.Fatalf("acquire: ok=%v err=%v", ok, err)
+	}
+	defer release()
+
+	var logs strings.Builder
+	stop := HeartbeatLock(lock, "first", 20*time.Millisecond, log.New(&logs, "", 0))
+	time.Sleep(3 * ttl)
+
+	_, ok, err = acquireLockWith(Env{Clock: ClockFunc(time.Now)}, lock, "second", ttl)
+	if err != nil {
+		t.Fatalf("second acquire: %v", err)
+	}
+	if ok {
+		t.Fatalf("expected heartbeated lock not to be taken over")
+	}
+
+	stop()
+	stop()
+	later := func() time.Time { return time.Now().Add(time.Hour) }
+	release2, ok, err := acquireLockWith(Env{Clock: ClockFunc(later)}, lock, "second", ttl)
+	if err != nil || !ok {
+		t.Fatalf("expected takeover after heartbeat stopped: ok=%v err=%v", ok, err)
+	}
+	release2()
+	if logs.Len() != 0 {
+		t.Fatalf("unexpected heartbeat warnings %q", logs.String())
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestHeartbeatLock_Taken verifies the heartbeat stops with a warning instead
+// of refreshing a lock that was broken and reclaimed by another run.
+func TestHeartbeatLock_Taken(t *testing.T) {
+	lock := filepath.Join(t.TempDir(), "test.lock")
+	release, ok, err := AcquireLock(lock, "first")
+	if err != nil || !ok {
+		t.Fatalf("acquire: ok=%v err=%v", ok, err)
+	}
+	defer release()
+
+	var logs strings.Builder
+	stop := HeartbeatLock(lock, "first", 10*time.Millisecond, log.New(&logs, "", 0))
+	defer stop()
+	info, _, err := ReadLock(lock)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := BreakLock(lock, info); err != nil {
+		t.Fatalf("break: %v", err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.WriteFile(lock, []byte("pid=1 host=other agent=second\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	stop()
+
+	fi, err := os.Stat(lock)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if !fi.ModTime().Equal(old) {
+		t.Fatalf("expected the other run's lock not to be refreshed, got %s", fi.ModTime())
+	}
+	if got := logs.String(); strings.Count(got, "no longer held by this run") != 1 {
+		t.Fatalf("expected one warning, got %q", got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRemoveOrphanedLock verifies only locks of dead processes on this host
+// are removed.
+func TestRemoveOrphanedLock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("process liveness isn't checked on windows")
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("hostname: %v", err)
+	}
+	// NOTE(joel): The PID of a process that ran and was reaped is free, unless
+	// the system reuses it right away.
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	dead := cmd.Process.Pid
+
+	lock := filepath.Join(t.TempDir(), "test.lock")
+	if pid, err := RemoveOrphanedLock(lock); err != nil || pid != 0 {
+		t.Fatalf("expected nothing to remove, got %d %v", pid, err)
+	}
+	for _, content := range []string{
+		fmt.Sprintf("pid=%d host=%s agent=a time=x\n", os.Getpid(), host),
+		fmt.Sprintf("pid=%d host=%s-other agent=a time=x\n", dead, host),
+		fmt.Sprintf("pid=%d agent=a time=x\n", dead),
+	} {
+		if err := os.WriteFile(lock, []byte(content), 0o600); err != nil {
+			t.Fatalf("write lock: %v", err)
+		}
+		if pid, err := RemoveOrphanedLock(lock); err != nil || pid != 0 {
+			t.Fatalf("expected lock %q kept, got %d %v", content, pid, err)
+		}
+	}
+
+	content := fmt.Sprintf("pid=%d host=%s agent=a time=x\n", dead, host)
+	if err := os.WriteFile(lock, []byte(content), 0o600); err != nil {
+		t.Fatalf("write lock: %v", err)
+	}
+	if pid, err := RemoveOrphanedLock(lock); err != nil || pid != dead {
+		t.Fatalf("expected orphaned lock removed, got %d %v", pid, err)
+	}
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Fatalf("expected lock file removed, got %v", err)
+	}
+	release, ok, err := AcquireLock(lock, "next")
+	if err != nil || !ok {
+		t.Fatalf("acquire: ok=%v err=%v", ok, err)
+	}
+	defer release()
+	if b, _ := os.ReadFile(lock); !strings.Contains(string(b), "host="+host+" ") {
+		t.Fatalf("expected host in lock file, got %q", b)
+	}
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// Log timestamp formats (-log-time).
+const (
+	// LogTimeLocal uses the standard log date and time in local time.
+	LogTimeLocal = "local"
+	// LogTimeUTC uses ISO 8601 (RFC 3339) timestamps in UTC with millisecond
+	// precision, so logs of agents in different timezones correlate.
+	LogTimeUTC = "utc"
+	// LogTimeNone omits timestamps, e.g. if the log collector adds its own.
+	LogTimeNone = "none"
+)
+
+// logTimeLayout is the timestamp layout of LogTimeUTC.
+const logTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewLogger creates a logger writing to w with timestamps in the given format
+// (see LogTimeLocal, LogTimeUTC and LogTimeNone; empty means local). prefix is
+// placed between the timestamp and the message.
+func NewLogger(w io.Writer, timeFormat, prefix string) (*log.Logger, error) {
+	switch timeFormat {
+	case "", LogTimeLocal:
+		return log.New(w, prefix, log.LstdFlags|log.Lmsgprefix), nil
+	case LogTimeUTC:
+		return log.New(utcWriter{w: w, now: time.Now}, prefix, log.Lmsgprefix), nil
+	case LogTimeNone:
+		return log.New(w, prefix, log.Lmsgprefix), nil
+	default:
+		return nil, fmt.Errorf("unknown log time format %q", timeFormat)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// utcWriter prepends an ISO 8601 UTC timestamp to every write. log.Logger
+// writes each line with a single call.
+type utcWriter struct {
+	w   io.Writer
+	now func() time.Time
+}
+
+// Write implements io.Writer.
+func (u utcWriter) Write(p []byte) (int, error) {
+	b := make([]byte, 0, len(logTimeLayout)+1+len(p))
+	b = u.now().UTC().AppendFormat(b, logTimeLayout)
+	b = append(b, ' ')
+	b = append(b, p...)
+	if _, err := u.w.Write(b); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
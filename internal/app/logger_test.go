@@ -0,0 +1,57 @@
+package app
+
+import (
+	"bytes"
+	"log"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestNewLogger verifies the timestamp formats and the prefix placement.
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := NewLogger(&buf, LogTimeUTC, "site=eu1 ")
+	if err != nil {
+		t.Fatalf("NewLogger: %v", err)
+	}
+	l.Printf("hello")
+	if !regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}Z site=eu1 hello\n$`).MatchString(buf.String()) {
+		t.Fatalf("unexpected utc line %q", buf.String())
+	}
+
+	buf.Reset()
+	l, err = NewLogger(&buf, LogTimeNone, "p ")
+	if err != nil {
+		t.Fatalf("NewLogger: %v", err)
+	}
+	l.Printf("hello")
+	if buf.String() != "p hello\n" {
+		t.Fatalf("unexpected line without time %q", buf.String())
+	}
+
+	l, err = NewLogger(&buf, "", "p ")
+	if err != nil || l.Flags() != log.LstdFlags|log.Lmsgprefix {
+		t.Fatalf("expected standard local flags, got %v", err)
+	}
+
+	if _, err := NewLogger(&buf, "zulu", ""); err == nil {
+		t.Fatalf("expected error for unknown format")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUTCWriter verifies timestamps are converted to UTC.
+func TestUTCWriter(t *testing.T) {
+	var buf bytes.Buffer
+	loc := time.FixedZone("CEST", 2*60*60)
+	w := utcWriter{w: &buf, now: func() time.Time { return time.Date(2025, 9, 10, 14, 0, 0, 5e6, loc) }}
+	if n, err := w.Write([]byte("msg\n")); err != nil || n != 4 {
+		t.Fatalf("Write: %d %v", n, err)
+	}
+	if got := buf.String(); !strings.HasPrefix(got, "2025-09-10T12:00:00.005Z msg") {
+		t.Fatalf("unexpected line %q", got)
+	}
+}
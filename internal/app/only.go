@@ -0,0 +1,74 @@
+package app
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// NameFilter limits a run to the triggers whose name matches a pattern
+// (-only), e.g. to reprocess a single order. The zero value matches
+// everything.
+type NameFilter struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Enabled reports whether triggers are filtered at all.
+func (f NameFilter) Enabled() bool {
+	return f.pattern != ""
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Match reports whether readyFile is selected: its base name, with or without
+// its extension (e.g. `ORDER123.RDY` or `ORDER123`, the folder's name for the
+// default trigger), matches the glob or regular expression.
+func (f NameFilter) Match(readyFile string) bool {
+	if !f.Enabled() {
+		return true
+	}
+	name := filepath.Base(readyFile)
+	for _, n := range []string{name, strings.TrimSuffix(name, filepath.Ext(name))} {
+		if f.re != nil {
+			if f.re.MatchString(n) {
+				return true
+			}
+		} else if ok, _ := path.Match(f.pattern, n); ok {
+			return true
+		}
+	}
+	return false
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// String returns the filter in the form of -only.
+func (f NameFilter) String() string {
+	if f.re != nil {
+		return "re:" + f.pattern
+	}
+	return f.pattern
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ParseNameFilter parses a -only value: a glob (see path.Match) or, prefixed
+// with `re:`, a regular expression. An empty value disables filtering.
+func ParseNameFilter(s string) (NameFilter, error) {
+	if expr, ok := strings.CutPrefix(s, "re:"); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil || expr == "" {
+			return NameFilter{}, fmt.Errorf("invalid -only regular expression %q: %v", expr, err)
+		}
+		return NameFilter{pattern: expr, re: re}, nil
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return NameFilter{}, fmt.Errorf("invalid -only glob %q: %w", s, err)
+	}
+	return NameFilter{pattern: s}, nil
+}
@@ -0,0 +1,45 @@
+package app
+
+import "testing"
+
+// TestNameFilter verifies -only globs and regular expressions match trigger
+// names with and without extension.
+func TestNameFilter(t *testing.T) {
+	var zero NameFilter
+	if zero.Enabled() || !zero.Match("/data/ORDER1.RDY") {
+		t.Fatalf("expected zero value to match everything")
+	}
+
+	tests := []struct {
+		pattern, readyFile string
+		want               bool
+	}{
+		{"ORDER1", "/data/ORDER1.RDY", true},
+		{"ORDER1.RDY", "/data/ORDER1.RDY", true},
+		{"ORDER1", "/data/ORDER12.RDY", false},
+		{"ORDER1*", "/data/sub/ORDER12.RDY", true},
+		{"ORDER?", "/data/ORDER12.RDY", false},
+		{"ORDER1", "/data/ORDER1", true},
+		{"re:^ORDER1[0-9]$", "/data/ORDER12.RDY", true},
+		{"re:^ORDER1[0-9]$", "/data/ORDER1.RDY", false},
+		{"re:12", "/data/ORDER123.RDY", true},
+	}
+	for _, tt := range tests {
+		f, err := ParseNameFilter(tt.pattern)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tt.pattern, err)
+		}
+		if got := f.Match(tt.readyFile); got != tt.want {
+			t.Fatalf("%q matching %s: expected %v, got %v", tt.pattern, tt.readyFile, tt.want, got)
+		}
+		if f.String() != tt.pattern {
+			t.Fatalf("expected String %q, got %q", tt.pattern, f.String())
+		}
+	}
+
+	for _, bad := range []string{"ORDER[", "re:(", "re:"} {
+		if _, err := ParseNameFilter(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
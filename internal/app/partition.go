@@ -0,0 +1,80 @@
+package app
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Partition selects the share of triggers one of several cooperating
+// processes handles, so a large directory can be worked on in parallel. The
+// zero value handles everything.
+type Partition struct {
+	// Index is the zero based index of this process, below Count.
+	Index int
+	// Count is the number of cooperating processes.
+	Count int
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Enabled reports whether triggers are partitioned at all.
+func (p Partition) Enabled() bool {
+	return p.Count > 1
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Owns reports whether readyFile belongs to this partition. Triggers are
+// assigned by the FNV-1a hash of their slash separated path relative to
+// root, so processes agree regardless of where root is mounted. Triggers
+// outside of root are hashed by their absolute path.
+func (p Partition) Owns(root, readyFile string) bool {
+	if !p.Enabled() {
+		return true
+	}
+	key := readyFile
+	if rel, err := filepath.Rel(root, readyFile); err == nil && filepath.IsLocal(rel) {
+		key = rel
+	}
+	h := fnv.New32a()
+	h.Write([]byte(filepath.ToSlash(key)))
+	return int(h.Sum32()%uint32(p.Count)) == p.Index
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// String returns the partition in the form of -partition, e.g. `1/4`.
+func (p Partition) String() string {
+	return fmt.Sprintf("%d/%d", p.Index, p.Count)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// suffix returns the suffix of file names derived for this partition, e.g.
+// `.p1of4`, or "" if partitioning is disabled.
+func (p Partition) suffix() string {
+	if !p.Enabled() {
+		return ""
+	}
+	return fmt.Sprintf(".p%dof%d", p.Index, p.Count)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// parsePartition parses a -partition value `INDEX/COUNT`. An empty value
+// disables partitioning.
+func parsePartition(s string) (Partition, error) {
+	if s == "" {
+		return Partition{}, nil
+	}
+	i, n, ok := strings.Cut(s, "/")
+	index, err1 := strconv.Atoi(i)
+	count, err2 := strconv.Atoi(n)
+	if !ok || err1 != nil || err2 != nil || count < 1 || index < 0 || index >= count {
+		return Partition{}, fmt.Errorf("invalid -partition value %q, expected INDEX/COUNT with 0 <= INDEX < COUNT", s)
+	}
+	return Partition{Index: index, Count: count}, nil
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestPartition_Owns verifies every trigger belongs to exactly one partition,
+// regardless of where the root is mounted.
+func TestPartition_Owns(t *testing.T) {
+	var zero Partition
+	if zero.Enabled() || !zero.Owns("/data", "/data/ORDER1.RDY") || zero.suffix() != "" {
+		t.Fatalf("expected zero value to own everything")
+	}
+
+	counts := make([]int, 3)
+	for i := range 30 {
+		rel := filepath.Join("site", "ORDER"+string(rune('A'+i))+".RDY")
+		owners := 0
+		for index := range 3 {
+			p := Partition{Index: index, Count: 3}
+			if p.Owns("/data", filepath.Join("/data", rel)) != p.Owns("/mnt/share", filepath.Join("/mnt/share", rel)) {
+				t.Fatalf("expected %s owned independently of the root", rel)
+			}
+			if p.Owns("/data", filepath.Join("/data", rel)) {
+				owners++
+				counts[index]++
+			}
+		}
+		if owners != 1 {
+			t.Fatalf("expected %s owned by one partition, got %d", rel, owners)
+		}
+	}
+	for i, n := range counts {
+		if n == 0 {
+			t.Fatalf("expected partition %d to own some triggers, got %v", i, counts)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestParsePartition verifies valid and invalid -partition values.
+func TestParsePartition(t *testing.T) {
+	p, err := parsePartition("1/4")
+	if err != nil || p != (Partition{Index: 1, Count: 4}) || p.String() != "1/4" || p.suffix() != ".p1of4" {
+		t.Fatalf("unexpected result %v %v", p, err)
+	}
+	if p, err := parsePartition(""); err != nil || p.Enabled() {
+		t.Fatalf("expected partitioning disabled, got %v %v", p, err)
+	}
+	for _, s := range []string{"1", "4/4", "-1/4", "0/0", "a/b", "1/4/2"} {
+		if _, err := parsePartition(s); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+}
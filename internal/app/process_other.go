@@ -0,0 +1,13 @@
+//go:build !unix
+
+package app
+
+// processChecks is set on platforms where processAlive can tell whether a
+// process exists.
+const processChecks = false
+
+// processAlive is not supported on this platform; processes are always
+// considered alive, so only LockTTL expires their locks.
+func processAlive(pid int) bool {
+	return true
+}
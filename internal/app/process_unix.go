@@ -0,0 +1,20 @@
+//go:build unix
+
+package app
+
+import (
+	"errors"
+	"syscall"
+)
+
+// processChecks is set on platforms where processAlive can tell whether a
+// process exists.
+const processChecks = true
+
+// processAlive reports whether a process with pid exists on this host. Signal
+// 0 only checks for existence; EPERM means it exists but belongs to another
+// user.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,31 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+// TestParseObjectRetention verifies retention modes and periods in days or
+// as durations, and that malformed values are rejected.
+func TestParseObjectRetention(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ObjectRetention
+	}{
+		{"", ObjectRetention{}},
+		{"720h", ObjectRetention{Period: 720 * time.Hour}},
+		{"unlocked:30d", ObjectRetention{Period: 30 * 24 * time.Hour}},
+		{"locked:2555d", ObjectRetention{Period: 2555 * 24 * time.Hour, Locked: true}},
+	}
+	for _, tt := range tests {
+		got, err := parseObjectRetention(tt.in)
+		if err != nil || got != tt.want {
+			t.Fatalf("%q: expected %+v, got %+v (%v)", tt.in, tt.want, got, err)
+		}
+	}
+	for _, bad := range []string{"forever", "locked", "frozen:30d", "xd", "0d", "-1h"} {
+		if _, err := parseObjectRetention(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
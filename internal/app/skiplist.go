@@ -0,0 +1,73 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SkipList holds the triggers that must never be processed (-skip-list), e.g.
+// permanently broken producer artifacts. The zero value skips nothing.
+type SkipList struct {
+	patterns []string
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// LoadSkipList reads a skip list: one path or glob (see path.Match) per line.
+// Blank lines and lines starting with `#` are ignored. Patterns with a slash
+// are matched against a trigger's absolute path if they are absolute and its
+// slash separated path relative to the root otherwise; patterns without one
+// against its file name.
+func LoadSkipList(name string) (SkipList, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return SkipList{}, fmt.Errorf("read skip list: %w", err)
+	}
+	var l SkipList
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = filepath.ToSlash(line)
+		if _, err := path.Match(line, ""); err != nil {
+			return SkipList{}, fmt.Errorf("skip list %s:%d: invalid pattern %q: %w", name, i+1, line, err)
+		}
+		l.patterns = append(l.patterns, line)
+	}
+	return l, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Len returns the number of patterns.
+func (l SkipList) Len() int {
+	return len(l.patterns)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Skips reports whether readyFile, found below root, is on the list.
+func (l SkipList) Skips(root, readyFile string) bool {
+	abs := filepath.ToSlash(readyFile)
+	rel := abs
+	if r, err := filepath.Rel(root, readyFile); err == nil && filepath.IsLocal(r) {
+		rel = filepath.ToSlash(r)
+	}
+	for _, p := range l.patterns {
+		name := rel
+		switch {
+		case !strings.Contains(p, "/"):
+			name = path.Base(abs)
+		case filepath.IsAbs(filepath.FromSlash(p)):
+			name = abs
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
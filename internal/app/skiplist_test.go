@@ -0,0 +1,52 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSkipList verifies skip list patterns match trigger names, paths
+// relative to the root and absolute paths.
+func TestSkipList(t *testing.T) {
+	var zero SkipList
+	if zero.Len() != 0 || zero.Skips("/data", "/data/ORDER1.RDY") {
+		t.Fatalf("expected zero value to skip nothing")
+	}
+
+	file := filepath.Join(t.TempDir(), "skip.txt")
+	list := "# broken exports\nORDER1.RDY\n\nsite?/BAD*.RDY\n/archive/old/*.RDY\n"
+	if err := os.WriteFile(file, []byte(list), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	l, err := LoadSkipList(file)
+	if err != nil || l.Len() != 3 {
+		t.Fatalf("expected 3 patterns, got %d (%v)", l.Len(), err)
+	}
+	tests := []struct {
+		readyFile string
+		want      bool
+	}{
+		{"/data/ORDER1.RDY", true},
+		{"/data/sub/ORDER1.RDY", true},
+		{"/data/ORDER12.RDY", false},
+		{"/data/site1/BAD42.RDY", true},
+		{"/data/other/site1/BAD42.RDY", false},
+		{"/archive/old/X.RDY", true},
+	}
+	for _, tt := range tests {
+		if got := l.Skips("/data", tt.readyFile); got != tt.want {
+			t.Fatalf("%s: expected %v, got %v", tt.readyFile, tt.want, got)
+		}
+	}
+
+	if err := os.WriteFile(file, []byte("ORDER[\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := LoadSkipList(file); err == nil {
+		t.Fatalf("expected error for malformed pattern")
+	}
+	if _, err := LoadSkipList(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatalf("expected error for missing file")
+	}
+}
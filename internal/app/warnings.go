@@ -0,0 +1,138 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// Warnings logs warnings without flooding the log, e.g. with thousands of
+// stat failures of a flaky mount. Warnings are grouped by their format
+// string; only the first Limit of each group are logged, the number of the
+// others is logged by Flush. Detail, if set, receives every warning in full.
+type Warnings struct {
+	Logger *log.Logger
+	// Limit is the number of warnings logged per group and run; <= 0 logs all.
+	Limit int
+	// Detail, if set, receives every warning, including suppressed ones.
+	Detail *log.Logger
+
+	closer io.Closer
+	mu     sync.Mutex
+	groups map[string]*warningGroup
+	order  []string
+}
+
+// warningGroup counts the warnings of a format string.
+type warningGroup struct {
+	count int
+	// first is the first suppressed warning, quoted as an example by Flush.
+	first string
+}
+
+// DefaultWarningLimit is the default of -warning-limit.
+const DefaultWarningLimit = 10
+
+////////////////////////////////////////////////////////////////////////////////
+
+// OpenWarnings returns Warnings logging to logger, with every warning also
+// appended to the file at detailPath (if not empty) in the log format
+// timeFormat with prefix (see NewLogger).
+func OpenWarnings(logger *log.Logger, limit int, detailPath, timeFormat, prefix string) (*Warnings, error) {
+	w := &Warnings{Logger: logger, Limit: limit}
+	if detailPath == "" {
+		return w, nil
+	}
+	f, err := os.OpenFile(detailPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open warnings file: %w", err)
+	}
+	if w.Detail, err = NewLogger(f, timeFormat, prefix); err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.closer = f
+	return w, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Printf logs a warning unless its group already reached the limit of this
+// run. It is safe for concurrent use.
+func (w *Warnings) Printf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if w.Detail != nil {
+		w.Detail.Print(msg)
+	}
+	w.mu.Lock()
+	if w.groups == nil {
+		w.groups = make(map[string]*warningGroup)
+	}
+	g := w.groups[format]
+	if g == nil {
+		g = &warningGroup{}
+		w.groups[format] = g
+		w.order = append(w.order, format)
+	}
+	g.count++
+	n := g.count
+	if w.Limit > 0 && n == w.Limit+1 {
+		g.first = msg
+	}
+	w.mu.Unlock()
+
+	switch {
+	case w.Limit <= 0 || n < w.Limit:
+		w.Logger.Print(msg)
+	case n == w.Limit:
+		w.Logger.Printf("%s (further warnings like this are counted until the end of the run)", msg)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Flush logs the number of suppressed warnings of each group, in the order
+// the groups first occurred, and starts counting anew, e.g. for the next run.
+// It does nothing on a nil Warnings.
+func (w *Warnings) Flush() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, format := range w.order {
+		g := w.groups[format]
+		if w.Limit > 0 && g.count > w.Limit {
+			more := ""
+			if w.Detail != nil {
+				more = " (all in the warnings file)"
+			}
+			w.Logger.Printf("%d more warning(s) like %q suppressed%s", g.count-w.Limit, g.first, more)
+		}
+	}
+	w.groups, w.order = nil, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Close closes the warnings file, if any.
+func (w *Warnings) Close() error {
+	if w == nil || w.closer == nil {
+		return nil
+	}
+	return w.closer.Close()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Warnf logs a warning through c.Warnings, or c.Logger if there are none
+// (e.g. for embedders that don't set them).
+func (c *Config) Warnf(format string, args ...any) {
+	if c.Warnings == nil {
+		c.Logger.Printf(format, args...)
+		return
+	}
+	c.Warnings.Printf(format, args...)
+}
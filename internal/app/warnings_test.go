@@ -0,0 +1,69 @@
+package app
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestWarnings_Limit verifies only the first warnings of a kind are logged,
+// the rest are counted by Flush and all of them reach the warnings file.
+func TestWarnings_Limit(t *testing.T) {
+	var out bytes.Buffer
+	detail := filepath.Join(t.TempDir(), "warnings.log")
+	w, err := OpenWarnings(log.New(&out, "", 0), 2, detail, LogTimeNone, "run=1 ")
+	if err != nil {
+		t.Fatalf("OpenWarnings: %v", err)
+	}
+	for _, f := range []string{"a", "b", "c", "d"} {
+		w.Printf("stat warning: %s: %s", f, "input/output error")
+	}
+	w.Printf("notify warning: %v", "timeout")
+	w.Flush()
+
+	want := strings.Join([]string{
+		"stat warning: a: input/output error",
+		"stat warning: b: input/output error (further warnings like this are counted until the end of the run)",
+		"notify warning: timeout",
+		`2 more warning(s) like "stat warning: c: input/output error" suppressed (all in the warnings file)`,
+	}, "\n") + "\n"
+	if out.String() != want {
+		t.Fatalf("unexpected log\n%s\nwant\n%s", out.String(), want)
+	}
+
+	// NOTE(joel): Flush starts counting anew.
+	out.Reset()
+	w.Printf("stat warning: %s: %s", "e", "input/output error")
+	w.Flush()
+	if out.String() != "stat warning: e: input/output error\n" {
+		t.Fatalf("expected counts reset after Flush, got %q", out.String())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	b, err := os.ReadFile(detail)
+	if err != nil {
+		t.Fatalf("read warnings file: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(b)), "\n"); len(lines) != 6 || lines[3] != "run=1 stat warning: d: input/output error" {
+		t.Fatalf("expected every warning in the warnings file, got %q", b)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestConfig_Warnf verifies warnings go to the logger without Warnings.
+func TestConfig_Warnf(t *testing.T) {
+	var out bytes.Buffer
+	cfg := &Config{Logger: log.New(&out, "", 0)}
+	for range 3 {
+		cfg.Warnf("stat warning: %s", "x")
+	}
+	cfg.Warnings.Flush()
+	if strings.Count(out.String(), "stat warning: x\n") != 3 {
+		t.Fatalf("expected all warnings logged, got %q", out.String())
+	}
+}
@@ -2,7 +2,11 @@ package app
 
 import (
 	"context"
+	"fmt"
+	"iter"
+	"math"
 	"runtime"
+	"slices"
 	"sync"
 )
 
@@ -11,65 +15,264 @@ type Task func(ctx context.Context) error
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// taskLabelKey is the context key of the label of a task, see Labeled.
+type taskLabelKey struct{}
+
+// Labeled attaches label (e.g. the folder or file a task works on) to task.
+// The task's context carries the label (see TaskLabel) and errors it returns
+// are prefixed with it, so the error reported by the pool identifies the
+// failed unit without each closure building its own context strings.
+func Labeled(label string, task Task) Task {
+	return func(ctx context.Context) error {
+		return labelError(label, task(context.WithValue(ctx, taskLabelKey{}, label)))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// LabeledResult is Labeled for tasks producing a result.
+func LabeledResult[T any](label string, task ResultTask[T]) ResultTask[T] {
+	return func(ctx context.Context) (T, error) {
+		res, err := task(context.WithValue(ctx, taskLabelKey{}, label))
+		return res, labelError(label, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TaskLabel returns the label of the task ctx was passed to, or "" if the task
+// isn't labeled.
+func TaskLabel(ctx context.Context) string {
+	label, _ := ctx.Value(taskLabelKey{}).(string)
+	return label
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// labelError prefixes err with label; nil stays nil.
+func labelError(label string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", label, err)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// AutoConcurrency is the heuristic for the number of workers of a pool started
+// with a concurrency <= 0: NumCPU times Multiplier, clamped between Min and
+// Max. Uploads are I/O bound, so a Multiplier above 1 often pays off.
+type AutoConcurrency struct {
+	Multiplier float64
+	Min, Max   int
+}
+
+// DefaultAutoConcurrency uses NumCPU workers, capped between 2 and 8.
+var DefaultAutoConcurrency = AutoConcurrency{Multiplier: 1, Min: 2, Max: 8}
+
+// NOTE(joel): Set once at startup (see SetAutoConcurrency) before any pool
+// runs, so workers only ever read it.
+var autoConcurrency = DefaultAutoConcurrency
+
+////////////////////////////////////////////////////////////////////////////////
+
+// SetAutoConcurrency replaces the heuristic used for automatic concurrency
+// (-auto-concurrency-multiplier, -auto-concurrency-max).
+func SetAutoConcurrency(a AutoConcurrency) {
+	autoConcurrency = a
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Workers returns the number of workers for cpus CPUs.
+func (a AutoConcurrency) Workers(cpus int) int {
+	n := int(math.Ceil(float64(cpus) * a.Multiplier))
+	return max(min(n, a.Max), a.Min)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// EffectiveConcurrency returns concurrency, or the automatic value of the
+// current heuristic if concurrency <= 0.
+func EffectiveConcurrency(concurrency int) int {
+	if concurrency > 0 {
+		return concurrency
+	}
+	return autoConcurrency.Workers(runtime.NumCPU())
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 // RunParallel executes tasks in parallel with up to concurrency workers.
-// If concurrency <=0 an automatic value based on NumCPU (capped between 2 and
-// 8) is used. The returned error is the first non-nil error encountered
+// If concurrency <=0 an automatic value (see EffectiveConcurrency) is used.
+// The returned error is the first non-nil error encountered
 // (others may be suppressed).
 func RunParallel(parentCtx context.Context, concurrency int, tasks []Task) error {
 	if len(tasks) == 0 {
 		return nil
 	}
-	if concurrency <= 0 {
-		concurrency = max(min(runtime.NumCPU(), 8), 2)
-	}
+	concurrency = EffectiveConcurrency(concurrency)
 	if concurrency > len(tasks) {
 		concurrency = len(tasks)
 	}
+	return RunStream(parentCtx, concurrency, slices.Values(tasks))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ResultTask is a unit of work producing a result, see RunOrdered.
+type ResultTask[T any] func(ctx context.Context) (T, error)
+
+// RunOrdered is like RunParallel but stores the result of each task in the slot
+// of its index, so results keep the input order whatever order tasks finish
+// in. Results of failed tasks are stored too; tasks that didn't run (canceled
+// after the first error) leave the zero value.
+func RunOrdered[T any](parentCtx context.Context, concurrency int, tasks []ResultTask[T]) ([]T, error) {
+	results := make([]T, len(tasks))
+	wrapped := make([]Task, len(tasks))
+	for i, task := range tasks {
+		wrapped[i] = func(ctx context.Context) error {
+			res, err := task(ctx)
+			// NOTE(joel): Each task owns its slot, so no locking is needed.
+			results[i] = res
+			return err
+		}
+	}
+	err := RunParallel(parentCtx, concurrency, wrapped)
+	return results, err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// RunStream is like RunParallel but pulls tasks from an iterator as workers
+// become free, so tasks need not be held in memory all at once. The iterator
+// runs on the calling goroutine and is stopped early on the first error.
+func RunStream(parentCtx context.Context, concurrency int, tasks iter.Seq[Task]) error {
+	concurrency = EffectiveConcurrency(concurrency)
 
 	ctx, cancel := context.WithCancel(parentCtx)
 	defer cancel()
 
-	type job struct{ idx int }
-	jobs := make(chan job)
+	jobs := make(chan Task)
 	errCh := make(chan error, concurrency)
 	wg := sync.WaitGroup{}
 
-	// NOTE(joel): Worker goroutine to process jobs from the channel. Each
-	// task creates a new job with its index in the tasks slice.
-	worker := func() {
-		defer wg.Done()
-		for j := range jobs {
-			if ctx.Err() != nil {
-				return
-			}
-			// NOTE(joel): Run task and report first error. Cancel context to stop
-			// other workers from executing new tasks.
-			if err := tasks[j.idx](ctx); err != nil {
-				select {
-				case errCh <- err:
-					cancel()
-				default:
+	// NOTE(joel): Start workers and feed jobs.
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go runWorker(ctx, cancel, &wg, jobs, errCh)
+	}
+	// NOTE(joel): Workers exit on the first error, so stop feeding once the
+	// context is canceled instead of blocking on a send nobody receives.
+feed:
+	for task := range tasks {
+		select {
+		case jobs <- task:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+
+	// NOTE(joel): Wait for workers to finish and close error channel.
+	// If any errors were reported, return the first one.
+	wg.Wait()
+	close(errCh)
+	for e := range errCh {
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// RunTiered is like RunStream but the iterator also reports whether a task is
+// large. Large tasks run on at most largeWorkers of the concurrency workers,
+// so a few huge tasks can't occupy every worker while many small ones wait.
+// Workers reserved for small tasks take large ones only while no small task
+// is ready, e.g. once all small tasks were handed out. With largeWorkers <= 0
+// (or not less than concurrency) tasks run in order as with RunStream.
+func RunTiered(parentCtx context.Context, concurrency, largeWorkers int, tasks iter.Seq2[Task, bool]) error {
+	concurrency = EffectiveConcurrency(concurrency)
+	if largeWorkers <= 0 || largeWorkers >= concurrency {
+		return RunStream(parentCtx, concurrency, func(yield func(Task) bool) {
+			for task := range tasks {
+				if !yield(task) {
+					return
 				}
-				return
 			}
-		}
+		})
 	}
 
-	// NOTE(joel): Start workers and feed jobs.
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+
+	small := make(chan Task)
+	large := make(chan Task)
+	errCh := make(chan error, concurrency)
+	wg := sync.WaitGroup{}
 	wg.Add(concurrency)
 	for i := 0; i < concurrency; i++ {
-		go worker()
+		jobs := small
+		if i < largeWorkers {
+			jobs = large
+		}
+		go runWorker(ctx, cancel, &wg, jobs, errCh)
 	}
-	for i := range tasks {
-		if ctx.Err() != nil {
+
+	// NOTE(joel): Large tasks wait in a queue while the iterator is read on
+	// for the next small task. The queue is bounded so a folder of only large
+	// files isn't read into memory at once; while it is full, large tasks are
+	// offered to all workers.
+	maxQueued := 4 * concurrency
+	next, stop := iter.Pull2(tasks)
+	defer stop()
+	var queued []Task
+	var pending Task
+	exhausted := false
+feed:
+	for {
+		for pending == nil && !exhausted && len(queued) < maxQueued {
+			task, isLarge, ok := next()
+			switch {
+			case !ok:
+				exhausted = true
+			case isLarge:
+				queued = append(queued, task)
+			default:
+				pending = task
+			}
+		}
+		if pending == nil && len(queued) == 0 {
 			break
 		}
-		jobs <- job{idx: i}
+		var smallCh, largeCh chan Task
+		var smallTask, largeTask Task
+		if len(queued) > 0 {
+			largeCh, largeTask = large, queued[0]
+			smallCh, smallTask = small, queued[0]
+		}
+		if pending != nil {
+			smallCh, smallTask = small, pending
+		}
+		select {
+		case smallCh <- smallTask:
+			if pending != nil {
+				pending = nil
+			} else {
+				queued = queued[1:]
+			}
+		case largeCh <- largeTask:
+			queued = queued[1:]
+		case <-ctx.Done():
+			break feed
+		}
 	}
-	close(jobs)
+	close(small)
+	close(large)
 
-	// NOTE(joel): Wait for workers to finish and close error channel.
-	// If any errors were reported, return the first one.
 	wg.Wait()
 	close(errCh)
 	for e := range errCh {
@@ -79,3 +282,25 @@ func RunParallel(parentCtx context.Context, concurrency int, tasks []Task) error
 	}
 	return nil
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// runWorker runs tasks from jobs until it is closed. The first error is
+// reported on errCh and cancels ctx so other workers stop executing new
+// tasks.
+func runWorker(ctx context.Context, cancel context.CancelFunc, wg *sync.WaitGroup, jobs <-chan Task, errCh chan<- error) {
+	defer wg.Done()
+	for task := range jobs {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := task(ctx); err != nil {
+			select {
+			case errCh <- err:
+				cancel()
+			default:
+			}
+			return
+		}
+	}
+}
@@ -91,6 +91,101 @@ func TestRunParallel_AutoConcurrency(t *testing.T) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// TestAutoConcurrency verifies the heuristic scales NumCPU by the multiplier
+// within its limits and that explicit concurrencies are kept.
+func TestAutoConcurrency(t *testing.T) {
+	for _, tc := range []struct {
+		a    AutoConcurrency
+		cpus int
+		want int
+	}{
+		{DefaultAutoConcurrency, 1, 2},
+		{DefaultAutoConcurrency, 4, 4},
+		{DefaultAutoConcurrency, 32, 8},
+		{AutoConcurrency{Multiplier: 4, Min: 2, Max: 32}, 4, 16},
+		{AutoConcurrency{Multiplier: 4, Min: 2, Max: 32}, 16, 32},
+		{AutoConcurrency{Multiplier: 0.5, Min: 2, Max: 8}, 3, 2},
+	} {
+		if got := tc.a.Workers(tc.cpus); got != tc.want {
+			t.Fatalf("%+v with %d cpus: expected %d, got %d", tc.a, tc.cpus, tc.want, got)
+		}
+	}
+
+	t.Cleanup(func() { SetAutoConcurrency(DefaultAutoConcurrency) })
+	SetAutoConcurrency(AutoConcurrency{Multiplier: 1, Min: 3, Max: 3})
+	if got := EffectiveConcurrency(0); got != 3 {
+		t.Fatalf("expected auto concurrency 3, got %d", got)
+	}
+	if got := EffectiveConcurrency(5); got != 5 {
+		t.Fatalf("expected explicit concurrency kept, got %d", got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRunOrdered verifies results keep the input order although later tasks
+// finish first, and that the results of failed tasks are kept.
+func TestRunOrdered(t *testing.T) {
+	var tasks []ResultTask[int]
+	for i := range 5 {
+		tasks = append(tasks, func(ctx context.Context) (int, error) {
+			time.Sleep(time.Duration(5-i) * 5 * time.Millisecond)
+			return i * 10, nil
+		})
+	}
+	results, err := RunOrdered(context.Background(), 5, tasks)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, r := range results {
+		if r != i*10 {
+			t.Fatalf("expected results in input order, got %v", results)
+		}
+	}
+
+	sentinel := errors.New("boom")
+	failed, err := RunOrdered(context.Background(), 2, []ResultTask[string]{
+		func(context.Context) (string, error) { return "ok", nil },
+		func(context.Context) (string, error) { return "partial", sentinel },
+	})
+	if !errors.Is(err, sentinel) || len(failed) != 2 || failed[1] != "partial" {
+		t.Fatalf("unexpected results %q err=%v", failed, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestLabeled verifies labeled tasks see their label in the context and the
+// pool reports their errors prefixed with it.
+func TestLabeled(t *testing.T) {
+	sentinel := errors.New("boom")
+	var seen atomic.Value
+	err := RunParallel(context.Background(), 1, []Task{
+		Labeled("ORDER1/a.txt", func(ctx context.Context) error {
+			seen.Store(TaskLabel(ctx))
+			return sentinel
+		}),
+	})
+	if !errors.Is(err, sentinel) || err.Error() != "ORDER1/a.txt: boom" {
+		t.Fatalf("expected labeled error, got %v", err)
+	}
+	if seen.Load() != "ORDER1/a.txt" {
+		t.Fatalf("expected label in context, got %v", seen.Load())
+	}
+	if TaskLabel(context.Background()) != "" {
+		t.Fatalf("expected no label outside of labeled tasks")
+	}
+
+	results, err := RunOrdered(context.Background(), 1, []ResultTask[string]{
+		LabeledResult("ORDER2", func(ctx context.Context) (string, error) { return TaskLabel(ctx), nil }),
+	})
+	if err != nil || results[0] != "ORDER2" {
+		t.Fatalf("unexpected result %v %v", results, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 // TestRunParallel_ContextCancellationPropagation verifies that if the parent
 // context is cancelled, tasks observe that cancellation and stop as soon as
 // possible.
@@ -146,3 +241,102 @@ func TestRunParallel_ContextCancellationPropagation(t *testing.T) {
 		t.Fatalf("expected some tasks to be prevented by cancellation; ran=%d", ran.Load())
 	}
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRunStream_StopsIterator verifies tasks are pulled lazily and the
+// iterator is stopped after the first error.
+func TestRunStream_StopsIterator(t *testing.T) {
+	boom := errors.New("boom")
+	var pulled atomic.Int32
+	tasks := func(yield func(Task) bool) {
+		for i := range 1000 {
+			pulled.Add(1)
+			if !yield(func(ctx context.Context) error {
+				if i == 2 {
+					return boom
+				}
+				return nil
+			}) {
+				return
+			}
+		}
+	}
+	if err := RunStream(context.Background(), 1, tasks); !errors.Is(err, boom) {
+		t.Fatalf("expected boom, got %v", err)
+	}
+	if n := pulled.Load(); n >= 1000 {
+		t.Fatalf("expected iterator to stop early, pulled %d tasks", n)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRunTiered_SmallNotStarved verifies small tasks run while large tasks
+// occupy the large workers: both large tasks wait for the small one, which
+// would deadlock (and time out) with FIFO scheduling on two workers.
+func TestRunTiered_SmallNotStarved(t *testing.T) {
+	smallDone := make(chan struct{})
+	var ran atomic.Int32
+	largeTask := func(ctx context.Context) error {
+		select {
+		case <-smallDone:
+			ran.Add(1)
+			return nil
+		case <-time.After(5 * time.Second):
+			return errors.New("small task starved")
+		}
+	}
+	smallTask := func(ctx context.Context) error {
+		ran.Add(1)
+		close(smallDone)
+		return nil
+	}
+	tasks := func(yield func(Task, bool) bool) {
+		_ = yield(largeTask, true) && yield(largeTask, true) && yield(smallTask, false)
+	}
+	if err := RunTiered(context.Background(), 2, 1, tasks); err != nil {
+		t.Fatalf("RunTiered: %v", err)
+	}
+	if n := ran.Load(); n != 3 {
+		t.Fatalf("expected 3 tasks to run, got %d", n)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRunTiered_ManyLarge verifies all tasks run and errors are returned when
+// the large task queue overflows onto the small workers.
+func TestRunTiered_ManyLarge(t *testing.T) {
+	var ran atomic.Int32
+	tasks := func(yield func(Task, bool) bool) {
+		for i := range 100 {
+			if !yield(func(ctx context.Context) error { ran.Add(1); return nil }, i%10 != 0) {
+				return
+			}
+		}
+	}
+	if err := RunTiered(context.Background(), 3, 1, tasks); err != nil {
+		t.Fatalf("RunTiered: %v", err)
+	}
+	if n := ran.Load(); n != 100 {
+		t.Fatalf("expected 100 tasks to run, got %d", n)
+	}
+
+	boom := errors.New("boom")
+	failing := func(yield func(Task, bool) bool) {
+		for i := range 100 {
+			if !yield(func(ctx context.Context) error {
+				if i == 5 {
+					return boom
+				}
+				return nil
+			}, i%2 == 0) {
+				return
+			}
+		}
+	}
+	if err := RunTiered(context.Background(), 3, 1, failing); !errors.Is(err, boom) {
+		t.Fatalf("expected boom, got %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+// Package events writes a machine readable stream of run events as JSON lines,
+// independent of the human readable log, e.g. for ingestion by a log
+// pipeline.
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types in the order they occur during a run.
+const (
+	TypeScanStart   = "scan_start"
+	TypeMatchFound  = "match_found"
+	TypeStage       = "stage"
+	TypeUploadStart = "upload_start"
+	TypeUploadDone  = "upload_done"
+	TypeFolderDone  = "folder_done"
+	TypeRunDone     = "run_done"
+)
+
+// Folder outcomes reported by folder_done events.
+const (
+	StatusUploaded = "uploaded"
+	StatusEmitted  = "emitted"
+	StatusClaimed  = "claimed"
+	StatusFailed   = "failed"
+)
+
+// Event is a single line of the event stream. Fields not relevant for a type
+// are omitted.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Agent      string    `json:"agent,omitempty"`
+	RunID      string    `json:"runId,omitempty"`
+	Root       string    `json:"root,omitempty"`
+	ReadyFile  string    `json:"readyFile,omitempty"`
+	Folder     string    `json:"folder,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	Files      int       `json:"files,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	DurationMs int64     `json:"durationMs,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	// Summary holds the run counts of run_done events.
+	Summary *Summary `json:"summary,omitempty"`
+}
+
+// Summary holds the counts of a finished run. Uploading runs also report the
+// bytes uploaded, retries and dead letters (records queued in the pending
+// records file), broken down by destination and folder.
+type Summary struct {
+	Scanned      int                  `json:"scanned"`
+	Emitted      int                  `json:"emitted"`
+	Skipped      int                  `json:"skipped"`
+	Failed       int                  `json:"failed"`
+	Deferred     int                  `json:"deferred"`
+	Bytes        int64                `json:"bytes,omitempty"`
+	Retries      int                  `json:"retries,omitempty"`
+	DeadLetters  int                  `json:"deadLetters,omitempty"`
+	Destinations []DestinationSummary `json:"destinations,omitempty"`
+	Folders      []FolderSummary      `json:"folders,omitempty"`
+	// Warnings counts the matches with scan warnings.
+	Warnings int `json:"warnings,omitempty"`
+	// Latency and Backlog hold the trigger ages of the folders uploaded and
+	// of the triggers left unprocessed (see state.RunSummary).
+	Latency *AgeSummary `json:"latency,omitempty"`
+	Backlog *AgeSummary `json:"backlog,omitempty"`
+}
+
+// AgeSummary summarizes the ages of a set of triggers in milliseconds.
+type AgeSummary struct {
+	Count   int   `json:"count"`
+	MaxMs   int64 `json:"maxMs"`
+	P50Ms   int64 `json:"p50Ms"`
+	P90Ms   int64 `json:"p90Ms"`
+	P99Ms   int64 `json:"p99Ms"`
+	Overdue int   `json:"overdue,omitempty"`
+}
+
+// DestinationSummary holds the uploads of a run to a single destination.
+type DestinationSummary struct {
+	Name    string  `json:"name"`
+	Folders int     `json:"folders"`
+	Failed  int     `json:"failed,omitempty"`
+	Files   int     `json:"files"`
+	Bytes   int64   `json:"bytes"`
+	MBps    float64 `json:"mbps"`
+	Retries int     `json:"retries,omitempty"`
+}
+
+// FolderSummary holds the outcome of a single folder of a run; Status is one
+// of the folder_done statuses. RecordQueued is set if its record was
+// dead-lettered.
+type FolderSummary struct {
+	Folder       string `json:"folder"`
+	Status       string `json:"status"`
+	Files        int    `json:"files"`
+	Bytes        int64  `json:"bytes"`
+	DurationMs   int64  `json:"durationMs"`
+	Retries      int    `json:"retries,omitempty"`
+	RecordQueued bool   `json:"recordQueued,omitempty"`
+}
+
+// Writer encodes events as JSON lines. It is safe for concurrent use. A nil
+// *Writer is valid and discards all events, so callers don't need to check
+// whether an event stream is configured.
+type Writer struct {
+	// Agent and RunID are set on every event.
+	Agent string
+	RunID string
+
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+	now func() time.Time
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// New creates a writer encoding events to w.
+func New(w io.Writer) *Writer {
+	return &Writer{w: w, enc: json.NewEncoder(w), now: time.Now}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Open creates a writer for target: `fd:N` writes to the already open file
+// descriptor N, anything else is a file path events are appended to. An empty
+// target returns a nil writer.
+func Open(target string) (*Writer, error) {
+	if target == "" {
+		return nil, nil
+	}
+	if fd, ok := strings.CutPrefix(target, "fd:"); ok {
+		n, err := strconv.Atoi(fd)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid events file descriptor %q", target)
+		}
+		f := os.NewFile(uintptr(n), target)
+		if f == nil {
+			return nil, fmt.Errorf("invalid events file descriptor %q", target)
+		}
+		if _, err := f.Stat(); err != nil {
+			return nil, fmt.Errorf("events file descriptor %q: %w", target, err)
+		}
+		return New(f), nil
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open events file: %w", err)
+	}
+	return New(f), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Emit writes e as one line, setting its time (if unset), agent and run ID.
+func (w *Writer) Emit(e Event) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if e.Time.IsZero() {
+		e.Time = w.now().UTC()
+	}
+	e.Agent = w.Agent
+	e.RunID = w.RunID
+	if err := w.enc.Encode(e); err != nil {
+		return fmt.Errorf("write event: %w", err)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Close closes the underlying file, if any.
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+	if c, ok := w.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWriter_Emit verifies events are written as JSON lines carrying the
+// agent and run ID.
+func TestWriter_Emit(t *testing.T) {
+	var buf bytes.Buffer
+	w := New(&buf)
+	w.Agent, w.RunID = "a", "r"
+	w.now = func() time.Time { return time.Unix(100, 0) }
+	if err := w.Emit(Event{Type: TypeMatchFound, ReadyFile: "X.RDY"}); err != nil {
+		t.Fatalf("Emit: %v", err)
+	}
+	if err := w.Emit(Event{Type: TypeRunDone, Summary: &Summary{Scanned: 1}}); err != nil {
+		t.Fatalf("Emit: %v", err)
+	}
+
+	var got []map[string]any
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var m map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			t.Fatalf("decode %q: %v", sc.Text(), err)
+		}
+		got = append(got, m)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(got))
+	}
+	if got[0]["type"] != TypeMatchFound || got[0]["agent"] != "a" || got[0]["runId"] != "r" || got[0]["readyFile"] != "X.RDY" {
+		t.Fatalf("unexpected event %v", got[0])
+	}
+	if got[0]["time"] != "1970-01-01T00:01:40Z" {
+		t.Fatalf("unexpected time %v", got[0]["time"])
+	}
+	if _, ok := got[0]["summary"]; ok {
+		t.Fatalf("expected summary omitted, got %v", got[0])
+	}
+	if s, ok := got[1]["summary"].(map[string]any); !ok || s["scanned"] != 1.0 || s["failed"] != 0.0 {
+		t.Fatalf("unexpected summary %v", got[1]["summary"])
+	}
+
+	var nilWriter *Writer
+	if err := nilWriter.Emit(Event{Type: TypeScanStart}); err != nil || nilWriter.Close() != nil {
+		t.Fatalf("nil writer: %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestOpen verifies file targets are appended to and invalid descriptors are
+// rejected.
+func TestOpen(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "events.jsonl")
+	for range 2 {
+		w, err := Open(p)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if err := w.Emit(Event{Type: TypeScanStart}); err != nil {
+			t.Fatalf("Emit: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if n := strings.Count(string(b), "\n"); n != 2 {
+		t.Fatalf("expected 2 appended lines, got %d", n)
+	}
+
+	if w, err := Open(""); w != nil || err != nil {
+		t.Fatalf("expected nil writer for empty target")
+	}
+	for _, target := range []string{"fd:x", "fd:-1", "fd:987654"} {
+		if _, err := Open(target); err == nil {
+			t.Fatalf("expected error for %q", target)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package naming
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// Labels derives labels (e.g. customer, production line) from the path of a
+// matched folder relative to the scanned root. The zero value derives none.
+type Labels struct {
+	// Pattern is matched against the slash separated relative folder path;
+	// each named capture group becomes a label.
+	Pattern *regexp.Regexp
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewLabels compiles a label pattern. The pattern must have at least one named
+// capture group and must not use any of the reserved names (e.g. metadata keys
+// set by the uploader itself).
+func NewLabels(pattern string, reserved ...string) (Labels, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return Labels{}, err
+	}
+	named := 0
+	for _, name := range re.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		if slices.Contains(reserved, name) {
+			return Labels{}, fmt.Errorf("label name %q is reserved", name)
+		}
+		named++
+	}
+	if named == 0 {
+		return Labels{}, fmt.Errorf("pattern %s has no named groups", re)
+	}
+	return Labels{Pattern: re}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Names returns the label names in pattern order.
+func (l Labels) Names() []string {
+	if l.Pattern == nil {
+		return nil
+	}
+	var names []string
+	for _, name := range l.Pattern.SubexpNames() {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Derive returns the labels for a relative folder path. Groups that didn't
+// participate in the match or matched an empty string are left out; nil is
+// returned if the pattern doesn't match at all.
+func (l Labels) Derive(relPath string) map[string]string {
+	if l.Pattern == nil {
+		return nil
+	}
+	m := l.Pattern.FindStringSubmatch(relPath)
+	if m == nil {
+		return nil
+	}
+	labels := make(map[string]string)
+	for i, name := range l.Pattern.SubexpNames() {
+		if name != "" && m[i] != "" {
+			labels[name] = m[i]
+		}
+	}
+	return labels
+}
@@ -0,0 +1,40 @@
+package naming
+
+import (
+	"maps"
+	"testing"
+)
+
+// TestNewLabels verifies pattern validation.
+func TestNewLabels(t *testing.T) {
+	for _, pattern := range []string{"(", "^([^/]+)/", "^(?P<agent>[^/]+)/"} {
+		if _, err := NewLabels(pattern, "agent"); err == nil {
+			t.Fatalf("expected error for %q", pattern)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestLabels_Derive verifies labels are taken from named groups.
+func TestLabels_Derive(t *testing.T) {
+	l, err := NewLabels(`^(?P<customer>[^/]+)/(?:(?P<line>line[0-9]+)/)?`)
+	if err != nil {
+		t.Fatalf("NewLabels: %v", err)
+	}
+	for _, tc := range []struct {
+		path string
+		want map[string]string
+	}{
+		{"ACME/line3/ORDER1", map[string]string{"customer": "ACME", "line": "line3"}},
+		{"ACME/ORDER1", map[string]string{"customer": "ACME"}},
+		{"ORDER1", nil},
+	} {
+		if got := l.Derive(tc.path); !maps.Equal(got, tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.path, tc.want, got)
+		}
+	}
+	if got := (Labels{}).Derive("ACME/ORDER1"); got != nil {
+		t.Fatalf("expected no labels for zero value, got %v", got)
+	}
+}
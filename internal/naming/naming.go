@@ -0,0 +1,114 @@
+package naming
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Normalization steps accepted by Rules.Normalize.
+const (
+	NormUpper       = "upper"
+	NormLower       = "lower"
+	NormTrim        = "trim"
+	NormStripSpaces = "strip-spaces"
+)
+
+// Actions for folders whose names fail validation.
+const (
+	ActionReject     = "reject"
+	ActionQuarantine = "quarantine"
+)
+
+// QuarantinePrefix is the object prefix used for quarantined folders.
+const QuarantinePrefix = "quarantine"
+
+// Rules describe how matched folder names are normalized and validated. The
+// zero value accepts every name unchanged.
+type Rules struct {
+	// Pattern, if set, must match the (normalized) name.
+	Pattern *regexp.Regexp
+	// MaxLength, if > 0, limits the (normalized) name length in characters.
+	MaxLength int
+	// Forbidden lists characters that must not appear in the name.
+	Forbidden string
+	// Normalize lists normalization steps applied in order.
+	Normalize []string
+	// Action decides what happens to invalid names (reject or quarantine).
+	Action string
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ParseNormalize parses a comma separated list of normalization steps.
+func ParseNormalize(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var steps []string
+	for _, step := range strings.Split(s, ",") {
+		step = strings.TrimSpace(step)
+		switch step {
+		case NormUpper, NormLower, NormTrim, NormStripSpaces:
+			steps = append(steps, step)
+		default:
+			return nil, fmt.Errorf("unknown normalization %q", step)
+		}
+	}
+	return steps, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Apply normalizes name and validates the result. It returns the normalized
+// name and a non-nil error describing the first violated rule, if any.
+func (r Rules) Apply(name string) (string, error) {
+	n := r.normalize(name)
+	return n, r.validate(n)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// normalize applies the configured normalization steps in order.
+func (r Rules) normalize(name string) string {
+	for _, step := range r.Normalize {
+		switch step {
+		case NormUpper:
+			name = strings.ToUpper(name)
+		case NormLower:
+			name = strings.ToLower(name)
+		case NormTrim:
+			name = strings.TrimSpace(name)
+		case NormStripSpaces:
+			name = strings.Map(func(r rune) rune {
+				if unicode.IsSpace(r) {
+					return -1
+				}
+				return r
+			}, name)
+		}
+	}
+	return name
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// validate checks name against length, forbidden characters and pattern.
+func (r Rules) validate(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty folder name")
+	}
+	if r.MaxLength > 0 && utf8.RuneCountInString(name) > r.MaxLength {
+		return fmt.Errorf("folder name %q exceeds %d characters", name, r.MaxLength)
+	}
+	if i := strings.IndexAny(name, r.Forbidden); r.Forbidden != "" && i >= 0 {
+		c, _ := utf8.DecodeRuneInString(name[i:])
+		return fmt.Errorf("folder name %q contains forbidden character %q", name, c)
+	}
+	if r.Pattern != nil && !r.Pattern.MatchString(name) {
+		return fmt.Errorf("folder name %q does not match %s", name, r.Pattern)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package naming
+
+import (
+	"regexp"
+	"testing"
+)
+
+// TestRules_ZeroValue verifies the zero value accepts names unchanged.
+func TestRules_ZeroValue(t *testing.T) {
+	got, err := Rules{}.Apply("Order 1")
+	if err != nil || got != "Order 1" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRules_Normalize verifies normalization steps run in order.
+func TestRules_Normalize(t *testing.T) {
+	steps, err := ParseNormalize("trim, upper,strip-spaces")
+	if err != nil {
+		t.Fatalf("ParseNormalize: %v", err)
+	}
+	got, err := Rules{Normalize: steps}.Apply("  order 1\t2 ")
+	if err != nil || got != "ORDER12" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if _, err := ParseNormalize("upper,shout"); err == nil {
+		t.Fatalf("expected error for unknown step")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRules_Validate verifies each validation rule rejects violating names.
+func TestRules_Validate(t *testing.T) {
+	r := Rules{
+		Pattern:   regexp.MustCompile(`^ORDER[0-9]+$`),
+		MaxLength: 10,
+		Forbidden: "#%",
+	}
+	cases := map[string]bool{
+		"ORDER1":        true,
+		"ORDER12345678": false, // too long
+		"ORDER#1":       false, // forbidden
+		"INVOICE1":      false, // pattern
+		"":              false, // empty
+	}
+	for name, ok := range cases {
+		if _, err := r.Apply(name); (err == nil) != ok {
+			t.Errorf("%q: valid=%v err=%v", name, ok, err)
+		}
+	}
+}
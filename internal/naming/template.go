@@ -0,0 +1,86 @@
+package naming
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Template is a slash separated path with `{name}` placeholders, e.g. the
+// Firestore collection path `sites/{site}/uploads`, expanded per folder.
+type Template struct {
+	raw   string
+	names []string
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewTemplate parses a path template. Placeholders must be non-empty names of
+// letters, digits and `_`; braces must be balanced.
+func NewTemplate(s string) (Template, error) {
+	t := Template{raw: s}
+	rest := s
+	for {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			return t, nil
+		}
+		if rest[open] == '}' {
+			return Template{}, fmt.Errorf("unbalanced } in %q", s)
+		}
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] != '}' {
+			return Template{}, fmt.Errorf("unbalanced { in %q", s)
+		}
+		name := rest[open+1 : open+1+end]
+		if name == "" || strings.IndexFunc(name, invalidPlaceholderRune) >= 0 {
+			return Template{}, fmt.Errorf("invalid placeholder {%s} in %q", name, s)
+		}
+		t.names = append(t.names, name)
+		rest = rest[open+1+end+1:]
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Names returns the placeholder names in order of appearance.
+func (t Template) Names() []string {
+	return t.names
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Expand replaces the placeholders with their values. It fails if a value is
+// missing or empty, or contains a `/`, which would change the depth of the
+// path.
+func (t Template) Expand(values map[string]string) (string, error) {
+	if len(t.names) == 0 {
+		return t.raw, nil
+	}
+	pairs := make([]string, 0, 2*len(t.names))
+	for _, name := range t.names {
+		v := values[name]
+		if v == "" {
+			return "", fmt.Errorf("no value for {%s}", name)
+		}
+		if strings.Contains(v, "/") {
+			return "", fmt.Errorf("value %q of {%s} contains /", v, name)
+		}
+		pairs = append(pairs, "{"+name+"}", v)
+	}
+	return strings.NewReplacer(pairs...).Replace(t.raw), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// String returns the template as given.
+func (t Template) String() string {
+	return t.raw
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// invalidPlaceholderRune reports whether r can't be part of a placeholder
+// name.
+func invalidPlaceholderRune(r rune) bool {
+	return r != '_' && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9')
+}
@@ -0,0 +1,34 @@
+package naming
+
+import "testing"
+
+// TestTemplate verifies parsing and expansion of path templates.
+func TestTemplate(t *testing.T) {
+	for _, s := range []string{"a/{", "a/}", "a/{}", "a/{b{c}}", "a/{x-y}"} {
+		if _, err := NewTemplate(s); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+
+	tmpl, err := NewTemplate("sites/{site}/uploads/{date}/folders")
+	if err != nil {
+		t.Fatalf("NewTemplate: %v", err)
+	}
+	if names := tmpl.Names(); len(names) != 2 || names[0] != "site" || names[1] != "date" {
+		t.Fatalf("unexpected names %v", names)
+	}
+	got, err := tmpl.Expand(map[string]string{"site": "S1", "date": "2025-09-30"})
+	if err != nil || got != "sites/S1/uploads/2025-09-30/folders" {
+		t.Fatalf("Expand = %q, %v", got, err)
+	}
+	for _, values := range []map[string]string{{"site": "S1"}, {"site": "a/b", "date": "x"}} {
+		if got, err := tmpl.Expand(values); err == nil {
+			t.Fatalf("expected error for %v, got %q", values, got)
+		}
+	}
+
+	plain, _ := NewTemplate("uploads")
+	if got, err := plain.Expand(nil); err != nil || got != "uploads" {
+		t.Fatalf("Expand = %q, %v", got, err)
+	}
+}
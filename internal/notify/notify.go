@@ -0,0 +1,138 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Notifier delivers a short digest (subject and plain text body) to humans.
+type Notifier interface {
+	Notify(subject, body string) error
+}
+
+// NOTE(joel): Compile-time checks that the implementations satisfy the
+// interface.
+var (
+	_ Notifier = (*Slack)(nil)
+	_ Notifier = (*SMTP)(nil)
+	_ Notifier = Multi(nil)
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Slack posts digests to a Slack incoming webhook.
+type Slack struct {
+	WebhookURL string
+	client     *http.Client
+}
+
+// NewSlack creates a Slack notifier for the given incoming webhook URL.
+func NewSlack(webhookURL string) *Slack {
+	return &Slack{WebhookURL: webhookURL, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Notify posts subject (bold) and body as a single message.
+func (s *Slack) Notify(subject, body string) error {
+	b, err := json.Marshal(map[string]string{"text": "*" + subject + "*\n" + body})
+	if err != nil {
+		return fmt.Errorf("encode slack message: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.WebhookURL, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("create slack request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send slack message: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("send slack message: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// SMTP sends digests as plain text emails. If Username is set, PLAIN auth is
+// used (which net/smtp only allows over TLS or to localhost).
+type SMTP struct {
+	Addr     string
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+// NOTE(joel): sendMail is a variable so tests can capture messages without an
+// SMTP server.
+var sendMail = smtp.SendMail
+
+// Notify sends subject and body to all recipients.
+func (s *SMTP) Notify(subject, body string) error {
+	if s.Addr == "" || s.From == "" || len(s.To) == 0 {
+		return fmt.Errorf("smtp notifier requires address, sender and recipients")
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return fmt.Errorf("smtp address: %w", err)
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	if err := sendMail(s.Addr, auth, s.From, s.To, s.message(subject, body)); err != nil {
+		return fmt.Errorf("send mail: %w", err)
+	}
+	return nil
+}
+
+// message builds the RFC 5322 message for subject and body.
+func (s *SMTP) message(subject, body string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Multi fans a digest out to several notifiers. All notifiers are tried; their
+// errors are joined.
+type Multi []Notifier
+
+// Notify delivers the digest to every notifier.
+func (m Multi) Notify(subject, body string) error {
+	var errs []error
+	for _, n := range m {
+		if err := n.Notify(subject, body); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Due reports whether a new digest may be sent given the time the last one
+// was sent and the minimum interval between digests.
+func Due(last, now time.Time, interval time.Duration) bool {
+	return last.IsZero() || now.Sub(last) >= interval
+}
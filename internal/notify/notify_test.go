@@ -0,0 +1,100 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSlack_Notify verifies the webhook payload.
+func TestSlack_Notify(t *testing.T) {
+	var got map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	if err := NewSlack(srv.URL).Notify("subj", "line1\nline2"); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if got["text"] != "*subj*\nline1\nline2" {
+		t.Fatalf("unexpected payload %v", got)
+	}
+
+	if err := NewSlack(srv.URL+"/missing\x7f").Notify("s", "b"); err == nil {
+		t.Fatalf("expected error for invalid URL")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestSMTP_Notify verifies the email envelope and message.
+func TestSMTP_Notify(t *testing.T) {
+	var gotAddr, gotFrom string
+	var gotTo []string
+	var gotMsg []byte
+	prev := sendMail
+	sendMail = func(addr string, _ smtp.Auth, from string, to []string, msg []byte) error {
+		gotAddr, gotFrom, gotTo, gotMsg = addr, from, to, msg
+		return nil
+	}
+	t.Cleanup(func() { sendMail = prev })
+
+	s := &SMTP{Addr: "mail:25", From: "lfs@example.com", To: []string{"a@example.com", "b@example.com"}}
+	if err := s.Notify("subj", "line1\nline2"); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if gotAddr != "mail:25" || gotFrom != "lfs@example.com" || len(gotTo) != 2 {
+		t.Fatalf("unexpected envelope %s %s %v", gotAddr, gotFrom, gotTo)
+	}
+	msg := string(gotMsg)
+	if !strings.Contains(msg, "Subject: subj\r\n") || !strings.Contains(msg, "To: a@example.com, b@example.com\r\n") {
+		t.Fatalf("unexpected headers %q", msg)
+	}
+	if !strings.HasSuffix(msg, "\r\n\r\nline1\r\nline2\r\n") {
+		t.Fatalf("unexpected body %q", msg)
+	}
+
+	if err := (&SMTP{Addr: "mail:25"}).Notify("s", "b"); err == nil {
+		t.Fatalf("expected error for missing sender/recipients")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestMulti_Notify verifies all notifiers are tried and errors are joined.
+func TestMulti_Notify(t *testing.T) {
+	var calls int
+	ok := notifierFunc(func(string, string) error { calls++; return nil })
+	fail := notifierFunc(func(string, string) error { calls++; return errors.New("boom") })
+	if err := (Multi{fail, ok}).Notify("s", "b"); err == nil || calls != 2 {
+		t.Fatalf("expected joined error after 2 calls, got %v after %d", err, calls)
+	}
+}
+
+type notifierFunc func(subject, body string) error
+
+func (f notifierFunc) Notify(subject, body string) error { return f(subject, body) }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestDue verifies the rate limit check.
+func TestDue(t *testing.T) {
+	now := time.Now()
+	if !Due(time.Time{}, now, time.Hour) {
+		t.Fatalf("expected due without previous digest")
+	}
+	if Due(now.Add(-30*time.Minute), now, time.Hour) {
+		t.Fatalf("expected not due within interval")
+	}
+	if !Due(now.Add(-time.Hour), now, time.Hour) {
+		t.Fatalf("expected due after interval")
+	}
+}
@@ -0,0 +1,243 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"local-file-sync/internal/app"
+)
+
+// NOTE(joel): Archiving moves the uploaded data, which is read straight from
+// disk like the uploader does, not through Config.Env; its FileSystem only
+// covers lock, state and trigger files and has no symlinks or streaming
+// copies. Variables so tests can simulate moves across filesystems and copies
+// that don't match their source.
+var (
+	renamePath = os.Rename
+	copyFile   = copyFileContents
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// archive moves the folders uploaded by this run, by trigger, to the same path
+// relative to cfg.RootDir below cfg.ArchiveDir, followed by their trigger.
+// Triggers inside their folder (e.g. manifests) or being the folder itself
+// move along with it. A path that can't be moved stays in place; its error is
+// returned and the upload counts as done regardless.
+func archive(cfg *app.Config, folders map[string][]string) []error {
+	triggers := make([]string, 0, len(folders))
+	for t := range folders {
+		triggers = append(triggers, t)
+	}
+	sort.Strings(triggers)
+
+	var errs []error
+	for _, t := range triggers {
+		moved := true
+		for _, folder := range folders[t] {
+			if err := archivePath(cfg, folder); err != nil {
+				errs = append(errs, err)
+				moved = false
+			}
+		}
+		// NOTE(joel): The trigger of a folder that is still in place stays
+		// too, so both are found together again.
+		if !moved {
+			continue
+		}
+		if _, err := os.Lstat(t); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err := archivePath(cfg, t); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// archivePath moves path below cfg.ArchiveDir and logs the move.
+func archivePath(cfg *app.Config, path string) error {
+	rel, err := filepath.Rel(cfg.RootDir, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("archive %s: not below %s", path, cfg.RootDir)
+	}
+	dst := filepath.Join(cfg.ArchiveDir, rel)
+	if err := moveTree(path, dst); err != nil {
+		return fmt.Errorf("archive %s: %w", path, err)
+	}
+	cfg.Logger.Printf("archived: path=%s to=%s", path, dst)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// moveTree moves the file or directory src to dst, which must not exist. If
+// both are on different filesystems, where a rename fails, src is copied,
+// the copy is compared to src and only then src is removed. A copy that
+// fails or doesn't match is removed again, leaving src untouched.
+func moveTree(src, dst string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	err := renamePath(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return fmt.Errorf("copy across filesystems: %w", err)
+	}
+	if err := verifyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return fmt.Errorf("verify copy: %w", err)
+	}
+	if err := os.RemoveAll(src); err != nil {
+		return fmt.Errorf("remove after copy: %w", err)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// copyTree copies the directories, regular files (with their modification
+// time) and symlinks of src to dst.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0o700)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			if err := copyFile(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		default:
+			return fmt.Errorf("%s: unsupported file type %s", path, d.Type())
+		}
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// copyFileContents copies the regular file src to the new file dst.
+func copyFileContents(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	// NOTE(joel): The source is removed once verified, so the copy has to be
+	// on disk by then.
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// verifyTree checks that every entry of src exists in dst with the same type,
+// regular files with the same SHA-256 checksum and symlinks with the same
+// target.
+func verifyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		ti, err := os.Lstat(target)
+		if err != nil {
+			return err
+		}
+		if ti.Mode().Type() != d.Type() {
+			return fmt.Errorf("%s: type mismatch", target)
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			want, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			got, err := os.Readlink(target)
+			if err != nil {
+				return err
+			}
+			if got != want {
+				return fmt.Errorf("%s: link target mismatch", target)
+			}
+		case d.Type().IsRegular():
+			want, err := fileSHA256(path)
+			if err != nil {
+				return err
+			}
+			got, err := fileSHA256(target)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(got, want) {
+				return fmt.Errorf("%s: checksum mismatch", target)
+			}
+		}
+		return nil
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// fileSHA256 returns the SHA-256 checksum of the file at path.
+func fileSHA256(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
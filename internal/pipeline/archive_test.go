@@ -0,0 +1,151 @@
+package pipeline
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestRun_ArchiveDir verifies uploaded folders and their triggers are moved
+// below -archive-dir, keeping their relative path, while failed ones stay.
+func TestRun_ArchiveDir(t *testing.T) {
+	g, _ := useFakes(t)
+	root, archiveDir := t.TempDir(), t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "site"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	makeTrigger(t, filepath.Join(root, "site"), "ORDER1", "a")
+
+	cfg := testConfig(root, filepath.Join(t.TempDir(), "state.json"), filepath.Join(t.TempDir(), "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.Recursive = true
+	cfg.ArchiveDir = archiveDir
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if _, ok := g.Object("ORDER1/data.txt"); !ok {
+		t.Fatalf("expected uploaded object, got %v", g.ObjectNames())
+	}
+	b, err := os.ReadFile(filepath.Join(archiveDir, "site", "ORDER1", "data.txt"))
+	if err != nil || string(b) != "a" {
+		t.Fatalf("expected archived folder, got %q %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(archiveDir, "site", "ORDER1.RDY")); err != nil {
+		t.Fatalf("expected archived trigger: %v", err)
+	}
+	for _, p := range []string{"ORDER1", "ORDER1.RDY"} {
+		if _, err := os.Lstat(filepath.Join(root, "site", p)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s moved out of -dir, got %v", p, err)
+		}
+	}
+
+	// NOTE(joel): A folder whose upload fails is kept for the next run.
+	g.Err = os.ErrPermission
+	makeTrigger(t, root, "ORDER2", "b")
+	if err := run(cfg); err == nil {
+		t.Fatalf("expected error for failed upload")
+	}
+	if _, err := os.Stat(filepath.Join(root, "ORDER2", "data.txt")); err != nil {
+		t.Fatalf("expected failed folder in place: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(archiveDir, "ORDER2")); !os.IsNotExist(err) {
+		t.Fatalf("expected failed folder not archived, got %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestMoveTree_CrossDevice verifies a move across filesystems copies files,
+// subdirectories and symlinks, keeps modification times and removes the
+// source afterwards.
+func TestMoveTree_CrossDevice(t *testing.T) {
+	crossDevice(t)
+	src, dst := filepath.Join(t.TempDir(), "ORDER1"), filepath.Join(t.TempDir(), "archive", "ORDER1")
+	writeTree(t, src)
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "a.txt"), mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	if err := moveTree(src, dst); err != nil {
+		t.Fatalf("moveTree: %v", err)
+	}
+	if _, err := os.Lstat(src); !os.IsNotExist(err) {
+		t.Fatalf("expected source removed, got %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dst, "sub", "b.txt"))
+	if err != nil || string(b) != "bb" {
+		t.Fatalf("expected copied nested file, got %q %v", b, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "link")); err != nil || link != "a.txt" {
+		t.Fatalf("expected copied symlink, got %q %v", link, err)
+	}
+	fi, err := os.Stat(filepath.Join(dst, "a.txt"))
+	if err != nil || !fi.ModTime().Equal(mtime) {
+		t.Fatalf("expected modification time kept, got %v %v", fi, err)
+	}
+	if err := moveTree(dst, dst); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("expected existing destination to fail, got %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestMoveTree_VerifyMismatch verifies a copy that doesn't match its source is
+// removed again and the source is kept.
+func TestMoveTree_VerifyMismatch(t *testing.T) {
+	crossDevice(t)
+	prev := copyFile
+	copyFile = func(src, dst string, perm fs.FileMode) error {
+		return os.WriteFile(dst, []byte("corrupt"), perm)
+	}
+	t.Cleanup(func() { copyFile = prev })
+	src, dst := filepath.Join(t.TempDir(), "ORDER1"), filepath.Join(t.TempDir(), "ORDER1")
+	writeTree(t, src)
+
+	err := moveTree(src, dst)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if _, err := os.Lstat(dst); !os.IsNotExist(err) {
+		t.Fatalf("expected copy removed, got %v", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(src, "a.txt")); err != nil || string(b) != "a" {
+		t.Fatalf("expected source kept, got %q %v", b, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// crossDevice makes renames fail like they do across filesystems.
+func crossDevice(t *testing.T) {
+	t.Helper()
+	prev := renamePath
+	renamePath = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	t.Cleanup(func() { renamePath = prev })
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// writeTree creates a folder with a file, a nested file and a symlink.
+func writeTree(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("bb"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := os.Symlink("a.txt", filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+}
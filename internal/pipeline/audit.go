@@ -0,0 +1,223 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"path"
+	"path/filepath"
+	"slices"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/naming"
+	"local-file-sync/internal/scanner"
+	"local-file-sync/internal/state"
+	"local-file-sync/internal/uploader"
+
+	"github.com/google/uuid"
+)
+
+// Drift kinds reported by the state audit command.
+const (
+	// driftVanished marks entries whose trigger file (or data folder) no
+	// longer exists.
+	driftVanished = "vanished"
+	// driftModified marks entries whose folder holds files modified after the
+	// trigger was processed.
+	driftModified = "modified"
+	// driftMissing marks entries with files whose object is missing from the
+	// bucket.
+	driftMissing = "missing"
+)
+
+// drift is a state entry that no longer matches the filesystem or the
+// bucket.
+type drift struct {
+	Kind      string
+	ReadyFile string
+	// Detail names the affected folder, file or object, if any.
+	Detail string
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// auditState cross-checks the state entries against the filesystem and, with
+// -gcs-bucket, the bucket and prints one tab separated line per drift to
+// stdout. With -fix, drifted entries are removed from state (under the run
+// lock), so their folders are processed again on the next run.
+func auditState(cfg *app.Config) error {
+	if cfg.Fix {
+		if cfg.RunID == "" {
+			cfg.RunID = uuid.NewString()
+		}
+		// NOTE(joel): The audit doesn't start folders, so a lost lease only
+		// ends the heartbeat.
+		release, acquired, err := acquireRunLock(context.Background(), cfg, defaultClients(), func(error) {})
+		if err != nil {
+			return fmt.Errorf("acquire lock: %w", err)
+		}
+		defer release()
+		if !acquired {
+			return nil
+		}
+	}
+
+	st := state.New(cfg.StateFile)
+	st.FS = cfg.Env.FS
+	st.NormalizeKeys = cfg.NormalizeUnicode
+	st.Root = cfg.RootDir
+	st.RelativeKeys = cfg.StateRelativeKeys
+	if err := st.Load(); err != nil {
+		return fmt.Errorf("load state: %w", err)
+	}
+	paths := st.Paths()
+
+	matches, err := scanner.Scan(cfg.RootDir, scanOptions(cfg))
+	if err != nil {
+		return fmt.Errorf("scan: %w", err)
+	}
+	byReady := make(map[string][]scanner.Match, len(matches))
+	for _, m := range matches {
+		byReady[m.ReadyFile] = append(byReady[m.ReadyFile], m)
+	}
+
+	// NOTE(joel): The bucket is only checked if the uploader can list
+	// objects.
+	var lister uploader.Lister
+	if cfg.GCSBucket != "" {
+		u, err := newUploader(context.Background(), cfg)
+		if err != nil {
+			return fmt.Errorf("gcs init: %w", err)
+		}
+		defer u.Close()
+		if l, ok := u.(uploader.Lister); ok {
+			lister = l
+		} else {
+			cfg.Warnf("audit warning: uploader can't list objects; skipping bucket check")
+		}
+	}
+
+	var drifts []drift
+	for _, p := range paths {
+		// NOTE(joel): With -only, entries of other triggers aren't scanned
+		// and would be reported as orphaned.
+		if !cfg.Only.Match(p) {
+			continue
+		}
+		found, err := auditEntry(cfg, st, p, byReady[p], lister)
+		if err != nil {
+			return err
+		}
+		drifts = append(drifts, found...)
+	}
+	for _, d := range drifts {
+		if d.Detail != "" {
+			fmt.Fprintf(cfg.Stdout, "%s\t%s\t%s\n", d.Kind, d.ReadyFile, d.Detail)
+		} else {
+			fmt.Fprintf(cfg.Stdout, "%s\t%s\n", d.Kind, d.ReadyFile)
+		}
+	}
+
+	counts := make(map[string]int)
+	drifted := make(map[string]bool)
+	for _, d := range drifts {
+		counts[d.Kind]++
+		drifted[d.ReadyFile] = true
+	}
+	fixed := 0
+	if cfg.Fix && len(drifted) > 0 {
+		for _, p := range slices.Sorted(maps.Keys(drifted)) {
+			st.Delete(p)
+			fixed++
+		}
+		if err := st.Save(); err != nil {
+			return fmt.Errorf("save state: %w", err)
+		}
+	}
+	cfg.Logger.Printf(
+		"audit: entries=%d vanished=%d modified=%d missing=%d fixed=%d",
+		len(paths), counts[driftVanished], counts[driftModified], counts[driftMissing], fixed,
+	)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// auditEntry returns the drifts of the state entry for readyFile, given the
+// current matches of that trigger.
+func auditEntry(cfg *app.Config, st *state.Store, readyFile string, matches []scanner.Match, lister uploader.Lister) ([]drift, error) {
+	if _, err := cfg.Env.Files().Stat(readyFile); errors.Is(err, fs.ErrNotExist) {
+		return []drift{{Kind: driftVanished, ReadyFile: readyFile}}, nil
+	}
+
+	// NOTE(joel): The stored value is the trigger's modTime when it was
+	// processed (or the sentinel 1 if it was already gone by then).
+	processed, _ := st.Get(readyFile)
+	var drifts []drift
+	for _, m := range matches {
+		if m.MissingFolder || m.Folder == "" {
+			drifts = append(drifts, drift{Kind: driftVanished, ReadyFile: readyFile, Detail: m.Folder})
+			continue
+		}
+		if processed > 1 && !m.NewestModTime.IsZero() && m.NewestModTime.UnixNano() > processed {
+			drifts = append(drifts, drift{Kind: driftModified, ReadyFile: readyFile, Detail: m.Folder})
+		}
+		if lister == nil {
+			continue
+		}
+		missing, err := missingObjects(cfg, m, lister)
+		if err != nil {
+			return nil, fmt.Errorf("audit %s: %w", readyFile, err)
+		}
+		for _, name := range missing {
+			drifts = append(drifts, drift{Kind: driftMissing, ReadyFile: readyFile, Detail: name})
+		}
+	}
+	return drifts, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// missingObjects returns the sorted names of objects the files of m would be
+// uploaded to that don't exist in the bucket. Folders rejected by the folder
+// name rules have no objects and are not checked.
+func missingObjects(cfg *app.Config, m scanner.Match, lister uploader.Lister) ([]string, error) {
+	opts := uploader.UploadOptions{
+		Prefix:           cfg.DestPrefix,
+		NormalizeUnicode: cfg.NormalizeUnicode,
+		FollowSymlinks:   cfg.FollowFileSymlinks,
+		DedupeHardlinks:  cfg.DedupeHardlinks,
+		CompressSparse:   cfg.CompressSparse,
+		BundleSmallFiles: cfg.BundleSmallFiles,
+	}
+	name, err := cfg.FolderNameRules.Apply(filepath.Base(m.Folder))
+	switch {
+	case err == nil:
+		opts.FolderName = name
+	case cfg.FolderNameRules.Action == naming.ActionQuarantine:
+		opts.Prefix = path.Join(cfg.DestPrefix, naming.QuarantinePrefix)
+	default:
+		return nil, nil
+	}
+	if cfg.RelativeObjectNames {
+		opts.FolderName = relativeObjectName(cfg.RootDir, m.Folder, opts.FolderName)
+	}
+	prefix, names, err := uploader.ObjectNames(m, opts)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	objs, err := lister.ListObjects(prefix + "/")
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, name := range names {
+		if _, ok := objs[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	slices.Sort(missing)
+	return missing, nil
+}
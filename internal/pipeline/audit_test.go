@@ -0,0 +1,88 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"local-file-sync/internal/state"
+)
+
+// TestAuditState verifies vanished triggers, folders modified after
+// processing and missing objects are reported, and removed from state with
+// -fix.
+func TestAuditState(t *testing.T) {
+	g, _ := useFakes(t)
+	root := t.TempDir()
+	stateFile := filepath.Join(root, "state.json")
+	// NOTE(joel): makeTrigger writes the data after the trigger; backdate the
+	// data so only the explicitly modified folder counts as modified.
+	earlier := time.Now().Add(-time.Hour)
+	for _, name := range []string{"GONE", "MOD", "LOST", "OK"} {
+		makeTrigger(t, root, name, name)
+		if err := os.Chtimes(filepath.Join(root, name, "data.txt"), earlier, earlier); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+	cfg := testConfig(root, stateFile, filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(root, "GONE.RDY")); err != nil {
+		t.Fatalf("remove rdy: %v", err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "MOD", "data.txt"), later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	g.DeleteObject("LOST/data.txt")
+
+	audit := func(fix bool) string {
+		t.Helper()
+		out, err := os.CreateTemp(t.TempDir(), "audit-*.txt")
+		if err != nil {
+			t.Fatalf("create out: %v", err)
+		}
+		defer out.Close()
+		cfg.Stdout = out
+		cfg.Fix = fix
+		if err := auditState(cfg); err != nil {
+			t.Fatalf("auditState: %v", err)
+		}
+		b, err := os.ReadFile(out.Name())
+		if err != nil {
+			t.Fatalf("read out: %v", err)
+		}
+		return string(b)
+	}
+
+	want := strings.Join([]string{
+		"vanished\t" + filepath.Join(root, "GONE.RDY"),
+		"missing\t" + filepath.Join(root, "LOST.RDY") + "\tLOST/data.txt",
+		"modified\t" + filepath.Join(root, "MOD.RDY") + "\t" + filepath.Join(root, "MOD"),
+	}, "\n") + "\n"
+	if got := audit(false); got != want {
+		t.Fatalf("unexpected report:\n%s\nwant:\n%s", got, want)
+	}
+
+	// NOTE(joel): Without -fix state is left untouched, so the same drift is
+	// reported again.
+	if got := audit(true); got != want {
+		t.Fatalf("unexpected report with fix:\n%s", got)
+	}
+	st := state.New(stateFile)
+	if err := st.Load(); err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	paths := st.Paths()
+	if len(paths) != 1 || paths[0] != filepath.Join(root, "OK.RDY") {
+		t.Fatalf("expected only OK entry left, got %v", paths)
+	}
+	if got := audit(false); got != "" {
+		t.Fatalf("expected no drift after fix, got %q", got)
+	}
+}
@@ -0,0 +1,130 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/scanner"
+	"local-file-sync/internal/state"
+)
+
+// backfillChunk is a slice of the backfill processed by a single run.
+type backfillChunk struct {
+	targets []scanner.Target
+	// checkpoint is saved in state along with the outcome of the chunk; nil
+	// removes it after the last chunk.
+	checkpoint *state.Backfill
+	// saved is set by runChunk once the state (and checkpoint) was written.
+	saved bool
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// backfill onboards a directory with a large history of folders. It scans
+// once, then processes the triggered folders in path order in chunks of
+// -backfill-chunk, each a regular run that saves the state together with a
+// checkpoint. An interrupted backfill resumes after the last completed chunk.
+// Failed folders are not retried by the backfill; they stay unprocessed in
+// state, so the next regular run picks them up.
+func backfill(cfg *app.Config) error {
+	st := state.New(cfg.StateFile)
+	st.FS = cfg.Env.FS
+	st.NormalizeKeys = cfg.NormalizeUnicode
+	st.Root = cfg.RootDir
+	st.RelativeKeys = cfg.StateRelativeKeys
+	if err := st.Load(); err != nil {
+		return fmt.Errorf("load state: %w", err)
+	}
+
+	// NOTE(joel): Folder entries aren't needed yet; each chunk lists its own
+	// folders, so stream them here to keep memory flat for huge backlogs.
+	scanOpts := scanOptions(cfg)
+	if scanOpts.PageSize == 0 {
+		scanOpts.PageSize = 1000
+	}
+	if cfg.SkipUnreadable {
+		scanOpts.OnError = func(path string, err error) {
+			cfg.Warnf("scan warning: skipping %s: %v", path, err)
+		}
+	}
+	if cfg.ScanTimeout > 0 {
+		scanOpts.OnTimeout = func(path string, err error) {
+			cfg.Warnf("scan warning: skipping %s: %v", path, err)
+		}
+	}
+	matches, err := scanner.Scan(cfg.RootDir, scanOpts)
+	if err != nil {
+		return fmt.Errorf("scan: %w", err)
+	}
+
+	cp := st.Backfill()
+	if cp != nil && cp.Root != cfg.RootDir {
+		cfg.Warnf("backfill warning: discarding checkpoint of %s", cp.Root)
+		cp = nil
+	}
+	now := cfg.Env.Now()
+	if cp == nil {
+		cp = &state.Backfill{Root: cfg.RootDir, Started: now}
+	}
+	targets := make([]scanner.Target, 0, len(matches))
+	for _, m := range matches {
+		// NOTE(joel): Scan returns matches ordered by trigger and folder, so
+		// everything up to the cursor was handled by completed chunks.
+		if cp.Cursor != "" && (m.ReadyFile < cp.Cursor || (m.ReadyFile == cp.Cursor && m.Folder <= cp.CursorFolder)) {
+			continue
+		}
+		targets = append(targets, scanner.Target{ReadyFile: m.ReadyFile, Folder: m.Folder})
+	}
+	cp.Total = cp.Done + len(targets)
+	if cp.Done > 0 {
+		cfg.Logger.Printf("backfill: resuming after %d of %d folder(s) (started %s)", cp.Done, cp.Total, cp.Started.Format(time.RFC3339))
+	} else {
+		cfg.Logger.Printf("backfill: %d folder(s) in chunks of %d", cp.Total, cfg.BackfillChunk)
+	}
+
+	// NOTE(joel): Per-run caps would defer folders of a chunk past the cursor;
+	// the chunk size bounds each run instead.
+	chunkCfg := *cfg
+	chunkCfg.MaxFoldersPerRun = 0
+	chunkCfg.MaxBytesPerRun = 0
+	var failed error
+	for start := 0; start < len(targets); start += cfg.BackfillChunk {
+		end := min(start+cfg.BackfillChunk, len(targets))
+		last := targets[end-1]
+		cp.Done += end - start
+		cp.Cursor, cp.CursorFolder = last.ReadyFile, last.Folder
+		cp.Updated = cfg.Env.Now()
+		chunk := &backfillChunk{targets: targets[start:end], checkpoint: cp}
+		if end == len(targets) {
+			chunk.checkpoint = nil
+		}
+
+		err := runChunk(context.Background(), &chunkCfg, chunk, defaultClients(), &Report{})
+		if err != nil && !errors.Is(err, ErrFoldersFailed) {
+			return fmt.Errorf("backfill chunk ending at %s: %w", last.ReadyFile, err)
+		}
+		if err != nil {
+			failed = err
+		}
+		// NOTE(joel): A chunk that didn't save state (e.g. the lock is held by
+		// another process or uploads weren't confirmed) didn't run; stop so
+		// the checkpoint stays before it.
+		if !chunk.saved {
+			return fmt.Errorf("backfill stopped after %d of %d folder(s); run it again to resume", cp.Done-(end-start), cp.Total)
+		}
+		cfg.Logger.Printf("backfill: %d of %d folder(s) done", cp.Done, cp.Total)
+	}
+	if len(targets) == 0 && st.Backfill() != nil {
+		// NOTE(joel): Nothing left after the cursor, e.g. the remaining
+		// folders were removed since the backfill was interrupted.
+		st.SetBackfill(nil)
+		if err := st.Save(); err != nil {
+			return fmt.Errorf("save state: %w", err)
+		}
+	}
+	cfg.Logger.Printf("backfill: complete")
+	return failed
+}
@@ -0,0 +1,71 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"local-file-sync/internal/state"
+)
+
+// TestBackfill verifies folders are processed in chunks, each recorded as a
+// run, and an interrupted backfill resumes after its checkpoint.
+func TestBackfill(t *testing.T) {
+	g, _ := useFakes(t)
+	root := t.TempDir()
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	for _, name := range []string{"A", "B", "C", "D", "E"} {
+		makeTrigger(t, root, name, name)
+	}
+
+	// NOTE(joel): Simulate a backfill interrupted after its first chunk of A
+	// and B; their state was saved along with the checkpoint.
+	st := state.New(stateFile)
+	st.SetBackfill(&state.Backfill{
+		Root:         root,
+		Total:        5,
+		Done:         2,
+		Cursor:       filepath.Join(root, "B.RDY"),
+		CursorFolder: filepath.Join(root, "B"),
+	})
+	if err := st.Save(); err != nil {
+		t.Fatalf("save state: %v", err)
+	}
+
+	cfg := testConfig(root, stateFile, filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.HistorySize = 10
+	cfg.BackfillChunk = 2
+	cfg.MaxFoldersPerRun = 1
+	if err := backfill(cfg); err != nil {
+		t.Fatalf("backfill: %v", err)
+	}
+
+	want := []string{"C/data.txt", "D/data.txt", "E/data.txt"}
+	if got := g.ObjectNames(); !slices.Equal(got, want) {
+		t.Fatalf("unexpected objects %v, want %v", got, want)
+	}
+	st = state.New(stateFile)
+	if err := st.Load(); err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	if len(st.History) != 2 || st.History[0].Emitted != 2 || st.History[1].Emitted != 1 {
+		t.Fatalf("expected two chunk runs, got %+v", st.History)
+	}
+	if len(st.Paths()) != 3 {
+		t.Fatalf("expected C, D and E processed, got %v", st.Paths())
+	}
+	if st.Backfill() != nil {
+		t.Fatalf("expected checkpoint removed after completion, got %+v", st.Backfill())
+	}
+
+	// NOTE(joel): A new backfill starts over; processed folders are skipped
+	// by state and only the skipped A and B are uploaded.
+	if err := backfill(cfg); err != nil {
+		t.Fatalf("second backfill: %v", err)
+	}
+	if got := g.ObjectNames(); len(got) != 5 {
+		t.Fatalf("expected all folders uploaded, got %v", got)
+	}
+}
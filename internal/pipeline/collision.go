@@ -0,0 +1,103 @@
+package pipeline
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/scanner"
+	"local-file-sync/internal/uploader"
+)
+
+// nameCollisions finds emitted folders uploaded to the same destination
+// prefix, e.g. `a/ORDER1` and `b/ORDER1` of a recursive scan, which would
+// silently overwrite each other's objects. With -name-collisions namespace
+// the folder names of the colliding folders in opts are prefixed with their
+// directory relative to the root. The folders that can't be uploaded (all
+// colliding ones with fail, those that can't be namespaced otherwise) are
+// returned with their error by index.
+func nameCollisions(cfg *app.Config, matches []scanner.Match, opts []uploader.UploadOptions) map[int]error {
+	if cfg.NameCollisions == app.CollisionIgnore {
+		return nil
+	}
+	byDest := make(map[string][]int)
+	for i, m := range matches {
+		dest := destPath(m, opts[i])
+		byDest[dest] = append(byDest[dest], i)
+	}
+	dests := make([]string, 0, len(byDest))
+	for dest := range byDest {
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
+
+	// NOTE(joel): With relative object names only folders of the same
+	// directory (e.g. renamed by the folder name rules) can collide, which
+	// the directory can't tell apart.
+	namespace := cfg.NameCollisions == app.CollisionNamespace && !cfg.RelativeObjectNames
+	errs := make(map[int]error)
+	for _, dest := range dests {
+		idx := byDest[dest]
+		// NOTE(joel): Several triggers of the same folder (e.g. listed in two
+		// batches) upload the same data; that's not a collision.
+		folders := make(map[string]bool)
+		for _, i := range idx {
+			folders[matches[i].Folder] = true
+		}
+		if len(folders) < 2 {
+			continue
+		}
+		list := make([]string, 0, len(folders))
+		for f := range folders {
+			list = append(list, f)
+		}
+		sort.Strings(list)
+		err := fmt.Errorf("name collision: folders %s share destination %s/", strings.Join(list, ", "), dest)
+		for _, i := range idx {
+			if namespace {
+				if dir, ok := relativeDir(cfg.RootDir, matches[i].Folder); ok {
+					name := opts[i].FolderName
+					if name == "" {
+						name = filepath.Base(matches[i].Folder)
+					}
+					opts[i].FolderName = path.Join(dir, name)
+					continue
+				}
+			}
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// relativeDir returns the slash separated directory of folder relative to
+// root. ok is false for folders directly in or outside of root, which can't be
+// told apart by it.
+func relativeDir(root, folder string) (string, bool) {
+	rel, err := filepath.Rel(root, filepath.Dir(folder))
+	if err != nil || rel == "." || !filepath.IsLocal(rel) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// relativeObjectName returns the folder name objects of folder are stored
+// below with -relative-object-names: name (or the base name of folder if
+// empty) below the folder's directory relative to root. Folders directly in
+// or outside of root keep their name.
+func relativeObjectName(root, folder, name string) string {
+	if name == "" {
+		name = filepath.Base(folder)
+	}
+	if dir, ok := relativeDir(root, folder); ok {
+		return path.Join(dir, name)
+	}
+	return name
+}
@@ -0,0 +1,86 @@
+package pipeline
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"local-file-sync/internal/app"
+)
+
+// TestRun_NameCollisions verifies folders of a recursive scan sharing a
+// destination prefix are failed by default and namespaced by their relative
+// directory with -name-collisions namespace.
+func TestRun_NameCollisions(t *testing.T) {
+	g, f := useFakes(t)
+	root := t.TempDir()
+	for _, dir := range []string{"a", "b", "c"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	makeTrigger(t, filepath.Join(root, "a"), "ORDER1", "a")
+	makeTrigger(t, filepath.Join(root, "b"), "ORDER1", "b")
+	makeTrigger(t, filepath.Join(root, "c"), "ORDER2", "c")
+
+	cfg := testConfig(root, filepath.Join(t.TempDir(), "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.Recursive = true
+	if err := run(cfg); !errors.Is(err, ErrFoldersFailed) {
+		t.Fatalf("expected colliding folders to fail, got %v", err)
+	}
+	if got := g.ObjectNames(); !slices.Equal(got, []string{"ORDER2/data.txt"}) {
+		t.Fatalf("expected only the unique folder uploaded, got %v", got)
+	}
+
+	cfg.NameCollisions = app.CollisionNamespace
+	cfg.FirestoreCollection = "uploads"
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := []string{"ORDER2/data.txt", "a/ORDER1/data.txt", "b/ORDER1/data.txt"}
+	if got := g.ObjectNames(); !slices.Equal(got, want) {
+		t.Fatalf("unexpected objects %v, want %v", got, want)
+	}
+	if got, _ := g.Object("b/ORDER1/data.txt"); string(got) != "b" {
+		t.Fatalf("unexpected content %q", got)
+	}
+	// NOTE(joel): The record keeps the local folder path.
+	if rec, ok := f.Record("uploads", filepath.Join("b", "ORDER1")); !ok || rec.Files[0].Path != "b/ORDER1/data.txt" {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_RelativeObjectNames verifies objects are named after the folder
+// path relative to the root with -relative-object-names.
+func TestRun_RelativeObjectNames(t *testing.T) {
+	g, f := useFakes(t)
+	root := t.TempDir()
+	nested := filepath.Join(root, "site1", "2024")
+	if err := os.MkdirAll(nested, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	makeTrigger(t, nested, "ORDER1", "nested")
+	makeTrigger(t, root, "ORDER2", "top")
+
+	cfg := testConfig(root, filepath.Join(t.TempDir(), "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.DestPrefix = "intake"
+	cfg.FirestoreCollection = "uploads"
+	cfg.Recursive = true
+	cfg.RelativeObjectNames = true
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := []string{"intake/ORDER2/data.txt", "intake/site1/2024/ORDER1/data.txt"}
+	if got := g.ObjectNames(); !slices.Equal(got, want) {
+		t.Fatalf("unexpected objects %v, want %v", got, want)
+	}
+	if _, ok := f.Record("uploads", filepath.Join("intake", "site1", "2024", "ORDER1")); !ok {
+		t.Fatalf("expected record keyed by the relative folder path, got %+v", f.Records("uploads"))
+	}
+}
@@ -0,0 +1,81 @@
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/progress"
+	"local-file-sync/internal/scanner"
+	"local-file-sync/internal/uploader"
+)
+
+// NOTE(joel): The prompt output and terminal check are variables so tests can
+// answer the prompt through a pipe.
+var (
+	promptOut       io.Writer = os.Stderr
+	stdinIsTerminal           = progress.IsTerminal
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// confirmUploads lists the folders about to be uploaded and, with -confirm,
+// asks for confirmation on stdin unless -yes is set. Without -confirm it
+// always confirms. A non-interactive stdin fails instead of uploading
+// unconfirmed, so a scheduled run with -confirm doesn't hang or proceed.
+func confirmUploads(cfg *app.Config, matches []scanner.Match, opts []uploader.UploadOptions) (bool, error) {
+	if !cfg.Confirm || len(matches) == 0 {
+		return true, nil
+	}
+	var total int64
+	fmt.Fprintf(promptOut, "about to upload %d folder(s):\n", len(matches))
+	for i, m := range matches {
+		size := folderSize(m, cfg.FollowFileSymlinks)
+		total += size
+		dest := app.Destination{Scheme: app.SchemeGCS, Bucket: cfg.GCSBucket, Prefix: destPath(m, opts[i])}
+		fmt.Fprintf(promptOut, "  %s -> %s/ (%d files, %d bytes)\n", m.Folder, dest, m.FileCount, size)
+	}
+	fmt.Fprintf(promptOut, "total: %d bytes\n", total)
+	if cfg.Yes {
+		cfg.Logger.Printf("-yes set: uploads confirmed")
+		return true, nil
+	}
+	return askYes(cfg, "proceed?")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// askYes asks question on promptOut and reads the answer from stdin; only y
+// or yes confirm. A non-interactive stdin fails, pointing to -yes.
+func askYes(cfg *app.Config, question string) (bool, error) {
+	if !stdinIsTerminal(cfg.Stdin) {
+		return false, fmt.Errorf("stdin is not a terminal; pass -yes to confirm non-interactively")
+	}
+	fmt.Fprintf(promptOut, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(cfg.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("read answer: %w", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// destPath returns the object prefix the files of m are uploaded below.
+func destPath(m scanner.Match, opts uploader.UploadOptions) string {
+	name := opts.FolderName
+	if name == "" {
+		name = filepath.Base(m.Folder)
+	}
+	return path.Join(opts.Prefix, name, opts.Version)
+}
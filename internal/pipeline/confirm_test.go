@@ -0,0 +1,78 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRun_Confirm verifies uploads only proceed once confirmed and that a
+// non-interactive stdin fails unless -yes is set.
+func TestRun_Confirm(t *testing.T) {
+	g, _ := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.DestPrefix = "in"
+	cfg.Confirm = true
+
+	var prompt strings.Builder
+	prevOut, prevTerm := promptOut, stdinIsTerminal
+	promptOut = &prompt
+	terminal := true
+	stdinIsTerminal = func(*os.File) bool { return terminal }
+	t.Cleanup(func() { promptOut, stdinIsTerminal = prevOut, prevTerm })
+
+	answer := func(s string) {
+		t.Helper()
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatalf("pipe: %v", err)
+		}
+		t.Cleanup(func() { r.Close() })
+		if _, err := w.WriteString(s); err != nil {
+			t.Fatalf("write answer: %v", err)
+		}
+		w.Close()
+		cfg.Stdin = r
+	}
+
+	answer("n\n")
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if len(g.ObjectNames()) != 0 {
+		t.Fatalf("expected nothing uploaded when declined, got %v", g.ObjectNames())
+	}
+	if !strings.Contains(prompt.String(), filepath.Join(root, "ORDER1")+" -> gs://bucket/in/ORDER1/ (1 files, 1 bytes)") {
+		t.Fatalf("unexpected prompt %q", prompt.String())
+	}
+	if _, err := os.Stat(cfg.StateFile); !os.IsNotExist(err) {
+		t.Fatalf("expected no state written when declined, got %v", err)
+	}
+
+	terminal = false
+	if err := run(cfg); err == nil {
+		t.Fatalf("expected error for non-interactive stdin")
+	}
+
+	cfg.Yes = true
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := g.ObjectNames(); len(got) != 1 || got[0] != "in/ORDER1/data.txt" {
+		t.Fatalf("expected upload with -yes, got %v", got)
+	}
+
+	makeTrigger(t, root, "ORDER2", "b")
+	cfg.Yes, terminal = false, true
+	answer("YES\n")
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := g.ObjectNames(); len(got) != 2 {
+		t.Fatalf("expected upload once confirmed, got %v", got)
+	}
+}
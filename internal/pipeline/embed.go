@@ -0,0 +1,94 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/progress"
+	"local-file-sync/internal/scanner"
+	"local-file-sync/internal/state"
+	"local-file-sync/internal/uploader"
+)
+
+// Options configure a run embedded with Run.
+type Options struct {
+	// Config configures the run like the command line flags do; start from
+	// app.ParseFlags or fill in at least RootDir, LockFile (unless ScanOnly),
+	// Logger and Stdout. Run works on a copy, so a Config may be reused for
+	// many runs, also concurrently; each gets a new RunID unless one is set.
+	// The copy is shallow: runs share Logger, Warnings and Events. Embedded
+	// runs never show the progress display (Config.Progress is ignored), so
+	// they don't redirect the shared Logger's output.
+	Config *app.Config
+	// Uploader, if set, is used instead of a GCS client created from
+	// Config.GCSBucket. Run doesn't close it.
+	Uploader uploader.Uploader
+	// RecordWriter, if set, is used instead of a Firestore client created
+	// from Config.FirestoreProjectId. Run doesn't close it.
+	RecordWriter uploader.RecordWriter
+}
+
+// Report describes the outcome of a run: its summary as recorded in the run
+// history and the folders it emitted or uploaded.
+type Report struct {
+	state.RunSummary
+	// LockHeld is set if another process held the lock, so nothing ran.
+	LockHeld bool
+	// Matches are the folders the run emitted or uploaded, in order.
+	Matches []scanner.Match
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Run executes a single run (scan, filter, upload, record and state save) as
+// the command line tool does without a command, e.g. from a supervisor that
+// runs syncs periodically in a long-lived server. Canceling ctx stops
+// starting further folder uploads; folders not started fail and are retried
+// by the next run. If folders failed, the error wraps ErrFoldersFailed and
+// the report is complete. Run executes a single wave: Config.WaveBudget
+// defers the folders not started in time, Config.WaveSize is ignored; run
+// again while Report.Deferred is set to continue.
+func Run(ctx context.Context, opts Options) (Report, error) {
+	if opts.Config == nil {
+		return Report{}, errors.New("pipeline: Options.Config is required")
+	}
+	cfg := *opts.Config
+	cfg.Progress = progress.ModeNever
+	cl := defaultClients()
+	if opts.Uploader != nil {
+		cl.uploader = func(context.Context, *app.Config) (uploader.Uploader, error) {
+			return keepOpenUploader{opts.Uploader}, nil
+		}
+	}
+	if opts.RecordWriter != nil {
+		cl.recordWriter = func(context.Context, *app.Config) (uploader.RecordWriter, error) {
+			return keepOpenRecordWriter{opts.RecordWriter}, nil
+		}
+	}
+	var rep Report
+	err := runChunk(ctx, &cfg, nil, cl, &rep)
+	return rep, err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// keepOpenUploader hides Close of an uploader owned by the embedder.
+type keepOpenUploader struct{ uploader.Uploader }
+
+func (keepOpenUploader) Close() error { return nil }
+
+// WriteManifest implements uploader.ManifestWriter if the embedder's uploader
+// does.
+func (u keepOpenUploader) WriteManifest(m scanner.Match, rec uploader.FolderRecord, opts uploader.UploadOptions) error {
+	mw, ok := u.Uploader.(uploader.ManifestWriter)
+	if !ok {
+		return errManifestUnsupported
+	}
+	return mw.WriteManifest(m, rec, opts)
+}
+
+// keepOpenRecordWriter hides Close of a record writer owned by the embedder.
+type keepOpenRecordWriter struct{ uploader.RecordWriter }
+
+func (keepOpenRecordWriter) Close() error { return nil }
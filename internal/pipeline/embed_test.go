@@ -0,0 +1,233 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"local-file-sync/internal/progress"
+	"local-file-sync/internal/scanner"
+	"local-file-sync/internal/uploader"
+	"local-file-sync/lfs/fakes"
+)
+
+// TestRun_Options verifies an embedded run uses the injected clients without
+// closing them, reports its outcome and leaves the passed Config untouched.
+func TestRun_Options(t *testing.T) {
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	makeTrigger(t, root, "ORDER2", "b")
+	g, f := fakes.NewGCS(), fakes.NewFirestore()
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreProjectId = "project"
+	cfg.FirestoreCollection = "uploads"
+
+	rep, err := Run(context.Background(), Options{Config: cfg, Uploader: g, RecordWriter: f})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rep.LockHeld || rep.RunID == "" || rep.Scanned != 2 || rep.Emitted != 2 || rep.Failed != 0 || rep.Throughput == nil {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	if len(rep.Matches) != 2 || rep.Matches[0].Folder != filepath.Join(root, "ORDER1") {
+		t.Fatalf("unexpected matches %+v", rep.Matches)
+	}
+	if got := g.ObjectNames(); !slices.Equal(got, []string{"ORDER1/data.txt", "ORDER2/data.txt"}) {
+		t.Fatalf("expected uploads with the injected uploader, got %v", got)
+	}
+	if len(f.Records("uploads")) != 2 {
+		t.Fatalf("expected records with the injected writer, got %v", f.Records("uploads"))
+	}
+	if g.Closed() {
+		t.Fatalf("expected the injected uploader to stay open")
+	}
+	if cfg.RunID != "" {
+		t.Fatalf("expected the passed config untouched, got run ID %q", cfg.RunID)
+	}
+
+	rep2, err := Run(context.Background(), Options{Config: cfg, Uploader: g, RecordWriter: f})
+	if err != nil || rep2.RunID == rep.RunID || rep2.Skipped != 2 || rep2.Emitted != 0 {
+		t.Fatalf("expected a new run skipping processed folders, got %+v %v", rep2, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_Canceled verifies folders not started before the context was
+// canceled fail and are uploaded by the next run.
+func TestRun_Canceled(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"ORDER1", "ORDER2", "ORDER3"} {
+		makeTrigger(t, root, name, "a")
+	}
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FolderConcurrency = 1
+
+	g := fakes.NewGCS()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	u := cancelingUploader{Uploader: g, cancel: cancel}
+	rep, err := Run(ctx, Options{Config: cfg, Uploader: u})
+	if !errors.Is(err, ErrFoldersFailed) || rep.Emitted != 3 || rep.Failed != 2 {
+		t.Fatalf("expected folders after cancel to fail, got %+v %v", rep, err)
+	}
+	if got := g.ObjectNames(); len(got) != 1 {
+		t.Fatalf("expected one folder uploaded, got %v", got)
+	}
+
+	rep, err = Run(context.Background(), Options{Config: cfg, Uploader: g})
+	if err != nil || rep.Emitted != 2 || rep.Skipped != 1 {
+		t.Fatalf("expected remaining folders uploaded, got %+v %v", rep, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_NoProgress verifies embedded runs don't show the progress display,
+// so they leave the output of the shared logger alone.
+func TestRun_NoProgress(t *testing.T) {
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer out.Close()
+	var logs bytes.Buffer
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), out)
+	cfg.Logger = log.New(&logs, "", 0)
+	cfg.GCSBucket = "bucket"
+	cfg.Progress = progress.ModeAlways
+
+	u := checkingUploader{Uploader: fakes.NewGCS(), check: func() {
+		if w := cfg.Logger.Writer(); w != io.Writer(&logs) {
+			t.Errorf("expected the logger output untouched during the run, got %T", w)
+		}
+	}}
+	if _, err := Run(context.Background(), Options{Config: cfg, Uploader: u}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if b, _ := os.ReadFile(out.Name()); len(b) > 0 {
+		t.Fatalf("expected no progress display, got %q", b)
+	}
+	if !strings.Contains(logs.String(), "folder uploaded") {
+		t.Fatalf("expected run logs, got %q", logs.String())
+	}
+}
+
+// checkingUploader calls check before every folder upload.
+type checkingUploader struct {
+	uploader.Uploader
+	check func()
+}
+
+func (u checkingUploader) UploadFolder(m scanner.Match, opts uploader.UploadOptions) uploader.FolderResult {
+	u.check()
+	return u.Uploader.UploadFolder(m, opts)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// cancelingUploader cancels the run after its first folder.
+type cancelingUploader struct {
+	uploader.Uploader
+	cancel context.CancelFunc
+}
+
+func (u cancelingUploader) UploadFolder(m scanner.Match, opts uploader.UploadOptions) uploader.FolderResult {
+	defer u.cancel()
+	return u.Uploader.UploadFolder(m, opts)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_ReadBack verifies that with -read-back the uploaded objects are
+// recorded and counted as verified.
+func TestRun_ReadBack(t *testing.T) {
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	makeTrigger(t, root, "ORDER2", "b")
+	g, f := fakes.NewGCS(), fakes.NewFirestore()
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreProjectId = "project"
+	cfg.FirestoreCollection = "uploads"
+	cfg.ReadBack = 1
+
+	rep, err := Run(context.Background(), Options{Config: cfg, Uploader: g, RecordWriter: f})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rep.Throughput == nil || rep.Throughput.Verified != 2 {
+		t.Fatalf("expected 2 verified objects, got %+v", rep.Throughput)
+	}
+	rec, ok := f.Record("uploads", "ORDER1")
+	if !ok || len(rec.Files) != 1 || !rec.Files[0].Verified {
+		t.Fatalf("expected the record to mark the file verified, got %+v", rec)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_FolderManifest verifies that with -folder-manifest the folder record
+// is stored in the folder prefix, also without Firestore.
+func TestRun_FolderManifest(t *testing.T) {
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	g := fakes.NewGCS()
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FolderManifest = true
+
+	rep, err := Run(context.Background(), Options{Config: cfg, Uploader: g})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	b, ok := g.Object("ORDER1/" + uploader.ManifestName)
+	if !ok {
+		t.Fatalf("expected a manifest, got %v", g.ObjectNames())
+	}
+	var rec uploader.FolderRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		t.Fatalf("decode manifest: %v", err)
+	}
+	if rec.FolderPath != "ORDER1" || rec.RunID != rep.RunID || len(rec.Files) != 1 || rec.Files[0].Path != "ORDER1/data.txt" {
+		t.Fatalf("unexpected manifest %+v", rec)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_MatchID verifies the match ID is attached to the uploaded objects
+// and the folder record.
+func TestRun_MatchID(t *testing.T) {
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	g := fakes.NewGCS()
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FolderManifest = true
+
+	if _, err := Run(context.Background(), Options{Config: cfg, Uploader: g}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	id := scanner.MatchID(root, filepath.Join(root, "ORDER1.RDY"))
+	if got := g.ObjectMetadata("ORDER1/data.txt")["matchId"]; got != id {
+		t.Fatalf("expected matchId %q, got %q", id, got)
+	}
+	b, _ := g.Object("ORDER1/" + uploader.ManifestName)
+	var rec uploader.FolderRecord
+	if err := json.Unmarshal(b, &rec); err != nil || rec.MatchID != id {
+		t.Fatalf("expected record matchId %q, got %+v (%v)", id, rec, err)
+	}
+}
@@ -0,0 +1,86 @@
+package pipeline
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/state"
+	"local-file-sync/internal/uploader"
+)
+
+// exportHistory writes the upload history selected by -export-data as CSV
+// with a header row to stdout: one row per run summary of the state file
+// (oldest first) or per folder record of the local record index (by write
+// time). Times are RFC 3339 in UTC, so the rows compare as text.
+func exportHistory(cfg *app.Config) error {
+	var rows [][]string
+	switch cfg.ExportData {
+	case app.ExportRecords:
+		index, err := uploader.OpenRecordIndex(cfg.RecordIndex)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, []string{"written_at", "run_id", "collection", "id", "folder_path", "files", "checksum"})
+		for _, e := range index.Entries() {
+			rows = append(rows, []string{
+				csvTime(e.WrittenAt), e.RunID, e.Collection, e.ID, e.FolderPath,
+				strconv.Itoa(e.Files), e.Checksum,
+			})
+		}
+	default:
+		st := state.New(cfg.StateFile)
+		st.FS = cfg.Env.FS
+		if err := st.Load(); err != nil {
+			return fmt.Errorf("load state: %w", err)
+		}
+		rows = append(rows, []string{
+			"start", "run_id", "duration_ms", "scanned", "emitted", "skipped", "failed", "deferred",
+			"bytes", "mbps", "folder_concurrency", "file_concurrency",
+			"latency_p50_ms", "latency_p90_ms", "latency_max_ms", "backlog", "backlog_max_ms", "overdue", "errors",
+		})
+		for _, r := range st.History {
+			var tp state.Throughput
+			if r.Throughput != nil {
+				tp = *r.Throughput
+			}
+			var latency, backlog state.AgeStats
+			if r.Latency != nil {
+				latency = *r.Latency
+			}
+			if r.Backlog != nil {
+				backlog = *r.Backlog
+			}
+			rows = append(rows, []string{
+				csvTime(r.Start), r.RunID, strconv.FormatInt(r.Duration.Milliseconds(), 10),
+				strconv.Itoa(r.Scanned), strconv.Itoa(r.Emitted), strconv.Itoa(r.Skipped),
+				strconv.Itoa(r.Failed), strconv.Itoa(r.Deferred),
+				strconv.FormatInt(tp.Bytes, 10), strconv.FormatFloat(tp.MBps, 'f', 2, 64),
+				strconv.Itoa(tp.FolderConcurrency), strconv.Itoa(tp.FileConcurrency),
+				strconv.FormatInt(latency.P50.Milliseconds(), 10), strconv.FormatInt(latency.P90.Milliseconds(), 10),
+				strconv.FormatInt(latency.Max.Milliseconds(), 10), strconv.Itoa(backlog.Count),
+				strconv.FormatInt(backlog.Max.Milliseconds(), 10), strconv.Itoa(backlog.Overdue),
+				strings.Join(r.Errors, "\n"),
+			})
+		}
+	}
+
+	w := csv.NewWriter(cfg.Stdout)
+	if err := w.WriteAll(rows); err != nil {
+		return fmt.Errorf("write csv: %w", err)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// csvTime formats t for CSV output; the zero time is empty.
+func csvTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
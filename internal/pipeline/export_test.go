@@ -0,0 +1,67 @@
+package pipeline
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/uploader"
+)
+
+// TestExportHistory verifies the run history and the record index are
+// exported as CSV with a header row.
+func TestExportHistory(t *testing.T) {
+	useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "A", "a")
+	makeTrigger(t, root, "B", "bb")
+	cfg := testConfig(root, filepath.Join(t.TempDir(), "state.json"), filepath.Join(t.TempDir(), "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreCollection = "uploads"
+	cfg.RecordIndex = filepath.Join(t.TempDir(), "records.jsonl")
+	cfg.RunID = "run-1"
+	cfg.HistorySize = 5
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	export := func(data string) [][]string {
+		t.Helper()
+		out, err := os.CreateTemp(t.TempDir(), "export-*.csv")
+		if err != nil {
+			t.Fatalf("create out: %v", err)
+		}
+		defer out.Close()
+		cfg.Stdout = out
+		cfg.ExportData = data
+		if err := exportHistory(cfg); err != nil {
+			t.Fatalf("export: %v", err)
+		}
+		f, err := os.Open(out.Name())
+		if err != nil {
+			t.Fatalf("open out: %v", err)
+		}
+		defer f.Close()
+		rows, err := csv.NewReader(f).ReadAll()
+		if err != nil {
+			t.Fatalf("read csv: %v", err)
+		}
+		return rows
+	}
+
+	runs := export(app.ExportRuns)
+	if len(runs) != 2 || runs[0][0] != "start" || runs[1][1] != "run-1" || runs[1][4] != "2" || runs[1][8] != "3" {
+		t.Fatalf("unexpected runs export %q", runs)
+	}
+
+	records := export(app.ExportRecords)
+	if len(records) != 3 || !slices.Equal(records[0], []string{"written_at", "run_id", "collection", "id", "folder_path", "files", "checksum"}) {
+		t.Fatalf("unexpected records header %q", records)
+	}
+	if got := records[1][1:6]; !slices.Equal(got, []string{"run-1", "uploads", uploader.DocumentID("A"), "A", "1"}) {
+		t.Fatalf("unexpected record row %q", records[1])
+	}
+}
@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"sort"
+	"time"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/scanner"
+	"local-file-sync/internal/uploader"
+)
+
+// inProgressFiles returns, by index of matches, the names of the uploadable
+// files that look like they are still being written according to p: by their
+// name, as fresh empty files (as of now) or, with p.Settle, because their size or
+// modification time changed (or they vanished) between two stats. The second
+// stat happens once for all matches, so a run waits p.Settle at most once.
+func inProgressFiles(p app.InProgress, matches []scanner.Match, followSymlinks bool, now time.Time) map[int][]string {
+	type seen struct {
+		index int
+		entry scanner.FileEntry
+		size  int64
+		mod   time.Time
+	}
+	busy := make(map[int][]string)
+	var settle []seen
+	for i, m := range matches {
+		for fe, err := range m.Entries() {
+			// NOTE(joel): Listing errors are reported by the upload.
+			if err != nil {
+				break
+			}
+			fi, ok := uploader.Uploadable(fe, followSymlinks)
+			if !ok {
+				continue
+			}
+			if p.Partial(fe.Name, fi.Size(), fi.ModTime(), now) {
+				busy[i] = append(busy[i], fe.Name)
+				continue
+			}
+			if p.Settle > 0 {
+				settle = append(settle, seen{index: i, entry: fe, size: fi.Size(), mod: fi.ModTime()})
+			}
+		}
+	}
+	if len(settle) > 0 {
+		time.Sleep(p.Settle)
+		for _, s := range settle {
+			fi, ok := uploader.Uploadable(s.entry, followSymlinks)
+			if !ok || fi.Size() != s.size || !fi.ModTime().Equal(s.mod) {
+				busy[s.index] = append(busy[s.index], s.entry.Name)
+			}
+		}
+	}
+	for _, files := range busy {
+		sort.Strings(files)
+	}
+	return busy
+}
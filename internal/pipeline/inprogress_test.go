@@ -0,0 +1,76 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/scanner"
+)
+
+// TestRun_InProgress verifies folders with partial files are deferred without
+// being marked processed and uploaded once the files are complete.
+func TestRun_InProgress(t *testing.T) {
+	g, _ := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	makeTrigger(t, root, "ORDER2", "b")
+	partial := filepath.Join(root, "ORDER2", "scan.tiff.part")
+	if err := os.WriteFile(partial, []byte("b"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	cfg := testConfig(root, filepath.Join(t.TempDir(), "state.json"), filepath.Join(t.TempDir(), "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.InProgress = app.InProgress{Suffixes: []string{".part"}}
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if names := g.ObjectNames(); !slices.Equal(names, []string{"ORDER1/data.txt"}) {
+		t.Fatalf("expected only the complete folder uploaded, got %v", names)
+	}
+
+	if err := os.Rename(partial, filepath.Join(root, "ORDER2", "scan.tiff")); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	g2, _ := useFakes(t)
+	if err := run(cfg); err != nil {
+		t.Fatalf("run2: %v", err)
+	}
+	if names := g2.ObjectNames(); !slices.Equal(names, []string{"ORDER2/data.txt", "ORDER2/scan.tiff"}) {
+		t.Fatalf("expected deferred folder uploaded, got %v", names)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestInProgressFiles_Settle verifies files changing between the two stats
+// are flagged and unchanged ones aren't.
+func TestInProgressFiles_Settle(t *testing.T) {
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	growing := filepath.Join(root, "ORDER1", "growing.bin")
+	if err := os.WriteFile(growing, []byte("x"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	matches, err := scanner.Scan(root, scanner.Options{})
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("scan: %v %v", matches, err)
+	}
+
+	done := make(chan error)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		done <- os.WriteFile(growing, []byte("xyz"), 0o644)
+	}()
+	busy := inProgressFiles(app.InProgress{Settle: 200 * time.Millisecond}, matches, false, time.Now())
+	if err := <-done; err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if !slices.Equal(busy[0], []string{"growing.bin"}) {
+		t.Fatalf("expected growing file flagged, got %v", busy)
+	}
+}
@@ -0,0 +1,110 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"local-file-sync/internal/scanner"
+)
+
+// readTargets reads the folders to process with -stdin from r. The input is
+// either JSON, i.e. the match array printed by a run (or match objects, one
+// per line), or plain text with one folder path per line. Blank lines and
+// lines starting with `#` are ignored. Relative paths are resolved against
+// the working directory.
+func readTargets(r io.Reader) ([]scanner.Target, error) {
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if err != nil {
+		return nil, err
+	}
+	if first == '[' || first == '{' {
+		return readJSONTargets(br)
+	}
+
+	var targets []scanner.Target
+	sc := bufio.NewScanner(br)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		folder, err := filepath.Abs(line)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", line, err)
+		}
+		targets = append(targets, scanner.Target{Folder: folder})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read stdin: %w", err)
+	}
+	return targets, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// readJSONTargets decodes a stream of match arrays and objects. Only the
+// trigger and folder are taken from a match; the folder is listed again, so
+// truncated or outdated entries don't matter.
+func readJSONTargets(r io.Reader) ([]scanner.Target, error) {
+	type target struct {
+		ReadyFile string `json:"readyFile"`
+		Folder    string `json:"folder"`
+	}
+	var targets []scanner.Target
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if errors.Is(err, io.EOF) {
+			return targets, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode stdin: %w", err)
+		}
+		var batch []target
+		if raw = bytes.TrimSpace(raw); len(raw) > 0 && raw[0] == '{' {
+			batch = make([]target, 1)
+			err = json.Unmarshal(raw, &batch[0])
+		} else {
+			err = json.Unmarshal(raw, &batch)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode stdin: %w", err)
+		}
+		for _, t := range batch {
+			if t.ReadyFile == "" && t.Folder == "" {
+				return nil, fmt.Errorf("decode stdin: match without readyFile and folder")
+			}
+			targets = append(targets, scanner.Target{ReadyFile: t.ReadyFile, Folder: t.Folder})
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// peekNonSpace skips leading whitespace and returns the next byte without
+// consuming it, or 0 for empty input.
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.Peek(1)
+		if errors.Is(err, io.EOF) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("read stdin: %w", err)
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(b[0])) {
+			return b[0], nil
+		}
+		if _, err := br.ReadByte(); err != nil {
+			return 0, fmt.Errorf("read stdin: %w", err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"local-file-sync/internal/scanner"
+)
+
+// TestReadTargets verifies folder paths and JSON matches are read from stdin.
+func TestReadTargets(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	for name, tc := range map[string]struct {
+		in   string
+		want []scanner.Target
+	}{
+		"lines": {
+			in:   "\n/data/A\n# comment\n  rel/B  \n",
+			want: []scanner.Target{{Folder: "/data/A"}, {Folder: filepath.Join(wd, "rel", "B")}},
+		},
+		"array": {
+			in:   `[{"readyFile":"/data/A.RDY","folder":"/data/A","folderEntries":[]},{"readyFile":"/data/B.RDY","missingFolder":true}]`,
+			want: []scanner.Target{{ReadyFile: "/data/A.RDY", Folder: "/data/A"}, {ReadyFile: "/data/B.RDY"}},
+		},
+		"objects": {
+			in:   " {\"folder\":\"/data/A\"}\n{\"folder\":\"/data/B\"}\n",
+			want: []scanner.Target{{Folder: "/data/A"}, {Folder: "/data/B"}},
+		},
+		"empty": {in: "  \n"},
+	} {
+		got, err := readTargets(strings.NewReader(tc.in))
+		if err != nil {
+			t.Fatalf("%s: readTargets: %v", name, err)
+		}
+		if len(got) != len(tc.want) {
+			t.Fatalf("%s: expected %v, got %v", name, tc.want, got)
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Fatalf("%s: expected %v, got %v", name, tc.want, got)
+			}
+		}
+	}
+
+	if _, err := readTargets(strings.NewReader(`[{"size":1}]`)); err == nil {
+		t.Fatalf("expected error for match without folder")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_Stdin verifies folders read from stdin are uploaded without
+// scanning and skipped on the next run while unchanged.
+func TestRun_Stdin(t *testing.T) {
+	g, f := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "SCANNED", "x")
+	other := t.TempDir()
+	folder := filepath.Join(other, "PICKED")
+	if err := os.Mkdir(folder, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(folder, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreCollection = "uploads"
+	cfg.FromStdin = true
+	stdin := func() *os.File {
+		in, err := os.CreateTemp(t.TempDir(), "stdin-*")
+		if err != nil {
+			t.Fatalf("create stdin: %v", err)
+		}
+		if _, err := in.WriteString(folder + "\n"); err != nil {
+			t.Fatalf("write stdin: %v", err)
+		}
+		if _, err := in.Seek(0, 0); err != nil {
+			t.Fatalf("seek stdin: %v", err)
+		}
+		t.Cleanup(func() { in.Close() })
+		return in
+	}
+	cfg.Stdin = stdin()
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if names := g.ObjectNames(); len(names) != 1 || names[0] != "PICKED/a.txt" {
+		t.Fatalf("expected only the folder from stdin uploaded, got %v", names)
+	}
+	if _, ok := f.Record("uploads", folder); !ok {
+		t.Fatalf("expected record with absolute folder path, got %+v", f.Records("uploads"))
+	}
+
+	g.DeleteObject("PICKED/a.txt")
+	cfg.Stdin = stdin()
+	if err := run(cfg); err != nil {
+		t.Fatalf("run2: %v", err)
+	}
+	if names := g.ObjectNames(); len(names) != 0 {
+		t.Fatalf("expected unchanged folder skipped, got %v", names)
+	}
+}
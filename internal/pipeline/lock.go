@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"fmt"
+	"time"
+
+	"local-file-sync/internal/app"
+)
+
+// lockStatus prints whether the run lock file is held and, if so, by which
+// process (PID, host, agent), since when and whether that process is alive.
+func lockStatus(cfg *app.Config) error {
+	info, held, err := cfg.Env.ReadLock(cfg.LockFile)
+	if err != nil {
+		return err
+	}
+	if !held {
+		fmt.Fprintf(cfg.Stdout, "lock %s: not held\n", cfg.LockFile)
+		return nil
+	}
+	now := cfg.Env.Now()
+	status := "held"
+	if info.Stale(now) {
+		status = "stale (the next run reclaims it)"
+	}
+	fmt.Fprintf(cfg.Stdout, "lock %s: %s\n", cfg.LockFile, status)
+	fmt.Fprintf(cfg.Stdout, "  owner: %s\n", lockOwner(info))
+	if !info.Acquired.IsZero() {
+		fmt.Fprintf(cfg.Stdout, "  acquired: %s\n", info.Acquired.Format(time.RFC3339))
+	}
+	fmt.Fprintf(cfg.Stdout, "  refreshed: %s (%s ago)\n", info.Refreshed.Format(time.RFC3339), now.Sub(info.Refreshed).Round(time.Second))
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// breakLock removes the run lock file after asking for confirmation (unless
+// -yes is set), e.g. when its owner is known dead but the lock isn't stale
+// yet. Locks of processes alive on this host are never broken.
+func breakLock(cfg *app.Config) error {
+	info, held, err := cfg.Env.ReadLock(cfg.LockFile)
+	if err != nil {
+		return err
+	}
+	if !held {
+		fmt.Fprintf(cfg.Stdout, "lock %s: not held\n", cfg.LockFile)
+		return nil
+	}
+	if alive, known := info.OwnerAlive(); known && alive {
+		return fmt.Errorf("lock %s is held by the live process pid=%d; stop it instead", cfg.LockFile, info.PID)
+	}
+	fmt.Fprintf(promptOut, "lock %s held by %s\n", cfg.LockFile, lockOwner(info))
+	if !cfg.Yes {
+		ok, err := askYes(cfg, "break it?")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintf(cfg.Stdout, "lock %s: kept\n", cfg.LockFile)
+			return nil
+		}
+	}
+	if err := cfg.Env.BreakLock(cfg.LockFile, info); err != nil {
+		return err
+	}
+	cfg.Logger.Printf("lock %s broken: pid=%d host=%s agent=%s", cfg.LockFile, info.PID, info.Host, info.Agent)
+	fmt.Fprintf(cfg.Stdout, "lock %s: broken\n", cfg.LockFile)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// lockOwner describes the owner of a lock and whether it is alive.
+func lockOwner(info app.LockInfo) string {
+	owner := "unknown"
+	switch alive, known := info.OwnerAlive(); {
+	case known && alive:
+		owner = "alive"
+	case known:
+		owner = "dead"
+	}
+	return fmt.Sprintf("pid=%d host=%s agent=%s (%s)", info.PID, info.Host, info.Agent, owner)
+}
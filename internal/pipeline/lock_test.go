@@ -0,0 +1,112 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"local-file-sync/internal/app"
+)
+
+// TestLockStatusBreak verifies lock status reports the owner of the lock file
+// and lock break removes it once confirmed, but never for a live owner.
+func TestLockStatusBreak(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("process checks are not supported on windows")
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("hostname: %v", err)
+	}
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	dead := cmd.Process.Pid
+
+	var prompt strings.Builder
+	root := t.TempDir()
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	prevOut, prevTerm := promptOut, stdinIsTerminal
+	promptOut = &prompt
+	stdinIsTerminal = func(*os.File) bool { return true }
+	t.Cleanup(func() { promptOut, stdinIsTerminal = prevOut, prevTerm })
+	answer := func(s string) {
+		t.Helper()
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatalf("pipe: %v", err)
+		}
+		t.Cleanup(func() { r.Close() })
+		if _, err := w.WriteString(s); err != nil {
+			t.Fatalf("write answer: %v", err)
+		}
+		w.Close()
+		cfg.Stdin = r
+	}
+	writeLock := func(pid int) {
+		t.Helper()
+		content := fmt.Sprintf("pid=%d host=%s agent=a1 time=2024-05-01T12:00:00Z\n", pid, host)
+		if err := os.WriteFile(cfg.LockFile, []byte(content), 0o600); err != nil {
+			t.Fatalf("write lock: %v", err)
+		}
+	}
+
+	output := func(fn func(*app.Config) error) (string, error) {
+		t.Helper()
+		out, err := os.CreateTemp(t.TempDir(), "lock-*.txt")
+		if err != nil {
+			t.Fatalf("create out: %v", err)
+		}
+		defer out.Close()
+		cfg.Stdout = out
+		fnErr := fn(cfg)
+		b, err := os.ReadFile(out.Name())
+		if err != nil {
+			t.Fatalf("read out: %v", err)
+		}
+		return string(b), fnErr
+	}
+
+	if out, err := output(lockStatus); err != nil || !strings.Contains(out, ": not held") {
+		t.Fatalf("expected lock not held, got %q %v", out, err)
+	}
+
+	writeLock(os.Getpid())
+	out, err := output(lockStatus)
+	if err != nil {
+		t.Fatalf("lock status: %v", err)
+	}
+	for _, want := range []string{": held\n", fmt.Sprintf("owner: pid=%d host=%s agent=a1 (alive)", os.Getpid(), host), "acquired: 2024-05-01T12:00:00Z"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in status, got %q", want, out)
+		}
+	}
+	if _, err := output(breakLock); err == nil || !strings.Contains(err.Error(), "live process") {
+		t.Fatalf("expected live owner to be refused, got %v", err)
+	}
+
+	writeLock(dead)
+	answer("n\n")
+	if out, err := output(breakLock); err != nil || !strings.Contains(out, ": kept") {
+		t.Fatalf("expected lock kept when declined, got %q %v", out, err)
+	}
+	if !strings.Contains(prompt.String(), "(dead)") {
+		t.Fatalf("expected dead owner in prompt, got %q", prompt.String())
+	}
+	if _, err := os.Stat(cfg.LockFile); err != nil {
+		t.Fatalf("expected lock file kept: %v", err)
+	}
+
+	answer("y\n")
+	if out, err := output(breakLock); err != nil || !strings.Contains(out, ": broken") {
+		t.Fatalf("expected lock broken, got %q %v", out, err)
+	}
+	if _, err := os.Stat(cfg.LockFile); !os.IsNotExist(err) {
+		t.Fatalf("expected lock file removed, got %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/uploader"
+)
+
+// newGCSUploader creates the uploader of a GCS bucket with the client options
+// of cfg.
+func newGCSUploader(ctx context.Context, cfg *app.Config, bucket string) (*uploader.GCSUploader, error) {
+	u, err := uploader.NewGCS(ctx, bucket, cfg.FileConcurrency, uploader.ClientOptions{
+		API:            cfg.GCSAPI,
+		Proxy:          cfg.GCSProxy,
+		UserAgent:      cfg.GCSUserAgent,
+		BillingProject: cfg.GCSBillingProject,
+	})
+	if err != nil {
+		return nil, err
+	}
+	u.SimulateFailures(cfg.SimulateFailures)
+	u.LargeFileThreshold = cfg.LargeFileThreshold
+	return u, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// withMirrors returns primary, or with -mirror a uploader.Multi that uploads
+// to primary and every mirror. If a mirror can't be created, the uploaders
+// created so far (including primary) are closed.
+func withMirrors(ctx context.Context, cfg *app.Config, primary uploader.Uploader) (uploader.Uploader, error) {
+	if len(cfg.Mirrors) == 0 {
+		return primary, nil
+	}
+	primaryDest := primaryDestination(cfg)
+	multi := &uploader.Multi{Targets: []uploader.Target{{Name: primaryDest.String(), Uploader: primary}}}
+	for _, d := range cfg.Mirrors {
+		var (
+			u   uploader.Uploader
+			err error
+		)
+		switch d.Scheme {
+		case app.SchemeFile:
+			u, err = uploader.NewDir(ctx, d.Dir, cfg.FileConcurrency)
+		default:
+			u, err = newGCSUploader(ctx, cfg, d.Bucket)
+		}
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("mirror %s: %w", d, err), multi.Close())
+		}
+		multi.Targets = append(multi.Targets, uploader.Target{Name: d.String(), Uploader: u, Prefix: d.Prefix})
+	}
+	cfg.Logger.Printf("mirrors: %d destination(s) besides %s", len(cfg.Mirrors), primaryDest)
+	return multi, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// primaryDestination returns the -gcs-bucket destination of cfg.
+func primaryDestination(cfg *app.Config) app.Destination {
+	return app.Destination{Scheme: app.SchemeGCS, Bucket: cfg.GCSBucket, Prefix: cfg.DestPrefix}
+}
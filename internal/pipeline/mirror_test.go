@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/uploader"
+)
+
+// TestRun_Mirror verifies folders are uploaded to the mirrors too, and that a
+// folder the mirror didn't receive fails and is retried by the next run.
+func TestRun_Mirror(t *testing.T) {
+	g, f := useFakes(t)
+	newUploader = func(ctx context.Context, cfg *app.Config) (uploader.Uploader, error) {
+		return withMirrors(ctx, cfg, g)
+	}
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	makeTrigger(t, root, "ORDER2", "b")
+	mirror := t.TempDir()
+	// NOTE(joel): A file in place of the folder fails ORDER2 on the mirror.
+	if err := os.MkdirAll(filepath.Join(mirror, "in"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(mirror, "in", "ORDER2"), nil, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreProjectId = "project"
+	cfg.FirestoreCollection = "uploads"
+	cfg.Mirrors = []app.Destination{{Scheme: app.SchemeFile, Dir: mirror, Prefix: "in"}}
+
+	if err := run(cfg); !errors.Is(err, ErrFoldersFailed) {
+		t.Fatalf("expected failed folders, got %v", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(mirror, "in", "ORDER1", "data.txt")); err != nil || string(b) != "a" {
+		t.Fatalf("expected ORDER1 mirrored, got %q err=%v", b, err)
+	}
+	_, ok1 := f.Record("uploads", "ORDER1")
+	_, ok2 := f.Record("uploads", "ORDER2")
+	if !ok1 || ok2 {
+		t.Fatalf("expected only ORDER1 recorded, got %v", f.Records("uploads"))
+	}
+	if !g.Closed() {
+		t.Fatalf("expected primary closed")
+	}
+
+	if err := os.Remove(filepath.Join(mirror, "in", "ORDER2")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := run(cfg); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(mirror, "in", "ORDER2", "data.txt")); err != nil || string(b) != "b" {
+		t.Fatalf("expected ORDER2 mirrored by the retry, got %q err=%v", b, err)
+	}
+	if _, ok := f.Record("uploads", "ORDER2"); !ok {
+		t.Fatalf("expected ORDER2 recorded by the retry")
+	}
+}
@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/uploader"
+)
+
+// Record drift kinds reported by the records verify command.
+const (
+	// recordDeleted marks indexed records whose document no longer exists.
+	recordDeleted = "deleted"
+	// recordChanged marks indexed records whose document holds other content
+	// than written, e.g. overwritten by another agent or edited by hand.
+	recordChanged = "changed"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// listRecords prints the folder records of the local record index, one tab
+// separated line (collection, document ID, folder path, file count, write
+// time) per record, without contacting Firestore.
+func listRecords(cfg *app.Config) error {
+	index, err := uploader.OpenRecordIndex(cfg.RecordIndex)
+	if err != nil {
+		return err
+	}
+	entries := index.Entries()
+	if len(entries) == 0 {
+		fmt.Fprintf(cfg.Stdout, "no records in %s\n", cfg.RecordIndex)
+		return nil
+	}
+	for _, e := range entries {
+		fmt.Fprintf(cfg.Stdout, "%s\t%s\t%s\t%d\t%s\n", e.Collection, e.ID, e.FolderPath, e.Files, e.WrittenAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// verifyRecords reads the documents of all indexed records back from
+// Firestore and prints one tab separated line (kind, collection, document ID,
+// folder path) per record that was deleted or changed server-side. Records
+// that can't be read are reported as error after checking the others.
+func verifyRecords(cfg *app.Config) error {
+	index, err := uploader.OpenRecordIndex(cfg.RecordIndex)
+	if err != nil {
+		return err
+	}
+	fs, err := newRecordWriter(context.Background(), cfg)
+	if err != nil {
+		return fmt.Errorf("firestore init: %w", err)
+	}
+	defer fs.Close()
+	reader, ok := fs.(uploader.RecordReader)
+	if !ok {
+		return fmt.Errorf("record writer can't read records")
+	}
+
+	entries := index.Entries()
+	counts := make(map[string]int)
+	var errs []error
+	for _, e := range entries {
+		rec, found, err := reader.ReadFolderRecord(e.Collection, e.ID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s/%s: %w", e.Collection, e.ID, err))
+			continue
+		}
+		kind := ""
+		switch {
+		case !found:
+			kind = recordDeleted
+		case uploader.RecordChecksum(rec) != e.Checksum:
+			kind = recordChanged
+		default:
+			continue
+		}
+		counts[kind]++
+		fmt.Fprintf(cfg.Stdout, "%s\t%s\t%s\t%s\n", kind, e.Collection, e.ID, e.FolderPath)
+	}
+	cfg.Logger.Printf(
+		"records verify: records=%d deleted=%d changed=%d unreadable=%d",
+		len(entries), counts[recordDeleted], counts[recordChanged], len(errs),
+	)
+	if len(errs) > 0 {
+		return fmt.Errorf("read records: %w", errors.Join(errs...))
+	}
+	return nil
+}
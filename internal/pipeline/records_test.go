@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/uploader"
+)
+
+// TestRecords verifies written records are indexed locally, listed without
+// Firestore and verified against it.
+func TestRecords(t *testing.T) {
+	_, f := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "A", "a")
+	makeTrigger(t, root, "B", "b")
+	makeTrigger(t, root, "C", "c")
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreCollection = "uploads"
+	cfg.RecordIndex = filepath.Join(t.TempDir(), "records.jsonl")
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	capture := func(cmd func(*app.Config) error) string {
+		t.Helper()
+		out, err := os.CreateTemp(t.TempDir(), "records-*.txt")
+		if err != nil {
+			t.Fatalf("create out: %v", err)
+		}
+		defer out.Close()
+		cfg.Stdout = out
+		if err := cmd(cfg); err != nil {
+			t.Fatalf("records: %v", err)
+		}
+		b, err := os.ReadFile(out.Name())
+		if err != nil {
+			t.Fatalf("read out: %v", err)
+		}
+		return string(b)
+	}
+
+	listing := capture(listRecords)
+	lines := strings.Split(strings.TrimSpace(listing), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "uploads\t"+uploader.DocumentID("A")+"\tA\t1\t") {
+		t.Fatalf("unexpected listing %q", listing)
+	}
+
+	f.DeleteDocument("uploads", uploader.DocumentID("A"))
+	rec, _ := f.Record("uploads", "B")
+	rec.Files = nil
+	if err := f.WriteFolderRecord("uploads", rec); err != nil {
+		t.Fatalf("WriteFolderRecord: %v", err)
+	}
+	got := capture(verifyRecords)
+	want := "deleted\tuploads\t" + uploader.DocumentID("A") + "\tA\n" +
+		"changed\tuploads\t" + uploader.DocumentID("B") + "\tB\n"
+	if got != want {
+		t.Fatalf("unexpected drift %q, want %q", got, want)
+	}
+}
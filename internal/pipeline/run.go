@@ -0,0 +1,952 @@
+// Package pipeline runs local-file-sync: it scans a directory for triggers,
+// filters them with the state file, uploads the folders, writes their
+// records and saves the state. The command line tool and embedders (e.g. a
+// supervisor running syncs in a long-lived server, see Run) share it.
+package pipeline
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/notify"
+	"local-file-sync/internal/report"
+	"local-file-sync/internal/scanner"
+	"local-file-sync/internal/state"
+	"local-file-sync/internal/uploader"
+
+	"github.com/google/uuid"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ErrFoldersFailed is wrapped by the error a run returns if at least one
+// folder failed to upload. The failed folders were reported individually.
+var ErrFoldersFailed = errors.New("folder upload(s) failed")
+
+// errRecordWriterUnavailable is the record write error of folders uploaded
+// while Firestore could not be initialized.
+var errRecordWriterUnavailable = errors.New("firestore unavailable")
+
+// errClaimUnavailable fails the folders of -claim-collection runs while
+// Firestore could not be initialized, so agents don't upload folders they
+// couldn't claim.
+var errClaimUnavailable = errors.New("claim unavailable: firestore not initialized")
+
+// errManifestUnsupported fails the folders of -folder-manifest runs whose
+// uploader can't write manifests (see uploader.ManifestWriter).
+var errManifestUnsupported = errors.New("write manifest: not supported by the uploader")
+
+// Execute runs cfg.Command (a run if empty) as the command line tool does and
+// closes cfg.Events and cfg.Warnings afterwards. Errors other than failed folders are sent to
+// cfg.Reporter.
+func Execute(cfg *app.Config) error {
+	var err error
+	switch cfg.Command {
+	case app.CommandHistory:
+		err = printHistory(cfg)
+	case app.CommandSchema:
+		_, err = cfg.Stdout.Write(scanner.Schema)
+	case app.CommandStateAudit:
+		err = auditState(cfg)
+	case app.CommandBackfill:
+		err = backfill(cfg)
+	case app.CommandRecords:
+		err = listRecords(cfg)
+	case app.CommandRecordsVerify:
+		err = verifyRecords(cfg)
+	case app.CommandExport:
+		err = exportHistory(cfg)
+	case app.CommandLockStatus:
+		err = lockStatus(cfg)
+	case app.CommandLockBreak:
+		err = breakLock(cfg)
+	default:
+		err = run(cfg)
+	}
+	if cerr := cfg.Events.Close(); cerr != nil {
+		cfg.Warnf("events warning: %v", cerr)
+	}
+	cfg.Warnings.Flush()
+	if cerr := cfg.Warnings.Close(); cerr != nil {
+		cfg.Logger.Printf("warnings file warning: %v", cerr)
+	}
+	// NOTE(joel): Failed folders were reported individually already.
+	if err != nil && !errors.Is(err, ErrFoldersFailed) {
+		reportError(cfg, report.LevelFatal, err.Error(), nil)
+	}
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NOTE(joel): Client factories are variables so tests can inject in-memory
+// implementations from the fakes package; embedders pass clients to Run.
+var (
+	newUploader = func(ctx context.Context, cfg *app.Config) (uploader.Uploader, error) {
+		u, err := newGCSUploader(ctx, cfg, cfg.GCSBucket)
+		if err != nil {
+			return nil, err
+		}
+		return withMirrors(ctx, cfg, u)
+	}
+	newRecordWriter = func(ctx context.Context, cfg *app.Config) (uploader.RecordWriter, error) {
+		f, err := uploader.NewFirestore(ctx, cfg.FirestoreProjectId)
+		if err != nil {
+			return nil, err
+		}
+		f.SimulateFailures(cfg.SimulateFailures)
+		f.Retry = uploader.Backoff{Retries: cfg.FirestoreRetries, Initial: cfg.FirestoreBackoff}
+		return f, nil
+	}
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// lockHeartbeatInterval is how often a held run lock is refreshed; tests
+// shorten it.
+var lockHeartbeatInterval = app.LockHeartbeatInterval
+
+// acquireRunLock acquires the lock preventing overlapping runs on the same
+// root: the local lock file or, with -lock-collection, a Firestore lease that
+// also coordinates agents on other hosts. A held lock is refreshed in the
+// background; otherwise uploads taking longer than the stale TTL would let the
+// next invocation take it over. If the lease is taken over anyway (e.g. after
+// renewals failed for longer than app.LockTTL), cancel is called so the run
+// starts no further folders. The returned release stops refreshing and
+// releases the lock; it is a no-op if the lock wasn't acquired.
+func acquireRunLock(ctx context.Context, cfg *app.Config, cl clients, cancel context.CancelCauseFunc) (func(), bool, error) {
+	if cfg.LockCollection == "" {
+		// NOTE(joel): A lock left behind by a crashed run on this host is
+		// removed right away instead of after app.LockTTL.
+		if pid, err := cfg.Env.RemoveOrphanedLock(cfg.LockFile); err != nil {
+			cfg.Warnf("lock warning: %v", err)
+		} else if pid != 0 {
+			cfg.Logger.Printf("removed orphaned lock %s of dead process pid=%d", cfg.LockFile, pid)
+		}
+		release, acquired, err := cfg.Env.AcquireLock(cfg.LockFile, cfg.AgentID)
+		if err != nil || !acquired {
+			if err == nil {
+				cfg.Logger.Printf("another local-file-sync process holds lock %s; skip execution", cfg.LockFile)
+			}
+			return release, false, err
+		}
+		stop := cfg.Env.HeartbeatLock(cfg.LockFile, cfg.AgentID, lockHeartbeatInterval, cfg.Logger)
+		return func() { stop(); release() }, true, nil
+	}
+
+	fs, err := cl.recordWriter(ctx, cfg)
+	if err != nil {
+		return func() {}, false, fmt.Errorf("firestore init: %w", err)
+	}
+	now := cfg.Env.Now()
+	lease := uploader.Lease{
+		Key:        cfg.LockKey,
+		Agent:      cfg.AgentID,
+		RunID:      cfg.RunID,
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(app.LockTTL),
+	}
+	holder, acquired, err := fs.AcquireLease(cfg.LockCollection, lease)
+	if err != nil || !acquired {
+		fs.Close()
+		if err == nil {
+			cfg.Logger.Printf("another local-file-sync agent holds lease %s (agent=%s run=%s); skip execution", cfg.LockKey, holder.Agent, holder.RunID)
+		}
+		return func() {}, false, err
+	}
+	lost := false
+	stop := app.Heartbeat(lockHeartbeatInterval, cfg.Logger, func() error {
+		if lost {
+			return nil
+		}
+		lease.ExpiresAt = cfg.Env.Now().Add(app.LockTTL)
+		err := fs.RenewLease(cfg.LockCollection, lease)
+		if errors.Is(err, uploader.ErrLeaseLost) {
+			// NOTE(joel): Another agent holds the lease now; folders it may be
+			// processing must not be started here as well.
+			lost = true
+			cancel(err)
+			return fmt.Errorf("%w: no further folders are started", err)
+		}
+		return err
+	})
+	return func() {
+		// NOTE(joel): stop waits for a running renewal, so lease isn't
+		// modified concurrently below.
+		stop()
+		if err := fs.ReleaseLease(cfg.LockCollection, lease); err != nil {
+			cfg.Warnf("release lease warning: %v", err)
+		}
+		fs.Close()
+	}, true, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// clients creates the cloud clients of a run.
+type clients struct {
+	uploader     func(context.Context, *app.Config) (uploader.Uploader, error)
+	recordWriter func(context.Context, *app.Config) (uploader.RecordWriter, error)
+}
+
+// defaultClients returns the clients configured by newUploader and
+// newRecordWriter.
+func defaultClients() clients {
+	return clients{uploader: newUploader, recordWriter: newRecordWriter}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// run executes the main logic based on the provided configuration, in waves
+// with -wave-size or -wave-budget (see runWaves).
+func run(cfg *app.Config) error {
+	if cfg.WaveSize > 0 || cfg.WaveBudget > 0 {
+		return runWaves(context.Background(), cfg, defaultClients())
+	}
+	return runChunk(context.Background(), cfg, nil, defaultClients(), &Report{})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// runChunk executes a run and describes its outcome in rep. With a backfill
+// chunk, its targets are processed instead of scanning and its checkpoint is
+// saved along with the state. Cancelling ctx stops starting further folder
+// uploads. The stages of the run are methods of runner.
+func runChunk(ctx context.Context, cfg *app.Config, chunk *backfillChunk, cl clients, rep *Report) error {
+	// NOTE(joel): ParseFlags generates the run ID; embedders (and tests) may
+	// leave it empty.
+	if cfg.RunID == "" {
+		cfg.RunID = uuid.NewString()
+	}
+	// NOTE(joel): Warnings are limited per run; the suppressed ones are
+	// counted at its end.
+	defer cfg.Warnings.Flush()
+
+	// NOTE(joel): Acquire a process-level lock to avoid two concurrent
+	// local-file-sync processes handling the same *.RDY files simultaneously.
+	// A -scan-only run writes nothing, so it neither needs nor creates one.
+	if cfg.ScanOnly {
+		cfg.Logger.Printf("-scan-only set: no lock, state, uploads or notifications are written")
+	} else {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		release, acquired, err := acquireRunLock(ctx, cfg, cl, cancel)
+		if err != nil {
+			return fmt.Errorf("acquire lock: %w", err)
+		}
+		// NOTE(joel): release is a no-op if not acquired
+		defer release()
+
+		if !acquired {
+			rep.LockHeld = true
+			return nil
+		}
+	}
+
+	r := newRunner(cfg, chunk, rep)
+	r.loadState()
+	if err := r.scan(); err != nil {
+		return err
+	}
+	r.filter()
+
+	// NOTE(joel): If configured, upload each emitted folder (only those actually
+	// emitted this run) to GCS instead of emitting JSON lines to stdout. Runs
+	// ending without uploading (see openClients) aren't recorded in state.
+	if r.uploading() {
+		uc, ok, err := r.openClients(ctx, cl)
+		if err != nil || !ok {
+			return err
+		}
+		defer uc.close()
+		r.record(r.upload(ctx, uc), uc)
+	} else if err := r.emitMatches(); err != nil {
+		return err
+	}
+	return r.saveState()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// folderDeadlineGrace is how long a folder upload may run past its deadline
+// before it is abandoned (see uploadFolder).
+var folderDeadlineGrace = 30 * time.Second
+
+// uploadFolder uploads m with u. With a deadline, the uploader stops the
+// folder's uploads once it passed; a folder still not done after
+// folderDeadlineGrace, e.g. blocked reading from a broken mount, is abandoned
+// and fails with uploader.ErrFolderDeadline so it can't hold up the run.
+//
+// NOTE(joel): Blocked reads can't be interrupted; the abandoned upload
+// finishes, if ever, in the background and its result is discarded. The
+// deadline guards against real hangs, so it's timed on real time, not
+// Config.Env.
+func uploadFolder(u uploader.Uploader, m scanner.Match, opts uploader.UploadOptions) uploader.FolderResult {
+	if opts.Deadline <= 0 {
+		return u.UploadFolder(m, opts)
+	}
+	start := time.Now()
+	done := make(chan uploader.FolderResult, 1)
+	go func() { done <- u.UploadFolder(m, opts) }()
+	timer := time.NewTimer(opts.Deadline + folderDeadlineGrace)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res
+	case <-timer.C:
+		return uploader.FolderResult{
+			ReadyFile: m.ReadyFile,
+			Folder:    m.Folder,
+			Errors:    []error{fmt.Errorf("%w (%s): upload abandoned", uploader.ErrFolderDeadline, opts.Deadline)},
+			Duration:  time.Since(start),
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// scanOptions returns the scanner options configured by cfg. With
+// -partition, only the triggers of this process's partition are listed, with
+// -only those matching its pattern.
+func scanOptions(cfg *app.Config) scanner.Options {
+	opts := scanner.Options{
+		Recursive:        cfg.Recursive,
+		FollowSymlinks:   cfg.FollowSymlinks,
+		NormalizeUnicode: cfg.NormalizeUnicode,
+		IncludeHidden:    cfg.IncludeHidden,
+		Triggers:         cfg.Triggers,
+		PageSize:         cfg.EntryPageSize,
+		ReadyPreview:     cfg.ReadyPreview,
+		ReadySymlinks:    cfg.ReadySymlinks,
+		OpTimeout:        cfg.ScanTimeout,
+		OpRetries:        cfg.ScanRetries,
+		Root:             cfg.RootDir,
+	}
+	if cfg.Partition.Enabled() || cfg.Only.Enabled() {
+		opts.Select = func(readyFile string) bool {
+			return cfg.Partition.Owns(cfg.RootDir, readyFile) && cfg.Only.Match(readyFile)
+		}
+	}
+	// NOTE(joel): The age trigger measures quiet periods on the run's clock.
+	opts.Triggers = slices.Clone(cfg.Triggers)
+	for i, t := range opts.Triggers {
+		if age, ok := t.(scanner.Age); ok && age.Now == nil {
+			age.Now = cfg.Env.Now
+			opts.Triggers[i] = age
+		}
+	}
+	return opts
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// reportError sends an event to the configured error reporter (if any),
+// tagged with the agent ID. Delivery failures are logged as warnings.
+func reportError(cfg *app.Config, level, message string, tags map[string]string) {
+	if cfg.Reporter == nil {
+		return
+	}
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	tags["agent"] = cfg.AgentID
+	if cfg.RunID != "" {
+		tags["run"] = cfg.RunID
+	}
+	if err := cfg.Reporter.Capture(level, message, tags); err != nil {
+		cfg.Warnf("error report warning: %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// maxDigestItems caps the number of folders/triggers listed in a digest.
+const maxDigestItems = 20
+
+// maybeNotify sends a digest to the configured notifier if the run had failed
+// folders, at least -notify-orphans orphaned triggers or triggers overdue per
+// -rdy-age-sla. Digests are rate limited to one per -notify-interval using the
+// time stored in state.
+func maybeNotify(cfg *app.Config, st *state.Store, failures, orphans, overdue []string) {
+	if cfg.Notifier == nil {
+		return
+	}
+	orphaned := cfg.NotifyOrphans > 0 && len(orphans) >= cfg.NotifyOrphans
+	if len(failures) == 0 && !orphaned && len(overdue) == 0 {
+		return
+	}
+	now := cfg.Env.Now()
+	if st != nil && !notify.Due(st.LastNotified, now, cfg.NotifyInterval) {
+		cfg.Logger.Printf("notify: digest suppressed; last sent at %s", st.LastNotified.Format(time.RFC3339))
+		return
+	}
+
+	subject := fmt.Sprintf(
+		"local-file-sync on %s: %d failed folder(s), %d orphaned trigger(s)",
+		cfg.AgentID, len(failures), len(orphans),
+	)
+	if len(overdue) > 0 {
+		subject += fmt.Sprintf(", %d overdue trigger(s)", len(overdue))
+	}
+	var body strings.Builder
+	writeDigestList(&body, "Failed folders:", failures)
+	if orphaned {
+		writeDigestList(&body, "Orphaned triggers (no matching folder):", orphans)
+	}
+	writeDigestList(&body, fmt.Sprintf("Overdue triggers (unprocessed for longer than %s):", cfg.AgeSLA), overdue)
+	if err := cfg.Notifier.Notify(subject, strings.TrimSpace(body.String())); err != nil {
+		cfg.Warnf("notify warning: %v", err)
+		return
+	}
+	if st != nil {
+		st.SetLastNotified(now)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// writeDigestList writes a titled bullet list of at most maxDigestItems items.
+// Empty lists are omitted.
+func writeDigestList(b *strings.Builder, title string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	b.WriteString(title + "\n")
+	for i, item := range items {
+		if i == maxDigestItems {
+			fmt.Fprintf(b, "- ... and %d more\n", len(items)-i)
+			break
+		}
+		fmt.Fprintf(b, "- %s\n", item)
+	}
+	b.WriteString("\n")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// printHistory prints the run summaries recorded in the state file, oldest
+// first, to stdout.
+func printHistory(cfg *app.Config) error {
+	st := state.New(cfg.StateFile)
+	st.FS = cfg.Env.FS
+	if err := st.Load(); err != nil {
+		return fmt.Errorf("load state: %w", err)
+	}
+	if len(st.History) == 0 {
+		fmt.Fprintf(cfg.Stdout, "no runs recorded in %s\n", cfg.StateFile)
+		return nil
+	}
+	for _, r := range st.History {
+		fmt.Fprintf(
+			cfg.Stdout, "%s duration=%s scanned=%d emitted=%d skipped=%d failed=%d\n",
+			r.Start.Format(time.RFC3339), r.Duration.Round(time.Millisecond),
+			r.Scanned, r.Emitted, r.Skipped, r.Failed,
+		)
+		if r.RunID != "" {
+			fmt.Fprintf(cfg.Stdout, "  run: %s\n", r.RunID)
+		}
+		if l := r.Latency; l != nil {
+			fmt.Fprintf(cfg.Stdout, "  upload latency: folders=%d %s\n", l.Count, formatAges(l))
+		}
+		if b := r.Backlog; b != nil {
+			fmt.Fprintf(cfg.Stdout, "  backlog: triggers=%d %s\n", b.Count, formatAges(b))
+		}
+		if tp := r.Throughput; tp != nil {
+			fmt.Fprintf(cfg.Stdout, "  throughput: bytes=%d rate=%.2fMB/s", tp.Bytes, tp.MBps)
+			if tp.Retries > 0 || tp.DeadLetters > 0 {
+				fmt.Fprintf(cfg.Stdout, " retries=%d dead_letters=%d", tp.Retries, tp.DeadLetters)
+			}
+			if tp.FolderConcurrency > 0 {
+				fmt.Fprintf(cfg.Stdout, " folder_concurrency=%d file_concurrency=%d", tp.FolderConcurrency, tp.FileConcurrency)
+			}
+			fmt.Fprintln(cfg.Stdout)
+			for _, d := range tp.Destinations {
+				fmt.Fprintf(
+					cfg.Stdout, "  destination: %s folders=%d failed=%d files=%d bytes=%d retries=%d rate=%.2fMB/s\n",
+					d.Name, d.Folders, d.Failed, d.Files, d.Bytes, d.Retries, d.MBps,
+				)
+			}
+			for _, f := range tp.SlowestFolders {
+				fmt.Fprintf(cfg.Stdout, "  slowest folder: %s bytes=%d duration=%s\n", f.Path, f.Bytes, f.Duration.Round(time.Millisecond))
+			}
+			for _, f := range tp.SlowestFiles {
+				fmt.Fprintf(cfg.Stdout, "  slowest file: %s bytes=%d duration=%s\n", f.Path, f.Bytes, f.Duration.Round(time.Millisecond))
+			}
+		}
+		for _, e := range r.Errors {
+			fmt.Fprintf(cfg.Stdout, "  error: %s\n", e)
+		}
+		for _, w := range r.Warnings {
+			fmt.Fprintf(cfg.Stdout, "  warning: %s\n", w)
+		}
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// recordFailed handles a folder record that couldn't be written according to
+// the -state-policy. With the metadata policy the folder fails, so it isn't
+// marked processed and is retried (including its upload) on the next run.
+// With the upload policy the files are uploaded, so the record is queued for
+// the next run instead; if queueing fails too, the record is lost and only
+// reported, since the folder is still marked processed.
+func recordFailed(cfg *app.Config, pending *uploader.Pending, coll string, rec uploader.FolderRecord, res *uploader.FolderResult, err error) {
+	if cfg.StatePolicy == app.StatePolicyMetadata {
+		res.Errors = append(res.Errors, fmt.Errorf("firestore write: %w", err))
+		return
+	}
+	if pending != nil {
+		qerr := pending.Add(coll, rec)
+		if qerr == nil {
+			res.RecordQueued = true
+			cfg.Warnf("firestore write warning: folder=%s queued for next run: %v", rec.FolderPath, err)
+			return
+		}
+		err = errors.Join(err, qerr)
+	}
+	cfg.Warnf("firestore write warning: folder=%s record not written: %v", rec.FolderPath, err)
+	reportError(cfg, report.LevelError, "firestore write failed: "+err.Error(), map[string]string{
+		"folder": res.Folder,
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// maxSlowest is the number of slowest folders and files kept in the run
+// statistics.
+const maxSlowest = 5
+
+// describeConcurrency formats the effective value of a -folder-concurrency or
+// -file-concurrency setting, marking automatic values.
+func describeConcurrency(concurrency int) string {
+	n := app.EffectiveConcurrency(concurrency)
+	if concurrency <= 0 {
+		return fmt.Sprintf("%d (auto)", n)
+	}
+	return strconv.Itoa(n)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// throughput aggregates the upload statistics of a run from the folder results
+// and the wall time of the upload phase. Claimed and failed folders are left
+// out since they uploaded nothing (or not everything), as are hard links and
+// existing objects. Retries and dead letters are counted for all folders;
+// primary names the destination of results without a per-destination
+// breakdown (see destinationStats).
+func throughput(results []uploader.FolderResult, primary string, elapsed time.Duration) *state.Throughput {
+	tp := &state.Throughput{Destinations: destinationStats(results, primary, elapsed)}
+	for _, res := range results {
+		tp.Retries += res.Retries
+		if res.RecordQueued {
+			tp.DeadLetters++
+		}
+		if res.Failed() || res.ClaimedBy != "" {
+			continue
+		}
+		tp.Bytes += res.Bytes()
+		tp.SlowestFolders = append(tp.SlowestFolders, state.Timing{
+			Path:     res.Folder,
+			Bytes:    res.Bytes(),
+			Duration: res.Duration,
+		})
+		for _, f := range res.Uploaded {
+			if f.Verified {
+				tp.Verified++
+			}
+			if f.LinkOf != "" || f.Existing {
+				continue
+			}
+			tp.SlowestFiles = append(tp.SlowestFiles, state.Timing{
+				Path:     f.Path,
+				Bytes:    f.Size,
+				Duration: f.Duration,
+			})
+		}
+	}
+	tp.MBps = mbps(tp.Bytes, elapsed)
+	tp.SlowestFolders = slowest(tp.SlowestFolders, maxSlowest)
+	tp.SlowestFiles = slowest(tp.SlowestFiles, maxSlowest)
+	return tp
+}
+
+// slowest returns the n longest timings, longest first.
+func slowest(timings []state.Timing, n int) []state.Timing {
+	slices.SortStableFunc(timings, func(a, b state.Timing) int {
+		return cmp.Compare(b.Duration, a.Duration)
+	})
+	return timings[:min(n, len(timings))]
+}
+
+// mbps returns the rate of bytes transferred in d in MB/s (10^6 bytes per
+// second), or 0 if d is not positive.
+func mbps(bytes int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes) / 1e6 / d.Seconds()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// truncateEntries returns matches with at most limit folder entries each for
+// JSON output (limit < 0 means unlimited). Truncated matches are flagged and
+// record the full entry count; matches is left unchanged.
+func truncateEntries(matches []scanner.Match, limit int) []scanner.Match {
+	if limit < 0 {
+		return matches
+	}
+	out := slices.Clone(matches)
+	for i, m := range out {
+		if len(m.FolderEntries) <= limit {
+			continue
+		}
+		out[i].EntriesTruncated = true
+		out[i].EntryCount = len(m.FolderEntries)
+		out[i].FolderEntries = m.FolderEntries[:limit]
+	}
+	return out
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// selectFields returns matches for JSON output limited to the given JSON
+// fields (-fields). Without fields matches are returned as is. Fields a match
+// omits (e.g. empty optional ones) stay omitted.
+func selectFields(matches []scanner.Match, fields []string) (any, error) {
+	if len(fields) == 0 {
+		return matches, nil
+	}
+	out := make([]map[string]json.RawMessage, 0, len(matches))
+	for _, m := range matches {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		var all map[string]json.RawMessage
+		if err := json.Unmarshal(b, &all); err != nil {
+			return nil, err
+		}
+		sel := make(map[string]json.RawMessage, len(fields))
+		for _, f := range fields {
+			if v, ok := all[f]; ok {
+				sel[f] = v
+			}
+		}
+		out = append(out, sel)
+	}
+	return out, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// folderSize returns the total size of the uploadable entries of a match.
+// Without symlink following that's close enough to the size the scan
+// aggregated already (Match.TotalSize), so the folder isn't read again.
+func folderSize(m scanner.Match, followSymlinks bool) int64 {
+	if !followSymlinks {
+		return m.TotalSize
+	}
+	var n int64
+	for fe, err := range m.Entries() {
+		if err != nil {
+			break
+		}
+		if fi, ok := uploader.Uploadable(fe, followSymlinks); ok {
+			n += fi.Size()
+		}
+	}
+	return n
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// objectMetadata returns the custom metadata attached to every uploaded
+// object of the match: its labels, match ID, agent and run ID.
+func objectMetadata(cfg *app.Config, m scanner.Match) map[string]string {
+	md := map[string]string{}
+	maps.Copy(md, folderLabels(cfg, m.Folder))
+	if m.ID != "" {
+		md["matchId"] = m.ID
+	}
+	if cfg.AgentID != "" {
+		md["agent"] = cfg.AgentID
+	}
+	if cfg.RunID != "" {
+		md["run"] = cfg.RunID
+	}
+	return md
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// folderLabels derives the labels of a folder from its slash separated path
+// relative to the root directory (see -path-labels).
+func folderLabels(cfg *app.Config, folder string) map[string]string {
+	rel, err := filepath.Rel(cfg.RootDir, folder)
+	if err != nil {
+		rel = folder
+	}
+	return cfg.PathLabels.Derive(filepath.ToSlash(rel))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// recordFolderPath derives the folder path stored in Firestore. It is relative
+// to the configured root directory so documents don't store machine-specific
+// absolute paths, uses the normalized folder name and carries the upload
+// prefix (e.g. for quarantined folders).
+func recordFolderPath(root, folder string, opts uploader.UploadOptions) string {
+	relFolder := folder
+	// NOTE(joel): Folders outside root (e.g. read with -stdin) keep their
+	// absolute path.
+	if rel, err := filepath.Rel(root, folder); err == nil && rel != "." && rel != "" && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		relFolder = rel
+	}
+	// NOTE(joel): Only the folder's own name is replaced; a namespaced
+	// FolderName (see nameCollisions) carries directories already in relFolder.
+	if opts.FolderName != "" {
+		relFolder = filepath.Join(filepath.Dir(relFolder), path.Base(opts.FolderName))
+	}
+	if opts.Prefix != "" {
+		relFolder = filepath.Join(opts.Prefix, relFolder)
+	}
+	if opts.NormalizeUnicode {
+		relFolder = norm.NFC.String(relFolder)
+	}
+	return relFolder
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// documentID derives the Firestore document ID of the record and claim of m
+// per -doc-id. An empty ID leaves the default, the hashed record folder path.
+func documentID(cfg *app.Config, m scanner.Match, relFolder string) (string, error) {
+	var id string
+	switch cfg.DocIDStrategy {
+	case app.DocIDPath:
+		id = uploader.PathDocumentID(relFolder)
+	case app.DocIDReady:
+		name := filepath.Base(m.ReadyFile)
+		id = strings.TrimSuffix(name, filepath.Ext(name))
+	case app.DocIDProducer:
+		var ok bool
+		if id, ok = scanner.ReadyID(m); !ok {
+			return "", fmt.Errorf("document ID: trigger %s announces no id", m.ReadyFile)
+		}
+	default:
+		return "", nil
+	}
+	if err := uploader.ValidateDocumentID(id); err != nil {
+		return "", fmt.Errorf("document ID: %w", err)
+	}
+	return id, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// deliveries returns the object prefixes of the earlier deliveries of the
+// folder of m: the recorded versions or, for folders processed before
+// versioned re-uploads were enabled, its unversioned prefix. It returns nil
+// for folders not delivered before.
+func deliveries(st *state.Store, m scanner.Match, opts uploader.UploadOptions) []string {
+	if prev := st.Versions(m.Folder); len(prev) > 0 {
+		return prev
+	}
+	if _, ok := st.Get(m.ReadyFile); ok {
+		opts.Version = ""
+		return []string{destPath(m, opts)}
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// nextVersion returns the version a folder with the given earlier deliveries
+// is uploaded below. Timestamps are taken from the trigger and files rather
+// than the clock, so a retried upload keeps its version.
+func nextVersion(policy string, prev []string, m scanner.Match) string {
+	counter := fmt.Sprintf("v%d", len(prev)+1)
+	if policy != app.ReuploadTimestamp {
+		return counter
+	}
+	t := m.ReadyModTime
+	if m.NewestModTime.After(t) {
+		t = m.NewestModTime
+	}
+	version := t.UTC().Format("20060102T150405Z")
+	// NOTE(joel): A folder re-emitted without newer files (e.g. a deleted
+	// file with -track-changes) must not overwrite the last delivery.
+	for _, p := range prev {
+		if path.Base(p) == version {
+			return version + "-" + counter
+		}
+	}
+	return version
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// versionChain returns the object prefixes of all deliveries of the folder of
+// m including the one to opts, oldest first, or nil without
+// -reupload-versions.
+func versionChain(cfg *app.Config, st *state.Store, m scanner.Match, opts uploader.UploadOptions) []string {
+	if cfg.ReuploadVersions == app.ReuploadOverwrite || st == nil {
+		return nil
+	}
+	return append(deliveries(st, m, opts), destPath(m, opts))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// markProcessed records the current modTime of a *.RDY file in state. If the
+// file is missing by now, a sentinel value is stored so the already handled
+// trigger is not re-emitted on the next run. No-op if state is disabled.
+func markProcessed(cfg *app.Config, st *state.Store, readyFile string) {
+	if st == nil {
+		return
+	}
+	if fi, err := cfg.Env.Files().Stat(readyFile); err == nil {
+		st.Set(readyFile, fi.ModTime().UnixNano())
+	} else {
+		st.Set(readyFile, 1)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// recordFingerprint records the content fingerprint computed for a processed
+// folder with -track-changes. No-op if state is disabled or the folder has no
+// fingerprint.
+func recordFingerprint(st *state.Store, folder string, fingerprints map[string]string) {
+	if fp, ok := fingerprints[folder]; ok && st != nil {
+		st.SetFingerprint(folder, fp)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// batchRecord builds the per-run batch record from the folder results. ok is
+// false if no folder was uploaded, in which case no record is written. Folders
+// claimed by other agents are left out.
+func batchRecord(cfg *app.Config, start time.Time, results []uploader.FolderResult, opts []uploader.UploadOptions) (uploader.BatchRecord, bool) {
+	rec := uploader.BatchRecord{
+		RunID:      cfg.RunID,
+		Agent:      cfg.AgentID,
+		StartedAt:  start,
+		FinishedAt: cfg.Env.Now(),
+		Folders:    []string{},
+	}
+	for i, res := range results {
+		folder := recordFolderPath(cfg.RootDir, res.Folder, opts[i])
+		switch {
+		case res.Failed():
+			rec.FailedFolders = append(rec.FailedFolders, folder)
+		case res.ClaimedBy == "":
+			rec.Folders = append(rec.Folders, folder)
+			rec.Files += len(res.Uploaded)
+			rec.Bytes += res.Bytes()
+		}
+	}
+	return rec, len(rec.Folders) > 0
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// heldBatches returns the batch triggers (see scanner.Match.Batch) with a
+// folder that isn't processed this run (skipped, deferred, ...). They must not
+// be marked processed so the whole batch is picked up again on the next run.
+func heldBatches(matches, processed []scanner.Match) map[string]bool {
+	type key struct{ readyFile, folder string }
+	done := make(map[key]bool, len(processed))
+	for _, m := range processed {
+		done[key{m.ReadyFile, m.Folder}] = true
+	}
+	held := make(map[string]bool)
+	for _, m := range matches {
+		if m.Batch && !done[key{m.ReadyFile, m.Folder}] {
+			held[m.ReadyFile] = true
+		}
+	}
+	return held
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// hasUploadableFiles reports whether a matched folder contains at least one
+// file that would be uploaded. Listing errors count as files so the upload
+// reports them.
+func hasUploadableFiles(m scanner.Match, followSymlinks bool) bool {
+	for fe, err := range m.Entries() {
+		if err != nil {
+			return true
+		}
+		if _, ok := uploader.Uploadable(fe, followSymlinks); ok {
+			return true
+		}
+	}
+	return false
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// partialFiles converts the files uploaded for a failed folder into their
+// state representation. Hard links are left out; they are derived from their
+// primary entry again on the next run.
+func partialFiles(uploaded []uploader.UploadedFile) []state.PartialFile {
+	var files []state.PartialFile
+	for _, f := range uploaded {
+		if f.LinkOf != "" {
+			continue
+		}
+		files = append(files, state.PartialFile{
+			Name:            f.Name,
+			Size:            f.Size,
+			ModTime:         f.ModTime,
+			Checksum:        f.Checksum,
+			Path:            f.Path,
+			ContentEncoding: f.ContentEncoding,
+			Bundled:         f.Bundled,
+			Generation:      f.Generation,
+			Metageneration:  f.Metageneration,
+		})
+	}
+	return files
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// doneFiles converts the state of a partially uploaded folder into
+// UploadOptions.Done. It returns nil if nothing was uploaded before.
+func doneFiles(files []state.PartialFile) map[string]uploader.UploadedFile {
+	if len(files) == 0 {
+		return nil
+	}
+	done := make(map[string]uploader.UploadedFile, len(files))
+	for _, f := range files {
+		done[f.Name] = uploader.UploadedFile{
+			Name:            f.Name,
+			Size:            f.Size,
+			ModTime:         f.ModTime,
+			Checksum:        f.Checksum,
+			Path:            f.Path,
+			ContentEncoding: f.ContentEncoding,
+			Bundled:         f.Bundled,
+			Generation:      f.Generation,
+			Metageneration:  f.Metageneration,
+		}
+	}
+	return done
+}
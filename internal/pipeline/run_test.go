@@ -0,0 +1,2108 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/events"
+	"local-file-sync/internal/naming"
+	"local-file-sync/internal/report"
+	"local-file-sync/internal/scanner"
+	"local-file-sync/internal/state"
+	"local-file-sync/internal/uploader"
+	"local-file-sync/lfs/fakes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// helper to build config for tests.
+func testConfig(root, stateFile, lockFile string, stdout *os.File) *app.Config {
+	return &app.Config{
+		RootDir:        root,
+		Recursive:      false,
+		FollowSymlinks: false,
+		StateFile:      stateFile,
+		DisableState:   false,
+		LockFile:       lockFile,
+		GCSBucket:      "",
+		Logger:         log.New(io.Discard, "", 0),
+		Stdout:         stdout,
+	}
+}
+
+// useFakes swaps the client factories for in-memory fakes for the duration of
+// the test.
+func useFakes(t *testing.T) (*fakes.GCS, *fakes.Firestore) {
+	t.Helper()
+	g, f := fakes.NewGCS(), fakes.NewFirestore()
+	prevU, prevR := newUploader, newRecordWriter
+	newUploader = func(context.Context, *app.Config) (uploader.Uploader, error) { return g, nil }
+	newRecordWriter = func(context.Context, *app.Config) (uploader.RecordWriter, error) { return f, nil }
+	t.Cleanup(func() { newUploader, newRecordWriter = prevU, prevR })
+	return g, f
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_EmitsAndState verifies initial emit and subsequent skip leveraging
+// state.
+func TestRun_EmitsAndState(t *testing.T) {
+	root := t.TempDir()
+	// NOTE(joel): Prepare RDY + folder structure
+	rdy := filepath.Join(root, "ORDER777.RDY")
+	if err := os.WriteFile(rdy, []byte("ready"), 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+	folder := filepath.Join(root, "ORDER777")
+	if err := os.Mkdir(folder, 0o755); err != nil {
+		t.Fatalf("mkdir folder: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(folder, "file.txt"), []byte("data"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	stateFile := filepath.Join(root, "state.json")
+	lockFile := filepath.Join(root, "lockfile")
+	outFile, err := os.CreateTemp(root, "out1-*.jsonl")
+	if err != nil {
+		t.Fatalf("create temp out: %v", err)
+	}
+	cfg := testConfig(root, stateFile, lockFile, outFile)
+
+	if err := run(cfg); err != nil {
+		t.Fatalf("run1: %v", err)
+	}
+	// NOTE(joel): Rewind and read emitted JSON
+	if _, err := outFile.Seek(0, 0); err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	dec := json.NewDecoder(outFile)
+	var matches []map[string]any
+	if err := dec.Decode(&matches); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 match got %d", len(matches))
+	}
+
+	// NOTE(joel): Capture last modified time of state file then rerun; second
+	// run should produce no JSON.
+	info1, err := os.Stat(stateFile)
+	if err != nil {
+		t.Fatalf("stat state: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	outFile2, _ := os.CreateTemp(root, "out2-*.jsonl")
+	cfg2 := testConfig(root, stateFile, lockFile, outFile2)
+	if err := run(cfg2); err != nil {
+		t.Fatalf("run2: %v", err)
+	}
+	// NOTE(joel): Second output file should be empty (no new matches)
+	if fi, _ := outFile2.Stat(); fi.Size() != 0 {
+		t.Fatalf("expected no second emit, size=%d", fi.Size())
+	}
+	// NOTE(joel): State file should have been updated (LastRun changed) => mod
+	// time >= original
+	info2, err := os.Stat(stateFile)
+	if err != nil {
+		t.Fatalf("stat2: %v", err)
+	}
+	if !info2.ModTime().After(info1.ModTime()) && !info2.ModTime().Equal(info1.ModTime()) {
+		t.Fatalf("expected state file mod time updated")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_ReemitOnModTimeChange ensures that when an RDY file's modTime
+// changes it is emitted again (re-processing trigger).
+func TestRun_ReemitOnModTimeChange(t *testing.T) {
+	root := t.TempDir()
+	rdy := filepath.Join(root, "ORDER_MOD.RDY")
+	if err := os.WriteFile(rdy, []byte("ready"), 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+	folder := filepath.Join(root, "ORDER_MOD")
+	if err := os.Mkdir(folder, 0o755); err != nil {
+		t.Fatalf("mkdir folder: %v", err)
+	}
+	stateFile := filepath.Join(root, "state.json")
+	lockFile := filepath.Join(root, "lock")
+	out1, _ := os.CreateTemp(root, "out-mod1-*.jsonl")
+	cfg1 := testConfig(root, stateFile, lockFile, out1)
+	if err := run(cfg1); err != nil {
+		t.Fatalf("run1: %v", err)
+	}
+	if _, err := out1.Seek(0, 0); err != nil {
+		t.Fatalf("seek1: %v", err)
+	}
+	dec1 := json.NewDecoder(out1)
+	var matches1 []map[string]any
+	if err := dec1.Decode(&matches1); err != nil {
+		t.Fatalf("decode1: %v", err)
+	}
+	if len(matches1) != 1 {
+		t.Fatalf("expected 1 match got %d", len(matches1))
+	}
+
+	// NOTE(joel): Second run with no change -> expect skip.
+	out2, _ := os.CreateTemp(root, "out-mod2-*.jsonl")
+	cfg2 := testConfig(root, stateFile, lockFile, out2)
+	if err := run(cfg2); err != nil {
+		t.Fatalf("run2: %v", err)
+	}
+	if fi, _ := out2.Stat(); fi.Size() != 0 {
+		t.Fatalf("expected skip size=%d", fi.Size())
+	}
+
+	// NOTE(joel): Touch the RDY file to advance modTime (ensure at least 1ns
+	// difference).
+	time.Sleep(2 * time.Millisecond)
+	now := time.Now()
+	if err := os.Chtimes(rdy, now, now); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	out3, _ := os.CreateTemp(root, "out-mod3-*.jsonl")
+	cfg3 := testConfig(root, stateFile, lockFile, out3)
+	if err := run(cfg3); err != nil {
+		t.Fatalf("run3: %v", err)
+	}
+	if fi, _ := out3.Stat(); fi.Size() == 0 {
+		t.Fatalf("expected re-emit after modTime change")
+	}
+	if _, err := out3.Seek(0, 0); err != nil {
+		t.Fatalf("seek3: %v", err)
+	}
+	dec3 := json.NewDecoder(out3)
+	var matches3 []map[string]any
+	if err := dec3.Decode(&matches3); err != nil {
+		t.Fatalf("decode3: %v", err)
+	}
+	if len(matches3) != 1 {
+		t.Fatalf("expected 1 match after mod change got %d", len(matches3))
+	}
+	if filepath.Base(matches3[0]["readyFile"].(string)) != "ORDER_MOD.RDY" {
+		t.Fatalf("unexpected readyFile")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_LockNotAcquired ensures graceful exit when lock held.
+func TestRun_LockNotAcquired(t *testing.T) {
+	root := t.TempDir()
+	lockFile := filepath.Join(root, "lock")
+	// NOTE(joel): Pre-create lock file to simulate another process
+	if err := os.WriteFile(lockFile, []byte("lock"), 0o600); err != nil {
+		t.Fatalf("precreate lock: %v", err)
+	}
+	rdy := filepath.Join(root, "ORDER999.RDY")
+	if err := os.WriteFile(rdy, []byte("ready"), 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+	folder := filepath.Join(root, "ORDER999")
+	if err := os.Mkdir(folder, 0o755); err != nil {
+		t.Fatalf("mkdir folder: %v", err)
+	}
+	outFile, _ := os.CreateTemp(root, "out-lock-*.jsonl")
+	cfg := testConfig(root, filepath.Join(root, "state.json"), lockFile, outFile)
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if fi, _ := outFile.Stat(); fi.Size() != 0 {
+		t.Fatalf("expected no output when lock not acquired")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_NoMatches ensures no JSON emitted when there are no *.RDY files.
+func TestRun_NoMatches(t *testing.T) {
+	root := t.TempDir()
+	stateFile := filepath.Join(root, "state.json")
+	lockFile := filepath.Join(root, "lock")
+	outFile, _ := os.CreateTemp(root, "out-nomatch-*.jsonl")
+	cfg := testConfig(root, stateFile, lockFile, outFile)
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if fi, _ := outFile.Stat(); fi.Size() != 0 {
+		t.Fatalf("expected empty output, size=%d", fi.Size())
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_SkipExistingState pre-populates state so one of two matches is
+// skipped.
+func TestRun_SkipExistingState(t *testing.T) {
+	root := t.TempDir()
+	rdy1 := filepath.Join(root, "ORDER1.RDY")
+	rdy2 := filepath.Join(root, "ORDER2.RDY")
+	if err := os.WriteFile(rdy1, []byte("r1"), 0o644); err != nil {
+		t.Fatalf("write r1: %v", err)
+	}
+	if err := os.WriteFile(rdy2, []byte("r2"), 0o644); err != nil {
+		t.Fatalf("write r2: %v", err)
+	}
+	// NOTE(joel): Folders to accompany RDY files
+	for _, f := range []string{"ORDER1", "ORDER2"} {
+		d := filepath.Join(root, f)
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", f, err)
+		}
+	}
+	stateFile := filepath.Join(root, "state.json")
+	// NOTE(joel): Pre-populate state with rdy1 using its actual modTime so it is skipped.
+	fi1, err := os.Stat(rdy1)
+	if err != nil {
+		t.Fatalf("stat rdy1: %v", err)
+	}
+	content := []byte("{\n  \"version\":1,\n  \"last_run\":\"2025-01-01T00:00:00Z\",\n  \"files\": { \"" + rdy1 + "\": " + fmt.Sprintf("%d", fi1.ModTime().UnixNano()) + " }\n}\n")
+	if err := os.WriteFile(stateFile, content, 0o644); err != nil {
+		t.Fatalf("write state: %v", err)
+	}
+	lockFile := filepath.Join(root, "lock")
+	outFile, _ := os.CreateTemp(root, "out-skip-*.jsonl")
+	cfg := testConfig(root, stateFile, lockFile, outFile)
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	// NOTE(joel): Expect only one emitted match (ORDER2)
+	if _, err := outFile.Seek(0, 0); err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	dec := json.NewDecoder(outFile)
+	var matches []map[string]any
+	if err := dec.Decode(&matches); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 emitted match got %d", len(matches))
+	}
+	readyFile, _ := matches[0]["readyFile"].(string)
+	if filepath.Base(readyFile) != "ORDER2.RDY" {
+		t.Fatalf("expected ORDER2.RDY got %s", readyFile)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_StateDisabled covers -no-state branch; state file should be ignored
+// even if present.
+func TestRun_StateDisabled(t *testing.T) {
+	root := t.TempDir()
+	rdy := filepath.Join(root, "ORDERNOSTATE.RDY")
+	if err := os.WriteFile(rdy, []byte("r"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "ORDERNOSTATE"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	// NOTE(joel): Pre-create state file to show it's ignored.
+	stateFile := filepath.Join(root, "state.json")
+	if err := os.WriteFile(stateFile, []byte("{}"), 0o644); err != nil {
+		t.Fatalf("state write: %v", err)
+	}
+	lockFile := filepath.Join(root, "lock")
+	outFile, _ := os.CreateTemp(root, "out-nostate-*.jsonl")
+	cfg := testConfig(root, stateFile, lockFile, outFile)
+	cfg.DisableState = true
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if fi, _ := outFile.Stat(); fi.Size() == 0 {
+		t.Fatalf("expected emit even with state disabled")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_StateSaveWarning attempts to provoke a save warning by making
+// directory non-writable.
+func TestRun_StateSaveWarning(t *testing.T) {
+	root := t.TempDir()
+	rdy := filepath.Join(root, "ORDERWARN.RDY")
+	if err := os.WriteFile(rdy, []byte("r"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "ORDERWARN"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	// NOTE(joel): Create a directory with no write permissions for state file.
+	badDir := filepath.Join(root, "ro")
+	if err := os.Mkdir(badDir, 0o555); err != nil {
+		t.Fatalf("mkdir ro: %v", err)
+	}
+	stateFile := filepath.Join(badDir, "state.json")
+	lockFile := filepath.Join(root, "lock")
+	outFile, _ := os.CreateTemp(root, "out-warn-*.jsonl")
+	cfg := testConfig(root, stateFile, lockFile, outFile)
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	// NOTE(joel): Restore perms so cleanup can occur (best effort)
+	_ = os.Chmod(badDir, 0o755)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_UploadWithFakes verifies the upload pipeline end-to-end against
+// in-memory fakes: objects are stored, a Firestore record is written and the
+// trigger is marked processed.
+func TestRun_UploadWithFakes(t *testing.T) {
+	g, f := useFakes(t)
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "ORDER5.RDY"), nil, 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "ORDER5"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "ORDER5", "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	stateFile := filepath.Join(root, "state.json")
+	outFile, _ := os.CreateTemp(root, "out-upload-*.jsonl")
+	cfg := testConfig(root, stateFile, filepath.Join(root, "lock"), outFile)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreProjectId = "proj"
+	cfg.FirestoreCollection = "uploads"
+	cfg.AgentID = "scanner-7"
+	cfg.RunID = "run-1"
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if _, ok := g.Object("ORDER5/a.txt"); !ok {
+		t.Fatalf("expected uploaded object, got %v", g.ObjectNames())
+	}
+	if md := g.ObjectMetadata("ORDER5/a.txt"); md["agent"] != "scanner-7" || md["run"] != "run-1" {
+		t.Fatalf("expected agent and run object metadata, got %v", md)
+	}
+	rec, ok := f.Record("uploads", "ORDER5")
+	if !ok || len(rec.Files) != 1 {
+		t.Fatalf("expected firestore record, got %+v", rec)
+	}
+	if rec.Agent != "scanner-7" || rec.RunID != "run-1" {
+		t.Fatalf("expected agent and run on record, got %q %q", rec.Agent, rec.RunID)
+	}
+	if gen := g.Generation("ORDER5/a.txt"); gen == 0 || rec.Files[0].Generation != gen || rec.Files[0].Metageneration != 1 {
+		t.Fatalf("expected object generation %d on record, got %+v", gen, rec.Files[0])
+	}
+	if fi, _ := outFile.Stat(); fi.Size() != 0 {
+		t.Fatalf("expected no JSON output in upload mode")
+	}
+
+	// NOTE(joel): Second run must skip the already uploaded trigger.
+	g2, _ := useFakes(t)
+	if err := run(cfg); err != nil {
+		t.Fatalf("run2: %v", err)
+	}
+	if len(g2.ObjectNames()) != 0 {
+		t.Fatalf("expected no re-upload, got %v", g2.ObjectNames())
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_UploadFailureWithFakes verifies a failed folder upload returns an
+// error and leaves the trigger unprocessed in state.
+func TestRun_UploadFailureWithFakes(t *testing.T) {
+	g, f := useFakes(t)
+	g.Err = fmt.Errorf("boom")
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "ORDER6.RDY"), nil, 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "ORDER6"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	stateFile := filepath.Join(root, "state.json")
+	outFile, _ := os.CreateTemp(root, "out-fail-*.jsonl")
+	cfg := testConfig(root, stateFile, filepath.Join(root, "lock"), outFile)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreCollection = "uploads"
+	if err := run(cfg); err == nil {
+		t.Fatalf("expected error for failed folder upload")
+	}
+	if len(f.Records("uploads")) != 0 {
+		t.Fatalf("expected no firestore record for failed upload")
+	}
+	b, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatalf("read state: %v", err)
+	}
+	var ds struct {
+		Files map[string]int64 `json:"files"`
+	}
+	if err := json.Unmarshal(b, &ds); err != nil {
+		t.Fatalf("decode state: %v", err)
+	}
+	if len(ds.Files) != 0 {
+		t.Fatalf("expected no processed triggers in state, got %v", ds.Files)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_FolderNameRules verifies normalized names are used for objects and
+// Firestore paths, and invalid names are rejected or quarantined.
+func TestRun_FolderNameRules(t *testing.T) {
+	root := t.TempDir()
+	for _, n := range []string{"order 1", "bad#2"} {
+		if err := os.WriteFile(filepath.Join(root, n+".RDY"), nil, 0o644); err != nil {
+			t.Fatalf("write rdy: %v", err)
+		}
+		if err := os.Mkdir(filepath.Join(root, n), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(root, n, "a.txt"), []byte("a"), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+	newCfg := func(action string) *app.Config {
+		outFile, _ := os.CreateTemp(root, "out-names-*.jsonl")
+		cfg := testConfig(root, "", filepath.Join(root, "lock"), outFile)
+		cfg.GCSBucket = "bucket"
+		cfg.FirestoreCollection = "uploads"
+		cfg.FolderNameRules = naming.Rules{
+			Normalize: []string{naming.NormUpper, naming.NormStripSpaces},
+			Forbidden: "#",
+			Action:    action,
+		}
+		return cfg
+	}
+
+	g, f := useFakes(t)
+	if err := run(newCfg(naming.ActionReject)); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := g.ObjectNames(); len(got) != 1 || got[0] != "ORDER1/a.txt" {
+		t.Fatalf("unexpected objects %v", got)
+	}
+	if _, ok := f.Record("uploads", "ORDER1"); !ok {
+		t.Fatalf("expected record under normalized path")
+	}
+
+	g, f = useFakes(t)
+	if err := run(newCfg(naming.ActionQuarantine)); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if _, ok := g.Object("quarantine/bad#2/a.txt"); !ok {
+		t.Fatalf("expected quarantined object, got %v", g.ObjectNames())
+	}
+	if _, ok := f.Record("uploads", filepath.Join("quarantine", "bad#2")); !ok {
+		t.Fatalf("expected quarantined record")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_FolderClaims verifies that of two agents scanning replicas of the
+// same share only the first uploads a folder; the other skips it and records
+// it as processed.
+func TestRun_FolderClaims(t *testing.T) {
+	g, f := useFakes(t)
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "ORDER7.RDY"), nil, 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "ORDER7"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "ORDER7", "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	runAgent := func(agent string) *state.Store {
+		stateFile := filepath.Join(root, agent+".state.json")
+		cfg := testConfig(root, stateFile, filepath.Join(root, agent+".lock"), os.Stdout)
+		cfg.GCSBucket = "bucket"
+		cfg.FirestoreProjectId = "proj"
+		cfg.FirestoreCollection = "uploads"
+		cfg.ClaimCollection = "claims"
+		cfg.AgentID = agent
+		if err := run(cfg); err != nil {
+			t.Fatalf("run %s: %v", agent, err)
+		}
+		st := state.New(stateFile)
+		if err := st.Load(); err != nil {
+			t.Fatalf("load state: %v", err)
+		}
+		return st
+	}
+
+	runAgent("site-a")
+	if len(g.ObjectNames()) != 1 {
+		t.Fatalf("expected site-a upload, got %v", g.ObjectNames())
+	}
+
+	g2 := fakes.NewGCS()
+	newUploader = func(context.Context, *app.Config) (uploader.Uploader, error) { return g2, nil }
+	st := runAgent("site-b")
+	if len(g2.ObjectNames()) != 0 {
+		t.Fatalf("expected site-b to skip claimed folder, got %v", g2.ObjectNames())
+	}
+	if _, ok := st.Get(filepath.Join(root, "ORDER7.RDY")); !ok {
+		t.Fatalf("expected claimed trigger to be marked processed")
+	}
+	if rec, _ := f.Record("uploads", "ORDER7"); rec.Agent != "site-a" {
+		t.Fatalf("expected record from site-a, got %+v", rec)
+	}
+	if c, ok := f.Claim("claims", "ORDER7"); !ok || c.Agent != "site-a" || !c.Uploaded() {
+		t.Fatalf("expected uploaded claim of site-a, got %+v (ok=%v)", c, ok)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_FolderClaimsPending verifies agents only treat a claimed folder as
+// processed once the winner uploaded it: a failed winner releases its claim,
+// a folder still being uploaded is deferred and an expired claim is taken
+// over.
+func TestRun_FolderClaimsPending(t *testing.T) {
+	g, f := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER7", "a")
+	newConfig := func(agent string) *app.Config {
+		cfg := testConfig(root, filepath.Join(root, agent+".state.json"), filepath.Join(root, agent+".lock"), os.Stdout)
+		cfg.GCSBucket = "bucket"
+		cfg.FirestoreCollection = "uploads"
+		cfg.ClaimCollection = "claims"
+		cfg.AgentID = agent
+		return cfg
+	}
+
+	g.Err = errors.New("boom")
+	if err := run(newConfig("site-a")); !errors.Is(err, ErrFoldersFailed) {
+		t.Fatalf("expected ErrFoldersFailed, got %v", err)
+	}
+	if c, ok := f.Claim("claims", "ORDER7"); ok {
+		t.Fatalf("expected claim of failed upload released, got %+v", c)
+	}
+	g.Err = nil
+
+	// NOTE(joel): site-c claimed the folder and is still uploading it.
+	now := time.Now()
+	uploading := uploader.FolderClaim{FolderPath: "ORDER7", Agent: "site-c", ClaimedAt: now, Status: uploader.ClaimStatusClaimed, ExpiresAt: now.Add(time.Hour)}
+	if _, won, err := f.ClaimFolder("claims", uploading); err != nil || !won {
+		t.Fatalf("seed claim: won=%v err=%v", won, err)
+	}
+	cfg := newConfig("site-b")
+	var rep Report
+	if err := runChunk(context.Background(), cfg, nil, defaultClients(), &rep); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if rep.Deferred != 1 || rep.Emitted != 0 || len(g.ObjectNames()) != 0 {
+		t.Fatalf("expected folder deferred, got %+v objects=%v", rep.RunSummary, g.ObjectNames())
+	}
+	st := state.New(cfg.StateFile)
+	if err := st.Load(); err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	if _, ok := st.Get(filepath.Join(root, "ORDER7.RDY")); ok {
+		t.Fatalf("expected trigger of pending claim unprocessed")
+	}
+
+	// NOTE(joel): site-c crashed; once its claim expired, site-b takes over.
+	uploading.ClaimedAt, uploading.ExpiresAt = now.Add(-2*time.Hour), now.Add(-time.Hour)
+	if _, won, err := f.ClaimFolder("claims", uploading); err != nil || !won {
+		t.Fatalf("expire claim: won=%v err=%v", won, err)
+	}
+	if err := run(newConfig("site-b")); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if len(g.ObjectNames()) != 1 {
+		t.Fatalf("expected site-b upload, got %v", g.ObjectNames())
+	}
+	if c, ok := f.Claim("claims", "ORDER7"); !ok || c.Agent != "site-b" || !c.Uploaded() {
+		t.Fatalf("expected uploaded claim of site-b, got %+v (ok=%v)", c, ok)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_History verifies each run is recorded in the state file and printed
+// by the history command.
+func TestRun_History(t *testing.T) {
+	g, _ := useFakes(t)
+	root := t.TempDir()
+	g.FailFolders = map[string]bool{filepath.Join(root, "BAD"): true}
+	for _, name := range []string{"GOOD", "BAD"} {
+		if err := os.WriteFile(filepath.Join(root, name+".RDY"), nil, 0o644); err != nil {
+			t.Fatalf("write rdy: %v", err)
+		}
+		if err := os.Mkdir(filepath.Join(root, name), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	stateFile := filepath.Join(root, "state.json")
+	cfg := testConfig(root, stateFile, filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.HistorySize = 20
+	cfg.FolderConcurrency = 4
+	cfg.FileConcurrency = 5
+	if err := run(cfg); err == nil {
+		t.Fatalf("expected failure for BAD folder")
+	}
+
+	outFile, _ := os.CreateTemp(root, "history-*.txt")
+	cfg.Stdout = outFile
+	if err := printHistory(cfg); err != nil {
+		t.Fatalf("printHistory: %v", err)
+	}
+	b, _ := os.ReadFile(outFile.Name())
+	out := string(b)
+	if !strings.Contains(out, "scanned=2 emitted=2 skipped=0 failed=1") {
+		t.Fatalf("unexpected history output %q", out)
+	}
+	if !strings.Contains(out, "  run: ") {
+		t.Fatalf("expected run ID in history, got %q", out)
+	}
+	if !strings.Contains(out, "  throughput: bytes=0 ") {
+		t.Fatalf("expected throughput in history, got %q", out)
+	}
+	// NOTE(joel): Only two folders were uploaded, so only two folder workers
+	// ran.
+	if !strings.Contains(out, " folder_concurrency=2 file_concurrency=5\n") {
+		t.Fatalf("expected effective concurrency in history, got %q", out)
+	}
+	if !strings.Contains(out, "  error: "+filepath.Join(root, "BAD")) {
+		t.Fatalf("expected folder error in history, got %q", out)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_ReportsFailedFolders verifies failed folders are sent to the error
+// reporter tagged with folder and agent.
+func TestRun_ReportsFailedFolders(t *testing.T) {
+	var mu sync.Mutex
+	var events []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&ev)
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	g, _ := useFakes(t)
+	g.Err = fmt.Errorf("boom")
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "ORDER8.RDY"), nil, 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "ORDER8"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.AgentID = "scanner-7"
+	rep, err := report.NewSentry(strings.Replace(srv.URL, "http://", "http://key@", 1) + "/1")
+	if err != nil {
+		t.Fatalf("NewSentry: %v", err)
+	}
+	cfg.Reporter = rep
+
+	if err := run(cfg); !errors.Is(err, ErrFoldersFailed) {
+		t.Fatalf("expected folders failed error, got %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected one reported event, got %d", len(events))
+	}
+	tags, _ := events[0]["tags"].(map[string]any)
+	if events[0]["level"] != report.LevelError || tags["agent"] != "scanner-7" || tags["run"] != cfg.RunID || tags["folder"] != filepath.Join(root, "ORDER8") {
+		t.Fatalf("unexpected event %v", events[0])
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// recordingNotifier collects digests sent during a test.
+type recordingNotifier struct {
+	subjects []string
+	bodies   []string
+}
+
+func (n *recordingNotifier) Notify(subject, body string) error {
+	n.subjects = append(n.subjects, subject)
+	n.bodies = append(n.bodies, body)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_NotifyDigest verifies a digest is sent for failed folders and
+// orphaned triggers and rate limited across runs.
+func TestRun_NotifyDigest(t *testing.T) {
+	g, _ := useFakes(t)
+	g.Err = fmt.Errorf("boom")
+	root := t.TempDir()
+	for _, name := range []string{"ORDER9.RDY", "ORPHAN1.RDY", "ORPHAN2.RDY"} {
+		if err := os.WriteFile(filepath.Join(root, name), nil, 0o644); err != nil {
+			t.Fatalf("write rdy: %v", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "ORDER9"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	n := &recordingNotifier{}
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.AgentID = "scanner-7"
+	cfg.Notifier = n
+	cfg.NotifyOrphans = 2
+	cfg.NotifyInterval = time.Hour
+
+	_ = run(cfg)
+	if len(n.subjects) != 1 {
+		t.Fatalf("expected one digest, got %d", len(n.subjects))
+	}
+	if n.subjects[0] != "local-file-sync on scanner-7: 1 failed folder(s), 2 orphaned trigger(s)" {
+		t.Fatalf("unexpected subject %q", n.subjects[0])
+	}
+	if !strings.Contains(n.bodies[0], "- "+filepath.Join(root, "ORDER9")+": boom") ||
+		!strings.Contains(n.bodies[0], "- "+filepath.Join(root, "ORPHAN2.RDY")) {
+		t.Fatalf("unexpected body %q", n.bodies[0])
+	}
+
+	// NOTE(joel): Second run within the interval must not notify again.
+	_ = run(cfg)
+	if len(n.subjects) != 1 {
+		t.Fatalf("expected digest to be rate limited, got %d", len(n.subjects))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// makeTrigger creates `<root>/<name>.RDY` and a folder `<root>/<name>` holding
+// a single file with the given content.
+func makeTrigger(t *testing.T, root, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(root, name+".RDY"), nil, 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, name), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, name, "data.txt"), []byte(content), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// runJSON runs cfg in JSON mode and returns the ready files of the emitted
+// matches.
+func runJSON(t *testing.T, cfg *app.Config) []string {
+	t.Helper()
+	out, err := os.CreateTemp(t.TempDir(), "out-*.json")
+	if err != nil {
+		t.Fatalf("create out: %v", err)
+	}
+	defer out.Close()
+	cfg.Stdout = out
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	b, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatalf("read out: %v", err)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var matches []struct {
+		ReadyFile string `json:"readyFile"`
+	}
+	if err := json.Unmarshal(b, &matches); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	var names []string
+	for _, m := range matches {
+		names = append(names, filepath.Base(m.ReadyFile))
+	}
+	return names
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_PerRunCaps verifies matches beyond -max-folders-per-run /
+// -max-bytes-per-run are carried over to the next run.
+func TestRun_PerRunCaps(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"A", "B", "C"} {
+		makeTrigger(t, root, name, "12345")
+	}
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), nil)
+	cfg.MaxFoldersPerRun = 2
+	if got := runJSON(t, cfg); fmt.Sprint(got) != "[A.RDY B.RDY]" {
+		t.Fatalf("run1: unexpected matches %v", got)
+	}
+	if got := runJSON(t, cfg); fmt.Sprint(got) != "[C.RDY]" {
+		t.Fatalf("run2: unexpected matches %v", got)
+	}
+
+	root = t.TempDir()
+	for _, name := range []string{"A", "B", "C"} {
+		makeTrigger(t, root, name, "12345")
+	}
+	cfg = testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), nil)
+	cfg.MaxBytesPerRun = 8
+	for i, want := range []string{"[A.RDY]", "[B.RDY]", "[C.RDY]", "[]"} {
+		if got := runJSON(t, cfg); fmt.Sprint(got) != want {
+			t.Fatalf("bytes run%d: expected %s got %v", i+1, want, got)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_OrderOldest verifies per-run caps drain the backlog oldest first.
+func TestRun_OrderOldest(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	for i, name := range []string{"A", "B", "C"} {
+		makeTrigger(t, root, name, "x")
+		mt := now.Add(-time.Duration(i) * time.Hour)
+		if err := os.Chtimes(filepath.Join(root, name+".RDY"), mt, mt); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), nil)
+	cfg.Order = scanner.OrderOldest
+	cfg.MaxFoldersPerRun = 2
+	if got := runJSON(t, cfg); fmt.Sprint(got) != "[C.RDY B.RDY]" {
+		t.Fatalf("run1: unexpected matches %v", got)
+	}
+	if got := runJSON(t, cfg); fmt.Sprint(got) != "[A.RDY]" {
+		t.Fatalf("run2: unexpected matches %v", got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_RequireCount verifies incomplete folders are retried until their
+// entry count matches the announced count.
+func TestRun_RequireCount(t *testing.T) {
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "x")
+	if err := os.WriteFile(filepath.Join(root, "ORDER1.CNT"), []byte("2"), 0o644); err != nil {
+		t.Fatalf("write cnt: %v", err)
+	}
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), nil)
+	cfg.RequireCount = true
+	if got := runJSON(t, cfg); len(got) != 0 {
+		t.Fatalf("expected incomplete folder to be skipped, got %v", got)
+	}
+	if err := os.WriteFile(filepath.Join(root, "ORDER1", "more.txt"), nil, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if got := runJSON(t, cfg); fmt.Sprint(got) != "[ORDER1.RDY]" {
+		t.Fatalf("expected complete folder to be emitted, got %v", got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestThroughput verifies run statistics skip failed/claimed folders and hard
+// links and keep the slowest folders and files.
+func TestThroughput(t *testing.T) {
+	results := []uploader.FolderResult{
+		{Folder: "A", Duration: time.Second, Uploaded: []uploader.UploadedFile{
+			{Path: "A/1", Size: 1_000_000, Duration: 300 * time.Millisecond},
+			{Path: "A/2", Size: 1_000_000, Duration: 900 * time.Millisecond},
+			{Path: "A/1", Size: 1_000_000, LinkOf: "1"},
+		}},
+		{Folder: "B", Duration: 3 * time.Second, Uploaded: []uploader.UploadedFile{
+			{Path: "B/1", Size: 2_000_000, Duration: 2 * time.Second, Verified: true},
+		}},
+		{Folder: "FAILED", Errors: []error{errors.New("boom")}, Uploaded: []uploader.UploadedFile{{Size: 1}}},
+		{Folder: "CLAIMED", ClaimedBy: "other"},
+	}
+	tp := throughput(results, "gs://bucket", 2*time.Second)
+	if tp.Bytes != 4_000_000 || tp.MBps != 2 || tp.Verified != 1 {
+		t.Fatalf("unexpected totals %+v", tp)
+	}
+	if len(tp.SlowestFolders) != 2 || tp.SlowestFolders[0].Path != "B" || tp.SlowestFolders[1].Bytes != 2_000_000 {
+		t.Fatalf("unexpected slowest folders %+v", tp.SlowestFolders)
+	}
+	if len(tp.SlowestFiles) != 3 || tp.SlowestFiles[0].Path != "B/1" || tp.SlowestFiles[1].Path != "A/2" {
+		t.Fatalf("unexpected slowest files %+v", tp.SlowestFiles)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_PendingRecords verifies failed Firestore writes are queued without
+// failing the folder and flushed on the next run.
+func TestRun_PendingRecords(t *testing.T) {
+	_, f := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "")
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreCollection = "col"
+	cfg.PendingFile = filepath.Join(root, "pending.jsonl")
+
+	f.Err = errors.New("unavailable")
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if _, err := os.Stat(cfg.PendingFile); err != nil {
+		t.Fatalf("expected queued record: %v", err)
+	}
+
+	f.Err = nil
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if _, ok := f.Record("col", "ORDER1"); !ok {
+		t.Fatalf("expected flushed record, got %+v", f.Records("col"))
+	}
+	if _, err := os.Stat(cfg.PendingFile); !os.IsNotExist(err) {
+		t.Fatalf("expected pending file removed, got %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_FirestoreUnavailable verifies records of folders uploaded while
+// Firestore can't be initialized are queued and replayed once it is
+// reachable.
+func TestRun_FirestoreUnavailable(t *testing.T) {
+	_, f := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	makeTrigger(t, root, "ORDER2", "b")
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreCollection = "col"
+	cfg.PendingFile = filepath.Join(root, "pending.jsonl")
+
+	prev := newRecordWriter
+	newRecordWriter = func(context.Context, *app.Config) (uploader.RecordWriter, error) {
+		return nil, errors.New("dial: connection refused")
+	}
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	newRecordWriter = prev
+	if len(f.Records("col")) != 0 {
+		t.Fatalf("expected no records while unreachable")
+	}
+
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if recs := f.Records("col"); len(recs) != 2 {
+		t.Fatalf("expected 2 replayed records, got %+v", recs)
+	}
+	if _, err := os.Stat(cfg.PendingFile); !os.IsNotExist(err) {
+		t.Fatalf("expected pending file removed, got %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_ClaimsUnavailable verifies folders fail instead of being uploaded
+// unclaimed if claims are configured but Firestore could not be initialized.
+func TestRun_ClaimsUnavailable(t *testing.T) {
+	g, _ := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreCollection = "col"
+	cfg.ClaimCollection = "claims"
+	newRecordWriter = func(context.Context, *app.Config) (uploader.RecordWriter, error) {
+		return nil, errors.New("no credentials")
+	}
+
+	if err := run(cfg); !errors.Is(err, ErrFoldersFailed) {
+		t.Fatalf("expected failed folders, got %v", err)
+	}
+	if names := g.ObjectNames(); len(names) != 0 {
+		t.Fatalf("expected no uploads without claims, got %v", names)
+	}
+	st := state.New(cfg.StateFile)
+	if err := st.Load(); err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	if _, ok := st.Get(filepath.Join(root, "ORDER1.RDY")); ok {
+		t.Fatalf("expected unclaimed trigger to be retried")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_Strict verifies cloud init failures only fail the run in strict
+// mode.
+func TestRun_Strict(t *testing.T) {
+	useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreCollection = "col"
+
+	initErr := errors.New("no credentials")
+	newRecordWriter = func(context.Context, *app.Config) (uploader.RecordWriter, error) { return nil, initErr }
+	cfg.Strict = true
+	if err := run(cfg); !errors.Is(err, initErr) {
+		t.Fatalf("expected firestore init error, got %v", err)
+	}
+
+	newUploader = func(context.Context, *app.Config) (uploader.Uploader, error) { return nil, initErr }
+	if err := run(cfg); !errors.Is(err, initErr) {
+		t.Fatalf("expected gcs init error, got %v", err)
+	}
+	cfg.Strict = false
+	if err := run(cfg); err != nil {
+		t.Fatalf("expected warning only without -strict, got %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_StatePolicy verifies whether folders with a failed Firestore write
+// are marked processed depends on the state policy.
+func TestRun_StatePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy      string
+		pending     bool
+		wantFailed  bool
+		wantRetried bool
+	}{
+		{policy: app.StatePolicyUpload, pending: true},
+		{policy: app.StatePolicyUpload},
+		{policy: app.StatePolicyMetadata, pending: true, wantFailed: true, wantRetried: true},
+	} {
+		_, f := useFakes(t)
+		root := t.TempDir()
+		makeTrigger(t, root, "ORDER1", "a")
+		cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+		cfg.GCSBucket = "bucket"
+		cfg.FirestoreCollection = "col"
+		cfg.StatePolicy = tc.policy
+		if tc.pending {
+			cfg.PendingFile = filepath.Join(root, "pending.jsonl")
+		}
+
+		f.Err = errors.New("unavailable")
+		err := run(cfg)
+		if failed := errors.Is(err, ErrFoldersFailed); failed != tc.wantFailed {
+			t.Fatalf("%+v: unexpected run error %v", tc, err)
+		}
+		_, statErr := os.Stat(filepath.Join(root, "pending.jsonl"))
+		if queued := statErr == nil; queued != (tc.pending && !tc.wantFailed) {
+			t.Fatalf("%+v: unexpected pending file state %v", tc, statErr)
+		}
+
+		f.Err = nil
+		var out strings.Builder
+		cfg.Logger = log.New(&out, "", 0)
+		if err := run(cfg); err != nil {
+			t.Fatalf("%+v: run: %v", tc, err)
+		}
+		if retried := strings.Contains(out.String(), "folder uploaded:"); retried != tc.wantRetried {
+			t.Fatalf("%+v: expected retried=%v, log %q", tc, tc.wantRetried, out.String())
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_PartialFolder verifies a folder with failed files isn't marked
+// processed and only the missing files are uploaded on the next run.
+func TestRun_PartialFolder(t *testing.T) {
+	g, f := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	failing := filepath.Join(root, "ORDER1", "more.txt")
+	if err := os.WriteFile(failing, []byte("b"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreCollection = "col"
+
+	g.FailFiles = map[string]bool{failing: true}
+	var out strings.Builder
+	cfg.Logger = log.New(&out, "", 0)
+	if err := run(cfg); !errors.Is(err, ErrFoldersFailed) {
+		t.Fatalf("expected folders failed error, got %v", err)
+	}
+	if !strings.Contains(out.String(), "folder partially uploaded: folder="+filepath.Join(root, "ORDER1")+" uploaded=1 failed=1") {
+		t.Fatalf("expected partial upload log, got %q", out.String())
+	}
+	if recs := f.Records("col"); len(recs) != 0 {
+		t.Fatalf("expected no record for partial folder, got %+v", recs)
+	}
+
+	g.FailFiles = nil
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	recs := f.Records("col")
+	if len(recs) != 1 || len(recs[0].Files) != 2 {
+		t.Fatalf("expected one record with both files, got %+v", recs)
+	}
+	for _, file := range recs[0].Files {
+		if file.Existing != (file.Name == "data.txt") {
+			t.Fatalf("expected only the failed file uploaded again, got %+v", recs[0].Files)
+		}
+	}
+
+	st := state.New(cfg.StateFile)
+	if err := st.Load(); err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	if files := st.PartialFiles(filepath.Join(root, "ORDER1")); files != nil {
+		t.Fatalf("expected partial state cleared, got %+v", files)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_EmptyFolder verifies the -empty-folder policies.
+func TestRun_EmptyFolder(t *testing.T) {
+	for _, policy := range []string{app.EmptyFolderRecord, app.EmptyFolderRetry, app.EmptyFolderMarker} {
+		g, f := useFakes(t)
+		root := t.TempDir()
+		if err := os.WriteFile(filepath.Join(root, "ORDER1.RDY"), nil, 0o644); err != nil {
+			t.Fatalf("write rdy: %v", err)
+		}
+		if err := os.Mkdir(filepath.Join(root, "ORDER1"), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+		cfg.GCSBucket = "bucket"
+		cfg.FirestoreCollection = "col"
+		cfg.EmptyFolder = policy
+		if err := run(cfg); err != nil {
+			t.Fatalf("%s: run: %v", policy, err)
+		}
+
+		recs := f.Records("col")
+		switch policy {
+		case app.EmptyFolderRecord:
+			if len(recs) != 1 || len(recs[0].Files) != 0 {
+				t.Fatalf("%s: expected empty record, got %+v", policy, recs)
+			}
+		case app.EmptyFolderRetry:
+			if len(recs) != 0 {
+				t.Fatalf("%s: expected no record, got %+v", policy, recs)
+			}
+			// NOTE(joel): The folder is picked up once files appear.
+			if err := os.WriteFile(filepath.Join(root, "ORDER1", "data.txt"), []byte("a"), 0o644); err != nil {
+				t.Fatalf("write file: %v", err)
+			}
+			if err := run(cfg); err != nil {
+				t.Fatalf("%s: run: %v", policy, err)
+			}
+			if recs := f.Records("col"); len(recs) != 1 || len(recs[0].Files) != 1 {
+				t.Fatalf("%s: expected record after files appeared, got %+v", policy, recs)
+			}
+		case app.EmptyFolderMarker:
+			if _, ok := g.Object("ORDER1/" + uploader.EmptyMarkerName); !ok {
+				t.Fatalf("%s: expected marker object, got %v", policy, g.ObjectNames())
+			}
+			if len(recs) != 1 || len(recs[0].Files) != 1 || recs[0].Files[0].Name != uploader.EmptyMarkerName {
+				t.Fatalf("%s: expected marker recorded, got %+v", policy, recs)
+			}
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_BatchTrigger verifies all folders of a batch are uploaded and the
+// batch is only marked processed once every folder succeeded.
+func TestRun_BatchTrigger(t *testing.T) {
+	g, _ := useFakes(t)
+	root := t.TempDir()
+	for _, name := range []string{"ORDER1", "ORDER2"} {
+		if err := os.Mkdir(filepath.Join(root, name), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name, "data.txt"), []byte(name), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "BATCH42.RDY"), []byte("ORDER1\nORDER2\n"), 0o644); err != nil {
+		t.Fatalf("write batch: %v", err)
+	}
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.Triggers = []scanner.Trigger{scanner.Batch{Prefix: "BATCH"}}
+
+	g.FailFolders = map[string]bool{filepath.Join(root, "ORDER2"): true}
+	if err := run(cfg); !errors.Is(err, ErrFoldersFailed) {
+		t.Fatalf("expected folders failed error, got %v", err)
+	}
+	if _, ok := g.Object("ORDER1/data.txt"); !ok {
+		t.Fatalf("expected ORDER1 uploaded, got %v", g.ObjectNames())
+	}
+
+	g.FailFolders = nil
+	var out strings.Builder
+	cfg.Logger = log.New(&out, "", 0)
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if n := strings.Count(out.String(), "folder uploaded:"); n != 2 {
+		t.Fatalf("expected the whole batch retried, got %d uploads: %q", n, out.String())
+	}
+
+	out.Reset()
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if n := strings.Count(out.String(), "skip (unchanged)"); n != 2 {
+		t.Fatalf("expected batch marked processed, log %q", out.String())
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_BatchRecord verifies a single batch record summarizes the folders
+// uploaded in a run, and none is written if nothing was uploaded.
+func TestRun_BatchRecord(t *testing.T) {
+	g, f := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	makeTrigger(t, root, "ORDER2", "bb")
+	makeTrigger(t, root, "ORDER3", "ccc")
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreCollection = "col"
+	cfg.BatchCollection = "runs"
+	cfg.AgentID = "agent-1"
+
+	g.FailFolders = map[string]bool{filepath.Join(root, "ORDER3"): true}
+	if err := run(cfg); !errors.Is(err, ErrFoldersFailed) {
+		t.Fatalf("expected folders failed error, got %v", err)
+	}
+	recs := f.BatchRecords("runs")
+	if len(recs) != 1 {
+		t.Fatalf("expected one batch record, got %+v", recs)
+	}
+	rec := recs[0]
+	if rec.RunID == "" || rec.Agent != "agent-1" || rec.Files != 2 || rec.Bytes != 3 {
+		t.Fatalf("unexpected batch record %+v", rec)
+	}
+	if strings.Join(rec.Folders, ",") != "ORDER1,ORDER2" || strings.Join(rec.FailedFolders, ",") != "ORDER3" {
+		t.Fatalf("unexpected batch folders %+v", rec)
+	}
+
+	// NOTE(joel): Nothing uploaded: no batch record.
+	g.Err = errors.New("down")
+	if err := run(cfg); !errors.Is(err, ErrFoldersFailed) {
+		t.Fatalf("expected folders failed error, got %v", err)
+	}
+	if recs := f.BatchRecords("runs"); len(recs) != 1 {
+		t.Fatalf("expected no new batch record, got %+v", recs)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_PathLabels verifies labels derived from the directory structure are
+// attached to object metadata and Firestore records.
+func TestRun_PathLabels(t *testing.T) {
+	g, f := useFakes(t)
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "ACME", "line3"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	makeTrigger(t, filepath.Join(root, "ACME", "line3"), "ORDER1", "a")
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.Recursive = true
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreCollection = "col"
+	labels, err := naming.NewLabels(`^(?P<customer>[^/]+)/(?P<line>[^/]+)/`)
+	if err != nil {
+		t.Fatalf("NewLabels: %v", err)
+	}
+	cfg.PathLabels = labels
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	md := g.ObjectMetadata("ORDER1/data.txt")
+	if md["customer"] != "ACME" || md["line"] != "line3" {
+		t.Fatalf("expected labels in object metadata, got %v", md)
+	}
+	rec, ok := f.Record("col", filepath.Join("ACME", "line3", "ORDER1"))
+	if !ok || rec.Labels["customer"] != "ACME" || rec.Labels["line"] != "line3" {
+		t.Fatalf("expected labels on record, got %+v", rec)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_LockLease verifies runs skip while another agent holds the lease,
+// proceed once it expired and release their own lease when done.
+func TestRun_LockLease(t *testing.T) {
+	g, f := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreCollection = "col"
+	cfg.LockCollection = "locks"
+	cfg.LockKey = "share-1"
+	cfg.AgentID = "agent-1"
+
+	now := time.Now()
+	other := uploader.Lease{Key: "share-1", Agent: "agent-2", RunID: "run-2", AcquiredAt: now, ExpiresAt: now.Add(time.Hour)}
+	if _, ok, err := f.AcquireLease("locks", other); err != nil || !ok {
+		t.Fatalf("seed lease: ok=%v err=%v", ok, err)
+	}
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if len(g.ObjectNames()) != 0 {
+		t.Fatalf("expected no uploads while lease is held, got %v", g.ObjectNames())
+	}
+
+	// NOTE(joel): An expired lease is taken over.
+	other.ExpiresAt = now.Add(-time.Minute)
+	if err := f.RenewLease("locks", other); err != nil {
+		t.Fatalf("expire lease: %v", err)
+	}
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if len(g.ObjectNames()) != 1 {
+		t.Fatalf("expected upload after lease expired, got %v", g.ObjectNames())
+	}
+	if l, ok := f.Lease("locks", "share-1"); ok {
+		t.Fatalf("expected lease released, got %+v", l)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_LockLeaseLost verifies a run whose lease is taken over mid-run starts
+// no further folders.
+func TestRun_LockLeaseLost(t *testing.T) {
+	g, f := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	makeTrigger(t, root, "ORDER2", "b")
+	prevInterval := lockHeartbeatInterval
+	lockHeartbeatInterval = time.Millisecond
+	t.Cleanup(func() { lockHeartbeatInterval = prevInterval })
+
+	// NOTE(joel): While the first folder uploads, another agent takes the
+	// lease over; the upload finishes once the heartbeat noticed.
+	lost := &signalWriter{match: "lease lost", ch: make(chan struct{})}
+	newUploader = func(context.Context, *app.Config) (uploader.Uploader, error) {
+		return checkingUploader{Uploader: g, check: func() {
+			now := time.Now().Add(2 * time.Hour)
+			other := uploader.Lease{Key: "share-1", Agent: "agent-2", RunID: "run-2", AcquiredAt: now, ExpiresAt: now.Add(time.Hour)}
+			if _, ok, err := f.AcquireLease("locks", other); err != nil || !ok {
+				t.Errorf("take over lease: ok=%v err=%v", ok, err)
+			}
+			select {
+			case <-lost.ch:
+			case <-time.After(10 * time.Second):
+				t.Errorf("lease loss not noticed")
+			}
+		}}, nil
+	}
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreCollection = "col"
+	cfg.LockCollection = "locks"
+	cfg.LockKey = "share-1"
+	cfg.AgentID = "agent-1"
+	cfg.FolderConcurrency = 1
+	cfg.Logger = log.New(lost, "", 0)
+
+	if err := run(cfg); !errors.Is(err, ErrFoldersFailed) {
+		t.Fatalf("expected ErrFoldersFailed, got %v", err)
+	}
+	if names := g.ObjectNames(); strings.Join(names, ",") != "ORDER1/data.txt" {
+		t.Fatalf("expected only ORDER1 uploaded, got %v", names)
+	}
+	if l, ok := f.Lease("locks", "share-1"); !ok || l.Agent != "agent-2" {
+		t.Fatalf("expected lease of agent-2 kept, got %+v (ok=%v)", l, ok)
+	}
+}
+
+// signalWriter discards log output and closes ch once a line contains match.
+type signalWriter struct {
+	match string
+	ch    chan struct{}
+	once  sync.Once
+}
+
+func (w *signalWriter) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), w.match) {
+		w.once.Do(func() { close(w.ch) })
+	}
+	return len(p), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_ScanOnly verifies -scan-only filters matches using state and emits
+// them as JSON without writing state, lock file or uploads.
+func TestRun_ScanOnly(t *testing.T) {
+	g, _ := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	stateFile := filepath.Join(root, "state.json")
+	lockFile := filepath.Join(root, "lock")
+	if got := runJSON(t, testConfig(root, stateFile, lockFile, os.Stdout)); len(got) != 1 {
+		t.Fatalf("expected ORDER1 emitted, got %v", got)
+	}
+	before, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatalf("read state: %v", err)
+	}
+	makeTrigger(t, root, "ORDER2", "bb")
+
+	cfg := testConfig(root, stateFile, lockFile, os.Stdout)
+	cfg.ScanOnly = true
+	cfg.GCSBucket = "bucket"
+	if got := runJSON(t, cfg); strings.Join(got, ",") != "ORDER2.RDY" {
+		t.Fatalf("expected only ORDER2 emitted, got %v", got)
+	}
+	// NOTE(joel): Running again emits the same match since nothing was
+	// recorded.
+	if got := runJSON(t, cfg); strings.Join(got, ",") != "ORDER2.RDY" {
+		t.Fatalf("expected ORDER2 emitted again, got %v", got)
+	}
+	after, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatalf("read state: %v", err)
+	}
+	if string(after) != string(before) {
+		t.Fatalf("expected state file unchanged")
+	}
+	if _, err := os.Stat(lockFile); !os.IsNotExist(err) {
+		t.Fatalf("expected no lock file, got %v", err)
+	}
+	if len(g.ObjectNames()) != 0 {
+		t.Fatalf("expected no uploads, got %v", g.ObjectNames())
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestTruncateEntries verifies folder entries are limited for output only and
+// truncated matches are flagged with the full count.
+func TestTruncateEntries(t *testing.T) {
+	matches := []scanner.Match{
+		{ReadyFile: "A.RDY", FolderEntries: []scanner.FileEntry{{Name: "1"}, {Name: "2"}, {Name: "3"}}},
+		{ReadyFile: "B.RDY", FolderEntries: []scanner.FileEntry{{Name: "1"}}},
+	}
+	if got := truncateEntries(matches, -1); len(got[0].FolderEntries) != 3 || got[0].EntriesTruncated {
+		t.Fatalf("expected unlimited entries, got %+v", got[0])
+	}
+
+	got := truncateEntries(matches, 2)
+	if len(got[0].FolderEntries) != 2 || !got[0].EntriesTruncated || got[0].EntryCount != 3 {
+		t.Fatalf("expected truncated entries, got %+v", got[0])
+	}
+	if len(got[1].FolderEntries) != 1 || got[1].EntriesTruncated || got[1].EntryCount != 0 {
+		t.Fatalf("expected short match untouched, got %+v", got[1])
+	}
+	if len(matches[0].FolderEntries) != 3 || matches[0].EntriesTruncated {
+		t.Fatalf("expected input unchanged, got %+v", matches[0])
+	}
+
+	b, err := json.Marshal(truncateEntries(matches, 0))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if strings.Contains(string(b), "folderEntries") || !strings.Contains(string(b), `"entryCount":3`) {
+		t.Fatalf("expected entries omitted, got %s", b)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_DestPrefix verifies objects and records are placed below the -dest
+// prefix, including quarantined folders.
+func TestRun_DestPrefix(t *testing.T) {
+	g, f := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	makeTrigger(t, root, "bad name", "b")
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.DestPrefix = "intake/2025"
+	cfg.FirestoreCollection = "col"
+	cfg.FolderNameRules = naming.Rules{Forbidden: " ", Action: naming.ActionQuarantine}
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := strings.Join(g.ObjectNames(), ","); got != "intake/2025/ORDER1/data.txt,intake/2025/quarantine/bad name/data.txt" {
+		t.Fatalf("unexpected objects %s", got)
+	}
+	if _, ok := f.Record("col", "intake/2025/ORDER1"); !ok {
+		t.Fatalf("expected record below prefix, got %+v", f.Records("col"))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_TrackChanges verifies folders are re-emitted once their contents
+// change without the trigger being touched, and that folders processed before
+// enabling -track-changes get a baseline fingerprint.
+func TestRun_TrackChanges(t *testing.T) {
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	makeTrigger(t, root, "ORDER2", "b")
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	if got := runJSON(t, cfg); len(got) != 2 {
+		t.Fatalf("expected both folders emitted, got %v", got)
+	}
+
+	cfg.TrackChanges = true
+	if got := runJSON(t, cfg); len(got) != 0 {
+		t.Fatalf("expected nothing emitted while recording baseline, got %v", got)
+	}
+	if err := os.WriteFile(filepath.Join(root, "ORDER1", "late.txt"), []byte("late"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := runJSON(t, cfg); len(got) != 1 || got[0] != "ORDER1.RDY" {
+		t.Fatalf("expected changed folder re-emitted, got %v", got)
+	}
+	if got := runJSON(t, cfg); len(got) != 0 {
+		t.Fatalf("expected nothing emitted after re-processing, got %v", got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_Events verifies the event stream of an uploading run.
+func TestRun_Events(t *testing.T) {
+	g, _ := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "GOOD", "a")
+	makeTrigger(t, root, "BAD", "b")
+	g.FailFolders = map[string]bool{filepath.Join(root, "BAD"): true}
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	var buf strings.Builder
+	cfg.Events = events.New(&buf)
+	if err := run(cfg); !errors.Is(err, ErrFoldersFailed) {
+		t.Fatalf("expected failed folders, got %v", err)
+	}
+
+	var types []string
+	status := map[string]string{}
+	var summary *events.Summary
+	for line := range strings.Lines(buf.String()) {
+		var e events.Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("decode %q: %v", line, err)
+		}
+		types = append(types, e.Type)
+		if e.Type == events.TypeFolderDone {
+			status[filepath.Base(e.Folder)] = e.Status
+		}
+		if e.Type == events.TypeRunDone {
+			summary = e.Summary
+		}
+	}
+	if types[0] != events.TypeScanStart || types[len(types)-1] != events.TypeRunDone {
+		t.Fatalf("unexpected event order %v", types)
+	}
+	for typ, want := range map[string]int{
+		events.TypeMatchFound: 2, events.TypeUploadStart: 2, events.TypeUploadDone: 2, events.TypeFolderDone: 2,
+	} {
+		if n := strings.Count(strings.Join(types, " "), typ); n != want {
+			t.Fatalf("expected %d %s events, got %v", want, typ, types)
+		}
+	}
+	if status["GOOD"] != events.StatusUploaded || status["BAD"] != events.StatusFailed {
+		t.Fatalf("unexpected folder status %v", status)
+	}
+	if summary == nil || summary.Scanned != 2 || summary.Emitted != 2 || summary.Failed != 1 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+	if summary.Bytes != 1 || len(summary.Folders) != 2 || len(summary.Destinations) != 1 {
+		t.Fatalf("expected upload breakdown in summary, got %+v", summary)
+	}
+	if d := summary.Destinations[0]; d.Name != "gs://bucket" || d.Folders != 1 || d.Failed != 1 || d.Files != 1 {
+		t.Fatalf("unexpected destination summary %+v", d)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_ReuploadVersions verifies a re-emitted folder is uploaded below a
+// new version, keeping the earlier delivery, and the chain is recorded.
+func TestRun_ReuploadVersions(t *testing.T) {
+	g, f := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "first")
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreCollection = "uploads"
+	cfg.ReuploadVersions = app.ReuploadCounter
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "ORDER1", "data.txt"), []byte("second"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "ORDER1.RDY"), later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if err := run(cfg); err != nil {
+		t.Fatalf("run2: %v", err)
+	}
+	if b, _ := g.Object("ORDER1/data.txt"); string(b) != "first" {
+		t.Fatalf("expected first delivery kept, got %q", b)
+	}
+	if b, _ := g.Object("ORDER1/v2/data.txt"); string(b) != "second" {
+		t.Fatalf("expected versioned delivery, got %v", g.ObjectNames())
+	}
+	rec, _ := f.Record("uploads", "ORDER1")
+	if !slices.Equal(rec.Versions, []string{"ORDER1", "ORDER1/v2"}) || rec.Files[0].Path != "ORDER1/v2/data.txt" {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestNextVersion verifies counter and timestamp versions, including
+// timestamps already delivered.
+func TestNextVersion(t *testing.T) {
+	ts := time.Date(2025, 9, 30, 12, 34, 56, 0, time.UTC)
+	m := scanner.Match{ReadyModTime: ts.Add(-time.Minute), NewestModTime: ts}
+	prev := []string{"in/ORDER1"}
+	if got := nextVersion(app.ReuploadCounter, prev, m); got != "v2" {
+		t.Fatalf("unexpected counter version %q", got)
+	}
+	if got := nextVersion(app.ReuploadTimestamp, prev, m); got != "20250930T123456Z" {
+		t.Fatalf("unexpected timestamp version %q", got)
+	}
+	prev = append(prev, "in/ORDER1/20250930T123456Z")
+	if got := nextVersion(app.ReuploadTimestamp, prev, m); got != "20250930T123456Z-v3" {
+		t.Fatalf("unexpected repeated timestamp version %q", got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_PrettyFields verifies -pretty indents the output and -fields limits
+// each match to the selected fields.
+func TestRun_PrettyFields(t *testing.T) {
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "x")
+	out, err := os.CreateTemp(t.TempDir(), "out-*.json")
+	if err != nil {
+		t.Fatalf("create out: %v", err)
+	}
+	defer out.Close()
+	cfg := testConfig(root, "", filepath.Join(root, "lock"), out)
+	cfg.Pretty = true
+	cfg.Fields = []string{"readyFile", "totalSize"}
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	b, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatalf("read out: %v", err)
+	}
+	if !strings.HasPrefix(string(b), "[\n  {\n") {
+		t.Fatalf("expected indented output, got %s", b)
+	}
+	var matches []map[string]any
+	if err := json.Unmarshal(b, &matches); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(matches) != 1 || len(matches[0]) != 2 || matches[0]["totalSize"] != float64(1) {
+		t.Fatalf("unexpected matches %v", matches)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// hangingUploader blocks uploads of the folders in hang until release is
+// closed, like a folder on a broken mount.
+type hangingUploader struct {
+	*fakes.GCS
+	hang    map[string]bool
+	release chan struct{}
+}
+
+func (h hangingUploader) UploadFolder(m scanner.Match, opts uploader.UploadOptions) uploader.FolderResult {
+	if h.hang[m.Folder] {
+		<-h.release
+	}
+	return h.GCS.UploadFolder(m, opts)
+}
+
+// TestRun_FolderDeadline verifies a folder stuck past -folder-deadline fails
+// without holding up the other folders of the run.
+func TestRun_FolderDeadline(t *testing.T) {
+	g, _ := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "A", "a")
+	makeTrigger(t, root, "B", "b")
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	newUploader = func(context.Context, *app.Config) (uploader.Uploader, error) {
+		return hangingUploader{GCS: g, hang: map[string]bool{filepath.Join(root, "B"): true}, release: release}, nil
+	}
+	prevGrace := folderDeadlineGrace
+	folderDeadlineGrace = 0
+	t.Cleanup(func() { folderDeadlineGrace = prevGrace })
+
+	stateFile := filepath.Join(root, "state.json")
+	cfg := testConfig(root, stateFile, filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.HistorySize = 5
+	cfg.FolderDeadline = 20 * time.Millisecond
+	if err := run(cfg); !errors.Is(err, ErrFoldersFailed) {
+		t.Fatalf("expected folders failed error, got %v", err)
+	}
+	if got := g.ObjectNames(); !slices.Equal(got, []string{"A/data.txt"}) {
+		t.Fatalf("expected only A uploaded, got %v", got)
+	}
+	st := state.New(stateFile)
+	if err := st.Load(); err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	if paths := st.Paths(); len(paths) != 1 || paths[0] != filepath.Join(root, "A.RDY") {
+		t.Fatalf("expected only A processed, got %v", paths)
+	}
+	if errs := st.History[0].Errors; len(errs) != 1 || !strings.Contains(errs[0], "folder deadline exceeded") {
+		t.Fatalf("expected deadline error in history, got %v", errs)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_DocIDStrategy verifies record and claim document IDs per -doc-id and
+// that folders without a producer ID aren't uploaded.
+func TestRun_DocIDStrategy(t *testing.T) {
+	g, f := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "A", "a")
+	makeTrigger(t, root, "B", "b")
+	if err := os.WriteFile(filepath.Join(root, "A.RDY"), []byte("id=order-a\n"), 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+
+	stateFile := filepath.Join(root, "state.json")
+	cfg := testConfig(root, stateFile, filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreCollection = "uploads"
+	cfg.ClaimCollection = "claims"
+	cfg.DocIDStrategy = app.DocIDProducer
+	if err := run(cfg); !errors.Is(err, ErrFoldersFailed) {
+		t.Fatalf("expected folders failed error, got %v", err)
+	}
+	if got := g.ObjectNames(); !slices.Equal(got, []string{"A/data.txt"}) {
+		t.Fatalf("expected only A uploaded, got %v", got)
+	}
+	if rec, ok := f.Document("uploads", "order-a"); !ok || rec.FolderPath != "A" {
+		t.Fatalf("expected record with producer ID, got %+v", f.Records("uploads"))
+	}
+
+	if err := os.Remove(stateFile); err != nil {
+		t.Fatalf("remove state: %v", err)
+	}
+	cfg.DocIDStrategy = app.DocIDReady
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if _, ok := f.Document("uploads", "B"); !ok {
+		t.Fatalf("expected record named after the trigger, got %+v", f.Records("uploads"))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_CollectionTemplate verifies records are written to the nested
+// collection expanded per folder and folders the template can't be expanded
+// for aren't uploaded.
+func TestRun_CollectionTemplate(t *testing.T) {
+	g, f := useFakes(t)
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "S1"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	makeTrigger(t, filepath.Join(root, "S1"), "ORDER1", "a")
+	makeTrigger(t, root, "ORDER2", "b")
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.Recursive = true
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreCollection = "sites/{site}/uploads"
+	labels, err := naming.NewLabels(`^(?P<site>[^/]+)/`)
+	if err != nil {
+		t.Fatalf("NewLabels: %v", err)
+	}
+	cfg.PathLabels = labels
+	if err := run(cfg); !errors.Is(err, ErrFoldersFailed) {
+		t.Fatalf("expected folders failed error, got %v", err)
+	}
+
+	if got := g.ObjectNames(); !slices.Equal(got, []string{"ORDER1/data.txt"}) {
+		t.Fatalf("expected only ORDER1 uploaded, got %v", got)
+	}
+	if _, ok := f.Record("sites/S1/uploads", filepath.Join("S1", "ORDER1")); !ok {
+		t.Fatalf("expected record in nested collection, got %+v", f.Records("sites/S1/uploads"))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_RescanBeforeUpload verifies files added between the scan and the
+// upload are only uploaded with -rescan-before-upload.
+func TestRun_RescanBeforeUpload(t *testing.T) {
+	for _, rescan := range []bool{false, true} {
+		g, _ := useFakes(t)
+		root := t.TempDir()
+		makeTrigger(t, root, "ORDER1", "a")
+		// NOTE(joel): The uploader is created after the scan, right before
+		// the uploads start.
+		prev := newUploader
+		newUploader = func(ctx context.Context, cfg *app.Config) (uploader.Uploader, error) {
+			if err := os.WriteFile(filepath.Join(root, "ORDER1", "late.txt"), []byte("b"), 0o644); err != nil {
+				t.Fatalf("write file: %v", err)
+			}
+			return prev(ctx, cfg)
+		}
+
+		cfg := testConfig(root, filepath.Join(t.TempDir(), "state.json"), filepath.Join(t.TempDir(), "lock"), os.Stdout)
+		cfg.GCSBucket = "bucket"
+		cfg.RescanBeforeUpload = rescan
+		if err := run(cfg); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+		if _, ok := g.Object("ORDER1/late.txt"); ok != rescan {
+			t.Fatalf("rescan=%v: unexpected objects %v", rescan, g.ObjectNames())
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_Partition verifies processes with -partition upload disjoint shares
+// of the triggers that together cover all of them.
+func TestRun_Partition(t *testing.T) {
+	root := t.TempDir()
+	for i := range 8 {
+		makeTrigger(t, root, fmt.Sprintf("ORDER%d", i), "a")
+	}
+	seen := make(map[string]int)
+	for index := range 2 {
+		g, _ := useFakes(t)
+		cfg := testConfig(root, filepath.Join(root, fmt.Sprintf("state%d.json", index)), filepath.Join(root, fmt.Sprintf("%d.lock", index)), os.Stdout)
+		cfg.GCSBucket = "bucket"
+		cfg.Partition = app.Partition{Index: index, Count: 2}
+		if err := run(cfg); err != nil {
+			t.Fatalf("run partition %d: %v", index, err)
+		}
+		names := g.ObjectNames()
+		if len(names) == 0 || len(names) == 8 {
+			t.Fatalf("expected partition %d to upload a share, got %v", index, names)
+		}
+		for _, n := range names {
+			seen[n]++
+		}
+	}
+	if len(seen) != 8 {
+		t.Fatalf("expected all folders uploaded, got %v", seen)
+	}
+	for n, c := range seen {
+		if c != 1 {
+			t.Fatalf("expected %s uploaded once, got %d", n, c)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_Only verifies -only uploads just the matching folders and leaves the
+// others to the next run.
+func TestRun_Only(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"ORDER1", "ORDER12", "ORDER2"} {
+		makeTrigger(t, root, name, "a")
+	}
+	stateFile := filepath.Join(root, "state.json")
+	g, _ := useFakes(t)
+	cfg := testConfig(root, stateFile, filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	only, err := app.ParseNameFilter("ORDER1*")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	cfg.Only = only
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if names := g.ObjectNames(); !slices.Equal(names, []string{"ORDER1/data.txt", "ORDER12/data.txt"}) {
+		t.Fatalf("expected only ORDER1* uploaded, got %v", names)
+	}
+
+	g, _ = useFakes(t)
+	cfg = testConfig(root, stateFile, filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	if err := run(cfg); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if names := g.ObjectNames(); !slices.Equal(names, []string{"ORDER2/data.txt"}) {
+		t.Fatalf("expected ORDER2 left for the next run, got %v", names)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_SkipList verifies triggers on the skip list are never uploaded and
+// the list is read again on every run.
+func TestRun_SkipList(t *testing.T) {
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	makeTrigger(t, root, "ORDER2", "b")
+	list := filepath.Join(t.TempDir(), "skip.txt")
+	if err := os.WriteFile(list, []byte("ORDER2.RDY\n"), 0o644); err != nil {
+		t.Fatalf("write skip list: %v", err)
+	}
+	stateFile := filepath.Join(root, "state.json")
+	g, _ := useFakes(t)
+	cfg := testConfig(root, stateFile, filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.SkipListFile = list
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if names := g.ObjectNames(); !slices.Equal(names, []string{"ORDER1/data.txt"}) {
+		t.Fatalf("expected ORDER2 skipped, got %v", names)
+	}
+
+	if err := os.WriteFile(list, nil, 0o644); err != nil {
+		t.Fatalf("write skip list: %v", err)
+	}
+	if err := run(cfg); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if names := g.ObjectNames(); !slices.Equal(names, []string{"ORDER1/data.txt", "ORDER2/data.txt"}) {
+		t.Fatalf("expected ORDER2 uploaded once removed from the list, got %v", names)
+	}
+
+	cfg.SkipListFile = filepath.Join(t.TempDir(), "missing")
+	if err := run(cfg); err == nil {
+		t.Fatalf("expected error for a missing skip list")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_EnvClock verifies a run takes its timestamps (history, records, last
+// run) from the clock of Config.Env.
+func TestRun_EnvClock(t *testing.T) {
+	_, f := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cfg := testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreProjectId = "project"
+	cfg.FirestoreCollection = "uploads"
+	cfg.HistorySize = 5
+	cfg.Env = app.Env{Clock: app.ClockFunc(func() time.Time { return now })}
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	if rec, ok := f.Record("uploads", "ORDER1"); !ok || !rec.UploadedAt.Equal(now) {
+		t.Fatalf("expected record uploaded at the env's time, got %+v %v", rec, ok)
+	}
+	st := state.New(cfg.StateFile)
+	if err := st.Load(); err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	if len(st.History) != 1 || !st.History[0].Start.Equal(now) || st.History[0].Duration != 0 || !st.LastRun.Equal(now) {
+		t.Fatalf("expected history at the env's time, got %+v last run %s", st.History, st.LastRun)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// mtimeFS reports mod as the modification time of every file.
+type mtimeFS struct {
+	app.OSFileSystem
+	mod time.Time
+}
+
+type mtimeInfo struct {
+	fs.FileInfo
+	mod time.Time
+}
+
+func (i mtimeInfo) ModTime() time.Time { return i.mod }
+
+func (m mtimeFS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := m.OSFileSystem.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return mtimeInfo{fi, m.mod}, nil
+}
+
+// TestRun_EnvMtimes verifies the age trigger runs on the clock of Config.Env
+// and processed triggers are recorded with the modification time its FS
+// reports.
+func TestRun_EnvMtimes(t *testing.T) {
+	g, _ := useFakes(t)
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "ORDER1"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "ORDER1", "data.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	mod := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cfg := testConfig(root, filepath.Join(t.TempDir(), "state.json"), filepath.Join(t.TempDir(), "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.Triggers = []scanner.Trigger{scanner.Age{MinAge: time.Hour}}
+	cfg.Env = app.Env{
+		Clock: app.ClockFunc(func() time.Time { return time.Now().Add(2 * time.Hour) }),
+		FS:    mtimeFS{mod: mod},
+	}
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	if len(g.ObjectNames()) == 0 {
+		t.Fatalf("expected the folder to be old enough on the env's clock")
+	}
+	st := state.New(cfg.StateFile)
+	if err := st.Load(); err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	if v, ok := st.Get(filepath.Join(root, "ORDER1")); !ok || v != mod.UnixNano() {
+		t.Fatalf("expected the env's mtime in state, got %d %v", v, ok)
+	}
+}
@@ -0,0 +1,1168 @@
+package pipeline
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/events"
+	"local-file-sync/internal/naming"
+	"local-file-sync/internal/progress"
+	"local-file-sync/internal/report"
+	"local-file-sync/internal/scanner"
+	"local-file-sync/internal/state"
+	"local-file-sync/internal/uploader"
+)
+
+// runner carries a run through its stages: scan lists the triggers, filter
+// selects the folders to process, upload uploads them (or emitMatches prints
+// them), record evaluates the uploads and saveState records the run. Each
+// stage reads what the earlier ones left in the runner.
+type runner struct {
+	cfg   *app.Config
+	chunk *backfillChunk
+	rep   *Report
+	start time.Time
+	emit  func(events.Event)
+	st    *state.Store
+	sg    stages
+
+	// NOTE(joel): Set by scan.
+	matches      []scanner.Match
+	scanErrors   []string
+	scanWarnings []string
+
+	// NOTE(joel): Set by filter: the folders to process with their upload
+	// options, the trigger versions of the matches by folder and, with
+	// -track-changes, their content fingerprints (recorded in state once a
+	// folder is processed). held marks triggers that must not be marked
+	// processed yet.
+	matchedFiles []scanner.Match
+	uploadOpts   []uploader.UploadOptions
+	triggers     map[string]int64
+	fingerprints map[string]string
+	held         map[string]bool
+
+	// NOTE(joel): Counted by all stages.
+	skipped   int
+	emitted   int
+	failed    int
+	deferred  int
+	runErrors []string
+	orphans   []string
+
+	// NOTE(joel): Set by upload and record: the trigger ages at upload by
+	// folder (-1 if unknown, e.g. resumed folders), those of the uploaded
+	// folders and the statistics of the upload.
+	ages      []time.Duration
+	latencies []time.Duration
+	tp        *state.Throughput
+	folders   []events.FolderSummary
+}
+
+// uploadClients are the clients the folders of a run are uploaded and
+// recorded with (see runner.openClients). fs is nil if Firestore isn't
+// configured or could not be initialized; pending is nil without a pending
+// file.
+type uploadClients struct {
+	u       uploader.Uploader
+	fs      uploader.RecordWriter
+	pending *uploader.Pending
+	close   func()
+}
+
+// uploadPass is what the folder uploads of a run share (see
+// runner.uploadMatch).
+type uploadPass struct {
+	uploadClients
+	bar *progress.Display
+	// resumed marks folders whose upload and record completed in an
+	// interrupted run.
+	resumed map[string]bool
+	// budgetEnd is the end of the -wave-budget (zero without); folders not
+	// started before it are marked in overBudget.
+	budgetEnd  time.Time
+	overBudget []bool
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// newRunner prepares a run started now. The event stream of -events-file is
+// written alongside the log; scan-only runs write nothing, so they emit no
+// events either.
+func newRunner(cfg *app.Config, chunk *backfillChunk, rep *Report) *runner {
+	ev := cfg.Events
+	if cfg.ScanOnly {
+		ev = nil
+	}
+	r := &runner{
+		cfg:   cfg,
+		chunk: chunk,
+		rep:   rep,
+		start: cfg.Env.Now(),
+		emit: func(e events.Event) {
+			if err := ev.Emit(e); err != nil {
+				cfg.Warnf("events warning: %v", err)
+			}
+		},
+		triggers:     make(map[string]int64),
+		fingerprints: make(map[string]string),
+	}
+	r.sg = stages{cfg: cfg, emit: r.emit}
+	rep.RunID, rep.Start = cfg.RunID, r.start
+	return r
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// uploading reports whether the run uploads the folders it selects; otherwise
+// they are emitted as JSON.
+func (r *runner) uploading() bool {
+	return r.cfg.GCSBucket != "" && !r.cfg.ScanOnly
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// loadState loads the state file, if one is configured and enabled.
+func (r *runner) loadState() {
+	cfg := r.cfg
+	if cfg.StateFile == "" {
+		return
+	}
+	if cfg.DisableState {
+		cfg.Logger.Printf("-no-state set: ignoring existing state file and forcing full emit")
+		return
+	}
+	cfg.Logger.Printf("using state file: %s", cfg.StateFile)
+	r.st = state.New(cfg.StateFile)
+	r.st.FS = cfg.Env.FS
+	r.st.NormalizeKeys = cfg.NormalizeUnicode
+	r.st.Root = cfg.RootDir
+	r.st.RelativeKeys = cfg.StateRelativeKeys
+	if err := r.st.Load(); err != nil {
+		cfg.Warnf("state load warning: %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// scan lists the triggers of the run: the targets of the backfill chunk, the
+// folders read from stdin or the *.RDY files found below the root. With
+// -skip-unreadable, unreadable subdirectories are recorded in the run history
+// instead of failing the run.
+func (r *runner) scan() error {
+	cfg := r.cfg
+	scanOpts := scanOptions(cfg)
+	// NOTE(joel): The skip list is read on every run, so a process running
+	// the pipeline repeatedly picks up edits without a restart. Triggers on it
+	// are never listed, like those of other partitions.
+	skipListed := 0
+	if cfg.SkipListFile != "" {
+		skipList, err := app.LoadSkipList(cfg.SkipListFile)
+		if err != nil {
+			return err
+		}
+		sel := scanOpts.Select
+		scanOpts.Select = func(readyFile string) bool {
+			if skipList.Skips(cfg.RootDir, readyFile) {
+				skipListed++
+				return false
+			}
+			return sel == nil || sel(readyFile)
+		}
+	}
+	if cfg.SkipUnreadable {
+		scanOpts.OnError = func(path string, err error) {
+			cfg.Warnf("scan warning: skipping %s: %v", path, err)
+			r.scanErrors = append(r.scanErrors, fmt.Sprintf("scan: %v", err))
+		}
+	}
+	// NOTE(joel): With -scan-timeout, a hung mount only costs the affected
+	// subtree or folder; it is retried on the next run. A folder can time out
+	// while walking and again while being listed, but is reported once.
+	if cfg.ScanTimeout > 0 {
+		timedOut := make(map[string]bool)
+		scanOpts.OnTimeout = func(path string, err error) {
+			if timedOut[path] {
+				return
+			}
+			timedOut[path] = true
+			cfg.Warnf("scan warning: skipping %s: %v", path, err)
+			r.scanErrors = append(r.scanErrors, fmt.Sprintf("scan timeout: %v", err))
+		}
+	}
+	r.emit(events.Event{Type: events.TypeScanStart, Root: cfg.RootDir})
+	var matches []scanner.Match
+	if r.chunk != nil {
+		matches = scanner.ScanTargets(r.chunk.targets, scanOpts)
+	} else if cfg.FromStdin {
+		// NOTE(joel): Another tool chose the folders; they are listed like
+		// scanned ones and go through the same state checks and uploads.
+		targets, err := readTargets(cfg.Stdin)
+		if err != nil {
+			return fmt.Errorf("stdin: %w", err)
+		}
+		matches = scanner.ScanTargets(targets, scanOpts)
+		cfg.Logger.Printf("read %d folder(s) from stdin", len(matches))
+	} else {
+		var err error
+		if matches, err = scanner.Scan(cfg.RootDir, scanOpts); err != nil {
+			return fmt.Errorf("scan: %w", err)
+		}
+	}
+	if cfg.Partition.Enabled() {
+		cfg.Logger.Printf("partition %s: %d match(es)", cfg.Partition, len(matches))
+	}
+	if cfg.Only.Enabled() {
+		cfg.Logger.Printf("only %s: %d match(es)", cfg.Only, len(matches))
+	}
+	if skipListed > 0 {
+		cfg.Logger.Printf("skip list: ignored %d match(es)", skipListed)
+	}
+	// NOTE(joel): Order matches before filtering so per-run caps drain the
+	// backlog in the configured order.
+	scanner.SortMatches(matches, cfg.Order)
+	for _, m := range matches {
+		r.emit(events.Event{Type: events.TypeMatchFound, ReadyFile: m.ReadyFile, Folder: m.Folder})
+	}
+	// NOTE(joel): Non-fatal scan issues are logged one by one and summarized
+	// per match in the run history, so a folder with thousands of unreadable
+	// entries doesn't bloat the state file.
+	for _, m := range matches {
+		if len(m.Warnings) == 0 {
+			continue
+		}
+		for _, w := range m.Warnings {
+			cfg.Warnf("scan warning: %s: %s", m.ReadyFile, w)
+		}
+		line := fmt.Sprintf("%s: %s", m.ReadyFile, m.Warnings[0])
+		if n := len(m.Warnings) - 1; n > 0 {
+			line += fmt.Sprintf(" (and %d more)", n)
+		}
+		r.scanWarnings = append(r.scanWarnings, line)
+	}
+	r.matches = matches
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// filter selects the scanned matches to process: it skips orphaned,
+// incomplete, empty, invalidly named and (per state) unchanged ones, defers
+// those beyond the per-run caps or still being written and, when uploading,
+// fails folders whose objects would collide.
+func (r *runner) filter() {
+	cfg := r.cfg
+	// TODO: Emitted/skipped should track missing folders too.
+
+	// NOTE(joel): Build matchedFiles output considering existing state: skip any
+	// *.RDY files already recorded.
+	r.matchedFiles = make([]scanner.Match, 0, len(r.matches))
+	r.uploadOpts = make([]uploader.UploadOptions, 0, len(r.matches))
+	var runBytes int64
+	// NOTE(joel): With -nice-io, the reads of all uploads share one budget.
+	var nice *uploader.NiceIO
+	if cfg.NiceIO && r.uploading() {
+		nice = &uploader.NiceIO{Rate: cfg.NiceIORate}
+		if err := app.LowerIOPriority(); err != nil {
+			cfg.Warnf("nice-io warning: %v", err)
+		}
+	}
+	for _, m := range r.matches {
+		// NOTE(joel): Corresponding folder is missing: skip.
+		if m.MissingFolder || m.Folder == "" {
+			cfg.Logger.Printf("skip (missing folder): %s", m.ReadyFile)
+			r.orphans = append(r.orphans, m.ReadyFile)
+			r.skipped++
+			continue
+		}
+
+		// NOTE(joel): With -require-count, a folder is only ready once it holds
+		// the announced number of entries. Incomplete folders are not recorded
+		// in state, so they are checked again on the next run.
+		if cfg.RequireCount {
+			if ready, have, want := scanner.CountReady(m); !ready {
+				if want < 0 {
+					cfg.Logger.Printf("skip (no entry count announced): %s", m.ReadyFile)
+				} else {
+					cfg.Logger.Printf("skip (incomplete: %d of %d entries): %s", have, want, m.ReadyFile)
+				}
+				r.skipped++
+				continue
+			}
+		}
+
+		// NOTE(joel): With -empty-folder=retry, folders without uploadable files
+		// are left untouched until the producer wrote some.
+		if cfg.EmptyFolder == app.EmptyFolderRetry && !hasUploadableFiles(m, cfg.FollowFileSymlinks) {
+			cfg.Logger.Printf("skip (empty folder): %s", m.ReadyFile)
+			r.skipped++
+			continue
+		}
+
+		// NOTE(joel): Normalize and validate the folder name. Invalid names are
+		// either rejected (skipped) or quarantined under a dedicated prefix with
+		// their original name.
+		opts := r.uploadOptions(m, nice)
+		name, nameErr := cfg.FolderNameRules.Apply(filepath.Base(m.Folder))
+		switch {
+		case nameErr == nil:
+			opts.FolderName = name
+		case cfg.FolderNameRules.Action == naming.ActionQuarantine:
+			cfg.Logger.Printf("quarantine (invalid folder name): %s: %v", m.ReadyFile, nameErr)
+			opts.Prefix = path.Join(cfg.DestPrefix, naming.QuarantinePrefix)
+		default:
+			cfg.Logger.Printf("skip (invalid folder name): %s: %v", m.ReadyFile, nameErr)
+			r.skipped++
+			continue
+		}
+		if cfg.RelativeObjectNames {
+			opts.FolderName = relativeObjectName(cfg.RootDir, m.Folder, opts.FolderName)
+		}
+
+		if r.st != nil && r.unchanged(m) {
+			cfg.Logger.Printf("skip (unchanged): %s", m.ReadyFile)
+			r.skipped++
+			continue
+		}
+
+		// NOTE(joel): With -reupload-versions, a folder delivered before is
+		// uploaded below a new version instead of over the earlier delivery.
+		if cfg.ReuploadVersions != app.ReuploadOverwrite && r.st != nil {
+			if prev := deliveries(r.st, m, opts); len(prev) > 0 {
+				opts.Version = nextVersion(cfg.ReuploadVersions, prev, m)
+			}
+		}
+
+		// NOTE(joel): Enforce per-run caps. Once a cap is reached all remaining
+		// matches are deferred without touching state, so the next run picks
+		// them up. The first folder is always processed so a single folder
+		// larger than -max-bytes-per-run can't block the queue.
+		folderBytes := folderSize(m, cfg.FollowFileSymlinks)
+		if len(r.matchedFiles) > 0 && (r.deferred > 0 ||
+			(cfg.MaxFoldersPerRun > 0 && len(r.matchedFiles) >= cfg.MaxFoldersPerRun) ||
+			(cfg.MaxBytesPerRun > 0 && runBytes+folderBytes > cfg.MaxBytesPerRun)) {
+			r.deferred++
+			continue
+		}
+		runBytes += folderBytes
+
+		// NOTE(joel): No state or not seen before: emit.
+		r.matchedFiles = append(r.matchedFiles, m)
+		r.uploadOpts = append(r.uploadOpts, opts)
+		cfg.Logger.Printf("emit (new): %s", m.ReadyFile)
+		r.emitted++
+	}
+	if r.deferred > 0 {
+		cfg.Logger.Printf("per-run cap reached: deferred %d match(es) to the next run", r.deferred)
+	}
+	// NOTE(joel): Folders with files still being written are deferred like
+	// capped ones, so a later run picks them up once they are complete.
+	if cfg.InProgress.Enabled() {
+		if busy := inProgressFiles(cfg.InProgress, r.matchedFiles, cfg.FollowFileSymlinks, cfg.Env.Now()); len(busy) > 0 {
+			r.keep(func(i int, m scanner.Match) bool {
+				files, ok := busy[i]
+				if ok {
+					cfg.Logger.Printf("defer (in progress): folder=%s files=%s", m.Folder, strings.Join(files, ","))
+					r.emitted--
+					r.deferred++
+				}
+				return !ok
+			})
+		}
+	}
+	// NOTE(joel): Uploading runs track the pipeline stage of every match in
+	// state; see stages.
+	if r.uploading() {
+		r.sg.st = r.st
+	}
+	// NOTE(joel): Folders uploaded to the same prefix would overwrite each
+	// other's objects. Depending on -name-collisions they are namespaced or
+	// failed; failed ones stay unprocessed so they are reported every run.
+	if r.uploading() {
+		if errs := nameCollisions(cfg, r.matchedFiles, r.uploadOpts); len(errs) > 0 {
+			r.keep(func(i int, m scanner.Match) bool {
+				err, collides := errs[i]
+				if !collides {
+					return true
+				}
+				cfg.Warnf("folder upload warning: folder=%s err=%v", m.Folder, err)
+				r.sg.discover(m, r.triggers[m.Folder])
+				r.sg.advance(m.ReadyFile, m.Folder, state.StageFailed, err)
+				r.runErrors = append(r.runErrors, fmt.Sprintf("%s: %v", m.Folder, err))
+				reportError(cfg, report.LevelError, err.Error(), map[string]string{"folder": m.Folder})
+				r.emit(events.Event{Type: events.TypeFolderDone, ReadyFile: m.ReadyFile, Folder: m.Folder, Status: events.StatusFailed, Error: err.Error()})
+				r.failed++
+				return false
+			})
+		}
+	}
+	r.held = heldBatches(r.matches, r.matchedFiles)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// keep keeps the selected matches (and their upload options) for which fn
+// returns true, in order.
+func (r *runner) keep(fn func(i int, m scanner.Match) bool) {
+	keptMatches, keptOpts := r.matchedFiles[:0], r.uploadOpts[:0]
+	for i, m := range r.matchedFiles {
+		if fn(i, m) {
+			keptMatches, keptOpts = append(keptMatches, m), append(keptOpts, r.uploadOpts[i])
+		}
+	}
+	r.matchedFiles, r.uploadOpts = keptMatches, keptOpts
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// uploadOptions returns the upload options of m configured by the flags,
+// before its folder name is applied.
+func (r *runner) uploadOptions(m scanner.Match, nice *uploader.NiceIO) uploader.UploadOptions {
+	cfg := r.cfg
+	opts := uploader.UploadOptions{
+		Prefix:           cfg.DestPrefix,
+		NormalizeUnicode: cfg.NormalizeUnicode,
+		Metadata:         objectMetadata(cfg, m),
+		FollowSymlinks:   cfg.FollowFileSymlinks,
+		DedupeHardlinks:  cfg.DedupeHardlinks,
+		CompressSparse:   cfg.CompressSparse,
+		NiceIO:           nice,
+		ReadBack:         cfg.ReadBack,
+		BundleSmallFiles: cfg.BundleSmallFiles,
+		SkipExisting:     cfg.SkipExisting,
+		EmptyMarker:      cfg.EmptyFolder == app.EmptyFolderMarker,
+		Deadline:         cfg.FolderDeadline,
+		StrictSnapshot:   cfg.Snapshot == app.SnapshotStrict,
+		ContentTypes:     cfg.ContentTypes,
+		FileOwnership:    cfg.PreserveOwnership,
+		ObjectACLs:       cfg.ObjectACLs,
+		Hold:             cfg.ObjectHold,
+		Retention:        cfg.ObjectRetention,
+	}
+	switch cfg.FileFailure {
+	case app.FileFailureCancel:
+		opts.CancelOnFileFailure = true
+	case app.FileFailureRetry:
+		opts.FileRetry = uploader.Backoff{Retries: cfg.FileRetries, Initial: cfg.FileRetryBackoff}
+	}
+	switch cfg.IfExists {
+	case app.IfExistsSkip:
+		opts.CreateOnly, opts.SkipConflicts = true, true
+	case app.IfExistsConflict:
+		opts.CreateOnly = true
+	}
+	if r.st != nil {
+		opts.Done = doneFiles(r.st.PartialFiles(m.Folder))
+	}
+	return opts
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// unchanged reports whether m was processed before and neither its trigger
+// nor (with -track-changes) its contents changed since. It records the
+// trigger version and fingerprint of m for the later stages.
+func (r *runner) unchanged(m scanner.Match) bool {
+	cfg := r.cfg
+	// NOTE(joel): We re-emit a *.RDY file if its modTime has changed since
+	// first observation. This allows a workflow where the triggering file is
+	// "touched" or rewritten to signal re-processing.
+	var curMod int64 = 1
+	if fi, err := cfg.Env.Files().Stat(m.ReadyFile); err == nil {
+		curMod = fi.ModTime().UnixNano()
+	} else {
+		cfg.Warnf("stat warning: %s: %v", m.ReadyFile, err)
+	}
+	r.triggers[m.Folder] = curMod
+
+	// NOTE(joel): With -track-changes, a folder is also re-emitted if its
+	// contents changed since it was processed, covering producers that
+	// append files without touching the trigger.
+	var fingerprint string
+	if cfg.TrackChanges {
+		fp, err := m.Fingerprint()
+		if err != nil {
+			cfg.Warnf("fingerprint warning: %s: %v", m.Folder, err)
+		} else {
+			fingerprint = fp
+			r.fingerprints[m.Folder] = fp
+		}
+	}
+
+	prev, ok := r.st.Get(m.ReadyFile)
+	if !ok {
+		return false
+	}
+	recorded := r.st.Fingerprint(m.Folder)
+	switch {
+	case prev != curMod:
+		// NOTE(joel): Mod time changed: emit.
+		cfg.Logger.Printf("emit (changed): %s", m.ReadyFile)
+		return false
+	case fingerprint != "" && recorded != "" && fingerprint != recorded:
+		cfg.Logger.Printf("emit (contents changed): %s", m.ReadyFile)
+		return false
+	}
+	// NOTE(joel): Unchanged since last emission: skip. Folders processed
+	// before -track-changes was enabled get their fingerprint recorded now, as
+	// the baseline for later runs.
+	if fingerprint != "" && recorded == "" {
+		r.st.SetFingerprint(m.Folder, fingerprint)
+	}
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// openClients confirms the uploads (with -confirm) and creates the clients to
+// upload and record them. ok is false if the run ends without uploading:
+// the uploads weren't confirmed or, without -strict, the uploader could not
+// be initialized. With -strict, cloud init failures abort the run with a
+// non-zero exit (and without recording it) so schedulers notice. Records
+// queued by earlier runs are flushed before uploading, so they can't
+// overwrite newer records of the same folder.
+func (r *runner) openClients(ctx context.Context, cl clients) (uc uploadClients, ok bool, err error) {
+	cfg := r.cfg
+	// NOTE(joel): With -confirm, nothing is uploaded (and state is left
+	// untouched) unless the listed folders are confirmed.
+	ok, err = confirmUploads(cfg, r.matchedFiles, r.uploadOpts)
+	if err != nil {
+		return uc, false, fmt.Errorf("confirm: %w", err)
+	}
+	if !ok {
+		cfg.Logger.Printf("uploads not confirmed: nothing uploaded")
+		return uc, false, nil
+	}
+
+	uc.u, err = cl.uploader(ctx, cfg)
+	if err != nil {
+		if cfg.Strict {
+			return uc, false, fmt.Errorf("gcs init: %w", err)
+		}
+		cfg.Warnf("gcs init warning: %v", err)
+		return uc, false, nil
+	}
+	closers := []func(){func() { uc.u.Close() }}
+	uc.close = func() {
+		for _, c := range slices.Backward(closers) {
+			c()
+		}
+	}
+	if cfg.SimulateFailures > 0 {
+		cfg.Logger.Printf("simulate-failures enabled: rate=%.2f", cfg.SimulateFailures)
+	}
+	cfg.Logger.Printf(
+		"concurrency: folders=%s files=%s",
+		describeConcurrency(cfg.FolderConcurrency), describeConcurrency(cfg.FileConcurrency),
+	)
+
+	// NOTE(joel): If Firestore collection is configured, create a Firestore
+	// client to record uploaded folder metadata.
+	if cfg.FirestoreCollection != "" {
+		fs, err := cl.recordWriter(ctx, cfg)
+		if err != nil && cfg.Strict {
+			uc.close()
+			return uc, false, fmt.Errorf("firestore init: %w", err)
+		}
+		if err != nil {
+			cfg.Warnf("firestore init warning: %v (records are queued until it is reachable)", err)
+		} else {
+			uc.fs = fs
+			closers = append(closers, func() { fs.Close() })
+		}
+	}
+	// NOTE(joel): With -record-index, every record written (including
+	// flushed pending ones) is remembered locally; see recordsCommand.
+	if uc.fs != nil && cfg.RecordIndex != "" {
+		index, err := uploader.OpenRecordIndex(cfg.RecordIndex)
+		if err != nil {
+			cfg.Warnf("record index warning: %v (records are not indexed)", err)
+		} else {
+			uc.fs = uploader.IndexedWriter{RecordWriter: uc.fs, Index: index}
+			closers = append(closers, func() {
+				if err := index.Save(); err != nil {
+					cfg.Warnf("record index warning: %v", err)
+				}
+			})
+		}
+	}
+
+	// NOTE(joel): Records that failed to write on earlier runs (or while
+	// Firestore was unreachable) are queued locally.
+	if cfg.FirestoreCollection != "" && cfg.PendingFile != "" {
+		uc.pending = uploader.NewPending(cfg.PendingFile)
+	}
+	if uc.pending != nil && uc.fs != nil {
+		n, err := uc.pending.Flush(uc.fs)
+		if n > 0 {
+			cfg.Logger.Printf("flushed %d pending firestore record(s)", n)
+		}
+		if err != nil {
+			cfg.Warnf("pending records warning: %v", err)
+		}
+	}
+	return uc, true, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// upload uploads the selected folders with uc and returns their results in
+// match order. Folders deferred by -wave-budget are dropped from the
+// selection; folders not started before ctx was canceled fail.
+func (r *runner) upload(ctx context.Context, uc uploadClients) []uploader.FolderResult {
+	cfg := r.cfg
+	p := &uploadPass{uploadClients: uc, resumed: make(map[string]bool)}
+	// NOTE(joel): Matches whose upload and record completed for the same
+	// trigger in an interrupted run are resumed: only marking them processed
+	// is left. The others are validated now that the run is confirmed, and
+	// the stages are checkpointed before uploading.
+	for _, m := range r.matchedFiles {
+		if r.sg.discover(m, r.triggers[m.Folder]) {
+			p.resumed[m.Folder] = true
+			continue
+		}
+		r.sg.advance(m.ReadyFile, m.Folder, state.StageValidated, nil)
+	}
+	r.sg.checkpoint()
+
+	// NOTE(joel): On an interactive terminal, show a progress display and
+	// route log lines through it so they are printed above the bar.
+	logOut := cfg.Logger.Writer()
+	if len(r.matchedFiles) > 0 && progress.Enabled(cfg.Progress, cfg.Stdout) {
+		p.bar = progress.New(cfg.Stdout, len(r.matchedFiles))
+		cfg.Logger.SetOutput(p.bar.Writer(logOut))
+	}
+
+	r.ages = make([]time.Duration, len(r.matchedFiles))
+	for i := range r.ages {
+		r.ages[i] = -1
+	}
+	// NOTE(joel): With -wave-budget, folders not started within the budget
+	// are deferred instead of uploaded. The first folder always starts, so
+	// every wave makes progress.
+	if cfg.WaveBudget > 0 {
+		p.budgetEnd = cfg.Env.Now().Add(cfg.WaveBudget)
+	}
+	p.overBudget = make([]bool, len(r.matchedFiles))
+
+	// NOTE(joel): Build folder upload tasks. RunOrdered keeps their results
+	// in input order, so outcomes are evaluated in match order afterwards.
+	var tasks []app.ResultTask[uploader.FolderResult]
+	for i, m := range r.matchedFiles {
+		tasks = append(tasks, app.LabeledResult(m.Folder, func(ctx context.Context) (uploader.FolderResult, error) {
+			return r.uploadMatch(ctx, p, i, m), nil
+		}))
+	}
+	// NOTE(joel): Throughput divides the bytes actually sent by the time it
+	// took, like the uploader's own file and folder durations, so it stays on
+	// real time instead of cfg.Env.
+	uploadStart := time.Now()
+	var results []uploader.FolderResult
+	if len(tasks) > 0 {
+		var err error
+		results, err = app.RunOrdered(ctx, cfg.FolderConcurrency, tasks)
+		if err != nil {
+			cfg.Warnf("gcs folder upload warning: %v", err)
+		}
+		// NOTE(joel): Folders deferred by -wave-budget are left untouched,
+		// like those beyond a per-run cap; a batch waits for its deferred
+		// folders.
+		if slices.Contains(p.overBudget, true) {
+			kept := 0
+			for i, m := range r.matchedFiles {
+				if p.overBudget[i] {
+					if m.Batch {
+						r.held[m.ReadyFile] = true
+					}
+					continue
+				}
+				r.matchedFiles[kept], r.uploadOpts[kept], r.ages[kept], results[kept] = m, r.uploadOpts[i], r.ages[i], results[i]
+				kept++
+			}
+			n := len(r.matchedFiles) - kept
+			r.matchedFiles, r.uploadOpts, r.ages, results = r.matchedFiles[:kept], r.uploadOpts[:kept], r.ages[:kept], results[:kept]
+			cfg.Logger.Printf("wave budget of %s reached: deferred %d match(es) to the next wave", cfg.WaveBudget, n)
+			r.emitted -= n
+			r.deferred += n
+		}
+		// NOTE(joel): Folders not started before ctx was canceled fail, so
+		// their triggers are retried by the next run.
+		for i, res := range results {
+			if res.ReadyFile == "" {
+				m := r.matchedFiles[i]
+				results[i] = uploader.FolderResult{ReadyFile: m.ReadyFile, Folder: m.Folder, Errors: []error{fmt.Errorf("not started: %w", context.Cause(ctx))}}
+			}
+		}
+		r.tp = throughput(results, primaryDestination(cfg).String(), time.Since(uploadStart))
+		r.folders = folderSummaries(results)
+		// NOTE(joel): The folder pool never starts more workers than folders.
+		r.tp.FolderConcurrency = min(app.EffectiveConcurrency(cfg.FolderConcurrency), len(tasks))
+		r.tp.FileConcurrency = app.EffectiveConcurrency(cfg.FileConcurrency)
+	}
+	if p.bar != nil {
+		p.bar.Finish()
+		cfg.Logger.SetOutput(logOut)
+	}
+	return results
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// uploadMatch claims, uploads and records the i-th selected folder m. A
+// zero result means the folder wasn't started: ctx was canceled or the wave
+// budget exhausted (see uploadPass.overBudget).
+func (r *runner) uploadMatch(ctx context.Context, p *uploadPass, i int, m scanner.Match) (res uploader.FolderResult) {
+	cfg, st := r.cfg, r.st
+	fail := func(err error) uploader.FolderResult {
+		p.bar.FolderDone(0)
+		return uploader.FolderResult{ReadyFile: m.ReadyFile, Folder: m.Folder, Errors: []error{err}}
+	}
+	// NOTE(joel): A worker may still pick up a folder after ctx was
+	// canceled; it is failed as not started by upload.
+	if ctx.Err() != nil {
+		return uploader.FolderResult{}
+	}
+	if i > 0 && !p.budgetEnd.IsZero() && cfg.Env.Now().After(p.budgetEnd) {
+		p.overBudget[i] = true
+		p.bar.FolderDone(0)
+		return uploader.FolderResult{}
+	}
+	if p.resumed[m.Folder] {
+		cfg.Logger.Printf("folder resumed: folder=%s", m.Folder)
+		p.bar.FolderDone(0)
+		return uploader.FolderResult{
+			ReadyFile: m.ReadyFile,
+			Folder:    m.Folder,
+			Uploaded:  resumedFiles(st.PartialFiles(m.Folder)),
+		}
+	}
+	r.sg.advance(m.ReadyFile, m.Folder, state.StageUploading, nil)
+	r.sg.checkpoint()
+	opts := r.uploadOpts[i]
+	relFolder := recordFolderPath(cfg.RootDir, m.Folder, opts)
+	// NOTE(joel): Resolve the record's collection and document ID before
+	// uploading, so a folder whose record can't be written isn't uploaded
+	// either.
+	var coll, docID string
+	if cfg.FirestoreCollection != "" {
+		var err error
+		coll, err = app.RecordCollection(cfg, folderLabels(cfg, m.Folder), cfg.Env.Now())
+		if err == nil {
+			docID, err = documentID(cfg, m, relFolder)
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	// NOTE(joel): If claims are configured, only the agent that claims the
+	// folder first uploads it. Others record the winner and skip. Without
+	// Firestore nobody can claim, so the folder fails and is retried instead
+	// of being uploaded by every agent.
+	if cfg.ClaimCollection != "" && p.fs == nil {
+		return fail(errClaimUnavailable)
+	}
+	if cfg.ClaimCollection != "" {
+		now := cfg.Env.Now()
+		claim := uploader.FolderClaim{
+			FolderPath: relFolder,
+			Agent:      cfg.AgentID,
+			ClaimedAt:  now,
+			Status:     uploader.ClaimStatusClaimed,
+			ExpiresAt:  now.Add(cmp.Or(cfg.ClaimTTL, app.DefaultClaimTTL)),
+			ID:         docID,
+		}
+		winner, won, err := p.fs.ClaimFolder(cfg.ClaimCollection, claim)
+		if err != nil {
+			return fail(fmt.Errorf("claim folder: %w", err))
+		}
+		if !won {
+			p.bar.FolderDone(0)
+			return uploader.FolderResult{
+				ReadyFile:    m.ReadyFile,
+				Folder:       m.Folder,
+				ClaimedBy:    winner.Agent,
+				ClaimPending: !winner.Uploaded(),
+			}
+		}
+		defer func() { r.settleClaim(claim, p.fs, res) }()
+	}
+
+	// NOTE(joel): Files added since the scan are part of the upload (and,
+	// with -snapshot strict, of the snapshot) if relisted.
+	if cfg.RescanBeforeUpload {
+		listed, err := m.Relist()
+		if err != nil {
+			return fail(err)
+		}
+		if len(listed.FolderEntries) != len(m.FolderEntries) {
+			cfg.Logger.Printf("folder relisted: folder=%s entries=%d scanned=%d", m.Folder, len(listed.FolderEntries), len(m.FolderEntries))
+		}
+		m = listed
+	}
+
+	r.emit(events.Event{Type: events.TypeUploadStart, ReadyFile: m.ReadyFile, Folder: m.Folder})
+	res = uploadFolder(p.u, m, opts)
+	var rec uploader.FolderRecord
+	if !res.Failed() {
+		rec = uploader.FolderRecord{
+			FolderPath: relFolder,
+			UploadedAt: cfg.Env.Now(),
+			Files:      res.Uploaded,
+			Agent:      cfg.AgentID,
+			RunID:      cfg.RunID,
+			Labels:     folderLabels(cfg, m.Folder),
+			MatchID:    m.ID,
+			Versions:   versionChain(cfg, st, m, opts),
+			ID:         docID,
+		}
+	}
+	// NOTE(joel): The manifest is written after all objects of the folder, so
+	// bucket-only consumers can take it as the folder being complete. A
+	// folder without manifest fails and is uploaded again.
+	if !res.Failed() && cfg.FolderManifest {
+		err := errManifestUnsupported
+		if mw, ok := p.u.(uploader.ManifestWriter); ok {
+			err = mw.WriteManifest(m, rec, opts)
+		}
+		if err != nil {
+			res.Errors = append(res.Errors, err)
+		}
+	}
+	done := events.Event{
+		Type:       events.TypeUploadDone,
+		ReadyFile:  m.ReadyFile,
+		Folder:     m.Folder,
+		Files:      len(res.Uploaded),
+		Bytes:      res.Bytes(),
+		DurationMs: res.Duration.Milliseconds(),
+	}
+	if res.Failed() {
+		done.Error = res.Err().Error()
+	}
+	r.emit(done)
+
+	// NOTE(joel): Write folder record to Firestore if configured and upload
+	// was successful. If Firestore is unreachable, the record goes straight
+	// to the pending queue.
+	if !res.Failed() && (p.fs != nil || p.pending != nil) {
+		err := errRecordWriterUnavailable
+		if p.fs != nil {
+			err = p.fs.WriteFolderRecord(coll, rec)
+		}
+		if err != nil {
+			recordFailed(cfg, p.pending, coll, rec, &res, err)
+		}
+	}
+	// NOTE(joel): The uploaded files are kept until the trigger is marked
+	// processed, so a resumed folder reports them again.
+	if !res.Failed() && r.sg.st != nil {
+		st.SetPartial(m.Folder, partialFiles(res.Uploaded))
+		r.sg.advance(m.ReadyFile, m.Folder, state.StageRecorded, nil)
+		r.sg.checkpoint()
+	}
+	if !res.Failed() {
+		if age, ok := triggerAge(cfg.Env, m.ReadyFile); ok {
+			r.ages[i] = age
+		}
+	}
+	var bytes int64
+	for _, f := range res.Uploaded {
+		bytes += f.Size
+	}
+	p.bar.FolderDone(bytes)
+	return res
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// settleClaim completes the won claim of a folder once res is in: it marks
+// the claim uploaded, so the other agents treat the folder as processed, or
+// releases it if the folder failed, so any agent may retry it. If that fails,
+// the claim blocks the other agents until it expires.
+func (r *runner) settleClaim(claim uploader.FolderClaim, fs uploader.RecordWriter, res uploader.FolderResult) {
+	settle, action := fs.CompleteClaim, "complete"
+	if res.Failed() {
+		settle, action = fs.ReleaseClaim, "release"
+	}
+	if err := settle(r.cfg.ClaimCollection, claim); err != nil {
+		r.cfg.Warnf("claim warning: %s folder=%s err=%v", action, res.Folder, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// record evaluates the folder results of upload. State for a *.RDY file is
+// only updated after a successful upload (and Firestore write if configured)
+// of all folders it triggered. Processed triggers are archived with
+// -archive-dir and, with -batch-collection, a single document per run lets
+// downstream systems react once to all folders uploaded in it.
+func (r *runner) record(results []uploader.FolderResult, uc uploadClients) {
+	cfg, st := r.cfg, r.st
+	for _, res := range results {
+		if res.Failed() || res.ClaimPending {
+			r.held[res.ReadyFile] = true
+		}
+	}
+	archived := make(map[string][]string)
+	for i, res := range results {
+		if res.Failed() {
+			cfg.Warnf("folder upload warning: folder=%s err=%v", res.Folder, res.Err())
+			r.runErrors = append(r.runErrors, fmt.Sprintf("%s: %v", res.Folder, res.Err()))
+			reportError(cfg, report.LevelError, "folder upload failed: "+res.Err().Error(), map[string]string{
+				"folder": res.Folder,
+			})
+			// NOTE(joel): Remember the files that made it so the next run only
+			// uploads the missing ones.
+			if st != nil {
+				if files := partialFiles(res.Uploaded); len(files) > 0 {
+					cfg.Logger.Printf(
+						"folder partially uploaded: folder=%s uploaded=%d failed=%d",
+						res.Folder, len(files), len(res.FailedFiles),
+					)
+					st.SetPartial(res.Folder, files)
+				}
+			}
+			r.emit(events.Event{
+				Type:      events.TypeFolderDone,
+				ReadyFile: res.ReadyFile,
+				Folder:    res.Folder,
+				Status:    events.StatusFailed,
+				Error:     res.Err().Error(),
+			})
+			r.sg.advance(res.ReadyFile, res.Folder, state.StageFailed, res.Err())
+			r.failed++
+			continue
+		}
+		// NOTE(joel): A folder the winning agent is still uploading (or failed
+		// to upload without releasing its claim) is deferred like capped
+		// ones; the next run checks the claim again.
+		if res.ClaimPending {
+			cfg.Logger.Printf("defer (claimed by another agent, not uploaded yet): folder=%s winner=%s", res.Folder, res.ClaimedBy)
+			r.emitted--
+			r.deferred++
+			continue
+		}
+		if res.ClaimedBy != "" {
+			cfg.Logger.Printf("folder claimed by another agent: folder=%s winner=%s", res.Folder, res.ClaimedBy)
+			r.emit(events.Event{Type: events.TypeFolderDone, ReadyFile: res.ReadyFile, Folder: res.Folder, Status: events.StatusClaimed})
+			recordFingerprint(st, res.Folder, r.fingerprints)
+			if !r.held[res.ReadyFile] {
+				markProcessed(cfg, st, res.ReadyFile)
+				r.sg.advance(res.ReadyFile, res.Folder, state.StageDone, nil)
+			}
+			continue
+		}
+		cfg.Logger.Printf(
+			"folder uploaded: folder=%s files=%d skipped=%d bytes=%d duration=%s rate=%.2fMB/s",
+			res.Folder, len(res.Uploaded), len(res.Skipped), res.Bytes(), res.Duration,
+			mbps(res.Bytes(), res.Duration),
+		)
+		if cfg.SkipExisting {
+			existing := 0
+			for _, f := range res.Uploaded {
+				if f.Existing {
+					existing++
+				}
+			}
+			cfg.Logger.Printf("folder existing objects skipped: folder=%s files=%d", res.Folder, existing)
+		}
+		// NOTE(joel): Folders held back by a failed batch sibling keep their
+		// uploaded files and are resumed by the next run.
+		if st != nil {
+			if !r.held[res.ReadyFile] {
+				st.SetPartial(res.Folder, nil)
+			}
+			if chain := versionChain(cfg, st, r.matchedFiles[i], r.uploadOpts[i]); chain != nil {
+				st.SetVersions(res.Folder, chain)
+			}
+		}
+		if r.ages[i] >= 0 {
+			r.latencies = append(r.latencies, r.ages[i])
+		}
+		r.emit(events.Event{
+			Type:       events.TypeFolderDone,
+			ReadyFile:  res.ReadyFile,
+			Folder:     res.Folder,
+			Status:     events.StatusUploaded,
+			Files:      len(res.Uploaded),
+			Bytes:      res.Bytes(),
+			DurationMs: res.Duration.Milliseconds(),
+		})
+		recordFingerprint(st, res.Folder, r.fingerprints)
+		if !r.held[res.ReadyFile] {
+			markProcessed(cfg, st, res.ReadyFile)
+			r.sg.advance(res.ReadyFile, res.Folder, state.StageDone, nil)
+			if cfg.ArchiveDir != "" {
+				archived[res.ReadyFile] = append(archived[res.ReadyFile], res.Folder)
+			}
+		}
+	}
+
+	// NOTE(joel): Archive once all folders are evaluated, so a batch trigger
+	// moves after all of its folders.
+	for _, err := range archive(cfg, archived) {
+		cfg.Warnf("archive warning: %v", err)
+		r.runErrors = append(r.runErrors, err.Error())
+		reportError(cfg, report.LevelError, "archive failed: "+err.Error(), nil)
+	}
+
+	if cfg.BatchCollection != "" && uc.fs != nil {
+		if rec, ok := batchRecord(cfg, r.start, results, r.uploadOpts); ok {
+			if err := uc.fs.WriteBatchRecord(cfg.BatchCollection, rec); err != nil {
+				cfg.Warnf("batch record warning: %v", err)
+				r.runErrors = append(r.runErrors, fmt.Sprintf("batch record: %v", err))
+				reportError(cfg, report.LevelError, "batch record failed: "+err.Error(), nil)
+			} else {
+				cfg.Logger.Printf("batch record written: folders=%d", len(rec.Folders))
+			}
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// emitMatches emits the selected matches as a JSON array to stdout instead of
+// uploading them. State is updated before encoding.
+func (r *runner) emitMatches() error {
+	cfg := r.cfg
+	for _, m := range r.matchedFiles {
+		r.emit(events.Event{Type: events.TypeFolderDone, ReadyFile: m.ReadyFile, Folder: m.Folder, Status: events.StatusEmitted})
+		recordFingerprint(r.st, m.Folder, r.fingerprints)
+		if !r.held[m.ReadyFile] {
+			markProcessed(r.cfg, r.st, m.ReadyFile)
+		}
+	}
+	if len(r.matchedFiles) == 0 {
+		return nil
+	}
+	enc := json.NewEncoder(cfg.Stdout)
+	if cfg.Pretty {
+		enc.SetIndent("", "  ")
+	}
+	out, err := selectFields(truncateEntries(r.matchedFiles, cfg.MaxEntriesInOutput), cfg.Fields)
+	if err != nil {
+		return fmt.Errorf("encode initial: %w", err)
+	}
+	if err := enc.Encode(out); err != nil {
+		return fmt.Errorf("encode initial: %w", err)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// saveState completes the run: it notifies about failures and overdue
+// triggers, fills in the report, records the run in the state file (with the
+// checkpoint of a backfill chunk) and logs and emits its summary. The error
+// wraps ErrFoldersFailed if folders failed.
+func (r *runner) saveState() error {
+	cfg, st, rep := r.cfg, r.st, r.rep
+	// NOTE(joel): Triggers left unprocessed form the backlog; with
+	// -rdy-age-sla, those waiting too long are warned about and notified.
+	var backlogAges []time.Duration
+	var overdue []string
+	if st != nil {
+		backlogAges, overdue = backlog(cfg, st, r.matches, cfg.Env.Now())
+	}
+	if len(overdue) > 0 {
+		cfg.Warnf("sla warning: %d trigger(s) unprocessed for longer than %s, oldest: %s", len(overdue), cfg.AgeSLA, overdue[0])
+	}
+	if !cfg.ScanOnly {
+		maybeNotify(cfg, st, r.runErrors, r.orphans, overdue)
+	}
+
+	rep.RunSummary = state.RunSummary{
+		RunID:      cfg.RunID,
+		Start:      r.start,
+		Duration:   cfg.Env.Now().Sub(r.start),
+		Scanned:    len(r.matches),
+		Emitted:    r.emitted,
+		Skipped:    r.skipped,
+		Failed:     r.failed,
+		Deferred:   r.deferred,
+		Errors:     append(r.scanErrors, r.runErrors...),
+		Warnings:   r.scanWarnings,
+		Throughput: r.tp,
+		Latency:    ageStats(r.latencies, cfg.AgeSLA),
+		Backlog:    ageStats(backlogAges, cfg.AgeSLA),
+	}
+	rep.Matches = r.matchedFiles
+	// NOTE(joel): Update last run timestamp after initial emit (if any).
+	// This ensures that even if no new files were emitted, the state file's
+	// timestamp reflects the last time local-file-sync was run.
+	// If state is disabled, this step is skipped.
+	if st != nil && !cfg.ScanOnly {
+		st.AddRun(rep.RunSummary, cfg.HistorySize)
+		st.SetLastRun(cfg.Env.Now())
+		if r.chunk != nil {
+			st.SetBackfill(r.chunk.checkpoint)
+		}
+		if err := st.Save(); err != nil {
+			if r.chunk != nil {
+				return fmt.Errorf("save backfill checkpoint: %w", err)
+			}
+			cfg.Warnf("state save warning: %v", err)
+		}
+		if r.chunk != nil {
+			r.chunk.saved = true
+		}
+	}
+
+	cfg.Logger.Printf(
+		"summary: scanned=%d emitted=%d skipped=%d failed=%d deferred=%d",
+		len(r.matches), r.emitted, r.skipped, r.failed, r.deferred,
+	)
+	if l := rep.Latency; l != nil {
+		cfg.Logger.Printf("upload latency: folders=%d %s", l.Count, formatAges(l))
+	}
+	if b := rep.Backlog; b != nil {
+		cfg.Logger.Printf("backlog: triggers=%d %s", b.Count, formatAges(b))
+	}
+	r.emit(events.Event{
+		Type:       events.TypeRunDone,
+		Root:       cfg.RootDir,
+		DurationMs: cfg.Env.Now().Sub(r.start).Milliseconds(),
+		Summary:    runSummary(rep.RunSummary, r.tp, r.folders),
+	})
+	if tp := r.tp; tp != nil {
+		cfg.Logger.Printf(
+			"throughput: bytes=%d rate=%.2fMB/s retries=%d dead_letters=%d folder_concurrency=%d file_concurrency=%d",
+			tp.Bytes, tp.MBps, tp.Retries, tp.DeadLetters, tp.FolderConcurrency, tp.FileConcurrency,
+		)
+		if cfg.ReadBack > 0 {
+			cfg.Logger.Printf("read-back: verified=%d", tp.Verified)
+		}
+		for _, d := range tp.Destinations {
+			cfg.Logger.Printf(
+				"destination: name=%s folders=%d failed=%d files=%d bytes=%d retries=%d rate=%.2fMB/s",
+				d.Name, d.Folders, d.Failed, d.Files, d.Bytes, d.Retries, d.MBps,
+			)
+		}
+		for _, f := range r.folders {
+			cfg.Logger.Printf(
+				"folder summary: folder=%s status=%s files=%d bytes=%d retries=%d record_queued=%t duration=%s",
+				f.Folder, f.Status, f.Files, f.Bytes, f.Retries, f.RecordQueued, time.Duration(f.DurationMs)*time.Millisecond,
+			)
+		}
+		for _, f := range tp.SlowestFolders {
+			cfg.Logger.Printf("slowest folder: folder=%s bytes=%d duration=%s", f.Path, f.Bytes, f.Duration)
+		}
+		for _, f := range tp.SlowestFiles {
+			cfg.Logger.Printf("slowest file: file=%s bytes=%d duration=%s", f.Path, f.Bytes, f.Duration)
+		}
+	}
+
+	if r.failed > 0 {
+		return fmt.Errorf("%d %w", r.failed, ErrFoldersFailed)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package pipeline
+
+import (
+	"slices"
+	"strings"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/events"
+	"local-file-sync/internal/scanner"
+	"local-file-sync/internal/state"
+	"local-file-sync/internal/uploader"
+)
+
+// stages moves the matches of an uploading run through the pipeline stages
+// persisted in the state file (see state.Stage), so an interrupted run can be
+// told apart from a finished one and resumed. Every transition is emitted as
+// stage event. Without state it does nothing.
+type stages struct {
+	cfg  *app.Config
+	st   *state.Store
+	emit func(events.Event)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// discover starts the match m for version trigger of its trigger. It
+// reports whether the match is resumable instead: its upload and record
+// completed for the same trigger version in an interrupted run, so only
+// marking the trigger processed is left.
+func (s stages) discover(m scanner.Match, trigger int64) bool {
+	if s.st == nil {
+		return false
+	}
+	if ms, ok := s.st.Match(m.Folder); ok && ms.Stage == state.StageRecorded && ms.Trigger == trigger {
+		return true
+	}
+	s.st.Discover(m.Folder, m.ReadyFile, m.ID, trigger, s.cfg.Env.Now())
+	s.emit(events.Event{Type: events.TypeStage, ReadyFile: m.ReadyFile, Folder: m.Folder, Status: string(state.StageDiscovered)})
+	return false
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// advance moves the match of folder to stage to; err is recorded for
+// state.StageFailed. Transitions not allowed are logged as warnings and
+// ignored.
+func (s stages) advance(readyFile, folder string, to state.Stage, err error) {
+	if s.st == nil {
+		return
+	}
+	if aerr := s.st.Advance(folder, to, s.cfg.Env.Now(), err); aerr != nil {
+		s.cfg.Warnf("stage warning: %v", aerr)
+		return
+	}
+	e := events.Event{Type: events.TypeStage, ReadyFile: readyFile, Folder: folder, Status: string(to)}
+	if to == state.StageFailed && err != nil {
+		e.Error = err.Error()
+	}
+	s.emit(e)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// checkpoint saves the state, so the stages reached so far survive a crash.
+func (s stages) checkpoint() {
+	if s.st == nil {
+		return
+	}
+	if err := s.st.Save(); err != nil {
+		s.cfg.Warnf("state checkpoint warning: %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// resumedFiles reports the files recorded for a resumed folder as uploaded by
+// the interrupted run.
+func resumedFiles(files []state.PartialFile) []uploader.UploadedFile {
+	uploaded := make([]uploader.UploadedFile, 0, len(files))
+	for _, f := range doneFiles(files) {
+		f.Existing = true
+		uploaded = append(uploaded, f)
+	}
+	slices.SortFunc(uploaded, func(a, b uploader.UploadedFile) int { return strings.Compare(a.Name, b.Name) })
+	return uploaded
+}
@@ -0,0 +1,90 @@
+package pipeline
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"local-file-sync/internal/state"
+)
+
+// TestRun_Stages verifies failed matches keep their stage and attempts in
+// state, and that a match recorded by an interrupted run is resumed without
+// being uploaded again.
+func TestRun_Stages(t *testing.T) {
+	g, f := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "ORDER1", "a")
+	makeTrigger(t, root, "ORDER2", "b")
+	stateFile := filepath.Join(root, "state.json")
+	cfg := testConfig(root, stateFile, filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.FirestoreProjectId = "project"
+	cfg.FirestoreCollection = "uploads"
+	g.FailFolders = map[string]bool{filepath.Join(root, "ORDER2"): true}
+
+	if err := run(cfg); !errors.Is(err, ErrFoldersFailed) {
+		t.Fatalf("expected failed folders, got %v", err)
+	}
+	if _, ok := g.Object("ORDER1/data.txt"); !ok {
+		t.Fatalf("expected ORDER1 uploaded, got %v", g.ObjectNames())
+	}
+	st := state.New(stateFile)
+	if err := st.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if _, ok := st.Match(filepath.Join(root, "ORDER1")); ok {
+		t.Fatalf("expected ORDER1 done")
+	}
+	ms, ok := st.Match(filepath.Join(root, "ORDER2"))
+	if !ok || ms.Stage != state.StageFailed || ms.Attempts != 1 || ms.Error == "" {
+		t.Fatalf("expected ORDER2 failed after 1 attempt, got %+v ok=%v", ms, ok)
+	}
+
+	// NOTE(joel): Simulate a crash of a run after ORDER3 was uploaded and
+	// recorded, but before its trigger was marked processed.
+	makeTrigger(t, root, "ORDER3", "c")
+	fi, err := os.Stat(filepath.Join(root, "ORDER3.RDY"))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	folder := filepath.Join(root, "ORDER3")
+	st.Discover(folder, filepath.Join(root, "ORDER3.RDY"), "", fi.ModTime().UnixNano(), fi.ModTime())
+	for _, to := range []state.Stage{state.StageValidated, state.StageUploading, state.StageRecorded} {
+		if err := st.Advance(folder, to, fi.ModTime(), nil); err != nil {
+			t.Fatalf("advance: %v", err)
+		}
+	}
+	st.SetPartial(folder, []state.PartialFile{{Name: "data.txt", Size: 1}})
+	if err := st.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	g.FailFolders = nil
+
+	if err := run(cfg); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if _, ok := g.Object("ORDER3/data.txt"); ok {
+		t.Fatalf("expected resumed ORDER3 not uploaded again")
+	}
+	if _, ok := f.Record("uploads", "ORDER3"); ok {
+		t.Fatalf("expected resumed ORDER3 not recorded again")
+	}
+	if _, ok := f.Record("uploads", "ORDER2"); !ok {
+		t.Fatalf("expected ORDER2 recorded by the retry")
+	}
+	st = state.New(stateFile)
+	if err := st.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if _, ok := st.Get(filepath.Join(root, "ORDER3.RDY")); !ok {
+		t.Fatalf("expected ORDER3 trigger processed")
+	}
+	if n := len(st.Matches()); n != 0 {
+		t.Fatalf("expected all matches done, got %v", st.Matches())
+	}
+	if files := st.PartialFiles(folder); len(files) != 0 {
+		t.Fatalf("expected partial files cleared, got %v", files)
+	}
+}
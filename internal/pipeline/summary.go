@@ -0,0 +1,218 @@
+package pipeline
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/events"
+	"local-file-sync/internal/scanner"
+	"local-file-sync/internal/state"
+	"local-file-sync/internal/uploader"
+)
+
+// destinationStats breaks the folder results of a run down by destination,
+// in the order of uploader.FolderResult.Destinations. Results without a
+// breakdown (a single destination, or folders that failed before their
+// upload) count for primary. Claimed folders are left out. Rates are computed
+// over elapsed, the wall time of the upload phase.
+func destinationStats(results []uploader.FolderResult, primary string, elapsed time.Duration) []state.DestinationStats {
+	var stats []state.DestinationStats
+	index := make(map[string]int)
+	add := func(name string, files int, bytes int64, retries int, failed bool) {
+		i, ok := index[name]
+		if !ok {
+			i = len(stats)
+			index[name] = i
+			stats = append(stats, state.DestinationStats{Name: name})
+		}
+		d := &stats[i]
+		d.Files += files
+		d.Bytes += bytes
+		d.Retries += retries
+		if failed {
+			d.Failed++
+		} else {
+			d.Folders++
+		}
+	}
+	for _, res := range results {
+		if res.ClaimedBy != "" {
+			continue
+		}
+		if len(res.Destinations) == 0 {
+			add(primary, len(res.Uploaded), res.Bytes(), res.Retries, res.Failed())
+			continue
+		}
+		for _, d := range res.Destinations {
+			add(d.Name, d.Uploaded, d.Bytes, d.Retries, d.Err != nil)
+		}
+	}
+	for i := range stats {
+		stats[i].MBps = mbps(stats[i].Bytes, elapsed)
+	}
+	return stats
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// folderSummaries returns the outcome of each folder result for the run
+// summary, in result order.
+func folderSummaries(results []uploader.FolderResult) []events.FolderSummary {
+	folders := make([]events.FolderSummary, 0, len(results))
+	for _, res := range results {
+		status := events.StatusUploaded
+		switch {
+		case res.Failed():
+			status = events.StatusFailed
+		case res.ClaimedBy != "":
+			status = events.StatusClaimed
+		}
+		folders = append(folders, events.FolderSummary{
+			Folder:       res.Folder,
+			Status:       status,
+			Files:        len(res.Uploaded),
+			Bytes:        res.Bytes(),
+			DurationMs:   res.Duration.Milliseconds(),
+			Retries:      res.Retries,
+			RecordQueued: res.RecordQueued,
+		})
+	}
+	return folders
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// runSummary returns the summary of the run_done event: the counts, trigger
+// ages and, for uploading runs, the breakdown of tp and folders.
+func runSummary(rs state.RunSummary, tp *state.Throughput, folders []events.FolderSummary) *events.Summary {
+	sum := &events.Summary{
+		Scanned:  rs.Scanned,
+		Emitted:  rs.Emitted,
+		Skipped:  rs.Skipped,
+		Failed:   rs.Failed,
+		Deferred: rs.Deferred,
+		Warnings: len(rs.Warnings),
+		Folders:  folders,
+	}
+	sum.Latency, sum.Backlog = ageSummary(rs.Latency), ageSummary(rs.Backlog)
+	if tp != nil {
+		sum.Bytes, sum.Retries, sum.DeadLetters = tp.Bytes, tp.Retries, tp.DeadLetters
+		for _, d := range tp.Destinations {
+			sum.Destinations = append(sum.Destinations, events.DestinationSummary(d))
+		}
+	}
+	return sum
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// triggerAge returns the age of readyFile on e's clock, measured from its
+// modification time. ok is false if it can't be stat'ed.
+func triggerAge(e app.Env, readyFile string) (age time.Duration, ok bool) {
+	fi, err := e.Files().Stat(readyFile)
+	if err != nil {
+		return 0, false
+	}
+	return max(e.Now().Sub(fi.ModTime()), 0), true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// backlog returns the ages at now of the triggers of matches not marked
+// processed in st, e.g. failed, deferred or incomplete ones, and those older
+// than cfg.AgeSLA (oldest first, with their age). Triggers without a folder
+// are left out; they are reported as orphans.
+func backlog(cfg *app.Config, st *state.Store, matches []scanner.Match, now time.Time) ([]time.Duration, []string) {
+	type pending struct {
+		readyFile string
+		age       time.Duration
+	}
+	var ages []time.Duration
+	var overdue []pending
+	for _, m := range matches {
+		if m.MissingFolder || m.Folder == "" {
+			continue
+		}
+		fi, err := cfg.Env.Files().Stat(m.ReadyFile)
+		if err != nil {
+			continue
+		}
+		if prev, ok := st.Get(m.ReadyFile); ok && prev == fi.ModTime().UnixNano() {
+			continue
+		}
+		age := max(now.Sub(fi.ModTime()), 0)
+		ages = append(ages, age)
+		if cfg.AgeSLA > 0 && age > cfg.AgeSLA {
+			overdue = append(overdue, pending{m.ReadyFile, age})
+		}
+	}
+	slices.SortStableFunc(overdue, func(a, b pending) int { return cmp.Compare(b.age, a.age) })
+	var out []string
+	for _, p := range overdue {
+		out = append(out, fmt.Sprintf("%s (age %s)", p.readyFile, p.age.Round(time.Second)))
+	}
+	return ages, out
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ageStats summarizes ages, counting those above sla (if > 0) as overdue.
+// Percentiles use the nearest rank. It returns nil for no ages.
+func ageStats(ages []time.Duration, sla time.Duration) *state.AgeStats {
+	if len(ages) == 0 {
+		return nil
+	}
+	sorted := slices.Sorted(slices.Values(ages))
+	rank := func(p int) time.Duration {
+		return sorted[max((p*len(sorted)+99)/100, 1)-1]
+	}
+	stats := &state.AgeStats{
+		Count: len(sorted),
+		Max:   sorted[len(sorted)-1],
+		P50:   rank(50),
+		P90:   rank(90),
+		P99:   rank(99),
+	}
+	if sla > 0 {
+		for _, age := range sorted {
+			if age > sla {
+				stats.Overdue++
+			}
+		}
+	}
+	return stats
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ageSummary converts a for the run_done event; nil stays nil.
+func ageSummary(a *state.AgeStats) *events.AgeSummary {
+	if a == nil {
+		return nil
+	}
+	return &events.AgeSummary{
+		Count:   a.Count,
+		MaxMs:   a.Max.Milliseconds(),
+		P50Ms:   a.P50.Milliseconds(),
+		P90Ms:   a.P90.Milliseconds(),
+		P99Ms:   a.P99.Milliseconds(),
+		Overdue: a.Overdue,
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// formatAges formats a for the summary log and the history command.
+func formatAges(a *state.AgeStats) string {
+	s := fmt.Sprintf(
+		"max=%s p50=%s p90=%s p99=%s",
+		a.Max.Round(time.Second), a.P50.Round(time.Second), a.P90.Round(time.Second), a.P99.Round(time.Second),
+	)
+	if a.Overdue > 0 {
+		s += fmt.Sprintf(" overdue=%d", a.Overdue)
+	}
+	return s
+}
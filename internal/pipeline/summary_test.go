@@ -0,0 +1,114 @@
+package pipeline
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"local-file-sync/internal/events"
+	"local-file-sync/internal/state"
+	"local-file-sync/internal/uploader"
+)
+
+// TestDestinationStats verifies folder results are broken down by
+// destination, results without a breakdown count for the primary and
+// claimed folders are left out.
+func TestDestinationStats(t *testing.T) {
+	results := []uploader.FolderResult{
+		{Folder: "A", Retries: 2, Uploaded: []uploader.UploadedFile{{Size: 1_000_000}}, Destinations: []uploader.DestinationResult{
+			{Name: "gs://new", Uploaded: 1, Bytes: 1_000_000},
+			{Name: "file:///mnt/copy", Uploaded: 1, Bytes: 1_000_000, Retries: 2},
+		}},
+		{Folder: "B", Errors: []error{errors.New("boom")}, Destinations: []uploader.DestinationResult{
+			{Name: "gs://new", Uploaded: 1, Bytes: 1_000_000},
+			{Name: "file:///mnt/copy", Err: errors.New("boom")},
+		}},
+		{Folder: "C", Errors: []error{errors.New("not started")}},
+		{Folder: "D", ClaimedBy: "other"},
+	}
+	stats := destinationStats(results, "gs://new", time.Second)
+	if len(stats) != 2 {
+		t.Fatalf("expected 2 destinations, got %+v", stats)
+	}
+	if d := stats[0]; d.Name != "gs://new" || d.Folders != 2 || d.Failed != 1 || d.Files != 2 || d.Bytes != 2_000_000 || d.MBps != 2 {
+		t.Fatalf("unexpected primary stats %+v", d)
+	}
+	if d := stats[1]; d.Name != "file:///mnt/copy" || d.Folders != 1 || d.Failed != 1 || d.Retries != 2 {
+		t.Fatalf("unexpected mirror stats %+v", d)
+	}
+
+	folders := folderSummaries(results)
+	if len(folders) != 4 || folders[0].Status != events.StatusUploaded || folders[0].Retries != 2 ||
+		folders[1].Status != events.StatusFailed || folders[3].Status != events.StatusClaimed {
+		t.Fatalf("unexpected folder summaries %+v", folders)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestAgeStats verifies nearest rank percentiles and overdue counts.
+func TestAgeStats(t *testing.T) {
+	if ageStats(nil, time.Hour) != nil {
+		t.Fatalf("expected no stats without ages")
+	}
+	var ages []time.Duration
+	for i := 100; i >= 1; i-- {
+		ages = append(ages, time.Duration(i)*time.Minute)
+	}
+	a := ageStats(ages, time.Hour)
+	if a.Count != 100 || a.Max != 100*time.Minute || a.P50 != 50*time.Minute || a.P90 != 90*time.Minute || a.P99 != 99*time.Minute {
+		t.Fatalf("unexpected stats %+v", a)
+	}
+	if a.Overdue != 40 {
+		t.Fatalf("expected 40 overdue, got %d", a.Overdue)
+	}
+	if a := ageStats([]time.Duration{time.Second}, 0); a.P50 != time.Second || a.P99 != time.Second || a.Overdue != 0 {
+		t.Fatalf("unexpected single age stats %+v", a)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRun_AgeSLA verifies the latency of uploaded folders and the backlog of
+// unprocessed triggers are recorded, and overdue triggers are notified.
+func TestRun_AgeSLA(t *testing.T) {
+	g, _ := useFakes(t)
+	root := t.TempDir()
+	makeTrigger(t, root, "NEW", "a")
+	makeTrigger(t, root, "OLD", "b")
+	old := time.Now().Add(-3 * time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "OLD.RDY"), old, old); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	g.FailFolders = map[string]bool{filepath.Join(root, "OLD"): true}
+	n := &recordingNotifier{}
+	stateFile := filepath.Join(root, "state.json")
+	cfg := testConfig(root, stateFile, filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.AgentID = "scanner-7"
+	cfg.Notifier = n
+	cfg.AgeSLA = time.Hour
+	cfg.HistorySize = 5
+
+	_ = run(cfg)
+	if len(n.subjects) != 1 || !strings.HasSuffix(n.subjects[0], ", 1 overdue trigger(s)") {
+		t.Fatalf("unexpected digests %q", n.subjects)
+	}
+	if !strings.Contains(n.bodies[0], "- "+filepath.Join(root, "OLD.RDY")+" (age 3h0m0s)") {
+		t.Fatalf("expected overdue trigger in digest, got %q", n.bodies[0])
+	}
+	st := state.New(stateFile)
+	if err := st.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	r := st.History[len(st.History)-1]
+	if r.Latency == nil || r.Latency.Count != 1 || r.Latency.Max > time.Hour || r.Latency.Overdue != 0 {
+		t.Fatalf("unexpected latency %+v", r.Latency)
+	}
+	if r.Backlog == nil || r.Backlog.Count != 1 || r.Backlog.Max < 3*time.Hour || r.Backlog.Overdue != 1 {
+		t.Fatalf("unexpected backlog %+v", r.Backlog)
+	}
+}
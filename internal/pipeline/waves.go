@@ -0,0 +1,71 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"local-file-sync/internal/app"
+
+	"github.com/google/uuid"
+)
+
+// runWaves executes a run in waves (-wave-size, -wave-budget). Each wave is a
+// run of its own: it takes the lock, scans, uploads at most -wave-size
+// folders, starting them within -wave-budget, and saves the state before
+// releasing the lock, so a crash or a lost host only costs the current wave.
+// Waves continue while folders were deferred and the last wave made
+// progress. -max-folders-per-run and -max-bytes-per-run bound all waves
+// together. Wave run IDs are the run ID suffixed with the wave number.
+func runWaves(ctx context.Context, cfg *app.Config, cl clients) error {
+	if cfg.RunID == "" {
+		cfg.RunID = uuid.NewString()
+	}
+	var folders, failed int
+	var bytes int64
+	for wave := 1; ; wave++ {
+		waveCfg := *cfg
+		waveCfg.RunID = fmt.Sprintf("%s.%d", cfg.RunID, wave)
+		waveCfg.MaxFoldersPerRun = cfg.WaveSize
+		if cfg.MaxFoldersPerRun > 0 {
+			left := cfg.MaxFoldersPerRun - folders
+			if waveCfg.MaxFoldersPerRun == 0 || left < waveCfg.MaxFoldersPerRun {
+				waveCfg.MaxFoldersPerRun = left
+			}
+		}
+		if cfg.MaxBytesPerRun > 0 {
+			waveCfg.MaxBytesPerRun = cfg.MaxBytesPerRun - bytes
+		}
+		cfg.Logger.Printf("wave %d: run %s", wave, waveCfg.RunID)
+
+		var rep Report
+		err := runChunk(ctx, &waveCfg, nil, cl, &rep)
+		if err != nil && !errors.Is(err, ErrFoldersFailed) {
+			return fmt.Errorf("wave %d: %w", wave, err)
+		}
+		// NOTE(joel): Another process took the lock between two waves; it
+		// scans for itself and picks up the remaining folders.
+		if rep.LockHeld {
+			if wave > 1 {
+				cfg.Logger.Printf("wave %d: lock held by another process; leaving the remaining folders to it", wave)
+			}
+			break
+		}
+		folders += rep.Emitted
+		failed += rep.Failed
+		if rep.Throughput != nil {
+			bytes += rep.Throughput.Bytes
+		}
+		if rep.Deferred == 0 || rep.Emitted == 0 || ctx.Err() != nil {
+			break
+		}
+		if (cfg.MaxFoldersPerRun > 0 && folders >= cfg.MaxFoldersPerRun) || (cfg.MaxBytesPerRun > 0 && bytes >= cfg.MaxBytesPerRun) {
+			cfg.Logger.Printf("per-run cap reached after wave %d: deferred the remaining folders to the next run", wave)
+			break
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d %w", failed, ErrFoldersFailed)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/state"
+)
+
+// TestRun_Waves verifies a run with -wave-size uploads all folders in waves
+// that are recorded as runs of their own, and that -max-folders-per-run
+// bounds all waves together.
+func TestRun_Waves(t *testing.T) {
+	root := t.TempDir()
+	for i := range 5 {
+		makeTrigger(t, root, fmt.Sprintf("ORDER%d", i), "a")
+	}
+	stateFile := filepath.Join(root, "state.json")
+	g, _ := useFakes(t)
+	cfg := testConfig(root, stateFile, filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.HistorySize = 10
+	cfg.RunID = "run"
+	cfg.WaveSize = 2
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if names := g.ObjectNames(); len(names) != 5 {
+		t.Fatalf("expected all folders uploaded, got %v", names)
+	}
+	st := state.New(stateFile)
+	if err := st.Load(); err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	if len(st.History) != 3 {
+		t.Fatalf("expected 3 waves, got %+v", st.History)
+	}
+	for i, r := range st.History {
+		if r.RunID != fmt.Sprintf("run.%d", i+1) || r.Emitted != min(2, 5-2*i) {
+			t.Fatalf("unexpected wave %d: %+v", i+1, r)
+		}
+	}
+
+	root = t.TempDir()
+	for i := range 5 {
+		makeTrigger(t, root, fmt.Sprintf("ORDER%d", i), "a")
+	}
+	g, _ = useFakes(t)
+	cfg = testConfig(root, filepath.Join(root, "state.json"), filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.WaveSize = 2
+	cfg.MaxFoldersPerRun = 3
+	if err := run(cfg); err != nil {
+		t.Fatalf("capped run: %v", err)
+	}
+	if names := g.ObjectNames(); len(names) != 3 {
+		t.Fatalf("expected 3 folders uploaded, got %v", names)
+	}
+}
+
+// TestRun_WaveBudget verifies folders not started within -wave-budget are
+// deferred to the next wave instead of failed.
+func TestRun_WaveBudget(t *testing.T) {
+	root := t.TempDir()
+	for i := range 3 {
+		makeTrigger(t, root, fmt.Sprintf("ORDER%d", i), "a")
+	}
+	stateFile := filepath.Join(root, "state.json")
+	g, _ := useFakes(t)
+	cfg := testConfig(root, stateFile, filepath.Join(root, "lock"), os.Stdout)
+	cfg.GCSBucket = "bucket"
+	cfg.HistorySize = 10
+	cfg.FolderConcurrency = 1
+	cfg.WaveBudget = time.Minute
+	// NOTE(joel): Every reading of the clock advances it, so the budget is
+	// used up once the first folder of a wave started.
+	var mu sync.Mutex
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cfg.Env = app.Env{Clock: app.ClockFunc(func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(time.Minute)
+		return now
+	})}
+	if err := run(cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if names := g.ObjectNames(); len(names) != 3 {
+		t.Fatalf("expected all folders uploaded, got %v", names)
+	}
+	st := state.New(stateFile)
+	if err := st.Load(); err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	if len(st.History) != 3 {
+		t.Fatalf("expected 3 waves, got %+v", st.History)
+	}
+	for i, r := range st.History {
+		if r.Emitted != 1 || r.Failed != 0 || r.Deferred != 2-i {
+			t.Fatalf("unexpected wave %d: %+v", i+1, r)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Package progress renders an in-place progress line (folders done, upload
+// throughput and ETA) for interactive runs.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Modes accepted by the -progress flag.
+const (
+	ModeAuto   = "auto"
+	ModeAlways = "always"
+	ModeNever  = "never"
+)
+
+// Display renders a single, in-place progress line (folders done/total,
+// throughput and ETA) on an interactive terminal.
+type Display struct {
+	out   io.Writer
+	total int
+	done  int
+	bytes int64
+	start time.Time
+	now   func() time.Time
+	mu    sync.Mutex
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// New creates a Display for the given number of folders and draws the initial
+// line to out.
+func New(out io.Writer, total int) *Display {
+	return newWithClock(out, total, time.Now)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// newWithClock allows tests to inject a clock.
+func newWithClock(out io.Writer, total int, now func() time.Time) *Display {
+	d := &Display{out: out, total: total, start: now(), now: now}
+	d.mu.Lock()
+	d.draw()
+	d.mu.Unlock()
+	return d
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Enabled reports whether a progress display should be shown for the given
+// mode. In auto mode it is only shown if out is a terminal.
+func Enabled(mode string, out *os.File) bool {
+	switch mode {
+	case ModeAlways:
+		return true
+	case ModeNever:
+		return false
+	default:
+		return IsTerminal(out)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// IsTerminal reports whether f refers to a character device (a TTY).
+func IsTerminal(f *os.File) bool {
+	if f == nil {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// FolderDone records a finished folder and the number of bytes it uploaded,
+// then redraws the progress line. It is a no-op on a nil Display.
+func (d *Display) FolderDone(bytes int64) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.done++
+	d.bytes += bytes
+	d.draw()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Finish redraws the final state and terminates the progress line. It is a
+// no-op on a nil Display.
+func (d *Display) Finish() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.draw()
+	_, _ = fmt.Fprintln(d.out)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Writer wraps w so that every write (e.g. a log line) first clears the
+// progress line, is written to w and then has the progress line redrawn
+// beneath it. This keeps log output readable while the display is active.
+// On a nil Display w is returned unchanged.
+func (d *Display) Writer(w io.Writer) io.Writer {
+	if d == nil {
+		return w
+	}
+	return writerFunc(func(p []byte) (int, error) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		_, _ = io.WriteString(d.out, "\r\033[K")
+		n, err := w.Write(p)
+		d.draw()
+		return n, err
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Line returns the current progress line without terminal control codes, or
+// "" on a nil Display.
+func (d *Display) Line() string {
+	if d == nil {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.line()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// line formats the progress line; callers must hold d.mu.
+func (d *Display) line() string {
+	elapsed := d.now().Sub(d.start)
+	rate := 0.0
+	if secs := elapsed.Seconds(); secs > 0 {
+		rate = float64(d.bytes) / secs / (1 << 20)
+	}
+	eta := "--"
+	if d.done > 0 && d.done < d.total {
+		remaining := time.Duration(float64(elapsed) / float64(d.done) * float64(d.total-d.done))
+		eta = remaining.Round(time.Second).String()
+	} else if d.done >= d.total {
+		eta = "0s"
+	}
+	return fmt.Sprintf("folders %d/%d | %.1f MB/s | ETA %s", d.done, d.total, rate, eta)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// draw writes the progress line in place; callers must hold d.mu.
+func (d *Display) draw() {
+	_, _ = fmt.Fprintf(d.out, "\r\033[K%s", d.line())
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// writerFunc adapts a function to io.Writer.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
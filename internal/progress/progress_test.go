@@ -0,0 +1,91 @@
+package progress
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDisplay_Line verifies counts, throughput and ETA formatting.
+func TestDisplay_Line(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.Unix(0, 0)
+	d := newWithClock(&buf, 4, func() time.Time { return now })
+	if got := d.Line(); got != "folders 0/4 | 0.0 MB/s | ETA --" {
+		t.Fatalf("unexpected initial line %q", got)
+	}
+	now = now.Add(10 * time.Second)
+	d.FolderDone(20 << 20)
+	if got := d.Line(); got != "folders 1/4 | 2.0 MB/s | ETA 30s" {
+		t.Fatalf("unexpected line %q", got)
+	}
+	d.FolderDone(0)
+	d.FolderDone(0)
+	d.FolderDone(0)
+	if got := d.Line(); !strings.HasPrefix(got, "folders 4/4") || !strings.HasSuffix(got, "ETA 0s") {
+		t.Fatalf("unexpected final line %q", got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestDisplay_Writer verifies log writes clear and redraw the progress line.
+func TestDisplay_Writer(t *testing.T) {
+	var bar, logs bytes.Buffer
+	d := New(&bar, 1)
+	bar.Reset()
+	w := d.Writer(&logs)
+	if _, err := w.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if logs.String() != "hello\n" {
+		t.Fatalf("log not forwarded: %q", logs.String())
+	}
+	if !strings.HasPrefix(bar.String(), "\r\033[K") || !strings.Contains(bar.String(), "folders 0/1") {
+		t.Fatalf("progress line not redrawn: %q", bar.String())
+	}
+	d.Finish()
+	if !strings.HasSuffix(bar.String(), "\n") {
+		t.Fatalf("expected trailing newline after finish")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestEnabled verifies mode handling and TTY detection for regular files.
+func TestEnabled(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer f.Close()
+	if Enabled(ModeAuto, f) {
+		t.Fatalf("regular file must not be treated as terminal")
+	}
+	if !Enabled(ModeAlways, f) || Enabled(ModeNever, f) {
+		t.Fatalf("explicit modes not honoured")
+	}
+	if IsTerminal(nil) {
+		t.Fatalf("nil file is not a terminal")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestDisplay_Nil verifies all methods are no-ops on a nil Display.
+func TestDisplay_Nil(t *testing.T) {
+	var d *Display
+	d.FolderDone(1)
+	d.Finish()
+	var logs strings.Builder
+	if w := d.Writer(&logs); w != io.Writer(&logs) {
+		t.Fatalf("expected writer to be returned unchanged")
+	}
+	if got := d.Line(); got != "" {
+		t.Fatalf("expected empty line, got %q", got)
+	}
+}
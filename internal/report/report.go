@@ -0,0 +1,133 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Event levels understood by Sentry.
+const (
+	LevelError = "error"
+	LevelFatal = "fatal"
+)
+
+// Sentry sends error events to a Sentry project using the HTTP store
+// endpoint. A nil *Sentry is valid and discards all events, so callers don't
+// need to check whether error reporting is configured.
+type Sentry struct {
+	// Release and ServerName are attached to every event if set.
+	Release    string
+	ServerName string
+
+	endpoint string
+	key      string
+	client   *http.Client
+}
+
+// event is the subset of the Sentry event payload we send.
+type event struct {
+	EventID    string            `json:"event_id"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Level      string            `json:"level"`
+	Logger     string            `json:"logger"`
+	Platform   string            `json:"platform"`
+	Message    string            `json:"message"`
+	Release    string            `json:"release,omitempty"`
+	ServerName string            `json:"server_name,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewSentry creates a reporter from a Sentry DSN of the form
+// `https://<key>@<host>/<project>`. An empty DSN returns a nil reporter.
+func NewSentry(dsn string) (*Sentry, error) {
+	if dsn == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parse dsn: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid dsn scheme %q", u.Scheme)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("dsn missing public key")
+	}
+
+	// NOTE(joel): The project ID is the last path segment; anything before it
+	// is a path prefix of self-hosted installations.
+	path := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	project := path[i+1:]
+	if project == "" {
+		return nil, fmt.Errorf("dsn missing project id")
+	}
+	endpoint := fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, path[:i], project)
+
+	return &Sentry{
+		endpoint: endpoint,
+		key:      u.User.Username(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Capture sends a single event with the given level, message and tags. It
+// blocks until the event was delivered (or failed) so fatal errors are sent
+// before the process exits. No-op on a nil reporter.
+func (s *Sentry) Capture(level, message string, tags map[string]string) error {
+	if s == nil {
+		return nil
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("event id: %w", err)
+	}
+	ev := event{
+		EventID:    hex.EncodeToString(id),
+		Timestamp:  time.Now().UTC(),
+		Level:      level,
+		Logger:     "local-file-sync",
+		Platform:   "go",
+		Message:    message,
+		Release:    s.Release,
+		ServerName: s.ServerName,
+		Tags:       tags,
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf(
+		"Sentry sentry_version=7, sentry_client=local-file-sync/%s, sentry_key=%s",
+		s.Release, s.key,
+	))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send event: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("send event: unexpected status %s", resp.Status)
+	}
+	return nil
+}
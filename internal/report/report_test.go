@@ -0,0 +1,80 @@
+package report
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestNewSentry_DSN verifies DSN parsing into the store endpoint.
+func TestNewSentry_DSN(t *testing.T) {
+	s, err := NewSentry("https://abc@o1.ingest.sentry.io/42")
+	if err != nil {
+		t.Fatalf("NewSentry: %v", err)
+	}
+	if s.endpoint != "https://o1.ingest.sentry.io/api/42/store/" || s.key != "abc" {
+		t.Fatalf("unexpected endpoint %q key %q", s.endpoint, s.key)
+	}
+
+	s, err = NewSentry("http://abc@sentry.local/prefix/7")
+	if err != nil {
+		t.Fatalf("NewSentry: %v", err)
+	}
+	if s.endpoint != "http://sentry.local/prefix/api/7/store/" {
+		t.Fatalf("unexpected endpoint %q", s.endpoint)
+	}
+
+	for _, dsn := range []string{"ftp://abc@host/1", "https://host/1", "https://abc@host/"} {
+		if _, err := NewSentry(dsn); err == nil {
+			t.Fatalf("expected error for %q", dsn)
+		}
+	}
+
+	if s, err := NewSentry(""); s != nil || err != nil {
+		t.Fatalf("expected nil reporter for empty DSN")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestSentry_Capture verifies the event payload and auth header.
+func TestSentry_Capture(t *testing.T) {
+	var got event
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("X-Sentry-Auth")
+		if r.URL.Path != "/api/3/store/" {
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := NewSentry(strings.Replace(srv.URL, "http://", "http://key@", 1) + "/3")
+	if err != nil {
+		t.Fatalf("NewSentry: %v", err)
+	}
+	s.Release = "1.2.3"
+	if err := s.Capture(LevelFatal, "boom", map[string]string{"agent": "a"}); err != nil {
+		t.Fatalf("Capture: %v", err)
+	}
+	if got.Level != LevelFatal || got.Message != "boom" || got.Tags["agent"] != "a" || got.Release != "1.2.3" {
+		t.Fatalf("unexpected event %+v", got)
+	}
+	if len(got.EventID) != 32 {
+		t.Fatalf("unexpected event id %q", got.EventID)
+	}
+	if !strings.Contains(auth, "sentry_key=key") {
+		t.Fatalf("unexpected auth header %q", auth)
+	}
+
+	var nilReporter *Sentry
+	if err := nilReporter.Capture(LevelError, "ignored", nil); err != nil {
+		t.Fatalf("nil reporter: %v", err)
+	}
+}
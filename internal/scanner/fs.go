@@ -0,0 +1,196 @@
+package scanner
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// ErrTimeout is returned (wrapped in an *fs.PathError) for filesystem
+// operations that didn't finish within Options.OpTimeout.
+var ErrTimeout = errors.New("operation timed out")
+
+// fileSystem is the filesystem a scan reads from: the OS filesystem with
+// native paths if fsys is nil, otherwise fsys with slash-separated paths (see
+// Options.FS). With a timeout, stat and directory reads give up after it
+// (see Options.OpTimeout).
+type fileSystem struct {
+	fsys    fs.FS
+	timeout time.Duration
+	retries int
+}
+
+// newFileSystem returns the filesystem configured by opts.
+func newFileSystem(opts Options) fileSystem {
+	return fileSystem{fsys: opts.FS, timeout: opts.OpTimeout, retries: opts.OpRetries}
+}
+
+// Stat returns the file info of name, following symlinks.
+func (f fileSystem) Stat(name string) (fs.FileInfo, error) {
+	return withTimeout(f, "stat", name, func() (fs.FileInfo, error) {
+		if f.fsys == nil {
+			return os.Stat(name)
+		}
+		return fs.Stat(f.fsys, name)
+	})
+}
+
+// Lstat returns the file info of name without following symlinks. An fs.FS
+// that doesn't implement fs.ReadLinkFS has no symlinks, so this is Stat.
+func (f fileSystem) Lstat(name string) (fs.FileInfo, error) {
+	return withTimeout(f, "lstat", name, func() (fs.FileInfo, error) {
+		if f.fsys == nil {
+			return os.Lstat(name)
+		}
+		return fs.Lstat(f.fsys, name)
+	})
+}
+
+// ReadDir returns the entries of the directory name sorted by name.
+func (f fileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	return withTimeout(f, "readdir", name, func() ([]fs.DirEntry, error) {
+		if f.fsys == nil {
+			return os.ReadDir(name)
+		}
+		return fs.ReadDir(f.fsys, name)
+	})
+}
+
+// ReadFile returns the content of name.
+func (f fileSystem) ReadFile(name string) ([]byte, error) {
+	if f.fsys == nil {
+		return os.ReadFile(name)
+	}
+	return fs.ReadFile(f.fsys, name)
+}
+
+// Open opens name for reading.
+func (f fileSystem) Open(name string) (fs.File, error) {
+	if f.fsys == nil {
+		return os.Open(name)
+	}
+	return f.fsys.Open(name)
+}
+
+// WalkDir walks the tree below root like filepath.WalkDir (or fs.WalkDir for
+// an fs.FS), but with every stat and directory read subject to the timeout.
+func (f fileSystem) WalkDir(root string, fn fs.WalkDirFunc) error {
+	stat := f.Lstat
+	if f.fsys != nil {
+		stat = f.Stat
+	}
+	info, err := stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = f.walkDir(root, fs.FileInfoToDirEntry(info), fn)
+	}
+	if err == fs.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// walkDir recursively descends name, calling fn like fs.WalkDir does.
+func (f fileSystem) walkDir(name string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(name, d, nil); err != nil || !d.IsDir() {
+		if err == fs.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+	entries, err := f.ReadDir(name)
+	if err != nil {
+		// NOTE(joel): Second call for the same directory, reporting the error.
+		if err = fn(name, d, err); err != nil {
+			if err == fs.SkipDir && d.IsDir() {
+				err = nil
+			}
+			return err
+		}
+	}
+	for _, e := range entries {
+		if err := f.walkDir(f.Join(name, e.Name()), e, fn); err != nil {
+			if err == fs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Join joins path elements with the separator of the filesystem.
+func (f fileSystem) Join(elem ...string) string {
+	if f.fsys == nil {
+		return filepath.Join(elem...)
+	}
+	return path.Join(elem...)
+}
+
+// Dir returns all but the last element of name.
+func (f fileSystem) Dir(name string) string {
+	if f.fsys == nil {
+		return filepath.Dir(name)
+	}
+	return path.Dir(name)
+}
+
+// Base returns the last element of name.
+func (f fileSystem) Base(name string) string {
+	if f.fsys == nil {
+		return filepath.Base(name)
+	}
+	return path.Base(name)
+}
+
+// Local converts the slash-separated relative path rel to a path of the
+// filesystem. ok is false if rel escapes its base directory.
+func (f fileSystem) Local(rel string) (string, bool) {
+	if f.fsys == nil {
+		rel = filepath.FromSlash(rel)
+		return rel, filepath.IsLocal(rel)
+	}
+	return rel, rel != "" && fs.ValidPath(path.Clean(rel))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// withTimeout runs call, giving up after the timeout of f and retrying up to
+// f.retries times. Without a timeout call runs directly.
+//
+// NOTE(joel): A call blocked on a hung network mount (SMB/NFS) can't be
+// interrupted; its goroutine is abandoned and finishes, if ever, in the
+// background. The timeout only keeps the scan from waiting for it.
+func withTimeout[T any](f fileSystem, op, name string, call func() (T, error)) (T, error) {
+	if f.timeout <= 0 {
+		return call()
+	}
+	type result struct {
+		v   T
+		err error
+	}
+	for attempt := 0; ; attempt++ {
+		done := make(chan result, 1)
+		go func() {
+			v, err := call()
+			done <- result{v, err}
+		}()
+		timer := time.NewTimer(f.timeout)
+		select {
+		case r := <-done:
+			timer.Stop()
+			return r.v, r.err
+		case <-timer.C:
+		}
+		if attempt >= f.retries {
+			var zero T
+			return zero, &fs.PathError{Op: op, Path: name, Err: ErrTimeout}
+		}
+	}
+}
@@ -1,23 +1,72 @@
 package scanner
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"iter"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 // Match represents the relationship between a *.RDY file and a directory with
 // the same base name.
 type Match struct {
+	// SchemaVersion is the output schema version (see SchemaVersion).
+	SchemaVersion int `json:"schemaVersion"`
+	// ID is a stable identifier of the match derived from the trigger's path
+	// relative to the root (see MatchID), the same on every scan and machine.
+	ID            string      `json:"id"`
 	ReadyFile     string      `json:"readyFile"`
 	Folder        string      `json:"folder,omitempty"`
 	MissingFolder bool        `json:"missingFolder"`
 	FolderEntries []FileEntry `json:"folderEntries,omitempty"`
+	// EntriesTruncated is set if FolderEntries was cut short for output (see
+	// -max-entries-in-output); EntryCount then holds the full number.
+	EntriesTruncated bool `json:"entriesTruncated,omitempty"`
+	EntryCount       int  `json:"entryCount,omitempty"`
+	// Batch is set if the trigger gates several folders (see BatchTrigger);
+	// the other folders of the batch share ReadyFile.
+	Batch bool `json:"batch,omitempty"`
+	// ReadySize and ReadyModTime describe the trigger itself, so consumers
+	// don't need to stat it. The size is 0 for directory triggers.
+	ReadySize    int64     `json:"readySize"`
+	ReadyModTime time.Time `json:"readyModTime"`
+	// ReadyPreview holds the first Options.ReadyPreview bytes of a trigger
+	// file (invalid UTF-8 replaced), e.g. a producer's note or checksum.
+	ReadyPreview string `json:"readyPreview,omitempty"`
+	// FileCount and TotalSize aggregate the regular files among the folder
+	// entries (subdirectories and symlinks aren't counted), OldestModTime and
+	// NewestModTime their modification times (omitted without files). They
+	// are computed for streamed entries (Options.PageSize) too.
+	FileCount     int       `json:"fileCount"`
+	TotalSize     int64     `json:"totalSize"`
+	OldestModTime time.Time `json:"oldestModTime,omitzero"`
+	NewestModTime time.Time `json:"newestModTime,omitzero"`
+	// Warnings describe non-fatal issues of the scan, e.g. a folder entry
+	// that couldn't be stat'ed (its size and modification time are unknown)
+	// or a folder that couldn't be read completely.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// NOTE(joel): Set for matches scanned with Options.PageSize; their entries
+	// are streamed from disk by Entries instead of listed in FolderEntries.
+	pageSize      int
+	includeHidden bool
+	// NOTE(joel): The number of leading Warnings about the trigger rather
+	// than the folder, which Relist keeps.
+	readyWarnings int
+	// NOTE(joel): The filesystem the match was scanned from (see Options.FS).
+	fs fileSystem
 }
 
 // FileEntry represents a child entry inside a matched folder.
@@ -26,99 +75,721 @@ type FileEntry struct {
 	Size    int64     `json:"size"`
 	ModTime time.Time `json:"modTime"`
 	Path    string    `json:"path"`
+
+	regular bool
+	// NOTE(joel): The error stat'ing the entry, reported as a warning of the
+	// match.
+	statErr error
 }
 
 // Options control scanning behavior.
 type Options struct {
 	Recursive      bool
 	FollowSymlinks bool
+	// NormalizeUnicode matches sibling folders whose names only differ from
+	// the *.RDY base name in Unicode normalization form (NFC vs NFD).
+	NormalizeUnicode bool
+	// IncludeHidden keeps hidden and system files (see IsHidden) in
+	// FolderEntries. By default they are excluded.
+	IncludeHidden bool
+	// Triggers decide which entries signal a ready folder. The first trigger
+	// matching an entry wins. Defaults to SuffixFile (`NAME.RDY` files).
+	Triggers []Trigger
+	// OnError, if set, receives errors reading entries below root (e.g. a
+	// permission denied subdirectory) during a recursive scan, and the walk
+	// continues without them. Otherwise the first such error aborts the scan.
+	OnError func(path string, err error)
+	// OpTimeout, if > 0, limits each stat and directory read, so a hung
+	// network mount (SMB/NFS) stalls only the affected subtree or folder
+	// instead of the whole scan. Timed out operations are retried OpRetries
+	// times before failing with ErrTimeout.
+	OpTimeout time.Duration
+	OpRetries int
+	// OnTimeout, if set, receives paths below root whose operations timed out
+	// (see OpTimeout). Timed out subtrees are skipped and the walk continues;
+	// timed out folders are returned with MissingFolder set. Otherwise
+	// timeouts are handled like other errors (see OnError).
+	OnTimeout func(path string, err error)
+	// PageSize, if > 0, skips listing folder entries during the scan. Instead
+	// Match.Entries streams them from disk in pages of PageSize, keeping memory
+	// flat for huge folders. FolderEntries stays empty and streamed entries are
+	// yielded in directory order rather than sorted by name.
+	PageSize int
+	// ReadyPreview, if > 0, sets Match.ReadyPreview to up to this many bytes
+	// of the trigger file's content.
+	ReadyPreview int
+	// ReadySymlinks is the ReadySymlink* policy for triggers that are
+	// symlinks; empty means ReadySymlinkFollow.
+	ReadySymlinks string
+	// FS, if set, is scanned instead of the OS filesystem, e.g. an in-memory
+	// fstest.MapFS in tests or a remote source. Paths (root, targets and all
+	// returned paths) are then slash-separated paths within FS (see
+	// fs.ValidPath). Symlinks are only detected if FS implements
+	// fs.ReadLinkFS.
+	FS fs.FS
+	// Select, if set, limits the scan to triggers for whose path it returns
+	// true; the folders of other triggers aren't listed (e.g. those of other
+	// processes sharing the work).
+	Select func(readyFile string) bool
+	// Root is the directory match IDs are relative to (see MatchID) for
+	// ScanTargets; Scan uses its root.
+	Root string
+}
+
+// Symlinked trigger policies (Options.ReadySymlinks).
+const (
+	// ReadySymlinkFollow treats a symlinked trigger like its target: a link to
+	// a file is a trigger file, a link to a directory a marker directory, and
+	// the trigger's size and modification time (the state's change detection)
+	// are the target's. Dangling links are skipped.
+	ReadySymlinkFollow = "follow"
+	// ReadySymlinkSkip ignores symlinked triggers.
+	ReadySymlinkSkip = "skip"
+)
+
+// IgnoreMarker is the name of a marker file that excludes the directory
+// containing it, including all subdirectories, from recursive scans (e.g.
+// archived or in-migration areas).
+const IgnoreMarker = ".lfs-ignore"
+
+// found is a trigger located during the scan, before its folder is listed.
+type found struct {
+	readyFile, folder string
+	trigger           Trigger
+	batch             bool
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// Scan scans the provided directory for *.RDY files and finds sibling folders
-// sharing the same base name.
+// Scan scans the provided directory for triggers (by default *.RDY files) and
+// lists the folders they refer to (by default sibling folders sharing the same
+// base name).
 func Scan(root string, opts Options) ([]Match, error) {
-	info, err := os.Stat(root)
+	fsys := newFileSystem(opts)
+	info, err := fsys.Stat(root)
 	if err != nil {
 		return nil, err
 	}
 	if !info.IsDir() {
 		return nil, errors.New("root is not a directory")
 	}
+	opts.Root = root
 
-	var rdyFiles []string
+	triggers := opts.Triggers
+	if len(triggers) == 0 {
+		triggers = []Trigger{SuffixFile{}}
+	}
+	if opts.FS != nil || opts.OpTimeout > 0 {
+		triggers = bindTriggers(triggers, fsys)
+	}
+	var triggered []found
+	visit := func(path string, d fs.DirEntry) (found, bool) {
+		// NOTE(joel): Triggers match on the entry type, which for a symlink is
+		// neither file nor directory; resolve it per policy first.
+		if d.Type()&fs.ModeSymlink != 0 {
+			if opts.ReadySymlinks == ReadySymlinkSkip {
+				return found{}, false
+			}
+			info, err := fsys.Stat(path)
+			if err != nil {
+				return found{}, false
+			}
+			d = fs.FileInfoToDirEntry(info)
+		}
+		for _, t := range triggers {
+			readyFile, folder, ok := t.Match(path, d)
+			if !ok {
+				continue
+			}
+			f := found{readyFile: readyFile, folder: folder, trigger: t}
+			// NOTE(joel): A batch yields one match per listed folder. An unreadable
+			// or empty batch yields a single match with a missing folder so it is
+			// reported like other orphaned triggers.
+			if bt, ok := t.(BatchTrigger); ok {
+				f.batch = true
+				folders, err := bt.Folders(readyFile)
+				if err != nil || len(folders) == 0 {
+					triggered = append(triggered, f)
+					return f, true
+				}
+				for _, folder := range folders {
+					f.folder = folder
+					triggered = append(triggered, f)
+				}
+				return f, true
+			}
+			triggered = append(triggered, f)
+			return f, true
+		}
+		return found{}, false
+	}
 
 	if opts.Recursive {
 		walkFn := func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
-				return err
+				if path != root && opts.OnTimeout != nil && errors.Is(err, ErrTimeout) {
+					opts.OnTimeout(path, err)
+					return nil
+				}
+				if opts.OnError == nil || path == root {
+					return err
+				}
+				opts.OnError(path, err)
+				return nil
 			}
 			if !d.IsDir() {
-				if strings.HasSuffix(strings.ToUpper(d.Name()), ".RDY") {
-					rdyFiles = append(rdyFiles, path)
-				}
+				visit(path, d)
+				return nil
+			}
+			if path == root {
 				return nil
 			}
+			if _, err := fsys.Lstat(fsys.Join(path, IgnoreMarker)); err == nil {
+				return fs.SkipDir
+			}
+			// NOTE(joel): Directories that are triggers (marker directories) or
+			// trigger their own contents (manifest, age) are not descended into.
+			if f, ok := visit(path, d); ok && (f.readyFile == path || f.folder == path) {
+				return fs.SkipDir
+			}
 			if !opts.FollowSymlinks && d.Type()&os.ModeSymlink != 0 {
 				return fs.SkipDir
 			}
 			return nil
 		}
-		if err := filepath.WalkDir(root, walkFn); err != nil {
+		if err := fsys.WalkDir(root, walkFn); err != nil {
 			return nil, fmt.Errorf("walk error: %w", err)
 		}
 	} else {
-		entries, err := os.ReadDir(root)
+		entries, err := fsys.ReadDir(root)
 		if err != nil {
 			return nil, err
 		}
 		for _, e := range entries {
-			if e.IsDir() {
-				continue
-			}
-			if strings.HasSuffix(strings.ToUpper(e.Name()), ".RDY") {
-				rdyFiles = append(rdyFiles, filepath.Join(root, e.Name()))
-			}
+			visit(fsys.Join(root, e.Name()), e)
 		}
 	}
 
-	sort.Strings(rdyFiles)
-	matches := make([]Match, 0, len(rdyFiles))
+	sort.Slice(triggered, func(i, j int) bool {
+		if triggered[i].readyFile != triggered[j].readyFile {
+			return triggered[i].readyFile < triggered[j].readyFile
+		}
+		return triggered[i].folder < triggered[j].folder
+	})
+	matches := make([]Match, 0, len(triggered))
+	for _, f := range triggered {
+		if opts.Select != nil && !opts.Select(f.readyFile) {
+			continue
+		}
+		if m, ok := newMatch(f, opts); ok {
+			matches = append(matches, m)
+		}
+	}
+	return matches, nil
+}
 
-	for _, rdy := range rdyFiles {
-		base := filepath.Base(rdy)
-		nameNoExt := strings.TrimSuffix(base, filepath.Ext(base))
-		candidateDir := filepath.Join(filepath.Dir(rdy), nameNoExt)
+////////////////////////////////////////////////////////////////////////////////
 
-		m := Match{ReadyFile: rdy}
-		if st, err := os.Stat(candidateDir); err == nil && st.IsDir() {
-			m.Folder = candidateDir
-			entries, err := os.ReadDir(candidateDir)
-			if err != nil {
-				// NOTE(joel): Treat as missing contents rather than whole failure.
-				m.MissingFolder = true
-			} else {
-				for _, e := range entries {
-					// NOTE(joel): Ignoring error; may lack modtime/size if fail
-					finfo, _ := e.Info()
-					fe := FileEntry{
-						Name: e.Name(),
-						Path: filepath.Join(candidateDir, e.Name()),
-					}
-					if finfo != nil {
-						fe.Size = finfo.Size()
-						fe.ModTime = finfo.ModTime()
-					}
+// Target is a folder chosen without scanning, e.g. by another tool (see
+// ScanTargets).
+type Target struct {
+	// ReadyFile is the trigger of the folder. If empty, the folder itself is
+	// the trigger, like with the age trigger.
+	ReadyFile string
+	Folder    string
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ScanTargets lists the given folders the way Scan lists triggered folders,
+// in the given order. Folders that don't exist are returned with
+// MissingFolder set.
+func ScanTargets(targets []Target, opts Options) []Match {
+	matches := make([]Match, 0, len(targets))
+	for _, t := range targets {
+		f := found{readyFile: t.ReadyFile, folder: t.Folder}
+		if f.readyFile == "" {
+			f.readyFile = t.Folder
+		}
+		if opts.Select != nil && !opts.Select(f.readyFile) {
+			continue
+		}
+		if m, ok := newMatch(f, opts); ok {
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// newMatch lists the folder of a found trigger. ok is false if the trigger
+// doesn't consider the folder ready yet; found folders without a trigger are
+// always ready.
+func newMatch(f found, opts Options) (m Match, ok bool) {
+	fsys := newFileSystem(opts)
+	candidateDir := f.folder
+	if opts.NormalizeUnicode {
+		candidateDir = resolveNormalized(fsys, candidateDir)
+	}
+
+	m = Match{SchemaVersion: SchemaVersion, ID: MatchID(opts.Root, f.readyFile), ReadyFile: f.readyFile, Batch: f.batch, includeHidden: opts.IncludeHidden, fs: fsys}
+	// NOTE(joel): The folders of a batch share the trigger; each one's path
+	// tells them apart.
+	if f.batch && f.folder != "" {
+		m.ID = MatchID(opts.Root, f.readyFile+"\x00"+f.folder)
+	}
+	st, err := fsys.Stat(candidateDir)
+	if candidateDir != "" && err == nil && st.IsDir() {
+		m.Folder = candidateDir
+		if opts.PageSize > 0 {
+			m.pageSize = opts.PageSize
+		} else if entries, err := fsys.ReadDir(candidateDir); err != nil {
+			// NOTE(joel): Treat as missing contents rather than whole failure.
+			m.MissingFolder = true
+			m.warnf("read folder: %v", err)
+			timedOut(opts, candidateDir, err)
+		} else {
+			for _, e := range entries {
+				if fe, ok := m.entry(e); ok {
 					m.FolderEntries = append(m.FolderEntries, fe)
 				}
-				sort.Slice(m.FolderEntries, func(i, j int) bool { return m.FolderEntries[i].Name < m.FolderEntries[j].Name })
 			}
-		} else {
-			m.MissingFolder = true
+			sort.Slice(m.FolderEntries, func(i, j int) bool { return m.FolderEntries[i].Name < m.FolderEntries[j].Name })
+		}
+		if !m.MissingFolder && f.trigger != nil && !f.trigger.Ready(m) {
+			return Match{}, false
+		}
+	} else {
+		m.MissingFolder = true
+		if candidateDir != "" {
+			timedOut(opts, candidateDir, err)
 		}
-		matches = append(matches, m)
 	}
+	m.readyInfo(opts.ReadyPreview)
+	m.readyWarnings = len(m.Warnings)
+	m.folderStats()
+	return m, true
+}
 
-	return matches, nil
+////////////////////////////////////////////////////////////////////////////////
+
+// MatchID returns the ID of the match of readyFile: the hex encoded first 16
+// bytes of the SHA256 digest of its slash separated path relative to root.
+// Triggers outside root (or without root) are hashed by their full path.
+func MatchID(root, readyFile string) string {
+	p := readyFile
+	if rel, err := filepath.Rel(root, readyFile); root != "" && err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		p = rel
+	}
+	sum := sha256.Sum256([]byte(filepath.ToSlash(p)))
+	return hex.EncodeToString(sum[:16])
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// timedOut passes err to opts.OnTimeout if it is a timeout.
+func timedOut(opts Options, path string, err error) {
+	if opts.OnTimeout != nil && errors.Is(err, ErrTimeout) {
+		opts.OnTimeout(path, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// readyInfo sets the size, modification time and, if preview > 0, content
+// preview of the trigger. Failures leave the fields empty and are added to
+// the warnings; the trigger may have been removed since it was found.
+func (m *Match) readyInfo(preview int) {
+	fi, err := m.fs.Stat(m.ReadyFile)
+	if err != nil {
+		m.warnf("stat trigger: %v", err)
+		return
+	}
+	m.ReadyModTime = fi.ModTime()
+	if !fi.Mode().IsRegular() {
+		return
+	}
+	m.ReadySize = fi.Size()
+	if preview <= 0 || fi.Size() == 0 {
+		return
+	}
+	f, err := m.fs.Open(m.ReadyFile)
+	if err != nil {
+		m.warnf("read trigger preview: %v", err)
+		return
+	}
+	defer f.Close()
+	b := make([]byte, min(int64(preview), fi.Size()))
+	n, _ := io.ReadFull(f, b)
+	m.ReadyPreview = strings.ToValidUTF8(string(b[:n]), "\uFFFD")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// folderStats aggregates the regular files of the folder entries into
+// FileCount, TotalSize, OldestModTime and NewestModTime. Entries that can't
+// be read (streamed matches only) end the aggregation early. Both, and
+// entries that couldn't be stat'ed, are added to the warnings.
+func (m *Match) folderStats() {
+	for fe, err := range m.Entries() {
+		if err != nil {
+			m.warnf("read folder: %v (statistics incomplete)", err)
+			return
+		}
+		if fe.statErr != nil {
+			m.warnf("stat %s: %v (size and modification time unknown)", fe.Name, fe.statErr)
+		}
+		if !fe.regular {
+			continue
+		}
+		m.FileCount++
+		m.TotalSize += fe.Size
+		if m.OldestModTime.IsZero() || fe.ModTime.Before(m.OldestModTime) {
+			m.OldestModTime = fe.ModTime
+		}
+		if fe.ModTime.After(m.NewestModTime) {
+			m.NewestModTime = fe.ModTime
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// warnf adds a warning to the match.
+func (m *Match) warnf(format string, args ...any) {
+	m.Warnings = append(m.Warnings, fmt.Sprintf(format, args...))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Relist reads the matched folder again, with the filters of the scan (hidden
+// files, the trigger), and returns the match with FolderEntries, the folder
+// statistics and their warnings updated, e.g. to include files added since the scan right before
+// uploading. Streamed matches are read while iterating anyway and returned as
+// they are, like matches without a folder.
+func (m Match) Relist() (Match, error) {
+	if m.pageSize > 0 || m.MissingFolder || m.Folder == "" {
+		return m, nil
+	}
+	entries, err := m.fs.ReadDir(m.Folder)
+	if err != nil {
+		return m, fmt.Errorf("relist %s: %w", m.Folder, err)
+	}
+	m.FolderEntries = nil
+	for _, e := range entries {
+		if fe, ok := m.entry(e); ok {
+			m.FolderEntries = append(m.FolderEntries, fe)
+		}
+	}
+	sort.Slice(m.FolderEntries, func(i, j int) bool { return m.FolderEntries[i].Name < m.FolderEntries[j].Name })
+	m.FileCount, m.TotalSize = 0, 0
+	m.OldestModTime, m.NewestModTime = time.Time{}, time.Time{}
+	m.Warnings = slices.Clone(m.Warnings[:m.readyWarnings])
+	m.folderStats()
+	return m, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Fingerprint returns a hex SHA256 digest of the folder entries' names, sizes
+// and modification times (in name order), so adding, removing or rewriting a
+// file changes it.
+func (m Match) Fingerprint() (string, error) {
+	var lines []string
+	for fe, err := range m.Entries() {
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, fmt.Sprintf("%s\x00%d\x00%d\n", fe.Name, fe.Size, fe.ModTime.UnixNano()))
+	}
+	sort.Strings(lines)
+	h := sha256.New()
+	for _, l := range lines {
+		io.WriteString(h, l)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Regular reports whether the entry was a regular file when it was listed;
+// Size and ModTime describe it then.
+func (fe FileEntry) Regular() bool {
+	return fe.regular
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Entries yields the entries of the matched folder. For matches scanned with
+// Options.PageSize the folder is read in pages while iterating, and a read
+// error is yielded once before stopping. Otherwise FolderEntries is yielded.
+func (m Match) Entries() iter.Seq2[FileEntry, error] {
+	return func(yield func(FileEntry, error) bool) {
+		if m.pageSize <= 0 {
+			for _, fe := range m.FolderEntries {
+				if !yield(fe, nil) {
+					return
+				}
+			}
+			return
+		}
+		if m.MissingFolder || m.Folder == "" {
+			return
+		}
+		f, err := m.fs.Open(m.Folder)
+		if err != nil {
+			yield(FileEntry{}, err)
+			return
+		}
+		defer f.Close()
+		dir, ok := f.(fs.ReadDirFile)
+		if !ok {
+			yield(FileEntry{}, fmt.Errorf("read %s: not a directory", m.Folder))
+			return
+		}
+		for {
+			entries, err := dir.ReadDir(m.pageSize)
+			for _, e := range entries {
+				if fe, ok := m.entry(e); ok && !yield(fe, nil) {
+					return
+				}
+			}
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				yield(FileEntry{}, err)
+				return
+			}
+		}
+	}
+}
+
+// entry converts a directory entry of the matched folder into a FileEntry.
+// Hidden entries (unless included) and a trigger inside the folder (e.g. a
+// manifest), which is not part of the data, are left out.
+func (m Match) entry(e fs.DirEntry) (FileEntry, bool) {
+	if !m.includeHidden && IsHidden(e.Name()) {
+		return FileEntry{}, false
+	}
+	fe := FileEntry{
+		Name:    e.Name(),
+		Path:    m.fs.Join(m.Folder, e.Name()),
+		regular: e.Type().IsRegular(),
+	}
+	if fe.Path == m.ReadyFile {
+		return FileEntry{}, false
+	}
+	// NOTE(joel): An entry that can't be stat'ed (e.g. removed since the
+	// listing) is kept without size and modification time.
+	finfo, err := e.Info()
+	if err != nil {
+		fe.statErr = err
+		return fe, true
+	}
+	fe.Size = finfo.Size()
+	fe.ModTime = finfo.ModTime()
+	return fe, true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ExpectedCount returns the number of folder entries announced for a trigger.
+// A sibling `NAME.CNT` file takes precedence over the content of the *.RDY
+// file itself. Either may contain a plain number or a `count=N` / `count: N`
+// line. ok is false if no count is announced.
+func ExpectedCount(readyFile string) (n int, ok bool) {
+	return expectedCount(fileSystem{}, readyFile)
+}
+
+// expectedCount implements ExpectedCount for triggers on fsys.
+func expectedCount(fsys fileSystem, readyFile string) (n int, ok bool) {
+	stem := strings.TrimSuffix(readyFile, filepath.Ext(readyFile))
+	for _, p := range []string{stem + ".CNT", stem + ".cnt", readyFile} {
+		b, err := fsys.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		if n, ok := parseCount(string(b)); ok {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// CountReady reports whether the number of folder entries of m matches the
+// count announced for its trigger (see ExpectedCount). Matches without an
+// announced count are not ready. have and want are returned for logging.
+func CountReady(m Match) (ready bool, have, want int) {
+	for _, err := range m.Entries() {
+		if err == nil {
+			have++
+		}
+	}
+	want, ok := expectedCount(m.fs, m.ReadyFile)
+	if !ok {
+		return false, have, -1
+	}
+	return have == want, have, want
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// parseCount extracts the first count from s. Lines are either a plain
+// non-negative number or `count=N` / `count: N` (case-insensitive).
+func parseCount(s string) (int, bool) {
+	for line := range strings.Lines(s) {
+		line = strings.TrimSpace(line)
+		if k, v, found := strings.Cut(line, "="); found && strings.EqualFold(strings.TrimSpace(k), "count") {
+			line = strings.TrimSpace(v)
+		} else if k, v, found := strings.Cut(line, ":"); found && strings.EqualFold(strings.TrimSpace(k), "count") {
+			line = strings.TrimSpace(v)
+		}
+		if n, err := strconv.Atoi(line); err == nil && n >= 0 {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ReadyID returns the ID a producer announced for a trigger with an `id=ID` /
+// `id: ID` line (case-insensitive key) in the trigger file, e.g. to name the
+// folder's Firestore document. ok is false if the trigger can't be read or
+// announces no ID.
+func ReadyID(m Match) (id string, ok bool) {
+	b, err := m.fs.ReadFile(m.ReadyFile)
+	if err != nil {
+		return "", false
+	}
+	return parseID(string(b))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// parseID extracts the value of the first non-empty `id=ID` / `id: ID` line
+// from s.
+func parseID(s string) (string, bool) {
+	for line := range strings.Lines(s) {
+		for _, sep := range []string{"=", ":"} {
+			k, v, found := strings.Cut(line, sep)
+			if !found || !strings.EqualFold(strings.TrimSpace(k), "id") {
+				continue
+			}
+			if v = strings.TrimSpace(v); v != "" {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// IsHidden reports whether a folder entry is a hidden or system file that
+// should not end up in the bucket: dotfiles (including `.DS_Store` and macOS
+// `._*` resource forks), Windows `desktop.ini` / `Thumbs.db` and NTFS
+// alternate data streams (`file:Zone.Identifier`, `file::$DATA`, as exposed
+// by some SMB copies). Other names containing a colon are regular files.
+func IsHidden(name string) bool {
+	if strings.HasPrefix(name, ".") || isStream(name) {
+		return true
+	}
+	switch strings.ToLower(name) {
+	case "desktop.ini", "thumbs.db":
+		return true
+	}
+	return false
+}
+
+// streamNames lists the (lower-cased) NTFS alternate data streams Windows,
+// browsers and SMB servers commonly attach to files.
+var streamNames = map[string]bool{
+	"zone.identifier":        true,
+	"smartscreen":            true,
+	"encryptable":            true,
+	"favicon":                true,
+	"afp_afpinfo":            true,
+	"afp_resource":           true,
+	"com.dropbox.attributes": true,
+	"com.dropbox.attrs":      true,
+	"ms-properties":          true,
+}
+
+// isStream reports whether name is an NTFS alternate data stream: a name with
+// an explicit `:$DATA` stream type or a `:stream` suffix naming a known
+// stream.
+func isStream(name string) bool {
+	i := strings.LastIndexByte(name, ':')
+	if i <= 0 {
+		return false
+	}
+	if strings.EqualFold(name[i:], ":$DATA") {
+		return true
+	}
+	return streamNames[strings.ToLower(name[i+1:])]
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// resolveNormalized returns path unchanged if it exists. Otherwise it looks
+// for a sibling entry whose name is equal to the base name of path after NFC
+// normalization (e.g. a folder copied through macOS in NFD form) and returns
+// its path. If none is found, path is returned unchanged.
+func resolveNormalized(fsys fileSystem, path string) string {
+	if _, err := fsys.Lstat(path); err == nil {
+		return path
+	}
+	dir, base := fsys.Dir(path), fsys.Base(path)
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return path
+	}
+	want := norm.NFC.String(base)
+	for _, e := range entries {
+		if norm.NFC.String(e.Name()) == want {
+			return fsys.Join(dir, e.Name())
+		}
+	}
+	return path
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Processing orders supported by SortMatches.
+const (
+	OrderPath   = "path"
+	OrderOldest = "oldest"
+	OrderNewest = "newest"
+)
+
+// SortMatches reorders matches in place. OrderPath keeps the (path sorted)
+// scan order; OrderOldest and OrderNewest sort by the modification time of
+// the *.RDY files, falling back to path order for equal times. *.RDY files
+// that can't be stat'ed are moved to the end.
+func SortMatches(matches []Match, order string) {
+	if order != OrderOldest && order != OrderNewest {
+		return
+	}
+	mtimes := make(map[string]time.Time, len(matches))
+	for _, m := range matches {
+		if fi, err := m.fs.Stat(m.ReadyFile); err == nil {
+			mtimes[m.ReadyFile] = fi.ModTime()
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, aok := mtimes[matches[i].ReadyFile]
+		b, bok := mtimes[matches[j].ReadyFile]
+		if !aok || !bok {
+			return aok && !bok
+		}
+		if order == OrderNewest {
+			return a.After(b)
+		}
+		return a.Before(b)
+	})
 }
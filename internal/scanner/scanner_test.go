@@ -1,10 +1,17 @@
 package scanner
 
 import (
+	"errors"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"sort"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 // TestScan verifies basic scanning behavior.
@@ -106,6 +113,62 @@ func TestScan_RecursiveSymlinks(t *testing.T) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// TestScan_ReadySymlinks verifies symlinked triggers are matched like their
+// targets (dangling ones skipped) with ReadySymlinkFollow and ignored with
+// ReadySymlinkSkip.
+func TestScan_ReadySymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on windows")
+	}
+	root := t.TempDir()
+	targets := t.TempDir()
+	target := filepath.Join(targets, "ready")
+	if err := os.WriteFile(target, []byte("ready"), 0o644); err != nil {
+		t.Fatalf("write target: %v", err)
+	}
+	mtime := time.Date(2025, 9, 9, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(target, mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(targets, "marker"), 0o755); err != nil {
+		t.Fatalf("mkdir marker: %v", err)
+	}
+	for name, dest := range map[string]string{
+		"ORDER1.RDY": target,
+		"ORDER2.RDY": filepath.Join(targets, "marker"),
+		"ORDER3.RDY": filepath.Join(targets, "gone"),
+	} {
+		if err := os.Symlink(dest, filepath.Join(root, name)); err != nil {
+			t.Fatalf("symlink: %v", err)
+		}
+		if err := os.Mkdir(filepath.Join(root, strings.TrimSuffix(name, ".RDY")), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	triggers := []Trigger{SuffixFile{}, MarkerDir{}}
+
+	matches, err := Scan(root, Options{Triggers: triggers})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if len(matches) != 2 || filepath.Base(matches[0].Folder) != "ORDER1" || filepath.Base(matches[1].Folder) != "ORDER2" {
+		t.Fatalf("expected the file and directory links matched, got %+v", matches)
+	}
+	if !matches[0].ReadyModTime.Equal(mtime) || matches[0].ReadySize != 5 {
+		t.Fatalf("expected the target's size and time, got %d %s", matches[0].ReadySize, matches[0].ReadyModTime)
+	}
+
+	matches, err = Scan(root, Options{Triggers: triggers, ReadySymlinks: ReadySymlinkSkip})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if len(matches) != 0 {
+		t.Fatalf("expected symlinked triggers skipped, got %+v", matches)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 // TestScan_NonDirRoot verifies error when root is not a directory.
 func TestScan_NonDirRoot(t *testing.T) {
 	f := filepath.Join(t.TempDir(), "file")
@@ -116,3 +179,826 @@ func TestScan_NonDirRoot(t *testing.T) {
 		t.Fatalf("expected error for non-directory root")
 	}
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestScan_NormalizeUnicode verifies a folder stored in NFD form is matched to
+// an NFC named *.RDY file only when normalization is enabled.
+func TestScan_NormalizeUnicode(t *testing.T) {
+	root := t.TempDir()
+	nfc := "Caf\u00e9"  // precomposed e-acute
+	nfd := "Cafe\u0301" // e + combining acute accent
+	if err := os.WriteFile(filepath.Join(root, nfc+".RDY"), nil, 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, nfd), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, nfc)); err == nil {
+		t.Skip("filesystem is normalization-insensitive")
+	}
+
+	m, err := Scan(root, Options{})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if len(m) != 1 || !m[0].MissingFolder {
+		t.Fatalf("expected missing folder without normalization: %+v", m)
+	}
+	m, err = Scan(root, Options{NormalizeUnicode: true})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if len(m) != 1 || m[0].MissingFolder || m[0].Folder != filepath.Join(root, nfd) {
+		t.Fatalf("expected NFD folder to match: %+v", m)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestSortMatches verifies ordering by *.RDY modification time.
+func TestSortMatches(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	mtimes := map[string]time.Time{
+		"A.RDY": now.Add(-1 * time.Hour),
+		"B.RDY": now.Add(-3 * time.Hour),
+		"C.RDY": now.Add(-2 * time.Hour),
+	}
+	var matches []Match
+	for _, name := range []string{"A.RDY", "B.RDY", "C.RDY", "D.RDY"} {
+		p := filepath.Join(root, name)
+		matches = append(matches, Match{ReadyFile: p})
+		mt, ok := mtimes[name]
+		if !ok {
+			continue // NOTE(joel): D.RDY doesn't exist.
+		}
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := os.Chtimes(p, mt, mt); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+	names := func() string {
+		var s []string
+		for _, m := range matches {
+			s = append(s, filepath.Base(m.ReadyFile))
+		}
+		return strings.Join(s, ",")
+	}
+
+	SortMatches(matches, OrderPath)
+	if got := names(); got != "A.RDY,B.RDY,C.RDY,D.RDY" {
+		t.Fatalf("path order changed: %s", got)
+	}
+	SortMatches(matches, OrderOldest)
+	if got := names(); got != "B.RDY,C.RDY,A.RDY,D.RDY" {
+		t.Fatalf("unexpected oldest order: %s", got)
+	}
+	SortMatches(matches, OrderNewest)
+	if got := names(); got != "A.RDY,C.RDY,B.RDY,D.RDY" {
+		t.Fatalf("unexpected newest order: %s", got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestScan_HiddenFiles verifies hidden and system files are excluded from
+// folder entries unless IncludeHidden is set.
+func TestScan_HiddenFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "X.RDY"), nil, 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+	folder := filepath.Join(dir, "X")
+	if err := os.Mkdir(folder, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	names := []string{"a.txt", ".DS_Store", "._a.txt", "desktop.ini", "Thumbs.db"}
+	if runtime.GOOS != "windows" {
+		names = append(names, "a.txt:Zone.Identifier", "a.txt::$DATA")
+	}
+	for _, n := range names {
+		if err := os.WriteFile(filepath.Join(folder, n), nil, 0o644); err != nil {
+			t.Fatalf("write %s: %v", n, err)
+		}
+	}
+
+	matches, err := Scan(dir, Options{})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if got := matches[0].FolderEntries; len(got) != 1 || got[0].Name != "a.txt" {
+		t.Fatalf("expected only a.txt, got %+v", got)
+	}
+
+	matches, err = Scan(dir, Options{IncludeHidden: true})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if got := matches[0].FolderEntries; len(got) != len(names) {
+		t.Fatalf("expected %d entries with IncludeHidden, got %d", len(names), len(got))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestScan_ColonNames verifies regular file names containing a colon are
+// kept and not mistaken for NTFS alternate data streams.
+func TestScan_ColonNames(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colons are not valid in Windows file names")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "X.RDY"), nil, 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+	folder := filepath.Join(dir, "X")
+	if err := os.Mkdir(folder, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	names := []string{"2024-01-01T10:00:00.json", "scan 10:42.pdf", "scan 10:42.pdf:Zone.Identifier"}
+	for _, n := range names {
+		if err := os.WriteFile(filepath.Join(folder, n), nil, 0o644); err != nil {
+			t.Fatalf("write %s: %v", n, err)
+		}
+	}
+
+	matches, err := Scan(dir, Options{})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	var got []string
+	for _, e := range matches[0].FolderEntries {
+		got = append(got, e.Name)
+	}
+	want := []string{"2024-01-01T10:00:00.json", "scan 10:42.pdf"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestScan_DirTriggers verifies *.RDY directories are matched against their
+// sibling folder only with the MarkerDir trigger, and not descended into.
+func TestScan_DirTriggers(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []string{"ORDER1.rdy", "ORDER1", filepath.Join("sub", "ORDER2.RDY"), filepath.Join("sub", "ORDER2")} {
+		if err := os.MkdirAll(filepath.Join(dir, p), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	// NOTE(joel): A file trigger inside a trigger directory must be ignored.
+	if err := os.WriteFile(filepath.Join(dir, "ORDER1.rdy", "INNER.RDY"), nil, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	matches, err := Scan(dir, Options{Recursive: true})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if len(matches) != 1 || filepath.Base(matches[0].ReadyFile) != "INNER.RDY" {
+		t.Fatalf("expected only the file trigger without MarkerDir, got %+v", matches)
+	}
+
+	for _, recursive := range []bool{false, true} {
+		matches, err = Scan(dir, Options{Recursive: recursive, Triggers: []Trigger{SuffixFile{}, MarkerDir{}}})
+		if err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		want := 1
+		if recursive {
+			want = 2
+		}
+		if len(matches) != want {
+			t.Fatalf("recursive=%v: expected %d matches, got %+v", recursive, want, matches)
+		}
+		if matches[0].Folder != filepath.Join(dir, "ORDER1") || matches[0].MissingFolder {
+			t.Fatalf("recursive=%v: unexpected match %+v", recursive, matches[0])
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestScan_ReadyInfo verifies trigger size, modification time and preview are
+// included in matches.
+func TestScan_ReadyInfo(t *testing.T) {
+	dir := t.TempDir()
+	rdy := filepath.Join(dir, "ORDER1.RDY")
+	if err := os.WriteFile(rdy, []byte("checksum=abc\xff\nmore"), 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+	mod := time.Date(2025, 9, 30, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(rdy, mod, mod); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "ORDER1"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	matches, err := Scan(dir, Options{})
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("scan: %v %v", matches, err)
+	}
+	m := matches[0]
+	if m.ReadySize != 18 || !m.ReadyModTime.Equal(mod) || m.ReadyPreview != "" {
+		t.Fatalf("unexpected ready info size=%d mod=%s preview=%q", m.ReadySize, m.ReadyModTime, m.ReadyPreview)
+	}
+
+	matches, err = Scan(dir, Options{ReadyPreview: 13})
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("scan: %v %v", matches, err)
+	}
+	if got := matches[0].ReadyPreview; got != "checksum=abc\uFFFD" {
+		t.Fatalf("unexpected preview %q", got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestScan_FolderStats verifies the aggregate file stats of matched folders,
+// for listed and streamed entries.
+func TestScan_FolderStats(t *testing.T) {
+	dir := t.TempDir()
+	folder := filepath.Join(dir, "ORDER1")
+	if err := os.MkdirAll(filepath.Join(folder, "sub"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ORDER1.RDY"), nil, 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+	old := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	for name, mod := range map[string]time.Time{"a.txt": old, "b.txt": recent} {
+		p := filepath.Join(folder, name)
+		if err := os.WriteFile(p, []byte(name+name), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := os.Chtimes(p, mod, mod); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+	if err := os.Symlink("a.txt", filepath.Join(folder, "link")); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+
+	for _, pageSize := range []int{0, 1} {
+		matches, err := Scan(dir, Options{PageSize: pageSize})
+		if err != nil || len(matches) != 1 {
+			t.Fatalf("scan: %v %v", matches, err)
+		}
+		m := matches[0]
+		if m.FileCount != 2 || m.TotalSize != 20 || !m.OldestModTime.Equal(old) || !m.NewestModTime.Equal(recent) {
+			t.Fatalf("page size %d: unexpected stats count=%d size=%d oldest=%s newest=%s",
+				pageSize, m.FileCount, m.TotalSize, m.OldestModTime, m.NewestModTime)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestScan_IgnoreMarker verifies recursive scans skip subtrees containing the
+// ignore marker.
+func TestScan_IgnoreMarker(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []string{"ORDER1", filepath.Join("archive", "ORDER2"), filepath.Join("archive", "deep", "ORDER3"), filepath.Join("live", "ORDER4")} {
+		if err := os.MkdirAll(filepath.Join(dir, p), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, p+".RDY"), nil, 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "archive", IgnoreMarker), nil, 0o644); err != nil {
+		t.Fatalf("write marker: %v", err)
+	}
+
+	matches, err := Scan(dir, Options{Recursive: true})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	var got []string
+	for _, m := range matches {
+		got = append(got, filepath.Base(m.ReadyFile))
+	}
+	if strings.Join(got, ",") != "ORDER1.RDY,ORDER4.RDY" {
+		t.Fatalf("expected archive subtree skipped, got %v", got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestScan_OnError verifies unreadable subdirectories abort a recursive scan
+// unless OnError is set, in which case they are reported and skipped.
+func TestScan_OnError(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permission checks don't apply to root")
+	}
+	dir := t.TempDir()
+	for _, p := range []string{"ORDER1", filepath.Join("locked", "ORDER2")} {
+		if err := os.MkdirAll(filepath.Join(dir, p), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, p+".RDY"), nil, 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	locked := filepath.Join(dir, "locked")
+	if err := os.Chmod(locked, 0o000); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Chmod(locked, 0o755) })
+
+	if _, err := Scan(dir, Options{Recursive: true}); err == nil {
+		t.Fatalf("expected walk error without OnError")
+	}
+
+	var failed []string
+	matches, err := Scan(dir, Options{Recursive: true, OnError: func(path string, err error) {
+		failed = append(failed, path)
+	}})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if len(matches) != 1 || matches[0].Folder != filepath.Join(dir, "ORDER1") {
+		t.Fatalf("expected only the readable match, got %+v", matches)
+	}
+	if len(failed) != 1 || failed[0] != locked {
+		t.Fatalf("expected error for %s, got %v", locked, failed)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestScan_PageSize verifies folder entries are streamed from disk instead of
+// listed up front when a page size is set.
+func TestScan_PageSize(t *testing.T) {
+	dir := t.TempDir()
+	folder := filepath.Join(dir, "ORDER1")
+	if err := os.Mkdir(folder, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ORDER1.RDY"), []byte("5"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for _, n := range []string{"a", "b", "c", "d", "e", ".DS_Store"} {
+		if err := os.WriteFile(filepath.Join(folder, n), []byte(n), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	matches, err := Scan(dir, Options{PageSize: 2})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if len(matches) != 1 || matches[0].Folder != folder || len(matches[0].FolderEntries) != 0 {
+		t.Fatalf("expected a match without listed entries, got %+v", matches)
+	}
+	var names []string
+	for fe, err := range matches[0].Entries() {
+		if err != nil {
+			t.Fatalf("entries: %v", err)
+		}
+		if fe.Size != 1 || fe.Path != filepath.Join(folder, fe.Name) {
+			t.Fatalf("unexpected entry %+v", fe)
+		}
+		names = append(names, fe.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "a,b,c,d,e" {
+		t.Fatalf("unexpected streamed entries %v", names)
+	}
+	if ready, have, want := CountReady(matches[0]); !ready || have != 5 || want != 5 {
+		t.Fatalf("expected count ready, got %v %d/%d", ready, have, want)
+	}
+
+	if err := os.RemoveAll(folder); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	var gotErr error
+	for _, err := range matches[0].Entries() {
+		gotErr = err
+	}
+	if gotErr == nil {
+		t.Fatalf("expected error for removed folder")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestCountReady verifies entry counts announced in *.CNT or *.RDY files.
+func TestCountReady(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	write("A.RDY", "")
+	write("B.RDY", "producer=x\nCount: 2\n")
+	write("C.RDY", "5")
+	write("C.CNT", "2\n")
+	entries := []FileEntry{{Name: "1"}, {Name: "2"}}
+
+	for _, tc := range []struct {
+		rdy   string
+		ready bool
+		want  int
+	}{
+		{"A.RDY", false, -1},
+		{"B.RDY", true, 2},
+		{"C.RDY", true, 2},
+	} {
+		ready, have, want := CountReady(Match{ReadyFile: filepath.Join(dir, tc.rdy), FolderEntries: entries})
+		if ready != tc.ready || have != 2 || want != tc.want {
+			t.Fatalf("%s: got ready=%v have=%d want=%d", tc.rdy, ready, have, want)
+		}
+	}
+
+	if ready, _, _ := CountReady(Match{ReadyFile: filepath.Join(dir, "B.RDY"), FolderEntries: entries[:1]}); ready {
+		t.Fatalf("expected incomplete folder not to be ready")
+	}
+	for in, want := range map[string]int{"count=3": 3, " 7 ": 7, "x\ncount = 4": 4} {
+		if n, ok := parseCount(in); !ok || n != want {
+			t.Fatalf("parseCount(%q) = %d, %v", in, n, ok)
+		}
+	}
+	if _, ok := parseCount("count=-1\nfoo"); ok {
+		t.Fatalf("expected negative count to be rejected")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestMatch_Fingerprint verifies the fingerprint is stable and changes when
+// files are added or rewritten.
+func TestMatch_Fingerprint(t *testing.T) {
+	dir := t.TempDir()
+	folder := filepath.Join(dir, "ORDER1")
+	if err := os.Mkdir(folder, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ORDER1.RDY"), nil, 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(folder, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	fingerprint := func() string {
+		t.Helper()
+		matches, err := Scan(dir, Options{})
+		if err != nil || len(matches) != 1 {
+			t.Fatalf("scan: %v %v", matches, err)
+		}
+		fp, err := matches[0].Fingerprint()
+		if err != nil {
+			t.Fatalf("Fingerprint: %v", err)
+		}
+		return fp
+	}
+
+	first := fingerprint()
+	if fingerprint() != first {
+		t.Fatalf("expected stable fingerprint")
+	}
+	if err := os.WriteFile(filepath.Join(folder, "b.txt"), []byte("b"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	second := fingerprint()
+	if second == first {
+		t.Fatalf("expected fingerprint to change after adding a file")
+	}
+	if err := os.WriteFile(filepath.Join(folder, "b.txt"), []byte("bb"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if fingerprint() == second {
+		t.Fatalf("expected fingerprint to change after rewriting a file")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestMatch_Relist verifies files added or removed since the scan are picked
+// up, hidden files stay filtered and the folder statistics are updated.
+func TestMatch_Relist(t *testing.T) {
+	dir := t.TempDir()
+	folder := filepath.Join(dir, "ORDER1")
+	if err := os.Mkdir(folder, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ORDER1.RDY"), nil, 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(folder, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	matches, err := Scan(dir, Options{})
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("scan: %v %v", matches, err)
+	}
+	for name, content := range map[string]string{"b.txt": "bb", ".DS_Store": "x"} {
+		if err := os.WriteFile(filepath.Join(folder, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := os.Remove(filepath.Join(folder, "a.txt")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	m, err := matches[0].Relist()
+	if err != nil {
+		t.Fatalf("Relist: %v", err)
+	}
+	if len(m.FolderEntries) != 1 || m.FolderEntries[0].Name != "b.txt" || m.FileCount != 1 || m.TotalSize != 2 {
+		t.Fatalf("unexpected relisted match %+v", m)
+	}
+	if len(matches[0].FolderEntries) != 1 || matches[0].FolderEntries[0].Name != "a.txt" {
+		t.Fatalf("expected scanned match unchanged, got %+v", matches[0].FolderEntries)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestScanTargets verifies given folders are listed like scanned ones, with
+// the folder as its own trigger by default.
+func TestScanTargets(t *testing.T) {
+	dir := t.TempDir()
+	folder := filepath.Join(dir, "A")
+	if err := os.Mkdir(folder, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(folder, "f.txt"), []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	gone := filepath.Join(dir, "GONE")
+	matches := ScanTargets([]Target{{Folder: folder}, {ReadyFile: gone + ".RDY", Folder: gone}}, Options{})
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 matches, got %d", len(matches))
+	}
+	if m := matches[0]; m.ReadyFile != folder || m.Folder != folder || m.FileCount != 1 || m.TotalSize != 3 {
+		t.Fatalf("unexpected match %+v", m)
+	}
+	if m := matches[1]; m.ReadyFile != gone+".RDY" || !m.MissingFolder {
+		t.Fatalf("expected missing folder, got %+v", m)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestMatchID verifies match IDs only depend on the trigger's path relative
+// to the root and are set by Scan and ScanTargets.
+func TestMatchID(t *testing.T) {
+	id := MatchID("/data/in", "/data/in/sub/ORDER1.RDY")
+	if len(id) != 32 || id != MatchID("/mnt/share", "/mnt/share/sub/ORDER1.RDY") {
+		t.Fatalf("expected the same ID under both roots, got %q", id)
+	}
+	if id == MatchID("/data/in", "/data/in/sub/ORDER2.RDY") {
+		t.Fatalf("expected different IDs for different triggers")
+	}
+	if MatchID("/data/in", "/other/ORDER1.RDY") != MatchID("", "/other/ORDER1.RDY") {
+		t.Fatalf("expected triggers outside root to be hashed by their path")
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "A.RDY"), nil, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	matches, err := Scan(dir, Options{})
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("expected 1 match, got %d (%v)", len(matches), err)
+	}
+	want := MatchID("x", filepath.Join("x", "A.RDY"))
+	if matches[0].ID != want {
+		t.Fatalf("expected ID %q, got %q", want, matches[0].ID)
+	}
+	targets := ScanTargets([]Target{{ReadyFile: filepath.Join(dir, "A.RDY"), Folder: filepath.Join(dir, "A")}}, Options{Root: dir})
+	if len(targets) != 1 || targets[0].ID != want {
+		t.Fatalf("expected target ID %q, got %+v", want, targets)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestScan_FS verifies scanning an fs.FS instead of the OS filesystem,
+// including triggers reading files and streamed entries.
+func TestScan_FS(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"in/A.RDY":              {Data: []byte("count=2"), ModTime: mtime},
+		"in/A/one.txt":          {Data: []byte("1"), ModTime: mtime},
+		"in/A/two.txt":          {Data: []byte("22"), ModTime: mtime},
+		"in/A/.hidden":          {Data: []byte("x")},
+		"in/sub/M/_SUCCESS":     {Data: []byte("")},
+		"in/sub/M/data.bin":     {Data: []byte("data")},
+		"in/sub/BATCH1.RDY":     {Data: []byte("B1\nB2\n")},
+		"in/sub/B1/f.txt":       {Data: []byte("b1")},
+		"in/sub/B2/f.txt":       {Data: []byte("b2")},
+		"in/skip/.lfs-ignore":   {Data: []byte("")},
+		"in/skip/C.RDY":         {Data: []byte("")},
+		"in/skip/C/ignored.txt": {Data: []byte("")},
+	}
+	opts := Options{
+		FS:           fsys,
+		Recursive:    true,
+		PageSize:     1,
+		ReadyPreview: 5,
+		Triggers:     []Trigger{Manifest{Name: "_SUCCESS"}, Batch{Prefix: "BATCH"}, SuffixFile{}},
+	}
+	matches, err := Scan("in", opts)
+	if err != nil {
+		t.Fatalf("scan error: %v", err)
+	}
+	var got []string
+	for _, m := range matches {
+		got = append(got, m.ReadyFile+" "+m.Folder)
+	}
+	want := []string{
+		"in/A.RDY in/A",
+		"in/sub/BATCH1.RDY in/sub/B1",
+		"in/sub/BATCH1.RDY in/sub/B2",
+		"in/sub/M/_SUCCESS in/sub/M",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected matches:\n%s", strings.Join(got, "\n"))
+	}
+
+	a := matches[0]
+	if a.ReadyPreview != "count" || a.ReadySize != 7 || !a.ReadyModTime.Equal(mtime) {
+		t.Fatalf("unexpected ready info: %+v", a)
+	}
+	if a.FileCount != 2 || a.TotalSize != 3 || !a.NewestModTime.Equal(mtime) {
+		t.Fatalf("unexpected folder stats: %+v", a)
+	}
+	var paths []string
+	for fe, err := range a.Entries() {
+		if err != nil {
+			t.Fatalf("entries: %v", err)
+		}
+		paths = append(paths, fe.Path)
+	}
+	sort.Strings(paths)
+	if strings.Join(paths, ",") != "in/A/one.txt,in/A/two.txt" {
+		t.Fatalf("unexpected entries: %v", paths)
+	}
+	if ready, have, want := CountReady(a); !ready || have != 2 || want != 2 {
+		t.Fatalf("expected count ready, got %v %d/%d", ready, have, want)
+	}
+
+	// NOTE(joel): The manifest is the trigger and not part of the folder.
+	if m := matches[3]; m.FileCount != 1 {
+		t.Fatalf("expected manifest to be left out, got %d files", m.FileCount)
+	}
+
+	if _, err := Scan("missing", Options{FS: fsys}); err == nil {
+		t.Fatalf("expected error for missing root")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// hangFS blocks opening the names in hang until release is closed, like a hung
+// network mount.
+type hangFS struct {
+	fsys    fs.FS
+	hang    map[string]bool
+	release chan struct{}
+}
+
+func (h hangFS) Open(name string) (fs.File, error) {
+	if h.hang[name] {
+		<-h.release
+	}
+	return h.fsys.Open(name)
+}
+
+// TestScan_OpTimeout verifies hung directory reads and stats only skip the
+// affected subtree or folder and are reported to OnTimeout.
+func TestScan_OpTimeout(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	fsys := hangFS{
+		fsys: fstest.MapFS{
+			"in/ok/A.RDY":     {},
+			"in/ok/A/f.txt":   {Data: []byte("a")},
+			"in/slow/B.RDY":   {},
+			"in/slow/B/f.txt": {Data: []byte("b")},
+			"in/C.RDY":        {},
+			"in/C/f.txt":      {Data: []byte("c")},
+		},
+		hang:    map[string]bool{"in/slow": true, "in/C": true},
+		release: release,
+	}
+	var timedOut []string
+	opts := Options{
+		FS:        fsys,
+		Recursive: true,
+		OpTimeout: 10 * time.Millisecond,
+		OpRetries: 1,
+		OnTimeout: func(path string, err error) {
+			if !errors.Is(err, ErrTimeout) {
+				t.Errorf("expected timeout error, got %v", err)
+			}
+			timedOut = append(timedOut, path)
+		},
+	}
+	matches, err := Scan("in", opts)
+	if err != nil {
+		t.Fatalf("scan error: %v", err)
+	}
+	if len(matches) != 2 || matches[0].ReadyFile != "in/C.RDY" || !matches[0].MissingFolder ||
+		matches[1].Folder != "in/ok/A" || matches[1].FileCount != 1 {
+		t.Fatalf("unexpected matches: %+v", matches)
+	}
+	// NOTE(joel): in/C times out while walking and again while listing it as a
+	// matched folder.
+	if strings.Join(timedOut, ",") != "in/C,in/slow,in/C" {
+		t.Fatalf("unexpected timeouts: %v", timedOut)
+	}
+
+	// NOTE(joel): Without OnTimeout a hung subtree fails the scan like other
+	// read errors.
+	opts.OnTimeout = nil
+	if _, err := Scan("in", opts); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestReadyID verifies IDs announced in trigger files.
+func TestReadyID(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"A.RDY": "count=2\nID: ord-1\n", "B.RDY": "id=\n", "C.RDY": ""} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	if id, ok := ReadyID(Match{ReadyFile: filepath.Join(dir, "A.RDY")}); !ok || id != "ord-1" {
+		t.Fatalf("unexpected ID %q, %v", id, ok)
+	}
+	for _, name := range []string{"B.RDY", "C.RDY", "missing.RDY"} {
+		if id, ok := ReadyID(Match{ReadyFile: filepath.Join(dir, name)}); ok {
+			t.Fatalf("%s: unexpected ID %q", name, id)
+		}
+	}
+	if id, ok := parseID("id: a=b"); !ok || id != "a=b" {
+		t.Fatalf("parseID = %q, %v", id, ok)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// brokenInfoFS lists entries named broken that can't be stat'ed.
+type brokenInfoFS struct{ fstest.MapFS }
+
+func (b brokenInfoFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := b.MapFS.ReadDir(name)
+	for i, e := range entries {
+		if e.Name() == "broken" {
+			entries[i] = brokenEntry{e}
+		}
+	}
+	return entries, err
+}
+
+type brokenEntry struct{ fs.DirEntry }
+
+func (brokenEntry) Info() (fs.FileInfo, error) { return nil, fs.ErrPermission }
+
+// TestScan_Warnings verifies entries that can't be stat'ed and missing
+// triggers are reported as warnings of the match, and that Relist keeps the
+// trigger's warnings while listing the folder's again.
+func TestScan_Warnings(t *testing.T) {
+	fsys := brokenInfoFS{fstest.MapFS{
+		"in/A.RDY":    {},
+		"in/A/ok.txt": {Data: []byte("abc")},
+		"in/A/broken": {Data: []byte("abcdef")},
+	}}
+	matches, err := Scan("in", Options{FS: fsys})
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("expected 1 match, got %d (%v)", len(matches), err)
+	}
+	m := matches[0]
+	if len(m.Warnings) != 1 || !strings.Contains(m.Warnings[0], "stat broken") || !strings.Contains(m.Warnings[0], "unknown") {
+		t.Fatalf("unexpected warnings %q", m.Warnings)
+	}
+	if m.FileCount != 2 || m.TotalSize != 3 {
+		t.Fatalf("expected the broken entry counted without size, got %d files %d bytes", m.FileCount, m.TotalSize)
+	}
+
+	targets := ScanTargets([]Target{{ReadyFile: "in/GONE.RDY", Folder: "in/A"}}, Options{FS: fsys})
+	if len(targets) != 1 || len(targets[0].Warnings) != 2 || !strings.HasPrefix(targets[0].Warnings[0], "stat trigger") {
+		t.Fatalf("unexpected warnings %+v", targets)
+	}
+	delete(fsys.MapFS, "in/A/broken")
+	listed, err := targets[0].Relist()
+	if err != nil || len(listed.Warnings) != 1 || !strings.HasPrefix(listed.Warnings[0], "stat trigger") {
+		t.Fatalf("expected only the trigger warning after relisting, got %q (%v)", listed.Warnings, err)
+	}
+	if len(targets[0].Warnings) != 2 {
+		t.Fatalf("expected Relist to leave the original match untouched, got %q", targets[0].Warnings)
+	}
+}
@@ -0,0 +1,38 @@
+package scanner
+
+import (
+	_ "embed"
+	"reflect"
+	"strings"
+)
+
+// SchemaVersion is the version of the JSON schema emitted matches conform to.
+// It is set as Match.SchemaVersion and must be incremented (together with the
+// `const` in match.schema.json) whenever the output changes incompatibly, e.g.
+// a field is renamed, removed or changes type. Adding optional fields doesn't
+// require a new version.
+const SchemaVersion = 1
+
+// Schema is the JSON Schema (draft 2020-12) of the JSON array emitted by a
+// run, printed by the `schema` command.
+//
+//go:embed match.schema.json
+var Schema []byte
+
+////////////////////////////////////////////////////////////////////////////////
+
+// MatchFields returns the JSON names of the fields of an emitted Match in
+// output order, e.g. to validate a field selection.
+func MatchFields() []string {
+	typ := reflect.TypeFor[Match]()
+	var names []string
+	for i := range typ.NumField() {
+		f := typ.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,56 @@
+package scanner
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestSchema verifies the embedded schema is valid JSON, carries the current
+// version and documents every JSON field of Match and FileEntry.
+func TestSchema(t *testing.T) {
+	var s struct {
+		Defs map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(Schema, &s); err != nil {
+		t.Fatalf("decode schema: %v", err)
+	}
+
+	var version struct {
+		Const int `json:"const"`
+	}
+	if err := json.Unmarshal(s.Defs["match"].Properties["schemaVersion"], &version); err != nil || version.Const != SchemaVersion {
+		t.Fatalf("expected schemaVersion const %d, got %d (%v)", SchemaVersion, version.Const, err)
+	}
+
+	for def, typ := range map[string]reflect.Type{"match": reflect.TypeFor[Match](), "fileEntry": reflect.TypeFor[FileEntry]()} {
+		for i := range typ.NumField() {
+			f := typ.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "" || name == "-" {
+				continue
+			}
+			if _, ok := s.Defs[def].Properties[name]; !ok {
+				t.Fatalf("schema %s lacks property %q", def, name)
+			}
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestMatchFields verifies the JSON field names are listed in output order.
+func TestMatchFields(t *testing.T) {
+	fields := MatchFields()
+	if len(fields) < 3 || fields[0] != "schemaVersion" || fields[1] != "id" || fields[2] != "readyFile" {
+		t.Fatalf("unexpected fields %v", fields)
+	}
+	for _, f := range fields {
+		if strings.Contains(f, ",") {
+			t.Fatalf("field %q includes tag options", f)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package scanner
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// Trigger decides which entries found while scanning signal a ready data
+// folder. Implementations encode a producer convention (e.g. `NAME.RDY` next
+// to `NAME/`) so new conventions don't require changes to Scan.
+type Trigger interface {
+	// Match inspects an entry found while scanning. If the entry is a trigger
+	// it returns the path identifying the trigger (used as Match.ReadyFile and
+	// state key) and the path of the data folder it refers to.
+	Match(path string, d fs.DirEntry) (readyFile, folder string, ok bool)
+	// Ready reports whether a matched folder, with its entries listed, is
+	// ready for processing. Matches that aren't ready are left out of the scan
+	// results.
+	Ready(m Match) bool
+}
+
+// BatchTrigger is implemented by triggers gating several folders at once. For
+// a matched trigger, Folders returns the paths of all folders it refers to;
+// Scan produces one Match per folder (see Match.Batch).
+type BatchTrigger interface {
+	Trigger
+	Folders(readyFile string) ([]string, error)
+}
+
+// Trigger names accepted by NewTriggers.
+const (
+	TriggerRDY      = "rdy"
+	TriggerRDYDir   = "rdy-dir"
+	TriggerManifest = "manifest"
+	TriggerAge      = "age"
+	TriggerBatch    = "batch"
+)
+
+// NOTE(joel): Compile-time checks that the implementations satisfy the
+// interface.
+var (
+	_ Trigger      = SuffixFile{}
+	_ Trigger      = MarkerDir{}
+	_ Trigger      = Manifest{}
+	_ Trigger      = Age{}
+	_ BatchTrigger = Batch{}
+)
+
+// fsTrigger is implemented by triggers reading files other than the entry
+// they match. withFS returns a copy reading from fsys (see Options.FS).
+type fsTrigger interface {
+	withFS(fsys fileSystem) Trigger
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewTriggers builds triggers from their names. manifestName, minAge and
+// batchPrefix configure the manifest, age and batch triggers.
+func NewTriggers(names []string, manifestName string, minAge time.Duration, batchPrefix string) ([]Trigger, error) {
+	triggers := make([]Trigger, 0, len(names))
+	for _, name := range names {
+		switch strings.TrimSpace(name) {
+		case TriggerRDY:
+			triggers = append(triggers, SuffixFile{})
+		case TriggerRDYDir:
+			triggers = append(triggers, MarkerDir{})
+		case TriggerManifest:
+			if manifestName == "" {
+				return nil, fmt.Errorf("manifest trigger requires a manifest file name")
+			}
+			triggers = append(triggers, Manifest{Name: manifestName})
+		case TriggerAge:
+			if minAge <= 0 {
+				return nil, fmt.Errorf("age trigger requires a positive minimum age")
+			}
+			triggers = append(triggers, Age{MinAge: minAge})
+		case TriggerBatch:
+			if batchPrefix == "" {
+				return nil, fmt.Errorf("batch trigger requires a file name prefix")
+			}
+			triggers = append(triggers, Batch{Prefix: batchPrefix})
+		default:
+			return nil, fmt.Errorf("unknown trigger %q", name)
+		}
+	}
+	return triggers, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// SuffixFile matches files named `NAME<Suffix>` (case-insensitive) and refers
+// to the sibling folder `NAME`. The zero value uses the ".RDY" suffix.
+type SuffixFile struct {
+	Suffix string
+}
+
+// Match implements Trigger.
+func (t SuffixFile) Match(path string, d fs.DirEntry) (string, string, bool) {
+	if d.IsDir() || !hasSuffixFold(d.Name(), t.Suffix) {
+		return "", "", false
+	}
+	return path, siblingFolder(path, t.Suffix), true
+}
+
+// Ready implements Trigger; matched folders are always ready.
+func (SuffixFile) Ready(Match) bool { return true }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// MarkerDir matches directories named `NAME<Suffix>` (case-insensitive, e.g.
+// an empty `ORDER123.RDY/` marker) and refers to the sibling folder `NAME`.
+// The zero value uses the ".RDY" suffix.
+type MarkerDir struct {
+	Suffix string
+}
+
+// Match implements Trigger.
+func (t MarkerDir) Match(path string, d fs.DirEntry) (string, string, bool) {
+	if !d.IsDir() || !hasSuffixFold(d.Name(), t.Suffix) {
+		return "", "", false
+	}
+	return path, siblingFolder(path, t.Suffix), true
+}
+
+// Ready implements Trigger; matched folders are always ready.
+func (MarkerDir) Ready(Match) bool { return true }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Manifest matches folders containing a regular file called Name (e.g. a
+// manifest or `_SUCCESS` file written last by the producer). The manifest
+// file is the trigger and is not listed in the folder entries.
+type Manifest struct {
+	Name string
+
+	fs fileSystem
+}
+
+// Match implements Trigger.
+func (t Manifest) Match(path string, d fs.DirEntry) (string, string, bool) {
+	if !d.IsDir() || IsHidden(d.Name()) {
+		return "", "", false
+	}
+	manifest := t.fs.Join(path, t.Name)
+	if fi, err := t.fs.Stat(manifest); err != nil || !fi.Mode().IsRegular() {
+		return "", "", false
+	}
+	return manifest, path, true
+}
+
+// Ready implements Trigger; matched folders are always ready.
+func (Manifest) Ready(Match) bool { return true }
+
+func (t Manifest) withFS(fsys fileSystem) Trigger {
+	t.fs = fsys
+	return t
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Age matches every (non-hidden) folder and considers it ready once neither
+// the folder nor any of its entries was modified for MinAge. The folder itself
+// is the trigger, so adding or removing entries re-triggers it. Now defaults
+// to time.Now.
+type Age struct {
+	MinAge time.Duration
+	Now    func() time.Time
+}
+
+// Match implements Trigger.
+func (t Age) Match(path string, d fs.DirEntry) (string, string, bool) {
+	if !d.IsDir() || IsHidden(d.Name()) {
+		return "", "", false
+	}
+	return path, path, true
+}
+
+// Ready implements Trigger.
+func (t Age) Ready(m Match) bool {
+	now := time.Now
+	if t.Now != nil {
+		now = t.Now
+	}
+	cutoff := now().Add(-t.MinAge)
+	fi, err := m.fs.Stat(m.Folder)
+	if err != nil || fi.ModTime().After(cutoff) {
+		return false
+	}
+	for fe, err := range m.Entries() {
+		if err != nil || fe.ModTime.After(cutoff) {
+			return false
+		}
+	}
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Batch matches files named `<Prefix>...<Suffix>` (case-insensitive, e.g.
+// `BATCH42.RDY`) whose content lists the folders the batch consists of, one
+// path per line relative to the trigger's directory. Blank lines and lines
+// starting with `#` are ignored. The zero Suffix means ".RDY".
+type Batch struct {
+	Prefix string
+	Suffix string
+
+	fs fileSystem
+}
+
+// Match implements Trigger. The folder is left empty; see Folders.
+func (t Batch) Match(path string, d fs.DirEntry) (string, string, bool) {
+	name := d.Name()
+	if d.IsDir() || !hasSuffixFold(name, t.Suffix) || len(name) < len(t.Prefix) ||
+		!strings.EqualFold(name[:len(t.Prefix)], t.Prefix) {
+		return "", "", false
+	}
+	return path, "", true
+}
+
+// Ready implements Trigger; matched folders are always ready.
+func (Batch) Ready(Match) bool { return true }
+
+// Folders implements BatchTrigger. Listed paths must stay inside the
+// trigger's directory.
+func (t Batch) Folders(readyFile string) ([]string, error) {
+	b, err := t.fs.ReadFile(readyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read batch: %w", err)
+	}
+	dir := t.fs.Dir(readyFile)
+	var folders []string
+	for line := range strings.Lines(string(b)) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rel, ok := t.fs.Local(line)
+		if !ok {
+			return nil, fmt.Errorf("batch %s: folder %q outside of %s", readyFile, line, dir)
+		}
+		folders = append(folders, t.fs.Join(dir, rel))
+	}
+	if len(folders) == 0 {
+		return nil, fmt.Errorf("batch %s lists no folders", readyFile)
+	}
+	return folders, nil
+}
+
+func (t Batch) withFS(fsys fileSystem) Trigger {
+	t.fs = fsys
+	return t
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// hasSuffixFold reports whether name ends with suffix (case-insensitive). An
+// empty suffix means ".RDY".
+func hasSuffixFold(name, suffix string) bool {
+	if suffix == "" {
+		suffix = ".RDY"
+	}
+	return len(name) > len(suffix) && strings.EqualFold(name[len(name)-len(suffix):], suffix)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// siblingFolder returns the path of the folder next to a trigger, i.e. the
+// trigger path without its suffix.
+func siblingFolder(path, suffix string) string {
+	if suffix == "" {
+		suffix = ".RDY"
+	}
+	return path[:len(path)-len(suffix)]
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// bindTriggers returns triggers with those reading files bound to fsys.
+func bindTriggers(triggers []Trigger, fsys fileSystem) []Trigger {
+	bound := make([]Trigger, len(triggers))
+	for i, t := range triggers {
+		if ft, ok := t.(fsTrigger); ok {
+			t = ft.withFS(fsys)
+		}
+		bound[i] = t
+	}
+	return bound
+}
@@ -0,0 +1,179 @@
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestNewTriggers verifies trigger names map to their strategies.
+func TestNewTriggers(t *testing.T) {
+	triggers, err := NewTriggers([]string{"rdy", " rdy-dir", "manifest", "age", "batch"}, "_SUCCESS", time.Minute, "BATCH")
+	if err != nil {
+		t.Fatalf("NewTriggers: %v", err)
+	}
+	want := []Trigger{SuffixFile{}, MarkerDir{}, Manifest{Name: "_SUCCESS"}, Age{MinAge: time.Minute}, Batch{Prefix: "BATCH"}}
+	if len(triggers) != len(want) {
+		t.Fatalf("expected %d triggers, got %d", len(want), len(triggers))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(triggers[i], want[i]) {
+			t.Fatalf("trigger %d: expected %#v, got %#v", i, want[i], triggers[i])
+		}
+	}
+
+	for _, tc := range []struct {
+		names    []string
+		manifest string
+		minAge   time.Duration
+	}{
+		{[]string{"bogus"}, "MANIFEST", time.Minute},
+		{[]string{"manifest"}, "", time.Minute},
+		{[]string{"age"}, "MANIFEST", 0},
+	} {
+		if _, err := NewTriggers(tc.names, tc.manifest, tc.minAge, "BATCH"); err == nil {
+			t.Fatalf("expected error for %+v", tc)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestScan_ManifestTrigger verifies folders containing the manifest file are
+// matched, and the manifest itself is not listed as a folder entry.
+func TestScan_ManifestTrigger(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []string{"ORDER1", "ORDER2", filepath.Join("sub", "ORDER3")} {
+		if err := os.MkdirAll(filepath.Join(dir, p), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, p, "data.bin"), []byte("x"), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	for _, p := range []string{"ORDER1", filepath.Join("sub", "ORDER3")} {
+		if err := os.WriteFile(filepath.Join(dir, p, "MANIFEST"), nil, 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	for _, recursive := range []bool{false, true} {
+		matches, err := Scan(dir, Options{Recursive: recursive, Triggers: []Trigger{Manifest{Name: "MANIFEST"}}})
+		if err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		want := 1
+		if recursive {
+			want = 2
+		}
+		if len(matches) != want {
+			t.Fatalf("recursive=%v: expected %d matches, got %+v", recursive, want, matches)
+		}
+		m := matches[0]
+		if m.ReadyFile != filepath.Join(dir, "ORDER1", "MANIFEST") || m.Folder != filepath.Join(dir, "ORDER1") {
+			t.Fatalf("recursive=%v: unexpected match %+v", recursive, m)
+		}
+		if len(m.FolderEntries) != 1 || m.FolderEntries[0].Name != "data.bin" {
+			t.Fatalf("recursive=%v: expected only data.bin, got %+v", recursive, m.FolderEntries)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestScan_AgeTrigger verifies folders only match once neither the folder nor
+// its entries changed for MinAge.
+func TestScan_AgeTrigger(t *testing.T) {
+	dir := t.TempDir()
+	folder := filepath.Join(dir, "ORDER1")
+	if err := os.MkdirAll(folder, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	file := filepath.Join(folder, "data.bin")
+	if err := os.WriteFile(file, []byte("x"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for _, p := range []string{file, folder} {
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+
+	now := time.Now()
+	scan := func(minAge time.Duration) []Match {
+		matches, err := Scan(dir, Options{Triggers: []Trigger{Age{MinAge: minAge, Now: func() time.Time { return now }}}})
+		if err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		return matches
+	}
+
+	matches := scan(30 * time.Minute)
+	if len(matches) != 1 || matches[0].ReadyFile != folder || matches[0].Folder != folder {
+		t.Fatalf("expected settled folder to match, got %+v", matches)
+	}
+	if len(scan(2*time.Hour)) != 0 {
+		t.Fatalf("expected folder younger than MinAge to be skipped")
+	}
+
+	if err := os.Chtimes(file, now, now); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if len(scan(30*time.Minute)) != 0 {
+		t.Fatalf("expected folder with a recently modified entry to be skipped")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestScan_BatchTrigger verifies a batch trigger yields one match per listed
+// folder and that unusable batches are reported as missing folders.
+func TestScan_BatchTrigger(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []string{"ORDER1", "ORDER2", "ORDER3"} {
+		if err := os.Mkdir(filepath.Join(dir, p), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	files := map[string]string{
+		"BATCH42.RDY":  "# nightly\nORDER2\n\nORDER1\n",
+		"BATCH43.RDY":  "../elsewhere\n",
+		"ORDER3.RDY":   "",
+		"batch44.rdy":  "ORDER9\n",
+		"BATCH45.TXT":  "ORDER1\n",
+		"NOBATCH1.RDY": "ORDER1\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	matches, err := Scan(dir, Options{Triggers: []Trigger{Batch{Prefix: "BATCH"}}})
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	type result struct {
+		ready, folder string
+		missing       bool
+	}
+	var got []result
+	for _, m := range matches {
+		if !m.Batch {
+			t.Fatalf("expected batch match, got %+v", m)
+		}
+		got = append(got, result{filepath.Base(m.ReadyFile), filepath.Base(m.Folder), m.MissingFolder})
+	}
+	want := []result{
+		{"BATCH42.RDY", "ORDER1", false},
+		{"BATCH42.RDY", "ORDER2", false},
+		{"BATCH43.RDY", ".", true},
+		{"batch44.rdy", ".", true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,141 @@
+package state
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Stage is the step of the upload pipeline a match has reached. Matches move
+// forward through
+//
+//	discovered → validated → uploading → recorded → done
+//
+// and to failed from any step but done. A match is discovered again once its
+// trigger changes, and after failing, so it is retried.
+type Stage string
+
+// Stages of a match (see Stage).
+const (
+	// StageDiscovered: the trigger is new or changed since it was processed.
+	StageDiscovered Stage = "discovered"
+	// StageValidated: the folder passed the checks before uploading (name
+	// rules, files in progress, name collisions) and wasn't deferred.
+	StageValidated Stage = "validated"
+	// StageUploading: the upload of the folder started.
+	StageUploading Stage = "uploading"
+	// StageRecorded: all files are uploaded and the record (if any) is
+	// written or queued; only marking the trigger processed is left.
+	StageRecorded Stage = "recorded"
+	// StageDone: the trigger is marked processed. Done matches are removed
+	// from the state; the processed trigger records them.
+	StageDone Stage = "done"
+	// StageFailed: a step failed; the match is retried by the next run.
+	StageFailed Stage = "failed"
+)
+
+// transitions lists the stages each stage may advance to, besides
+// StageDiscovered which any stage may restart from.
+var transitions = map[Stage][]Stage{
+	StageDiscovered: {StageValidated, StageFailed},
+	StageValidated:  {StageUploading, StageFailed},
+	// NOTE(joel): Folders claimed by another agent are done without being
+	// recorded by this one.
+	StageUploading: {StageRecorded, StageDone, StageFailed},
+	StageRecorded:  {StageDone, StageFailed},
+}
+
+// MatchState is the persisted pipeline stage of a match.
+type MatchState struct {
+	Stage     Stage  `json:"stage"`
+	ReadyFile string `json:"ready_file"`
+	// ID is the match ID (see scanner.MatchID).
+	ID string `json:"id,omitempty"`
+	// Trigger identifies the version of the trigger the stage refers to, as
+	// recorded for processed triggers (its modification time).
+	Trigger int64     `json:"trigger"`
+	Updated time.Time `json:"updated"`
+	// Attempts counts the uploads started since the trigger was discovered.
+	Attempts int    `json:"attempts,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// CanAdvance reports whether a match may move from stage from to stage to.
+func CanAdvance(from, to Stage) bool {
+	return to == StageDiscovered || slices.Contains(transitions[from], to)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Match returns the pipeline stage of the match of folder.
+func (s *Store) Match(folder string) (MatchState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms, ok := s.matches[s.key(folder)]
+	return ms, ok
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Matches returns the pipeline stages of all matches not done, by folder key.
+func (s *Store) Matches() map[string]MatchState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.matches)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Discover (re)starts the match of folder with ID id, triggered by version
+// trigger of readyFile, at StageDiscovered. Attempts carry over from an earlier failed
+// or interrupted pass over the same trigger version.
+func (s *Store) Discover(folder, readyFile, id string, trigger int64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := s.key(folder)
+	ms := MatchState{Stage: StageDiscovered, ReadyFile: readyFile, ID: id, Trigger: trigger, Updated: now}
+	if prev, ok := s.matches[k]; ok && prev.Trigger == trigger {
+		ms.Attempts = prev.Attempts
+	}
+	if s.matches == nil {
+		s.matches = make(map[string]MatchState)
+	}
+	s.matches[k] = ms
+	s.dirty = true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Advance moves the match of folder to stage to, recording err for
+// StageFailed. StageUploading counts an attempt and StageDone removes the
+// match. It fails without changes if the match is unknown or the transition
+// isn't allowed (see CanAdvance).
+func (s *Store) Advance(folder string, to Stage, now time.Time, err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := s.key(folder)
+	ms, ok := s.matches[k]
+	if !ok {
+		return fmt.Errorf("advance %s to %s: match not discovered", folder, to)
+	}
+	if !CanAdvance(ms.Stage, to) {
+		return fmt.Errorf("advance %s from %s to %s: not allowed", folder, ms.Stage, to)
+	}
+	s.dirty = true
+	if to == StageDone {
+		delete(s.matches, k)
+		return nil
+	}
+	ms.Stage, ms.Updated, ms.Error = to, now, ""
+	if to == StageUploading {
+		ms.Attempts++
+	}
+	if to == StageFailed && err != nil {
+		ms.Error = err.Error()
+	}
+	s.matches[k] = ms
+	return nil
+}
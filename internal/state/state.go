@@ -2,11 +2,17 @@ package state
 
 import (
 	"encoding/json"
-	"maps"
+	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
+
+	"local-file-sync/internal/sys"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 // Store manages persistent value state for processed RDY files.
@@ -14,8 +20,44 @@ type Store struct {
 	Path    string
 	Data    map[string]int64
 	LastRun time.Time
-	dirty   bool
-	mu      sync.Mutex
+	// NormalizeKeys stores and looks up keys in Unicode NFC form so paths
+	// differing only in normalization (NFC vs NFD) share one entry. Set it
+	// before Load so existing keys are migrated.
+	NormalizeKeys bool
+	// Root is the scanned root directory. With RelativeKeys, paths below Root
+	// are stored relative to it (slash separated) so state survives moving or
+	// remounting the intake directory. Set both before Load so existing keys
+	// are migrated.
+	Root         string
+	RelativeKeys bool
+	// History holds summaries of the most recent runs, oldest first.
+	History []RunSummary
+	// LastNotified is the time the last failure digest was sent; used to rate
+	// limit notifications across runs.
+	LastNotified time.Time
+	// FS is the filesystem the state file is read and written through; nil
+	// uses the real one.
+	FS sys.FileSystem
+	// NOTE(joel): Files already uploaded for folders whose upload failed part
+	// way, keyed by folder path (normalized like Data keys).
+	partial map[string][]PartialFile
+	// NOTE(joel): Content fingerprints of processed folders (see
+	// scanner.Match.Fingerprint), keyed like partial.
+	fingerprints map[string]string
+	// NOTE(joel): Object prefixes of the deliveries of each folder with
+	// versioned re-uploads, oldest first, keyed like partial.
+	versions map[string][]string
+	// NOTE(joel): Pipeline stage of the matches being processed (see Stage),
+	// keyed by folder like partial.
+	matches map[string]MatchState
+	// NOTE(joel): Progress of an unfinished backfill, nil otherwise.
+	backfill *Backfill
+	dirty    bool
+	mu       sync.Mutex
+	// NOTE(joel): Serializes Save, which may be called while other
+	// goroutines update the store, e.g. checkpoints of the pipeline
+	// stages.
+	saveMu sync.Mutex
 }
 
 // diskState defines the structured on-disk representation of state.
@@ -23,8 +65,128 @@ type diskState struct {
 	Version int              `json:"version"`
 	LastRun time.Time        `json:"last_run"`
 	Files   map[string]int64 `json:"files"`
+	History []RunSummary     `json:"history,omitempty"`
+	// NOTE(joel): Pointer so a zero time is omitted from the JSON.
+	LastNotified *time.Time               `json:"last_notified,omitempty"`
+	Partial      map[string][]PartialFile `json:"partial,omitempty"`
+	Fingerprints map[string]string        `json:"fingerprints,omitempty"`
+	Versions     map[string][]string      `json:"versions,omitempty"`
+	Matches      map[string]MatchState    `json:"matches,omitempty"`
+	Backfill     *Backfill                `json:"backfill,omitempty"`
+}
+
+// PartialFile is a file uploaded for a folder whose upload failed part way.
+// Files unchanged since (same size and modification time) aren't uploaded
+// again when the folder is retried.
+type PartialFile struct {
+	Name            string    `json:"name"`
+	Size            int64     `json:"size"`
+	ModTime         time.Time `json:"mod_time"`
+	Checksum        string    `json:"checksum"`
+	Path            string    `json:"path"`
+	ContentEncoding string    `json:"content_encoding,omitempty"`
+	Bundled         bool      `json:"bundled,omitempty"`
+	Generation      int64     `json:"generation,omitempty"`
+	Metageneration  int64     `json:"metageneration,omitempty"`
+}
+
+// Backfill checkpoints the progress of a backfill, which processes the
+// folders below Root in path order and in chunks. Cursor and CursorFolder
+// identify the last folder of the last completed chunk; a resumed backfill
+// continues after it.
+type Backfill struct {
+	Root         string    `json:"root"`
+	Total        int       `json:"total"`
+	Done         int       `json:"done"`
+	Cursor       string    `json:"cursor"`
+	CursorFolder string    `json:"cursor_folder,omitempty"`
+	Started      time.Time `json:"started"`
+	Updated      time.Time `json:"updated"`
+}
+
+// RunSummary describes a single run recorded in the state file history.
+type RunSummary struct {
+	RunID    string        `json:"run_id,omitempty"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Scanned  int           `json:"scanned"`
+	Emitted  int           `json:"emitted"`
+	Skipped  int           `json:"skipped"`
+	Failed   int           `json:"failed"`
+	Deferred int           `json:"deferred,omitempty"`
+	Errors   []string      `json:"errors,omitempty"`
+	// Warnings hold the non-fatal scan issues of the run, one line per match
+	// (see scanner.Match.Warnings).
+	Warnings []string `json:"warnings,omitempty"`
+	// Throughput is only recorded for runs that uploaded folders.
+	Throughput *Throughput `json:"throughput,omitempty"`
+	// Latency holds the ages of the triggers of the folders uploaded by the
+	// run at their upload, Backlog those of the triggers left unprocessed at
+	// its end. Both are omitted if there were none.
+	Latency *AgeStats `json:"latency,omitempty"`
+	Backlog *AgeStats `json:"backlog,omitempty"`
+}
+
+// AgeStats summarizes the ages of a set of triggers, measured from their
+// modification time.
+type AgeStats struct {
+	Count int           `json:"count"`
+	Max   time.Duration `json:"max"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	// Overdue counts the ages above the -rdy-age-sla, if set.
+	Overdue int `json:"overdue,omitempty"`
 }
 
+// Throughput aggregates the upload statistics of a run.
+type Throughput struct {
+	// Bytes uploaded and the resulting rate over the upload phase in MB/s
+	// (10^6 bytes per second).
+	Bytes          int64    `json:"bytes"`
+	MBps           float64  `json:"mbps"`
+	SlowestFolders []Timing `json:"slowest_folders,omitempty"`
+	SlowestFiles   []Timing `json:"slowest_files,omitempty"`
+	// FolderConcurrency and FileConcurrency are the effective number of
+	// upload workers of the run.
+	FolderConcurrency int `json:"folder_concurrency,omitempty"`
+	FileConcurrency   int `json:"file_concurrency,omitempty"`
+	// Retries counts the file upload retries of the run, DeadLetters the
+	// records queued in the pending records file instead of being written.
+	Retries     int `json:"retries,omitempty"`
+	DeadLetters int `json:"dead_letters,omitempty"`
+	// Verified counts the objects of the primary destination read back and
+	// found intact (see -read-back).
+	Verified int `json:"verified,omitempty"`
+	// Destinations breaks the uploads down by destination, the primary first.
+	Destinations []DestinationStats `json:"destinations,omitempty"`
+}
+
+// DestinationStats holds the upload statistics of a destination in a run.
+type DestinationStats struct {
+	Name string `json:"name"`
+	// Folders uploaded and failed on the destination.
+	Folders int `json:"folders"`
+	Failed  int `json:"failed,omitempty"`
+	// Files uploaded (or found existing) and the bytes uploaded, with the
+	// resulting rate over the upload phase.
+	Files   int     `json:"files"`
+	Bytes   int64   `json:"bytes"`
+	MBps    float64 `json:"mbps"`
+	Retries int     `json:"retries,omitempty"`
+}
+
+// Timing is the upload duration of a single folder or file.
+type Timing struct {
+	Path     string        `json:"path"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+}
+
+// maxRunErrors caps the number of error (and warning) messages kept per run
+// summary so a run with many failing folders doesn't bloat the state file.
+const maxRunErrors = 10
+
 ////////////////////////////////////////////////////////////////////////////////
 
 // New creates a new Store for the given path; data is empty until Load.
@@ -46,7 +208,7 @@ func (s *Store) Load() error {
 		return nil
 	}
 
-	b, err := os.ReadFile(s.Path)
+	b, err := sys.Files(s.FS).ReadFile(s.Path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
@@ -56,8 +218,62 @@ func (s *Store) Load() error {
 
 	var ds diskState
 	if err := json.Unmarshal(b, &ds); err == nil && ds.Files != nil {
-		maps.Copy(s.Data, ds.Files)
+		for k, v := range ds.Files {
+			nk := s.migrateKey(k)
+			// NOTE(joel): On collisions keep the most recent value.
+			if cur, ok := s.Data[nk]; !ok || v > cur {
+				s.Data[nk] = v
+			}
+			if nk != k {
+				s.dirty = true
+			}
+		}
 		s.LastRun = ds.LastRun
+		s.History = ds.History
+		if ds.LastNotified != nil {
+			s.LastNotified = *ds.LastNotified
+		}
+		for k, files := range ds.Partial {
+			nk := s.migrateKey(k)
+			if s.partial == nil {
+				s.partial = make(map[string][]PartialFile)
+			}
+			s.partial[nk] = files
+			if nk != k {
+				s.dirty = true
+			}
+		}
+		for k, fp := range ds.Fingerprints {
+			nk := s.migrateKey(k)
+			if s.fingerprints == nil {
+				s.fingerprints = make(map[string]string)
+			}
+			s.fingerprints[nk] = fp
+			if nk != k {
+				s.dirty = true
+			}
+		}
+		for k, prefixes := range ds.Versions {
+			nk := s.migrateKey(k)
+			if s.versions == nil {
+				s.versions = make(map[string][]string)
+			}
+			s.versions[nk] = prefixes
+			if nk != k {
+				s.dirty = true
+			}
+		}
+		for k, ms := range ds.Matches {
+			nk := s.migrateKey(k)
+			if s.matches == nil {
+				s.matches = make(map[string]MatchState)
+			}
+			s.matches[nk] = ms
+			if nk != k {
+				s.dirty = true
+			}
+		}
+		s.backfill = ds.Backfill
 		return nil
 	}
 	return nil
@@ -65,30 +281,49 @@ func (s *Store) Load() error {
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// Save writes the state atomically; no-op if Path empty.
+// Save writes the state atomically; no-op if Path empty. It is safe to call
+// while other goroutines update the store.
 func (s *Store) Save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.Lock()
 	if s.Path == "" || !s.dirty {
+		s.mu.Unlock()
 		return nil
 	}
-	if err := os.MkdirAll(filepath.Dir(s.Path), 0o755); err != nil {
-		return err
+	ds := diskState{Version: 1, LastRun: s.LastRun, Files: s.Data, History: s.History, Partial: s.partial, Fingerprints: s.fingerprints, Versions: s.versions, Matches: s.matches, Backfill: s.backfill}
+	if !s.LastNotified.IsZero() {
+		ds.LastNotified = &s.LastNotified
 	}
-	tmp := s.Path + ".tmp"
-	ds := diskState{Version: 1, LastRun: s.LastRun, Files: s.Data}
 	b, err := json.Marshal(ds)
+	// NOTE(joel): Updates made while writing mark the store dirty again.
+	s.dirty = err != nil
+	s.mu.Unlock()
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+	if err := s.write(b); err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
 		return err
 	}
-	if err := os.Rename(tmp, s.Path); err != nil {
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// write replaces the state file with b through a temporary file.
+func (s *Store) write(b []byte) error {
+	fsys := sys.Files(s.FS)
+	if err := fsys.MkdirAll(filepath.Dir(s.Path), 0o755); err != nil {
 		return err
 	}
-	s.mu.Lock()
-	s.dirty = false
-	s.mu.Unlock()
-	return nil
+	tmp := s.Path + ".tmp"
+	if err := fsys.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return fsys.Rename(tmp, s.Path)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -96,7 +331,7 @@ func (s *Store) Save() error {
 // Get returns stored value and whether it exists.
 func (s *Store) Get(path string) (int64, bool) {
 	s.mu.Lock()
-	v, ok := s.Data[path]
+	v, ok := s.Data[s.key(path)]
 	s.mu.Unlock()
 	return v, ok
 }
@@ -106,8 +341,9 @@ func (s *Store) Get(path string) (int64, bool) {
 // Set updates the value for a path.
 func (s *Store) Set(path string, value int64) {
 	s.mu.Lock()
-	if cur, ok := s.Data[path]; !ok || cur != value {
-		s.Data[path] = value
+	k := s.key(path)
+	if cur, ok := s.Data[k]; !ok || cur != value {
+		s.Data[k] = value
 		s.dirty = true
 	}
 	s.mu.Unlock()
@@ -115,6 +351,134 @@ func (s *Store) Set(path string, value int64) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// Delete removes the entry for path, so the trigger is processed again on the
+// next run.
+func (s *Store) Delete(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := s.key(path)
+	if _, ok := s.Data[k]; ok {
+		delete(s.Data, k)
+		s.dirty = true
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Paths returns the paths of all entries, sorted. Keys stored relative to Root
+// are resolved against it.
+func (s *Store) Paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths := make([]string, 0, len(s.Data))
+	for k := range s.Data {
+		if s.Root != "" && !filepath.IsAbs(k) {
+			k = filepath.Join(s.Root, filepath.FromSlash(k))
+		}
+		paths = append(paths, k)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// PartialFiles returns the files already uploaded for a partially uploaded
+// folder.
+func (s *Store) PartialFiles(path string) []PartialFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.partial[s.key(path)]
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// SetPartial records the files already uploaded for a partially uploaded
+// folder. An empty list removes the entry, e.g. once the folder completed.
+func (s *Store) SetPartial(path string, files []PartialFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := s.key(path)
+	if len(files) == 0 {
+		if _, ok := s.partial[k]; ok {
+			delete(s.partial, k)
+			s.dirty = true
+		}
+		return
+	}
+	if s.partial == nil {
+		s.partial = make(map[string][]PartialFile)
+	}
+	s.partial[k] = files
+	s.dirty = true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Fingerprint returns the content fingerprint recorded for a processed
+// folder, or "" if none.
+func (s *Store) Fingerprint(path string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fingerprints[s.key(path)]
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// SetFingerprint records the content fingerprint of a processed folder. An
+// empty fingerprint removes the entry.
+func (s *Store) SetFingerprint(path, fingerprint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := s.key(path)
+	if s.fingerprints[k] == fingerprint {
+		return
+	}
+	if fingerprint == "" {
+		delete(s.fingerprints, k)
+	} else {
+		if s.fingerprints == nil {
+			s.fingerprints = make(map[string]string)
+		}
+		s.fingerprints[k] = fingerprint
+	}
+	s.dirty = true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Versions returns the object prefixes a folder was delivered to with
+// versioned re-uploads, oldest first.
+func (s *Store) Versions(path string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.versions[s.key(path)])
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// SetVersions records the object prefixes a folder was delivered to. An empty
+// list removes the entry.
+func (s *Store) SetVersions(path string, prefixes []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := s.key(path)
+	if slices.Equal(s.versions[k], prefixes) {
+		return
+	}
+	if len(prefixes) == 0 {
+		delete(s.versions, k)
+	} else {
+		if s.versions == nil {
+			s.versions = make(map[string][]string)
+		}
+		s.versions[k] = slices.Clone(prefixes)
+	}
+	s.dirty = true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 // SetLastRun updates the last run timestamp and marks the store dirty so that
 // the persisted state file will reflect the most recent invocation even if no
 // new RDY files were discovered.
@@ -124,3 +488,99 @@ func (s *Store) SetLastRun(t time.Time) {
 	s.dirty = true
 	s.mu.Unlock()
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// AddRun appends a run summary to the history, keeping only the most recent
+// limit entries. A limit <= 0 disables history and drops existing entries.
+func (s *Store) AddRun(r RunSummary, limit int) {
+	if len(r.Errors) > maxRunErrors {
+		more := len(r.Errors) - maxRunErrors
+		r.Errors = append(r.Errors[:maxRunErrors:maxRunErrors], fmt.Sprintf("... and %d more", more))
+	}
+	if len(r.Warnings) > maxRunErrors {
+		more := len(r.Warnings) - maxRunErrors
+		r.Warnings = append(r.Warnings[:maxRunErrors:maxRunErrors], fmt.Sprintf("... and %d more", more))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if limit <= 0 {
+		if s.History != nil {
+			s.History = nil
+			s.dirty = true
+		}
+		return
+	}
+	s.History = append(s.History, r)
+	if n := len(s.History); n > limit {
+		s.History = append([]RunSummary(nil), s.History[n-limit:]...)
+	}
+	s.dirty = true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Backfill returns the checkpoint of an unfinished backfill, or nil.
+func (s *Store) Backfill() *Backfill {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.backfill == nil {
+		return nil
+	}
+	b := *s.backfill
+	return &b
+}
+
+// SetBackfill records the checkpoint of a backfill; nil removes it once the
+// backfill completed.
+func (s *Store) SetBackfill(b *Backfill) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b != nil {
+		c := *b
+		b = &c
+	} else if s.backfill == nil {
+		return
+	}
+	s.backfill = b
+	s.dirty = true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// SetLastNotified records the time a failure digest was sent.
+func (s *Store) SetLastNotified(t time.Time) {
+	s.mu.Lock()
+	s.LastNotified = t
+	s.dirty = true
+	s.mu.Unlock()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// key returns the map key for path, normalized to NFC and made relative to
+// Root if enabled.
+func (s *Store) key(path string) string {
+	if s.NormalizeKeys {
+		path = norm.NFC.String(path)
+	}
+	if s.RelativeKeys && s.Root != "" && filepath.IsAbs(path) {
+		rel, err := filepath.Rel(s.Root, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return path
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// migrateKey converts a key read from disk to the configured key format:
+// absolute keys become relative if RelativeKeys is set, and relative keys
+// are resolved against Root otherwise.
+func (s *Store) migrateKey(k string) string {
+	if !s.RelativeKeys && s.Root != "" && !filepath.IsAbs(k) {
+		k = filepath.Join(s.Root, filepath.FromSlash(k))
+	}
+	return s.key(k)
+}
@@ -1,11 +1,15 @@
 package state
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"local-file-sync/internal/sys"
 )
 
 // TestStore_LoadSave verifies saving and loading state to/from JSON file.
@@ -137,3 +141,389 @@ func TestStore_ConcurrentSet(t *testing.T) {
 		t.Fatalf("expected at least one value written")
 	}
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestStore_NormalizeKeys verifies NFC/NFD variants share one entry and that
+// existing NFD keys are migrated on Load.
+func TestStore_NormalizeKeys(t *testing.T) {
+	nfc := "/in/Caf\u00e9.RDY"
+	nfd := "/in/Cafe\u0301.RDY"
+	p := filepath.Join(t.TempDir(), "state.json")
+	legacy := New(p)
+	legacy.Set(nfd, 42)
+	if err := legacy.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	s := New(p)
+	s.NormalizeKeys = true
+	if err := s.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if v, ok := s.Get(nfc); !ok || v != 42 {
+		t.Fatalf("expected migrated NFD key to be found via NFC: %v %v", v, ok)
+	}
+	if _, ok := s.Data[nfd]; ok {
+		t.Fatalf("expected NFD key to be rewritten")
+	}
+	if !s.dirty {
+		t.Fatalf("expected migration to mark store dirty")
+	}
+	s.Set(nfd, 43)
+	if v, _ := s.Get(nfc); v != 43 || len(s.Data) != 1 {
+		t.Fatalf("expected single normalized entry, got %v", s.Data)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestStore_RelativeKeys verifies keys below Root are stored relative, that
+// absolute keys are migrated on Load, and that relative keys resolve back to
+// absolute ones when the option is disabled again.
+func TestStore_RelativeKeys(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "intake")
+	p := filepath.Join(t.TempDir(), "state.json")
+	abs := filepath.Join(root, "sub", "ORDER1.RDY")
+	outside := filepath.Join(filepath.Dir(root), "other", "X.RDY")
+
+	legacy := New(p)
+	legacy.Set(abs, 1)
+	legacy.Set(outside, 2)
+	if err := legacy.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	s := New(p)
+	s.Root = root
+	s.RelativeKeys = true
+	if err := s.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if _, ok := s.Data["sub/ORDER1.RDY"]; !ok {
+		t.Fatalf("expected migrated relative key, got %v", s.Data)
+	}
+	if _, ok := s.Data[outside]; !ok {
+		t.Fatalf("expected key outside root to stay absolute, got %v", s.Data)
+	}
+	if v, ok := s.Get(abs); !ok || v != 1 {
+		t.Fatalf("lookup by absolute path failed: %v %v", v, ok)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	// NOTE(joel): Moved intake directory keeps its state.
+	moved := New(p)
+	moved.Root = filepath.Join(t.TempDir(), "moved")
+	moved.RelativeKeys = true
+	if err := moved.Load(); err != nil {
+		t.Fatalf("load moved: %v", err)
+	}
+	if _, ok := moved.Get(filepath.Join(moved.Root, "sub", "ORDER1.RDY")); !ok {
+		t.Fatalf("expected state to survive moved root")
+	}
+
+	// NOTE(joel): Disabling relative keys resolves them against Root.
+	back := New(p)
+	back.Root = root
+	if err := back.Load(); err != nil {
+		t.Fatalf("load back: %v", err)
+	}
+	if _, ok := back.Data[abs]; !ok {
+		t.Fatalf("expected absolute key restored, got %v", back.Data)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestStore_History verifies run summaries are persisted, trimmed to the limit
+// and capped in their number of errors and warnings.
+func TestStore_History(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "state.json")
+	s := New(p)
+	for i := range 5 {
+		s.AddRun(RunSummary{Start: time.Unix(int64(i), 0), Scanned: i}, 3)
+	}
+	errs := make([]string, maxRunErrors+5)
+	s.AddRun(RunSummary{Start: time.Unix(5, 0), Errors: errs, Warnings: errs[:maxRunErrors+1]}, 3)
+	if err := s.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	s2 := New(p)
+	if err := s2.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(s2.History) != 3 || s2.History[0].Scanned != 3 {
+		t.Fatalf("expected last 3 runs, got %+v", s2.History)
+	}
+	last := s2.History[2].Errors
+	if len(last) != maxRunErrors+1 || last[maxRunErrors] != "... and 5 more" {
+		t.Fatalf("expected capped errors, got %q", last)
+	}
+	if w := s2.History[2].Warnings; len(w) != maxRunErrors+1 || w[maxRunErrors] != "... and 1 more" {
+		t.Fatalf("expected capped warnings, got %q", w)
+	}
+
+	s2.AddRun(RunSummary{}, 0)
+	if s2.History != nil {
+		t.Fatalf("expected history dropped with limit 0")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestStore_Partial verifies partially uploaded folders are persisted and
+// cleared.
+func TestStore_Partial(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "state.json")
+	s := New(p)
+	mod := time.Unix(100, 0).UTC()
+	files := []PartialFile{{Name: "a.txt", Size: 3, ModTime: mod, Checksum: "abc", Path: "X/a.txt"}}
+	s.SetPartial("/tmp/X", files)
+	if err := s.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	s2 := New(p)
+	if err := s2.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	got := s2.PartialFiles("/tmp/X")
+	if len(got) != 1 || got[0].Name != "a.txt" || !got[0].ModTime.Equal(mod) || got[0].Path != "X/a.txt" {
+		t.Fatalf("unexpected partial files %+v", got)
+	}
+
+	s2.SetPartial("/tmp/X", nil)
+	if err := s2.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	s3 := New(p)
+	if err := s3.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := s3.PartialFiles("/tmp/X"); got != nil {
+		t.Fatalf("expected partial entry cleared, got %+v", got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestStore_PathsDelete verifies entries are listed as absolute paths (also
+// for relative keys) and can be deleted.
+func TestStore_PathsDelete(t *testing.T) {
+	root := t.TempDir()
+	s := New(filepath.Join(root, "state.json"))
+	s.Root = root
+	s.RelativeKeys = true
+	s.Set(filepath.Join(root, "B.RDY"), 2)
+	s.Set(filepath.Join(root, "A.RDY"), 1)
+
+	got := s.Paths()
+	if len(got) != 2 || got[0] != filepath.Join(root, "A.RDY") || got[1] != filepath.Join(root, "B.RDY") {
+		t.Fatalf("unexpected paths %v", got)
+	}
+
+	s.Delete(filepath.Join(root, "A.RDY"))
+	if _, ok := s.Get(filepath.Join(root, "A.RDY")); ok {
+		t.Fatalf("expected entry deleted")
+	}
+	if got := s.Paths(); len(got) != 1 {
+		t.Fatalf("unexpected paths after delete %v", got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestStore_Fingerprint verifies folder fingerprints persist and can be
+// removed.
+func TestStore_Fingerprint(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "state.json")
+	s := New(p)
+	s.SetFingerprint("/tmp/X", "abc")
+	if err := s.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	s2 := New(p)
+	if err := s2.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := s2.Fingerprint("/tmp/X"); got != "abc" {
+		t.Fatalf("unexpected fingerprint %q", got)
+	}
+	s2.SetFingerprint("/tmp/X", "")
+	if got := s2.Fingerprint("/tmp/X"); got != "" {
+		t.Fatalf("expected fingerprint removed, got %q", got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestStore_Versions verifies version chains persist and can be removed.
+func TestStore_Versions(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "state.json")
+	s := New(p)
+	s.SetVersions("/tmp/X", []string{"X", "X/v2"})
+	if err := s.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	s2 := New(p)
+	if err := s2.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := s2.Versions("/tmp/X"); len(got) != 2 || got[1] != "X/v2" {
+		t.Fatalf("unexpected versions %v", got)
+	}
+	s2.SetVersions("/tmp/X", nil)
+	if got := s2.Versions("/tmp/X"); got != nil {
+		t.Fatalf("expected versions removed, got %v", got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestStore_Backfill verifies the backfill checkpoint persists and is removed
+// once cleared.
+func TestStore_Backfill(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "state.json")
+	s := New(p)
+	if s.Backfill() != nil {
+		t.Fatalf("expected no checkpoint")
+	}
+	s.SetBackfill(&Backfill{Root: "/in", Total: 10, Done: 4, Cursor: "/in/D.RDY", CursorFolder: "/in/D"})
+	if err := s.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	s2 := New(p)
+	if err := s2.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	b := s2.Backfill()
+	if b == nil || b.Done != 4 || b.Total != 10 || b.Cursor != "/in/D.RDY" || b.CursorFolder != "/in/D" {
+		t.Fatalf("unexpected checkpoint %+v", b)
+	}
+	// NOTE(joel): The returned checkpoint is a copy.
+	b.Done = 5
+	if s2.Backfill().Done != 4 {
+		t.Fatalf("expected checkpoint to be copied")
+	}
+	s2.SetBackfill(nil)
+	if err := s2.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	b2, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if strings.Contains(string(b2), "backfill") {
+		t.Fatalf("expected checkpoint removed, got %s", b2)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestStore_FS verifies the state file is written through the store's
+// filesystem, so failures can be simulated, and a failed save keeps the old
+// state file.
+func TestStore_FS(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "state.json")
+	s := New(p)
+	s.Set("/a.RDY", 1)
+	if err := s.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	s.FS = renameFailingFS{}
+	s.Set("/b.RDY", 2)
+	if err := s.Save(); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("expected rename error, got %v", err)
+	}
+	s2 := New(p)
+	if err := s2.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if _, ok := s2.Get("/b.RDY"); ok {
+		t.Fatalf("expected the old state file kept")
+	}
+	if _, ok := s2.Get("/a.RDY"); !ok {
+		t.Fatalf("expected the old entry kept")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// renameFailingFS is a sys.OSFileSystem whose renames fail.
+type renameFailingFS struct{ sys.OSFileSystem }
+
+func (renameFailingFS) Rename(oldpath, newpath string) error {
+	return errors.New("disk full")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestStore_Stages verifies matches advance through the allowed stages only,
+// persist with attempts and errors, restart at discovered and are removed
+// once done.
+func TestStore_Stages(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "state.json")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := New(p)
+	if err := s.Advance("/tmp/X", StageValidated, now, nil); err == nil {
+		t.Fatalf("expected error for an undiscovered match")
+	}
+	s.Discover("/tmp/X", "/tmp/X.RDY", "", 42, now)
+	if err := s.Advance("/tmp/X", StageUploading, now, nil); err == nil {
+		t.Fatalf("expected error for skipping validation")
+	}
+	for _, to := range []Stage{StageValidated, StageUploading} {
+		if err := s.Advance("/tmp/X", to, now, nil); err != nil {
+			t.Fatalf("advance to %s: %v", to, err)
+		}
+	}
+	if err := s.Advance("/tmp/X", StageFailed, now, errors.New("boom")); err != nil {
+		t.Fatalf("advance to failed: %v", err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	s2 := New(p)
+	if err := s2.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	ms, ok := s2.Match("/tmp/X")
+	want := MatchState{Stage: StageFailed, ReadyFile: "/tmp/X.RDY", Trigger: 42, Updated: now, Attempts: 1, Error: "boom"}
+	if !ok || ms != want {
+		t.Fatalf("expected %+v, got %+v", want, ms)
+	}
+	if err := s2.Advance("/tmp/X", StageRecorded, now, nil); err == nil {
+		t.Fatalf("expected error for failed -> recorded")
+	}
+
+	// NOTE(joel): The retry of the same trigger keeps counting attempts.
+	s2.Discover("/tmp/X", "/tmp/X.RDY", "", 42, now)
+	for _, to := range []Stage{StageValidated, StageUploading, StageRecorded} {
+		if err := s2.Advance("/tmp/X", to, now, nil); err != nil {
+			t.Fatalf("advance to %s: %v", to, err)
+		}
+	}
+	if ms, _ := s2.Match("/tmp/X"); ms.Stage != StageRecorded || ms.Attempts != 2 || ms.Error != "" {
+		t.Fatalf("unexpected match %+v", ms)
+	}
+	if err := s2.Advance("/tmp/X", StageDone, now, nil); err != nil {
+		t.Fatalf("advance to done: %v", err)
+	}
+	if _, ok := s2.Match("/tmp/X"); ok || len(s2.Matches()) != 0 {
+		t.Fatalf("expected done match removed, got %v", s2.Matches())
+	}
+
+	s2.Discover("/tmp/Y", "/tmp/Y.RDY", "", 1, now)
+	s2.Discover("/tmp/Y", "/tmp/Y.RDY", "", 2, now)
+	if ms, _ := s2.Match("/tmp/Y"); ms.Trigger != 2 || ms.Attempts != 0 {
+		t.Fatalf("expected a changed trigger to start over, got %+v", ms)
+	}
+}
@@ -0,0 +1,76 @@
+// Package sys holds the clock and filesystem interfaces the run, its lock
+// and its state go through (see app.Env), so tests and embedders can replace
+// them. It imports nothing of this module, so every package may use it.
+package sys
+
+import (
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Clock tells the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a function like time.Now to a Clock.
+type ClockFunc func() time.Time
+
+// Now calls f.
+func (f ClockFunc) Now() time.Time { return f() }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// FileSystem is the filesystem lock and state files are read and written
+// through, and trigger modification times are read from. OSFileSystem is the real one; tests and embedders may wrap it, e.g.
+// to inject failures.
+type FileSystem interface {
+	Stat(name string) (fs.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	// CreateExclusive creates the file name with data. It fails with an error
+	// matching fs.ErrExist if name exists.
+	CreateExclusive(name string, data []byte, perm fs.FileMode) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	MkdirAll(path string, perm fs.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// OSFileSystem is the FileSystem of the operating system.
+type OSFileSystem struct{}
+
+func (OSFileSystem) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+func (OSFileSystem) ReadFile(name string) ([]byte, error)  { return os.ReadFile(name) }
+func (OSFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+func (OSFileSystem) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (OSFileSystem) Remove(name string) error                     { return os.Remove(name) }
+func (OSFileSystem) MkdirAll(path string, perm fs.FileMode) error { return os.MkdirAll(path, perm) }
+func (OSFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (OSFileSystem) CreateExclusive(name string, data []byte, perm fs.FileMode) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Files returns fsys, or OSFileSystem if it is nil.
+func Files(fsys FileSystem) FileSystem {
+	if fsys == nil {
+		return OSFileSystem{}
+	}
+	return fsys
+}
@@ -0,0 +1,23 @@
+package sys
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"testing"
+)
+
+// TestOSFileSystem_CreateExclusive verifies an existing file isn't replaced.
+func TestOSFileSystem_CreateExclusive(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "f")
+	var fsys OSFileSystem
+	if err := fsys.CreateExclusive(name, []byte("a"), 0o600); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := fsys.CreateExclusive(name, []byte("b"), 0o600); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected fs.ErrExist, got %v", err)
+	}
+	if b, _ := fsys.ReadFile(name); string(b) != "a" {
+		t.Fatalf("expected content kept, got %q", b)
+	}
+}
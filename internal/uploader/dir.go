@@ -0,0 +1,187 @@
+package uploader
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// dirStorage implements Storage with a local directory, e.g. a mirror on a
+// NAS next to the bucket. Object names are paths below root. Custom metadata
+// isn't stored; List computes the MetadataSHA256 of the files instead.
+type dirStorage struct {
+	root string
+}
+
+// NOTE(joel): Compile-time check that the directory store satisfies the
+// interface.
+var _ Storage = (*dirStorage)(nil)
+
+// dirTempPrefix starts the names of files being written to a dirStorage.
+const dirTempPrefix = ".lfs-tmp-"
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewDir creates an uploader writing the objects to files below the local
+// directory root, which is created if missing.
+func NewDir(ctx context.Context, root string, concurrency int) (*GCSUploader, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("create directory: %w", err)
+	}
+	return NewStorageUploader(ctx, "file://"+filepath.ToSlash(root), &dirStorage{root: root}, concurrency), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Put implements Storage. The content is written to a temporary file that is
+// renamed (or, with opts.CreateOnly, hard-linked) into place, so readers never
+// see partial files. Gzip encoded content is stored decompressed, as GCS
+// serves it.
+func (s *dirStorage) Put(ctx context.Context, name string, r io.Reader, opts PutOptions) (ObjectAttrs, error) {
+	dst, err := s.path(name)
+	if err != nil {
+		return ObjectAttrs{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return ObjectAttrs{}, fmt.Errorf("create directory for %s: %w", name, err)
+	}
+	if opts.ContentEncoding == "gzip" {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return ObjectAttrs{}, fmt.Errorf("decompress %s: %w", name, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), dirTempPrefix+"*")
+	if err != nil {
+		return ObjectAttrs{}, fmt.Errorf("create temp file for %s: %w", name, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, &ctxReader{ctx: ctx, r: r}); err != nil {
+		tmp.Close()
+		return ObjectAttrs{}, fmt.Errorf("copy to %s: %w", dst, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return ObjectAttrs{}, fmt.Errorf("close %s: %w", dst, err)
+	}
+	if opts.CreateOnly {
+		// NOTE(joel): Linking fails if the target exists, unlike renaming.
+		if err := os.Link(tmp.Name(), dst); err != nil {
+			if errors.Is(err, fs.ErrExist) {
+				return ObjectAttrs{Name: name}, fmt.Errorf("finalize %s: %w", dst, ErrObjectExists)
+			}
+			return ObjectAttrs{}, fmt.Errorf("finalize %s: %w", dst, err)
+		}
+	} else if err := os.Rename(tmp.Name(), dst); err != nil {
+		return ObjectAttrs{}, fmt.Errorf("finalize %s: %w", dst, err)
+	}
+	return ObjectAttrs{Name: name, Metadata: opts.Metadata}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// List implements Storage. It walks the directory holding prefix.
+func (s *dirStorage) List(ctx context.Context, prefix string) ([]ObjectAttrs, error) {
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i]
+	}
+	start, err := s.path(dir)
+	if err != nil {
+		return nil, err
+	}
+	var objs []ObjectAttrs
+	err = filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && p == start {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), dirTempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		sum, err := getChecksum(ctx, p, nil)
+		if err != nil {
+			return err
+		}
+		objs = append(objs, ObjectAttrs{Name: name, Metadata: map[string]string{MetadataSHA256: sum}})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list %s: %w", start, err)
+	}
+	return objs, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Get implements Storage. Files aren't versioned, so generation is ignored;
+// content is stored decompressed already.
+func (s *dirStorage) Get(ctx context.Context, name string, generation int64) (io.ReadCloser, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("read object %s: %w", name, err)
+	}
+	return f, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Close implements Storage.
+func (s *dirStorage) Close() error {
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// path returns the file of the object name, which must stay below root.
+func (s *dirStorage) path(name string) (string, error) {
+	if name == "" {
+		return s.root, nil
+	}
+	if !filepath.IsLocal(filepath.FromSlash(name)) || path.Clean(name) != strings.TrimSuffix(name, "/") {
+		return "", fmt.Errorf("invalid object name %q for a directory", name)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(name)), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ctxReader stops reading once ctx is done, so canceled uploads to local
+// files end like those to GCS.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read implements io.Reader.
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
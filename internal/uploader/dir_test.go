@@ -0,0 +1,89 @@
+package uploader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"local-file-sync/internal/scanner"
+)
+
+// TestDirStorage verifies objects are written as files below the root,
+// create-only writes don't replace existing files, gzip content is stored
+// decompressed and names escaping the root are rejected.
+func TestDirStorage(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "mirror")
+	u, err := NewDir(context.Background(), root, 2)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	s := u.store.(*dirStorage)
+	ctx := context.Background()
+
+	if _, err := s.Put(ctx, "F/a.txt", strings.NewReader("a"), PutOptions{}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if _, err := s.Put(ctx, "F/a.txt", strings.NewReader("b"), PutOptions{CreateOnly: true}); !errors.Is(err, ErrObjectExists) {
+		t.Fatalf("expected ErrObjectExists, got %v", err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("zipped"))
+	zw.Close()
+	if _, err := s.Put(ctx, "F/sub/z.img", &gz, PutOptions{ContentEncoding: "gzip"}); err != nil {
+		t.Fatalf("put gzip: %v", err)
+	}
+	for name, want := range map[string]string{"F/a.txt": "a", "F/sub/z.img": "zipped"} {
+		b, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil || string(b) != want {
+			t.Fatalf("%s: expected %q, got %q err=%v", name, want, b, err)
+		}
+	}
+	for _, name := range []string{"../x", "/abs", "F/../../x"} {
+		if _, err := s.Put(ctx, name, strings.NewReader("x"), PutOptions{}); err == nil {
+			t.Fatalf("expected error for %q", name)
+		}
+	}
+
+	objs, err := s.List(ctx, "F/")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(objs) != 2 || objs[0].Name != "F/a.txt" || objs[0].Metadata[MetadataSHA256] == "" || objs[1].Name != "F/sub/z.img" {
+		t.Fatalf("unexpected objects %+v", objs)
+	}
+	if objs, err := s.List(ctx, "missing/"); err != nil || len(objs) != 0 {
+		t.Fatalf("expected no objects for a missing prefix, got %v %v", objs, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestNewDir_UploadFolder verifies folders are uploaded into the directory
+// like into a bucket, and skipped by -skip-existing on the next upload.
+func TestNewDir_UploadFolder(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(t, filepath.Join(dir, "a.txt"), []byte("a"))
+	root := t.TempDir()
+	u, err := NewDir(context.Background(), root, 2)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	m := scanner.Match{Folder: dir, FolderEntries: []scanner.FileEntry{{Name: "a.txt", Path: filepath.Join(dir, "a.txt")}}}
+	res := u.UploadFolder(m, UploadOptions{Prefix: "in", FolderName: "F"})
+	if res.Failed() || len(res.Uploaded) != 1 || res.Uploaded[0].Path != "in/F/a.txt" {
+		t.Fatalf("unexpected result %+v err=%v", res, res.Err())
+	}
+	if b, err := os.ReadFile(filepath.Join(root, "in", "F", "a.txt")); err != nil || string(b) != "a" {
+		t.Fatalf("expected mirrored file, got %q err=%v", b, err)
+	}
+	res = u.UploadFolder(m, UploadOptions{Prefix: "in", FolderName: "F", SkipExisting: true})
+	if res.Failed() || !res.Uploaded[0].Existing {
+		t.Fatalf("expected existing file skipped, got %+v err=%v", res.Uploaded, res.Err())
+	}
+}
@@ -0,0 +1,138 @@
+package uploader
+
+import (
+	"context"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Documents is the document store Firestore keeps its records, claims and
+// leases in. NewFirestore uses a Cloud Firestore database; tests and
+// alternative backends provide their own implementation to
+// NewDocumentRecordWriter.
+type Documents interface {
+	// Set creates or overwrites the document id of collection with data.
+	Set(ctx context.Context, collection, id string, data any) error
+	// Get reads the document id of collection into dst (a pointer). ok is
+	// false if the document doesn't exist.
+	Get(ctx context.Context, collection, id string, dst any) (ok bool, err error)
+	// RunTransaction runs fn atomically. fn may be called again if the
+	// transaction conflicts with a concurrent one, so it must not have side
+	// effects other than through tx; all reads must happen before the first
+	// write.
+	RunTransaction(ctx context.Context, fn func(tx DocumentTx) error) error
+	Close() error
+}
+
+// DocumentTx reads and writes documents within a transaction (see
+// Documents.RunTransaction).
+type DocumentTx interface {
+	// Get reads the document id of collection into dst (a pointer). ok is
+	// false if the document doesn't exist.
+	Get(collection, id string, dst any) (ok bool, err error)
+	// Create creates the document id of collection; the transaction fails if
+	// it exists already.
+	Create(collection, id string, data any) error
+	// Set creates or overwrites the document id of collection.
+	Set(collection, id string, data any) error
+	// Delete deletes the document id of collection if it exists.
+	Delete(collection, id string) error
+}
+
+// firestoreDocuments implements Documents with a Cloud Firestore client.
+type firestoreDocuments struct {
+	client *firestore.Client
+}
+
+// firestoreTx implements DocumentTx with a Cloud Firestore transaction.
+type firestoreTx struct {
+	client *firestore.Client
+	tx     *firestore.Transaction
+}
+
+// NOTE(joel): Compile-time checks that the Firestore adapters satisfy the
+// interfaces.
+var (
+	_ Documents  = (*firestoreDocuments)(nil)
+	_ DocumentTx = (*firestoreTx)(nil)
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Set implements Documents.
+func (d *firestoreDocuments) Set(ctx context.Context, collection, id string, data any) error {
+	_, err := d.client.Collection(collection).Doc(id).Set(ctx, data)
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Get implements Documents.
+func (d *firestoreDocuments) Get(ctx context.Context, collection, id string, dst any) (bool, error) {
+	snap, err := d.client.Collection(collection).Doc(id).Get(ctx)
+	return decodeSnapshot(snap, err, dst)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// RunTransaction implements Documents.
+func (d *firestoreDocuments) RunTransaction(ctx context.Context, fn func(tx DocumentTx) error) error {
+	return d.client.RunTransaction(ctx, func(_ context.Context, tx *firestore.Transaction) error {
+		return fn(&firestoreTx{client: d.client, tx: tx})
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Close implements Documents.
+func (d *firestoreDocuments) Close() error {
+	return d.client.Close()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Get implements DocumentTx.
+func (t *firestoreTx) Get(collection, id string, dst any) (bool, error) {
+	snap, err := t.tx.Get(t.client.Collection(collection).Doc(id))
+	return decodeSnapshot(snap, err, dst)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Create implements DocumentTx.
+func (t *firestoreTx) Create(collection, id string, data any) error {
+	return t.tx.Create(t.client.Collection(collection).Doc(id), data)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Set implements DocumentTx.
+func (t *firestoreTx) Set(collection, id string, data any) error {
+	return t.tx.Set(t.client.Collection(collection).Doc(id), data)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Delete implements DocumentTx.
+func (t *firestoreTx) Delete(collection, id string) error {
+	return t.tx.Delete(t.client.Collection(collection).Doc(id))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// decodeSnapshot decodes the result of a document read into dst. ok is false
+// if the document doesn't exist.
+func decodeSnapshot(snap *firestore.DocumentSnapshot, err error, dst any) (bool, error) {
+	// NOTE(joel): For missing documents Get returns a NotFound error together
+	// with a snapshot that doesn't exist.
+	if snap != nil && !snap.Exists() {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := snap.DataTo(dst); err != nil {
+		return false, err
+	}
+	return true, nil
+}
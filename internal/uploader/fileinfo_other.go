@@ -0,0 +1,24 @@
+//go:build !unix
+
+package uploader
+
+import "os"
+
+// fileID is not supported on this platform; hard links are never detected.
+func fileID(fi os.FileInfo) (id [2]uint64, ok bool) {
+	return id, false
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// fileOwner is not supported on this platform; no owner is recorded.
+func fileOwner(fi os.FileInfo) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// isSparse is not supported on this platform; files are never sparse.
+func isSparse(fi os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,43 @@
+//go:build unix
+
+package uploader
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the device and inode of a file with more than one hard link.
+// ok is false for files without additional links or if the platform doesn't
+// expose inode information.
+func fileID(fi os.FileInfo) (id [2]uint64, ok bool) {
+	st, isStat := fi.Sys().(*syscall.Stat_t)
+	if !isStat || st.Nlink < 2 {
+		return id, false
+	}
+	return [2]uint64{uint64(st.Dev), uint64(st.Ino)}, true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// fileOwner returns the numeric user and group ID owning a file. ok is false
+// if the platform doesn't expose them.
+func fileOwner(fi os.FileInfo) (uid, gid uint32, ok bool) {
+	st, isStat := fi.Sys().(*syscall.Stat_t)
+	if !isStat {
+		return 0, 0, false
+	}
+	return st.Uid, st.Gid, true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// isSparse reports whether a file occupies fewer disk blocks than its size
+// implies, i.e. contains holes.
+func isSparse(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return int64(st.Blocks)*512 < fi.Size()
+}
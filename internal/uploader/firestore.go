@@ -4,8 +4,12 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"cloud.google.com/go/firestore"
 )
@@ -15,14 +19,96 @@ type FolderRecord struct {
 	FolderPath string         `firestore:"folderPath" json:"folderPath"`
 	UploadedAt time.Time      `firestore:"uploadedAt" json:"uploadedAt"`
 	Files      []UploadedFile `firestore:"files" json:"files"`
+	Agent      string         `firestore:"agent,omitempty" json:"agent,omitempty"`
+	// RunID identifies the run that uploaded the folder.
+	RunID string `firestore:"runId,omitempty" json:"runId,omitempty"`
+	// Labels are derived from the folder path (see -path-labels).
+	Labels map[string]string `firestore:"labels,omitempty" json:"labels,omitempty"`
+	// MatchID is the ID of the match the folder was uploaded for (see
+	// scanner.MatchID).
+	MatchID string `firestore:"matchId,omitempty" json:"matchId,omitempty"`
+	// Versions lists the object prefixes of all deliveries of the folder
+	// with versioned re-uploads (see -reupload-versions), oldest first; the
+	// last one holds Files.
+	Versions []string `firestore:"versions,omitempty" json:"versions,omitempty"`
+	// ID, if set, is the document ID used instead of the hashed FolderPath
+	// (see -doc-id).
+	ID string `firestore:"-" json:"id,omitempty"`
 }
 
-// Firestore wraps a firestore client and associated options.
+// FolderClaim represents the Firestore document created by the first agent
+// that claims a folder for upload.
+type FolderClaim struct {
+	FolderPath string    `firestore:"folderPath" json:"folderPath"`
+	Agent      string    `firestore:"agent" json:"agent"`
+	ClaimedAt  time.Time `firestore:"claimedAt" json:"claimedAt"`
+	// Status is ClaimStatusClaimed while the claimant uploads the folder and
+	// ClaimStatusUploaded once it did (see CompleteClaim).
+	Status string `firestore:"status,omitempty" json:"status,omitempty"`
+	// ExpiresAt is when a claim whose upload didn't complete (e.g. the
+	// claimant crashed) may be taken over by another agent.
+	ExpiresAt time.Time `firestore:"expiresAt,omitempty" json:"expiresAt,omitzero"`
+	// ID, if set, is the document ID used instead of the hashed FolderPath.
+	ID string `firestore:"-" json:"id,omitempty"`
+}
+
+// Claim statuses (see FolderClaim.Status).
+const (
+	ClaimStatusClaimed  = "claimed"
+	ClaimStatusUploaded = "uploaded"
+)
+
+// Uploaded reports whether the claimant uploaded the folder. Claims written
+// by earlier versions have no status and count as uploaded.
+func (c FolderClaim) Uploaded() bool {
+	return c.Status != ClaimStatusClaimed
+}
+
+// Expired reports whether the claim may be taken over at now: it is still
+// being uploaded and its ExpiresAt passed.
+func (c FolderClaim) Expired(now time.Time) bool {
+	return !c.Uploaded() && c.ExpiresAt.Before(now)
+}
+
+// BatchRecord represents the Firestore document stored per run summarizing
+// all folders uploaded in it (see -batch-collection). The run ID is the
+// document ID.
+type BatchRecord struct {
+	RunID      string    `firestore:"runId" json:"runId"`
+	Agent      string    `firestore:"agent,omitempty" json:"agent,omitempty"`
+	StartedAt  time.Time `firestore:"startedAt" json:"startedAt"`
+	FinishedAt time.Time `firestore:"finishedAt" json:"finishedAt"`
+	// Folders lists the record folder paths (see FolderRecord.FolderPath) of
+	// the folders uploaded successfully; FailedFolders those that failed.
+	Folders       []string `firestore:"folders" json:"folders"`
+	FailedFolders []string `firestore:"failedFolders,omitempty" json:"failedFolders,omitempty"`
+	Files         int      `firestore:"files" json:"files"`
+	Bytes         int64    `firestore:"bytes" json:"bytes"`
+}
+
+// Lease represents the Firestore document holding a time-limited lease, e.g.
+// the run lock shared by agents on several hosts (see -lock-collection). The
+// hashed key is the document ID; the run ID identifies the holder.
+type Lease struct {
+	Key        string    `firestore:"key" json:"key"`
+	Agent      string    `firestore:"agent" json:"agent"`
+	RunID      string    `firestore:"runId" json:"runId"`
+	AcquiredAt time.Time `firestore:"acquiredAt" json:"acquiredAt"`
+	ExpiresAt  time.Time `firestore:"expiresAt" json:"expiresAt"`
+}
+
+// ErrLeaseLost is returned by RenewLease if the lease expired and was taken
+// over by another run (or deleted).
+var ErrLeaseLost = errors.New("lease lost")
+
+// Firestore writes folder records and arbitrates claims and leases through a
+// Documents store and associated options.
 type Firestore struct {
-	client *firestore.Client
+	// Retry configures retries of failed record writes.
+	Retry  Backoff
+	docs   Documents
 	ctx    context.Context
-	// test hook: optional write bypass for unit tests
-	writeHook func(collection, id string, rec FolderRecord) error
+	faults *faultInjector
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -39,39 +125,350 @@ func NewFirestore(ctx context.Context, projectId string) (*Firestore, error) {
 	if err != nil {
 		return nil, fmt.Errorf("create firestore client: %w", err)
 	}
-	return &Firestore{client: client, ctx: ctx}, nil
+	return NewDocumentRecordWriter(ctx, &firestoreDocuments{client: client}), nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// Close releases the underlying firestore client.
+// NewDocumentRecordWriter creates a record writer keeping its documents in
+// docs (if ctx is nil, Background is used).
+func NewDocumentRecordWriter(ctx context.Context, docs Documents) *Firestore {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &Firestore{docs: docs, ctx: ctx}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Close releases the underlying document store.
 func (f *Firestore) Close() error {
-	if f.client != nil {
-		return f.client.Close()
+	if f.docs != nil {
+		return f.docs.Close()
 	}
 	return nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// SimulateFailures makes record writes fail randomly with the given rate
+// (0..1). Intended for staging environments only.
+func (f *Firestore) SimulateFailures(rate float64) {
+	f.faults = newFaultInjector(rate, nil)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 // WriteFolderRecord writes a FolderRecord to the specified collection using
-// the folder's base name (or full path hashed if collision-prone) as the
-// document ID.
+// rec.DocumentID() as the document ID. Failed writes are retried as
+// configured by Retry.
 func (f *Firestore) WriteFolderRecord(collection string, rec FolderRecord) error {
 	if collection == "" {
 		return fmt.Errorf("collection required")
 	}
-	if f.client == nil && f.writeHook == nil {
+	if f.docs == nil {
+		return fmt.Errorf("uploader client not initialized")
+	}
+
+	id := rec.DocumentID()
+	return f.Retry.Do(f.ctx, func() error {
+		if err := f.faults.maybeFail("write " + id); err != nil {
+			return err
+		}
+		return f.docs.Set(f.ctx, collection, id, rec)
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ReadFolderRecord reads the folder record with document ID id from the
+// specified collection. ok is false if the document doesn't exist.
+func (f *Firestore) ReadFolderRecord(collection, id string) (FolderRecord, bool, error) {
+	if collection == "" {
+		return FolderRecord{}, false, fmt.Errorf("collection required")
+	}
+	if f.docs == nil {
+		return FolderRecord{}, false, fmt.Errorf("uploader client not initialized")
+	}
+
+	var rec FolderRecord
+	if ok, err := f.docs.Get(f.ctx, collection, id, &rec); !ok || err != nil {
+		return FolderRecord{}, false, err
+	}
+	rec.ID = id
+	return rec, true, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// WriteBatchRecord writes a BatchRecord to the specified collection using the
+// run ID as document ID. Failed writes are retried as configured by Retry.
+func (f *Firestore) WriteBatchRecord(collection string, rec BatchRecord) error {
+	if collection == "" {
+		return fmt.Errorf("collection required")
+	}
+	if rec.RunID == "" {
+		return fmt.Errorf("run ID required")
+	}
+	if f.docs == nil {
+		return fmt.Errorf("uploader client not initialized")
+	}
+
+	return f.Retry.Do(f.ctx, func() error {
+		if err := f.faults.maybeFail("write batch " + rec.RunID); err != nil {
+			return err
+		}
+		return f.docs.Set(f.ctx, collection, rec.RunID, rec)
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ClaimFolder atomically stores claim for claim.FolderPath in the specified
+// collection unless another agent holds a claim for it already: one whose
+// folder was uploaded or that didn't expire by claim.ClaimedAt. It returns
+// the winning claim and whether claim.Agent holds it. Claiming a folder
+// already claimed by the same agent succeeds, so an agent may retry its own
+// failed uploads.
+func (f *Firestore) ClaimFolder(collection string, claim FolderClaim) (FolderClaim, bool, error) {
+	winner := claim
+	err := f.updateClaim(collection, claim, func(cur *FolderClaim) (*FolderClaim, error) {
+		if cur != nil && cur.Agent != claim.Agent && !cur.Expired(claim.ClaimedAt) {
+			winner = *cur
+			return cur, nil
+		}
+		winner = claim
+		return &claim, nil
+	})
+	if err != nil {
+		return FolderClaim{}, false, err
+	}
+	return winner, winner.Agent == claim.Agent, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// CompleteClaim atomically marks a claim held by claim.Agent as uploaded, so
+// other agents treat the folder as processed.
+func (f *Firestore) CompleteClaim(collection string, claim FolderClaim) error {
+	return f.updateClaim(collection, claim, func(cur *FolderClaim) (*FolderClaim, error) {
+		if cur == nil || cur.Agent != claim.Agent {
+			return cur, nil
+		}
+		done := *cur
+		done.Status = ClaimStatusUploaded
+		return &done, nil
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ReleaseClaim atomically deletes a claim held by claim.Agent whose folder
+// wasn't uploaded, so any agent may claim the folder again.
+func (f *Firestore) ReleaseClaim(collection string, claim FolderClaim) error {
+	return f.updateClaim(collection, claim, func(cur *FolderClaim) (*FolderClaim, error) {
+		if cur == nil || cur.Agent != claim.Agent || cur.Uploaded() {
+			return cur, nil
+		}
+		return nil, nil
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// claimUpdate receives the current claim (nil if there is none) and returns
+// the claim to store. Returning cur leaves the document unchanged; nil
+// deletes it.
+type claimUpdate func(cur *FolderClaim) (*FolderClaim, error)
+
+// updateClaim applies update to the claim document of claim in a transaction.
+func (f *Firestore) updateClaim(collection string, claim FolderClaim, update claimUpdate) error {
+	if collection == "" {
+		return fmt.Errorf("collection required")
+	}
+	if f.docs == nil {
 		return fmt.Errorf("uploader client not initialized")
 	}
 
-	id := hashPath(rec.FolderPath)
-	if f.writeHook != nil {
-		err := f.writeHook(collection, id, rec)
+	id := claim.DocumentID()
+	if err := f.faults.maybeFail("claim " + id); err != nil {
 		return err
 	}
-	_, err := f.client.Collection(collection).Doc(id).Set(f.ctx, rec)
-	return err
+	return f.docs.RunTransaction(f.ctx, func(tx DocumentTx) error {
+		var cur *FolderClaim
+		var held FolderClaim
+		ok, err := tx.Get(collection, id, &held)
+		if err != nil {
+			return err
+		}
+		if ok {
+			cur = &held
+		}
+		next, err := update(cur)
+		switch {
+		case err != nil:
+			return err
+		case next == cur:
+			return nil
+		case next == nil:
+			return tx.Delete(collection, id)
+		}
+		return tx.Set(collection, id, *next)
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// AcquireLease atomically stores lease in the specified collection unless
+// another run holds an unexpired lease for the same key. A held lease counts
+// as expired if its ExpiresAt is before lease.AcquiredAt. It returns the
+// current holder and whether lease.RunID holds the lease.
+func (f *Firestore) AcquireLease(collection string, lease Lease) (Lease, bool, error) {
+	holder := lease
+	err := f.updateLease(collection, lease.Key, func(cur *Lease) (*Lease, error) {
+		if cur != nil && cur.RunID != lease.RunID && !cur.ExpiresAt.Before(lease.AcquiredAt) {
+			holder = *cur
+			return cur, nil
+		}
+		holder = lease
+		return &lease, nil
+	})
+	if err != nil {
+		return Lease{}, false, err
+	}
+	return holder, holder.RunID == lease.RunID, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// RenewLease atomically replaces a lease held by lease.RunID, typically to
+// extend its ExpiresAt. It returns ErrLeaseLost if the run no longer holds the
+// lease.
+func (f *Firestore) RenewLease(collection string, lease Lease) error {
+	return f.updateLease(collection, lease.Key, func(cur *Lease) (*Lease, error) {
+		if cur == nil || cur.RunID != lease.RunID {
+			return cur, ErrLeaseLost
+		}
+		return &lease, nil
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ReleaseLease atomically deletes a lease if lease.RunID still holds it.
+func (f *Firestore) ReleaseLease(collection string, lease Lease) error {
+	return f.updateLease(collection, lease.Key, func(cur *Lease) (*Lease, error) {
+		if cur == nil || cur.RunID != lease.RunID {
+			return cur, nil
+		}
+		return nil, nil
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// leaseUpdate receives the current lease (nil if there is none) and returns
+// the lease to store. Returning cur leaves the document unchanged; nil deletes
+// it.
+type leaseUpdate func(cur *Lease) (*Lease, error)
+
+// updateLease applies update to the lease document of key in a transaction.
+func (f *Firestore) updateLease(collection, key string, update leaseUpdate) error {
+	if collection == "" {
+		return fmt.Errorf("collection required")
+	}
+	if f.docs == nil {
+		return fmt.Errorf("uploader client not initialized")
+	}
+
+	id := DocumentID(key)
+	if err := f.faults.maybeFail("lease " + id); err != nil {
+		return err
+	}
+	return f.docs.RunTransaction(f.ctx, func(tx DocumentTx) error {
+		var cur *Lease
+		var held Lease
+		ok, err := tx.Get(collection, id, &held)
+		if err != nil {
+			return err
+		}
+		if ok {
+			cur = &held
+		}
+		next, err := update(cur)
+		switch {
+		case err != nil:
+			return err
+		case next == cur:
+			return nil
+		case next == nil:
+			return tx.Delete(collection, id)
+		}
+		return tx.Set(collection, id, *next)
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// DocumentID returns the Firestore document ID used for a folder record with
+// the given (relative) folder path.
+func DocumentID(folderPath string) string {
+	return hashPath(folderPath)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// DocumentID returns the ID of the record's document: ID if set, the hashed
+// folder path otherwise.
+func (r FolderRecord) DocumentID() string {
+	if r.ID != "" {
+		return r.ID
+	}
+	return DocumentID(r.FolderPath)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// DocumentID returns the ID of the claim's document: ID if set, the hashed
+// folder path otherwise.
+func (c FolderClaim) DocumentID() string {
+	if c.ID != "" {
+		return c.ID
+	}
+	return DocumentID(c.FolderPath)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// PathDocumentID returns a human readable document ID for a folder path: the
+// slash separated path with `%` and `/` (not allowed in IDs) percent-encoded,
+// e.g. `in%2Fa%2FORDER1` for `in/a/ORDER1`. Distinct paths keep distinct IDs.
+func PathDocumentID(folderPath string) string {
+	r := strings.NewReplacer("%", "%25", "/", "%2F")
+	return r.Replace(filepath.ToSlash(folderPath))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ValidateDocumentID checks id against the Firestore document ID constraints:
+// non-empty valid UTF-8 of at most 1500 bytes without `/`, not `.` or `..`
+// and not of the reserved form `__.*__`.
+func ValidateDocumentID(id string) error {
+	switch {
+	case id == "":
+		return fmt.Errorf("empty document ID")
+	case len(id) > 1500:
+		return fmt.Errorf("document ID longer than 1500 bytes")
+	case !utf8.ValidString(id):
+		return fmt.Errorf("document ID %q is not valid UTF-8", id)
+	case strings.Contains(id, "/"):
+		return fmt.Errorf("document ID %q contains /", id)
+	case id == "." || id == "..":
+		return fmt.Errorf("invalid document ID %q", id)
+	case len(id) >= 4 && strings.HasPrefix(id, "__") && strings.HasSuffix(id, "__"):
+		return fmt.Errorf("document ID %q is reserved", id)
+	}
+	return nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -3,26 +3,148 @@ package uploader
 import (
 	"context"
 	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 	"unicode/utf8"
 )
 
-// TestWriteFolderRecord_HookSuccess ensures writeHook is invoked with
-// proper id.
-func TestWriteFolderRecord_HookSuccess(t *testing.T) {
-	var called bool
-	var gotCollection, gotID string
-	var gotRec FolderRecord
+// testDocs is an in-memory Documents store. set, if set, is called before
+// every write, e.g. to inject failures. Transactions are serialized and only
+// applied if fn succeeds.
+type testDocs struct {
+	mu   sync.Mutex
+	docs map[string]map[string]any
+	set  func(collection, id string) error
+}
 
-	fs := &Firestore{ctx: context.Background()}
-	fs.writeHook = func(col, id string, rec FolderRecord) error {
-		called = true
-		gotCollection = col
-		gotID = id
-		gotRec = rec
-		return nil
+func newTestDocs() *testDocs {
+	return &testDocs{docs: map[string]map[string]any{}}
+}
+
+func (d *testDocs) Set(_ context.Context, collection, id string, data any) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.set != nil {
+		if err := d.set(collection, id); err != nil {
+			return err
+		}
+	}
+	d.put(collection, id, data)
+	return nil
+}
+
+func (d *testDocs) Get(_ context.Context, collection, id string, dst any) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.get(collection, id, dst)
+}
+
+func (d *testDocs) RunTransaction(_ context.Context, fn func(tx DocumentTx) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	tx := &testTx{docs: d}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for _, w := range tx.writes {
+		if w.data == nil {
+			delete(d.docs[w.collection], w.id)
+			continue
+		}
+		d.put(w.collection, w.id, w.data)
+	}
+	return nil
+}
+
+func (d *testDocs) Close() error { return nil }
+
+// doc returns the document id of collection, nil if it doesn't exist.
+func (d *testDocs) doc(collection, id string) any {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.docs[collection][id]
+}
+
+// count returns the number of documents in collection.
+func (d *testDocs) count(collection string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.docs[collection])
+}
+
+// put stores data; callers must hold d.mu.
+func (d *testDocs) put(collection, id string, data any) {
+	if d.docs[collection] == nil {
+		d.docs[collection] = map[string]any{}
+	}
+	d.docs[collection][id] = data
+}
+
+// get copies a stored document into dst; callers must hold d.mu.
+func (d *testDocs) get(collection, id string, dst any) (bool, error) {
+	data, ok := d.docs[collection][id]
+	if !ok {
+		return false, nil
+	}
+	v := reflect.ValueOf(dst).Elem()
+	if !reflect.TypeOf(data).AssignableTo(v.Type()) {
+		return false, fmt.Errorf("cannot decode %T into %T", data, dst)
+	}
+	v.Set(reflect.ValueOf(data))
+	return true, nil
+}
+
+// testTx buffers the writes of a testDocs transaction; a nil data deletes.
+type testTx struct {
+	docs   *testDocs
+	writes []struct {
+		collection, id string
+		data           any
+	}
+}
+
+func (t *testTx) Get(collection, id string, dst any) (bool, error) {
+	if len(t.writes) > 0 {
+		return false, fmt.Errorf("read after write in transaction")
+	}
+	return t.docs.get(collection, id, dst)
+}
+
+func (t *testTx) Create(collection, id string, data any) error {
+	if _, ok := t.docs.docs[collection][id]; ok {
+		return fmt.Errorf("document %s/%s exists", collection, id)
+	}
+	return t.Set(collection, id, data)
+}
+
+func (t *testTx) Set(collection, id string, data any) error {
+	if t.docs.set != nil {
+		if err := t.docs.set(collection, id); err != nil {
+			return err
+		}
 	}
+	t.writes = append(t.writes, struct {
+		collection, id string
+		data           any
+	}{collection, id, data})
+	return nil
+}
+
+func (t *testTx) Delete(collection, id string) error {
+	return t.Set(collection, id, nil)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestWriteFolderRecord verifies records are stored under the hashed folder
+// path.
+func TestWriteFolderRecord(t *testing.T) {
+	docs := newTestDocs()
+	fs := NewDocumentRecordWriter(context.Background(), docs)
 
 	rec := FolderRecord{
 		FolderPath: "a/b",
@@ -35,28 +157,23 @@ func TestWriteFolderRecord_HookSuccess(t *testing.T) {
 	if err := fs.WriteFolderRecord("col", rec); err != nil {
 		t.Fatalf("WriteFolderRecord: %v", err)
 	}
-	if !called {
-		t.Fatal("hook not called")
-	}
-	if gotCollection != "col" {
-		t.Fatalf("collection mismatch %s", gotCollection)
+	got, ok := docs.doc("col", hashPath("a/b")).(FolderRecord)
+	if !ok {
+		t.Fatalf("record not stored under hashed path: %+v", docs.docs)
 	}
-	wantID := hashPath("a/b")
-	if gotID != wantID {
-		t.Fatalf("id mismatch got %s want %s", gotID, wantID)
-	}
-	if gotRec.FolderPath != rec.FolderPath || len(gotRec.Files) != 1 {
+	if got.FolderPath != rec.FolderPath || len(got.Files) != 1 {
 		t.Fatal("record mismatch")
 	}
 }
 
-// TestWriteFolderRecord_HookError ensures errors from hook propagate.
-func TestWriteFolderRecord_HookError(t *testing.T) {
+// TestWriteFolderRecord_Error ensures store errors propagate.
+func TestWriteFolderRecord_Error(t *testing.T) {
 	sentinel := errors.New("boom")
-	fs := &Firestore{ctx: context.Background()}
-	fs.writeHook = func(_, _ string, _ FolderRecord) error {
+	docs := newTestDocs()
+	docs.set = func(_, _ string) error {
 		return sentinel
 	}
+	fs := NewDocumentRecordWriter(context.Background(), docs)
 
 	err := fs.WriteFolderRecord("col", FolderRecord{FolderPath: "p"})
 	if !errors.Is(err, sentinel) {
@@ -66,21 +183,21 @@ func TestWriteFolderRecord_HookError(t *testing.T) {
 
 // TestWriteFolderRecord_NoCollection ensures empty collection errors.
 func TestWriteFolderRecord_NoCollection(t *testing.T) {
-	fs := &Firestore{ctx: context.Background()}
-	fs.writeHook = func(_, _ string, _ FolderRecord) error {
-		t.Fatalf("hook should not be called")
-		return nil
-	}
+	docs := newTestDocs()
+	fs := NewDocumentRecordWriter(context.Background(), docs)
 
 	err := fs.WriteFolderRecord("", FolderRecord{FolderPath: "x"})
 	if err == nil {
 		t.Fatal("expected error for empty collection")
 	}
+	if docs.count("") != 0 {
+		t.Fatal("expected nothing written")
+	}
 }
 
-// TestWriteFolderRecord_NoClientNoHook verifies defensive error when client
-// missing.
-func TestWriteFolderRecord_NoClientNoHook(t *testing.T) {
+// TestWriteFolderRecord_NoStore verifies defensive error when no store is
+// set.
+func TestWriteFolderRecord_NoStore(t *testing.T) {
 	fs := &Firestore{ctx: context.Background()}
 	err := fs.WriteFolderRecord("col", FolderRecord{FolderPath: "x"})
 	if err == nil {
@@ -88,7 +205,29 @@ func TestWriteFolderRecord_NoClientNoHook(t *testing.T) {
 	}
 }
 
-// TestFirestore_CloseNil ensures Close is no-op when nil client.
+// TestReadFolderRecord verifies written records are read back with their
+// document ID and missing documents are reported as such.
+func TestReadFolderRecord(t *testing.T) {
+	fs := NewDocumentRecordWriter(context.Background(), newTestDocs())
+	if err := fs.WriteFolderRecord("col", FolderRecord{FolderPath: "a/b", Agent: "me"}); err != nil {
+		t.Fatalf("WriteFolderRecord: %v", err)
+	}
+	rec, ok, err := fs.ReadFolderRecord("col", hashPath("a/b"))
+	if err != nil || !ok {
+		t.Fatalf("ReadFolderRecord: ok=%v err=%v", ok, err)
+	}
+	if rec.FolderPath != "a/b" || rec.Agent != "me" || rec.ID != hashPath("a/b") {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+	if _, ok, err := fs.ReadFolderRecord("col", "missing"); err != nil || ok {
+		t.Fatalf("expected missing record, got ok=%v err=%v", ok, err)
+	}
+	if _, _, err := fs.ReadFolderRecord("", "x"); err == nil {
+		t.Fatal("expected error for empty collection")
+	}
+}
+
+// TestFirestore_CloseNil ensures Close is no-op without a store.
 func TestFirestore_CloseNil(t *testing.T) {
 	fs := &Firestore{ctx: context.Background()}
 	if err := fs.Close(); err != nil {
@@ -135,3 +274,207 @@ func TestHashPath(t *testing.T) {
 		seen[h] = in
 	}
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestClaimFolder verifies the first agent wins a claim, the winner may claim
+// again and other agents get the winning claim.
+func TestClaimFolder(t *testing.T) {
+	docs := newTestDocs()
+	fs := NewDocumentRecordWriter(context.Background(), docs)
+	now := time.Unix(100, 0)
+	if winner, won, err := fs.ClaimFolder("claims", FolderClaim{FolderPath: "a/b", Agent: "other", ClaimedAt: now}); err != nil || !won || winner.Agent != "other" {
+		t.Fatalf("expected first claim to win, got won=%v winner=%+v err=%v", won, winner, err)
+	}
+	winner, won, err := fs.ClaimFolder("claims", FolderClaim{FolderPath: "a/b", Agent: "me", ClaimedAt: now.Add(time.Second)})
+	if err != nil {
+		t.Fatalf("ClaimFolder: %v", err)
+	}
+	if won || winner.Agent != "other" || !winner.ClaimedAt.Equal(now) {
+		t.Fatalf("expected claim lost to other, got won=%v winner=%+v", won, winner)
+	}
+	if _, won, err := fs.ClaimFolder("claims", FolderClaim{FolderPath: "a/b", Agent: "other"}); err != nil || !won {
+		t.Fatalf("expected winner to claim again, got won=%v err=%v", won, err)
+	}
+	if _, ok := docs.doc("claims", hashPath("a/b")).(FolderClaim); !ok || docs.count("claims") != 1 {
+		t.Fatalf("expected one claim under hashed path, got %+v", docs.docs)
+	}
+	if _, _, err := fs.ClaimFolder("", FolderClaim{}); err == nil {
+		t.Fatalf("expected error for empty collection")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestClaimFolder_Status verifies a released claim may be claimed by any
+// agent, an expired one is taken over and a completed one is never.
+func TestClaimFolder_Status(t *testing.T) {
+	docs := newTestDocs()
+	fs := NewDocumentRecordWriter(context.Background(), docs)
+	now := time.Unix(100, 0)
+	claim := func(agent string, at time.Time) FolderClaim {
+		return FolderClaim{FolderPath: "a/b", Agent: agent, ClaimedAt: at, Status: ClaimStatusClaimed, ExpiresAt: at.Add(time.Hour)}
+	}
+	if _, won, err := fs.ClaimFolder("claims", claim("a", now)); err != nil || !won {
+		t.Fatalf("expected a to win, got won=%v err=%v", won, err)
+	}
+	if err := fs.ReleaseClaim("claims", claim("b", now)); err != nil {
+		t.Fatalf("ReleaseClaim: %v", err)
+	}
+	if docs.count("claims") != 1 {
+		t.Fatalf("expected claim of a kept when released by b")
+	}
+	if err := fs.ReleaseClaim("claims", claim("a", now)); err != nil {
+		t.Fatalf("ReleaseClaim: %v", err)
+	}
+	if _, won, err := fs.ClaimFolder("claims", claim("b", now)); err != nil || !won {
+		t.Fatalf("expected b to win released claim, got won=%v err=%v", won, err)
+	}
+
+	if winner, won, _ := fs.ClaimFolder("claims", claim("c", now.Add(time.Minute))); won || winner.Agent != "b" || winner.Uploaded() {
+		t.Fatalf("expected pending claim of b, got won=%v winner=%+v", won, winner)
+	}
+	if _, won, err := fs.ClaimFolder("claims", claim("c", now.Add(2*time.Hour))); err != nil || !won {
+		t.Fatalf("expected c to take over expired claim, got won=%v err=%v", won, err)
+	}
+
+	if err := fs.CompleteClaim("claims", claim("c", now)); err != nil {
+		t.Fatalf("CompleteClaim: %v", err)
+	}
+	winner, won, err := fs.ClaimFolder("claims", claim("d", now.Add(48*time.Hour)))
+	if err != nil || won || winner.Agent != "c" || !winner.Uploaded() {
+		t.Fatalf("expected uploaded claim of c kept, got won=%v winner=%+v err=%v", won, winner, err)
+	}
+	if err := fs.ReleaseClaim("claims", claim("c", now)); err != nil || docs.count("claims") != 1 {
+		t.Fatalf("expected uploaded claim not released, err=%v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestWriteFolderRecord_Retry verifies failed writes are retried.
+func TestWriteFolderRecord_Retry(t *testing.T) {
+	calls := 0
+	docs := newTestDocs()
+	docs.set = func(string, string) error {
+		calls++
+		if calls == 1 {
+			return errors.New("aborted")
+		}
+		return nil
+	}
+	fs := NewDocumentRecordWriter(context.Background(), docs)
+	fs.Retry = Backoff{Retries: 2, Initial: time.Millisecond}
+	if err := fs.WriteFolderRecord("col", FolderRecord{FolderPath: "a"}); err != nil || calls != 2 {
+		t.Fatalf("expected success on retry, got %v after %d calls", err, calls)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestWriteBatchRecord verifies batch records are stored under the run ID and
+// that collection and run ID are required.
+func TestWriteBatchRecord(t *testing.T) {
+	docs := newTestDocs()
+	fs := NewDocumentRecordWriter(context.Background(), docs)
+	rec := BatchRecord{RunID: "run-1", Folders: []string{"a", "b"}, Files: 3}
+	if err := fs.WriteBatchRecord("runs", rec); err != nil {
+		t.Fatalf("WriteBatchRecord: %v", err)
+	}
+	if got, ok := docs.doc("runs", "run-1").(BatchRecord); !ok || got.Files != 3 {
+		t.Fatalf("expected batch record under run ID, got %+v", docs.docs)
+	}
+
+	if err := fs.WriteBatchRecord("", rec); err == nil {
+		t.Fatalf("expected error for empty collection")
+	}
+	if err := fs.WriteBatchRecord("runs", BatchRecord{}); err == nil {
+		t.Fatalf("expected error for empty run ID")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestLease verifies lease takeover only after expiry, renewal by the holder
+// only and release.
+func TestLease(t *testing.T) {
+	docs := newTestDocs()
+	fs := NewDocumentRecordWriter(context.Background(), docs)
+
+	now := time.Now()
+	first := Lease{Key: "/data", Agent: "a", RunID: "run-1", AcquiredAt: now, ExpiresAt: now.Add(time.Minute)}
+	if _, ok, err := fs.AcquireLease("locks", first); err != nil || !ok {
+		t.Fatalf("first acquire: ok=%v err=%v", ok, err)
+	}
+
+	second := Lease{Key: "/data", Agent: "b", RunID: "run-2", AcquiredAt: now.Add(30 * time.Second), ExpiresAt: now.Add(2 * time.Minute)}
+	holder, ok, err := fs.AcquireLease("locks", second)
+	if err != nil || ok || holder.Agent != "a" {
+		t.Fatalf("expected lease held by a, got ok=%v holder=%+v err=%v", ok, holder, err)
+	}
+
+	// NOTE(joel): Renewing extends the lease past the second attempt.
+	first.ExpiresAt = now.Add(3 * time.Minute)
+	if err := fs.RenewLease("locks", first); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	second.AcquiredAt = now.Add(2 * time.Minute)
+	if _, ok, _ := fs.AcquireLease("locks", second); ok {
+		t.Fatalf("expected renewed lease not to be taken over")
+	}
+
+	second.AcquiredAt = now.Add(4 * time.Minute)
+	if _, ok, err := fs.AcquireLease("locks", second); err != nil || !ok {
+		t.Fatalf("expected takeover of expired lease: ok=%v err=%v", ok, err)
+	}
+	if err := fs.RenewLease("locks", first); !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("expected lease lost, got %v", err)
+	}
+
+	// NOTE(joel): Releasing someone else's lease is a no-op.
+	if err := fs.ReleaseLease("locks", first); err != nil || docs.count("locks") != 1 {
+		t.Fatalf("unexpected release of foreign lease: %v %v", err, docs.docs)
+	}
+	if err := fs.ReleaseLease("locks", second); err != nil || docs.count("locks") != 0 {
+		t.Fatalf("expected lease released: %v %v", err, docs.docs)
+	}
+	if _, _, err := fs.AcquireLease("", first); err == nil {
+		t.Fatalf("expected error for empty collection")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestDocumentIDs verifies explicit record IDs, readable path IDs and ID
+// validation.
+func TestDocumentIDs(t *testing.T) {
+	docs := newTestDocs()
+	fs := NewDocumentRecordWriter(context.Background(), docs)
+	if err := fs.WriteFolderRecord("uploads", FolderRecord{FolderPath: "a/b", ID: "ORDER1"}); err != nil {
+		t.Fatalf("WriteFolderRecord: %v", err)
+	}
+	if docs.doc("uploads", "ORDER1") == nil {
+		t.Fatalf("expected record stored under explicit ID, got %+v", docs.docs)
+	}
+	if id := (FolderClaim{FolderPath: "a/b"}).DocumentID(); id != hashPath("a/b") {
+		t.Fatalf("expected hashed default ID, got %s", id)
+	}
+
+	if a, b := PathDocumentID("in/a_b/c"), PathDocumentID("in/a/b%2Fc"); a != "in%2Fa_b%2Fc" || b != "in%2Fa%2Fb%252Fc" {
+		t.Fatalf("unexpected path IDs %s, %s", a, b)
+	}
+	for id, valid := range map[string]bool{
+		"ORDER1":                  true,
+		"in%2FORDER1":             true,
+		"":                        false,
+		"a/b":                     false,
+		"..":                      false,
+		"__x__":                   false,
+		strings.Repeat("x", 1501): false,
+		string([]byte{0xff, 'a'}): false,
+	} {
+		if err := ValidateDocumentID(id); (err == nil) != valid {
+			t.Fatalf("ValidateDocumentID(%.20q) = %v, want valid=%v", id, err, valid)
+		}
+	}
+}
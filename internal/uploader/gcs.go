@@ -1,12 +1,22 @@
 package uploader
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"iter"
+	"maps"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -14,7 +24,7 @@ import (
 	"local-file-sync/internal/app"
 	"local-file-sync/internal/scanner"
 
-	"cloud.google.com/go/storage"
+	"golang.org/x/text/unicode/norm"
 )
 
 // GCSUploader uploads local folders (recursively) to a Google Cloud Storage
@@ -24,184 +34,861 @@ import (
 //	`<objectPrefix>/<basename(folder)>/<relative path inside folder>`
 type GCSUploader struct {
 	Bucket      string
-	client      *storage.Client
+	store       Storage
 	ctx         context.Context
 	Concurrency int
-	// test hook: if set, bypass real client
-	fileUploadHook func(localPath, objectName string) error
-	hookMu         sync.Mutex
+	// LargeFileThreshold, if > 0, schedules files of at least this many bytes
+	// on a quarter of the Concurrency workers (at least one), so a few huge
+	// files can't starve the many small ones sharing the rest.
+	LargeFileThreshold int64
+	faults             *faultInjector
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
 // NewGCS creates a new uploader using the provided context
 // (if nil, Background is used). The supplied context is stored and used as a
-// parent for per-file timeouts.
-func NewGCS(ctx context.Context, bucket string, concurrency int) (*GCSUploader, error) {
+// parent for per-file timeouts. opts configure the storage client's
+// transport.
+func NewGCS(ctx context.Context, bucket string, concurrency int, opts ClientOptions) (*GCSUploader, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	client, err := storage.NewClient(ctx)
+	client, err := newStorageClient(ctx, opts)
 	if err != nil {
 		return nil, fmt.Errorf("create storage client: %w", err)
 	}
+	bh := client.Bucket(bucket)
+	if opts.BillingProject != "" {
+		bh = bh.UserProject(opts.BillingProject)
+	}
+	store := &gcsStorage{client: client, bucket: bh}
+	return NewStorageUploader(ctx, bucket, store, concurrency), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewStorageUploader creates an uploader writing to store instead of a GCS
+// bucket, e.g. an alternative transport or an in-memory store in tests.
+// bucket only names the destination in records. ctx is used like with NewGCS.
+func NewStorageUploader(ctx context.Context, bucket string, store Storage, concurrency int) *GCSUploader {
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	return &GCSUploader{
 		Bucket:      bucket,
-		client:      client,
+		store:       store,
 		ctx:         ctx,
 		Concurrency: concurrency,
-	}, nil
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
 // Close releases underlying resources.
 func (u *GCSUploader) Close() error {
-	if u.client != nil {
-		return u.client.Close()
+	if u.store != nil {
+		return u.store.Close()
 	}
 	return nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// SimulateFailures makes file uploads fail randomly with the given rate
+// (0..1). Intended for staging environments only.
+func (u *GCSUploader) SimulateFailures(rate float64) {
+	u.faults = newFaultInjector(rate, nil)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// UploadedFile describes a single object written to GCS.
 type UploadedFile struct {
 	Name     string `firestore:"name" json:"name"`
 	Size     int64  `firestore:"size" json:"size"`
 	Checksum string `firestore:"checksum" json:"checksum"`
 	Path     string `firestore:"path" json:"path"`
+	// ContentEncoding is "gzip" if the object was stored compressed.
+	ContentEncoding string `firestore:"contentEncoding,omitempty" json:"contentEncoding,omitempty"`
+	// LinkOf names the entry this file is a hard link of; Path then refers to
+	// that entry's object and nothing was uploaded for this file.
+	LinkOf string `firestore:"linkOf,omitempty" json:"linkOf,omitempty"`
+	// Bundled is set if the file was uploaded as member Name of the tar
+	// bundle object Path (see UploadOptions.BundleSmallFiles).
+	Bundled bool `firestore:"bundled,omitempty" json:"bundled,omitempty"`
+	// Generation and Metageneration identify the version of the object at
+	// Path, so consumers can read exactly the uploaded content even if the
+	// object is overwritten later. They are zero if unknown.
+	Generation     int64 `firestore:"generation,omitempty" json:"generation,omitempty"`
+	Metageneration int64 `firestore:"metageneration,omitempty" json:"metageneration,omitempty"`
+	// Verified is set if the object was read back after its upload and
+	// matched the local content (see UploadOptions.ReadBack).
+	Verified bool `firestore:"verified,omitempty" json:"verified,omitempty"`
+	// Hold is the hold placed on the object by the upload (see
+	// UploadOptions.Hold), RetainUntil the time the object is retained until
+	// by its own or the bucket's retention, if reported by the store.
+	Hold        string    `firestore:"hold,omitempty" json:"hold,omitempty"`
+	RetainUntil time.Time `firestore:"retainUntil,omitempty" json:"retainUntil,omitzero"`
+	// ModTime is the modification time of the local file when it was read.
+	// It identifies unchanged files when resuming a partial upload and is not
+	// recorded.
+	ModTime time.Time `firestore:"-" json:"-"`
+	// Duration is the time spent checksumming and uploading the file. It is
+	// only used for run statistics and not recorded.
+	Duration time.Duration `firestore:"-" json:"-"`
+	// Existing is set if the object already existed with the same content
+	// and the upload was skipped (see UploadOptions.SkipExisting and
+	// UploadOptions.Done).
+	Existing bool `firestore:"-" json:"-"`
 }
 
+////////////////////////////////////////////////////////////////////////////////
+
+// FolderResult is the outcome of uploading a single matched folder. It is the
+// single source of truth for the run summary, the Firestore record and the
+// exit code.
+type FolderResult struct {
+	ReadyFile string
+	Folder    string
+	Uploaded  []UploadedFile
+	Skipped   []string
+	// FailedFiles names the entries that couldn't be uploaded. Uploaded then
+	// only holds the files that succeeded.
+	FailedFiles []string
+	Errors      []error
+	Duration    time.Duration
+	// ClaimedBy is set to the winning agent if another agent claimed the
+	// folder; nothing was uploaded in that case.
+	ClaimedBy string
+	// ClaimPending is set along with ClaimedBy if the winning agent hasn't
+	// uploaded the folder yet (see FolderClaim.Uploaded).
+	ClaimPending bool
+	// Retries is the number of file (and bundle) upload retries, summed over
+	// the destinations of a Multi uploader.
+	Retries int
+	// RecordQueued is set if the folder's record couldn't be written and was
+	// queued in the pending records file instead.
+	RecordQueued bool
+	// Destinations holds the outcome per destination of a Multi uploader, the
+	// primary first; it is empty for single destinations.
+	Destinations []DestinationResult
+}
+
+// Failed reports whether any error was recorded for the folder.
+func (r *FolderResult) Failed() bool {
+	return len(r.Errors) > 0
+}
+
+// Bytes returns the number of bytes uploaded for the folder. Hard links and
+// existing objects (which weren't uploaded) are not counted.
+func (r *FolderResult) Bytes() int64 {
+	var n int64
+	for _, f := range r.Uploaded {
+		if f.LinkOf == "" && !f.Existing {
+			n += f.Size
+		}
+	}
+	return n
+}
+
+// Err returns all recorded errors joined together, or nil if the folder
+// succeeded.
+func (r *FolderResult) Err() error {
+	return errors.Join(r.Errors...)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// UploadFolder uploads the immediate entries of a matched folder and reports
+// the outcome as a FolderResult. Failures are recorded in the result rather
+// than returned so callers can aggregate them.
+func (u *GCSUploader) UploadFolder(m scanner.Match, opts UploadOptions) FolderResult {
+	start := time.Now()
+	res := FolderResult{ReadyFile: m.ReadyFile, Folder: m.Folder}
+	uploaded, skipped, failed, retries, err := u.uploadEntries(m.Entries(), opts)
+	res.Uploaded = uploaded
+	res.Skipped = skipped
+	res.FailedFiles = failed
+	res.Retries = retries
+	if err != nil {
+		res.Errors = append(res.Errors, err)
+	}
+	if opts.EmptyMarker && err == nil && len(uploaded) == 0 {
+		marker, err := u.uploadMarker(m.Folder, opts)
+		if err != nil {
+			res.Errors = append(res.Errors, err)
+		} else {
+			res.Uploaded = append(res.Uploaded, marker)
+		}
+	}
+	res.Duration = time.Since(start)
+	return res
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 // UploadListedEntries uploads only the specified file entries (non-recursive).
 // Directory entries are ignored; only regular files (non-symlink) are uploaded.
 func (u *GCSUploader) UploadListedEntries(entries []scanner.FileEntry, objectPrefix string) ([]UploadedFile, error) {
-	if u.Bucket == "" {
-		return nil, fmt.Errorf("bucket not configured")
-	}
-	if u.client == nil && u.fileUploadHook == nil {
-		return nil, fmt.Errorf("uploader client not initialized")
-	}
-	if len(entries) == 0 {
-		return []UploadedFile{}, nil
+	m := scanner.Match{FolderEntries: entries}
+	meta, _, _, _, err := u.uploadEntries(m.Entries(), UploadOptions{Prefix: objectPrefix})
+	if err != nil {
+		return nil, err
 	}
+	return meta, nil
+}
 
-	var bucket *storage.BucketHandle
-	if u.fileUploadHook == nil {
-		bucket = u.client.Bucket(u.Bucket)
+////////////////////////////////////////////////////////////////////////////////
+
+// uploadEntries performs the actual upload of the given entries. Entries are
+// consumed as workers become free, so streamed entries are never held in
+// memory all at once. It returns the metadata of uploaded files (sorted by
+// object path), the names of entries that were skipped or failed and the
+// number of upload retries (see UploadOptions.FileRetry). A failed file
+// doesn't stop the others, so the metadata of the files that succeeded is
+// returned alongside the (joined) error.
+func (u *GCSUploader) uploadEntries(entries iter.Seq2[scanner.FileEntry, error], opts UploadOptions) ([]UploadedFile, []string, []string, int, error) {
+	if u.Bucket == "" {
+		return nil, nil, nil, 0, fmt.Errorf("bucket not configured")
+	}
+	if u.store == nil {
+		return nil, nil, nil, 0, fmt.Errorf("uploader client not initialized")
 	}
 
 	// NOTE(joel): Build a cached prefix getter (avoids repeated string ops
 	// per entry).
-	getPrefix := makePrefixGetter(objectPrefix)
+	getPrefix := MakePrefixGetter(opts.Prefix, opts.FolderName, opts.Version)
 
 	var mu sync.Mutex
-	meta := make([]UploadedFile, 0, len(entries))
-	tasks := make([]app.Task, 0, len(entries))
-	for _, fe := range entries {
-		name := fe.Name
-		localPath := fe.Path
-		// NOTE(joel): Guard against empty paths. This should not happen in
-		// practice since we control the FileEntry creation, but be defensive.
-		if localPath == "" {
-			continue
-		}
+	var skipped, failed []string
+	var fileErrs []error
+	var retries int
+	meta := []UploadedFile{}
 
-		fi, err := os.Lstat(localPath)
-		// NOTE(joel): Skip missing files, symlinks, directories and *.RDY files.
-		// We don't want to fail the entire upload in this case.
-		if err != nil || fi.Mode()&os.ModeSymlink != 0 || fi.IsDir() || strings.HasSuffix(strings.ToUpper(name), ".RDY") {
-			continue
-		}
+	// NOTE(joel): With DedupeHardlinks only the first entry of a set of hard
+	// links is uploaded; the others are recorded as links to it afterwards.
+	type hardlink struct {
+		name, primary string
+		size          int64
+	}
+	var links []hardlink
+	primaries := make(map[[2]uint64]string)
 
-		// NOTE(joel): Calculate (and cache) prefix per entry.
-		dir := filepath.Dir(localPath)
-		prefix := getPrefix(dir)
+	// NOTE(joel): With SkipExisting each destination prefix is listed once
+	// (a single Objects call instead of a stat per file); the listing maps
+	// object names to their recorded SHA256.
+	remote := make(map[string]map[string]remoteObject)
 
-		objectName := prefix + "/" + filepath.ToSlash(name)
+	// NOTE(joel): With BundleSmallFiles, small files are collected and
+	// uploaded together as one tar object once the bundle is full (or all
+	// entries were read). A failed bundle fails all of its files.
+	var bundle []bundleFile
+	var bundleBytes int64
+	bundleTask := func(files []bundleFile) app.Task {
+		label := fmt.Sprintf("bundle of %d file(s) from %s", len(files), files[0].name)
+		return app.Labeled(label, func(ctx context.Context) error {
+			var ufs []UploadedFile
+			attempts := 0
+			err := opts.FileRetry.Do(ctx, func() (err error) {
+				attempts++
+				ufs, err = u.uploadBundle(ctx, files, opts)
+				return err
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			retries += attempts - 1
+			if err != nil {
+				for _, f := range files {
+					failed = append(failed, f.name)
+				}
+				fileErrs = append(fileErrs, err)
+				return fileFailed(opts)
+			}
+			meta = append(meta, ufs...)
+			return nil
+		})
+	}
 
-		tasks = append(tasks, func(ctx context.Context) error {
-			// NOTE(joel): Pre-upload metadata.
-			size := fi.Size()
-			checksum, err := getChecksum(localPath)
+	// NOTE(joel): Tasks are built from entries on demand (on the goroutine
+	// calling RunTiered), so only bookkeeping below is shared with workers.
+	var listErr error
+	tasks := func(yield func(app.Task, bool) bool) {
+		for fe, err := range entries {
 			if err != nil {
-				return err
+				listErr = fmt.Errorf("list entries: %w", err)
+				return
+			}
+			name := fe.Name
+			localPath := fe.Path
+			strict := opts.StrictSnapshot && fe.Regular()
+			if strict {
+				if err := snapshotChanged(fe); err != nil {
+					mu.Lock()
+					failed = append(failed, name)
+					fileErrs = append(fileErrs, fmt.Errorf("upload %s: %w", name, err))
+					mu.Unlock()
+					if opts.CancelOnFileFailure {
+						return
+					}
+					continue
+				}
+			}
+			// NOTE(joel): Skip missing files, symlinks, directories and *.RDY files.
+			// We don't want to fail the entire upload in this case.
+			fi, ok := Uploadable(fe, opts.FollowSymlinks)
+			if !ok {
+				skipped = append(skipped, name)
+				continue
+			}
+			if opts.DedupeHardlinks {
+				if id, ok := fileID(fi); ok {
+					if primary, seen := primaries[id]; seen {
+						links = append(links, hardlink{name: name, primary: primary, size: fi.Size()})
+						continue
+					}
+					primaries[id] = name
+				}
 			}
+			// NOTE(joel): Calculate (and cache) prefix per entry.
+			dir := filepath.Dir(localPath)
+			prefix := getPrefix(dir)
 
-			// NOTE(joel): Perform upload.
-			if u.fileUploadHook != nil {
-				u.hookMu.Lock()
-				err := u.fileUploadHook(localPath, objectName)
-				u.hookMu.Unlock()
-				return err
-			} else {
-				if bucket == nil {
-					return fmt.Errorf("nil bucket for real upload")
+			objectName := ObjectName(prefix, name, opts)
+			if done, ok := DoneFile(name, objectName, fi, opts); ok {
+				mu.Lock()
+				meta = append(meta, done)
+				mu.Unlock()
+				continue
+			}
+			compress := opts.CompressSparse && isSparse(fi)
+
+			if opts.BundleSmallFiles > 0 && fi.Size() < opts.BundleSmallFiles && !compress {
+				bundle = append(bundle, bundleFile{name: name, path: localPath, prefix: prefix, fi: fi})
+				bundleBytes += fi.Size()
+				if bundleBytes >= bundleMaxBytes || len(bundle) >= bundleMaxFiles {
+					if !yield(bundleTask(bundle), false) {
+						return
+					}
+					bundle, bundleBytes = nil, 0
+				}
+				continue
+			}
+
+			var existing map[string]remoteObject
+			if opts.SkipExisting {
+				if _, ok := remote[prefix]; !ok {
+					objs, err := u.listPrefix(prefix + "/")
+					if err != nil {
+						listErr = err
+						return
+					}
+					remote[prefix] = objs
+				}
+				existing = remote[prefix]
+			}
+
+			upload := func(ctx context.Context) (UploadedFile, error) {
+				// NOTE(joel): Pre-upload metadata.
+				fileStart := time.Now()
+				uf := UploadedFile{Name: name, Size: fi.Size(), Path: objectName, ModTime: fi.ModTime()}
+				checksum, err := getChecksum(ctx, localPath, opts.NiceIO)
+				if err != nil {
+					return uf, err
+				}
+				uf.Checksum = checksum
+				if obj, ok := existing[objectName]; ok && obj.checksum == checksum {
+					uf.Duration = time.Since(fileStart)
+					uf.Existing = true
+					uf.Generation, uf.Metageneration = obj.generation, obj.metageneration
+					return uf, nil
+				}
+
+				// NOTE(joel): Perform upload.
+				if err := u.faults.maybeFail("upload " + objectName); err != nil {
+					return uf, err
+				}
+				metadata := map[string]string{MetadataSHA256: checksum}
+				maps.Copy(metadata, fileMetadata(fi, opts.FileOwnership))
+				maps.Copy(metadata, opts.Metadata)
+				put := protect(PutOptions{Metadata: metadata, CreateOnly: opts.CreateOnly, PredefinedACL: opts.ObjectACLs.For(name)}, opts)
+				attrs, err := uploadObject(ctx, u.store, localPath, objectName, put, opts.ContentTypes, compress, opts.NiceIO)
+				uf.Duration = time.Since(fileStart)
+				if errors.Is(err, ErrObjectExists) && opts.SkipConflicts {
+					// NOTE(joel): The object of the other writer is kept and recorded
+					// as is.
+					uf.Existing = true
+					if attrs.Name != "" {
+						uf.Checksum = attrs.Metadata[MetadataSHA256]
+						uf.ContentEncoding = attrs.ContentEncoding
+						uf.Generation, uf.Metageneration = attrs.Generation, attrs.Metageneration
+					}
+					return uf, nil
+				}
+				if err != nil {
+					return uf, err
+				}
+				// NOTE(joel): A file written to during the upload may not match
+				// its checksum, which was calculated before.
+				if strict {
+					if err := snapshotChanged(fe); err != nil {
+						return uf, fmt.Errorf("during upload: %w", err)
+					}
+				}
+				uf.Generation, uf.Metageneration = attrs.Generation, attrs.Metageneration
+				uf.Hold, uf.RetainUntil = opts.Hold, attrs.RetainUntil
+				if compress {
+					uf.ContentEncoding = "gzip"
 				}
-				if err := uploadObject(ctx, bucket, localPath, objectName); err != nil {
+				// NOTE(joel): A mismatch fails the attempt, so the file is
+				// uploaded again with FileRetry.
+				if ReadBackSampled(objectName, opts.ReadBack) {
+					if err := u.readBack(ctx, localPath, objectName, uf.Generation, opts.NiceIO); err != nil {
+						return uf, err
+					}
+					uf.Verified = true
+				}
+				return uf, nil
+			}
+
+			// NOTE(joel): Unless CancelOnFileFailure is set, a failed file doesn't
+			// stop the others; failures are collected so the folder can be
+			// completed on a later run.
+			task := func(ctx context.Context) error {
+				var uf UploadedFile
+				attempts := 0
+				err := opts.FileRetry.Do(ctx, func() (err error) {
+					attempts++
+					uf, err = upload(ctx)
 					return err
+				})
+				mu.Lock()
+				defer mu.Unlock()
+				retries += attempts - 1
+				if err != nil {
+					failed = append(failed, name)
+					fileErrs = append(fileErrs, fmt.Errorf("upload %s: %w", name, err))
+					return fileFailed(opts)
 				}
+				meta = append(meta, uf)
+				return nil
+			}
+			large := u.LargeFileThreshold > 0 && fi.Size() >= u.LargeFileThreshold
+			if !yield(app.Labeled(name, task), large) {
+				return
+			}
+		}
+		if len(bundle) > 0 {
+			yield(bundleTask(bundle), false)
+		}
+	}
+	largeWorkers := 0
+	if u.LargeFileThreshold > 0 {
+		largeWorkers = max(app.EffectiveConcurrency(u.Concurrency)/4, 1)
+	}
+	ctx := u.ctx
+	if opts.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Deadline)
+		defer cancel()
+	}
+	if err := app.RunTiered(ctx, u.Concurrency, largeWorkers, tasks); err != nil {
+		if !errors.Is(err, errFolderCanceled) {
+			return nil, skipped, nil, 0, err
+		}
+		fileErrs = append(fileErrs, err)
+	}
+	// NOTE(joel): The pool stops handing out files once the deadline passed
+	// without reporting it; files not started yet are neither uploaded nor
+	// failed, so the folder fails as a whole.
+	if opts.Deadline > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		fileErrs = append(fileErrs, fmt.Errorf("%w (%s)", ErrFolderDeadline, opts.Deadline))
+	}
+	if listErr != nil {
+		return nil, skipped, nil, 0, listErr
+	}
+	// NOTE(joel): Record hard links with the object of their primary entry.
+	// Links of a failed primary fail with it.
+	if len(links) > 0 {
+		byName := make(map[string]UploadedFile, len(meta))
+		for _, f := range meta {
+			byName[f.Name] = f
+		}
+		for _, l := range links {
+			p, ok := byName[l.primary]
+			if !ok {
+				failed = append(failed, l.name)
+				continue
 			}
+			meta = append(meta, UploadedFile{
+				Name:            l.name,
+				Size:            l.size,
+				Checksum:        p.Checksum,
+				Path:            p.Path,
+				ContentEncoding: p.ContentEncoding,
+				LinkOf:          l.primary,
+			})
+		}
+	}
+	// NOTE(joel): Tasks finish in arbitrary order; sort for stable records.
+	// Hard links share the path of their primary, so break ties by name.
+	sort.Slice(meta, func(i, j int) bool {
+		if meta[i].Path != meta[j].Path {
+			return meta[i].Path < meta[j].Path
+		}
+		return meta[i].Name < meta[j].Name
+	})
+	sort.Strings(failed)
+	return meta, skipped, failed, retries, errors.Join(fileErrs...)
+}
 
-			// NOTE(joel): Record metadata.
-			mu.Lock()
-			meta = append(meta, UploadedFile{Name: name, Size: size, Checksum: checksum, Path: objectName})
-			mu.Unlock()
-			return nil
-		})
+////////////////////////////////////////////////////////////////////////////////
+
+// ErrObjectExists is returned for create-only uploads (see
+// UploadOptions.CreateOnly) of objects that already exist, e.g. uploaded by
+// another agent.
+var ErrObjectExists = errors.New("object already exists")
+
+// ErrSnapshotChanged is returned for files that changed since they were
+// listed (see UploadOptions.StrictSnapshot).
+var ErrSnapshotChanged = errors.New("file changed since scan")
+
+// ErrFolderDeadline is returned for folders whose upload didn't finish within
+// UploadOptions.Deadline.
+var ErrFolderDeadline = errors.New("folder deadline exceeded")
+
+////////////////////////////////////////////////////////////////////////////////
+
+// snapshotChanged returns an error wrapping ErrSnapshotChanged if the regular
+// file fe vanished, isn't a regular file anymore or its size or modification
+// time differ from the listing.
+func snapshotChanged(fe scanner.FileEntry) error {
+	fi, err := os.Lstat(fe.Path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("%w: vanished", ErrSnapshotChanged)
+	case err != nil:
+		return err
+	case !fi.Mode().IsRegular():
+		return fmt.Errorf("%w: no longer a regular file", ErrSnapshotChanged)
+	case fi.Size() != fe.Size || !fi.ModTime().Equal(fe.ModTime):
+		return fmt.Errorf("%w: size or modification time changed", ErrSnapshotChanged)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// errFolderCanceled is returned by a failed file task with
+// UploadOptions.CancelOnFileFailure to stop the folder's remaining uploads.
+var errFolderCanceled = errors.New("remaining files canceled after a failed file")
+
+// fileFailed returns the error a failed file task returns to the worker pool:
+// errFolderCanceled with CancelOnFileFailure, nil otherwise.
+func fileFailed(opts UploadOptions) error {
+	if opts.CancelOnFileFailure {
+		return errFolderCanceled
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NOTE(joel): Bundles are closed once they reach either limit, so a single
+// bundle upload stays well within the per-object timeout.
+const (
+	bundleMaxBytes = 32 << 20
+	bundleMaxFiles = 1000
+)
+
+// bundleFile is a small file waiting to be added to a bundle.
+type bundleFile struct {
+	name, path, prefix string
+	fi                 os.FileInfo
+}
+
+// uploadBundle writes files into a tar archive in a temporary file and uploads
+// it as `<prefix>/.lfs-bundle-<hash>.tar`, named after the first 16 hex digits
+// of the archive's SHA256 so bundles of different runs (e.g. resuming a
+// partial upload) never overwrite each other. Members are named after the
+// files. It returns the metadata of the bundled files; their Path is the
+// bundle object.
+func (u *GCSUploader) uploadBundle(ctx context.Context, files []bundleFile, opts UploadOptions) ([]UploadedFile, error) {
+	start := time.Now()
+	tmp, err := os.CreateTemp("", "lfs-bundle-*.tar")
+	if err != nil {
+		return nil, fmt.Errorf("create bundle: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sum := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(tmp, sum))
+	ufs := make([]UploadedFile, 0, len(files))
+	for _, f := range files {
+		checksum, err := addToBundle(ctx, tw, f, opts.NiceIO)
+		if err != nil {
+			return nil, fmt.Errorf("bundle %s: %w", f.name, err)
+		}
+		ufs = append(ufs, UploadedFile{Name: f.name, Size: f.fi.Size(), Checksum: checksum, ModTime: f.fi.ModTime(), Bundled: true})
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("write bundle: %w", err)
+	}
+	checksum := fmt.Sprintf("%x", sum.Sum(nil))
+	objectName := files[0].prefix + "/.lfs-bundle-" + checksum[:16] + ".tar"
+	if opts.NormalizeUnicode {
+		objectName = norm.NFC.String(objectName)
+	}
+
+	if err := u.faults.maybeFail("upload " + objectName); err != nil {
+		return nil, fmt.Errorf("upload bundle %s: %w", objectName, err)
+	}
+	metadata := map[string]string{MetadataSHA256: checksum, MetadataBundle: "tar"}
+	maps.Copy(metadata, opts.Metadata)
+	put := protect(PutOptions{Metadata: metadata, CreateOnly: opts.CreateOnly, PredefinedACL: opts.ObjectACLs.For(path.Base(objectName))}, opts)
+	attrs, err := uploadObject(ctx, u.store, tmp.Name(), objectName, put, opts.ContentTypes, false, nil)
+	// NOTE(joel): Bundles are named by their content hash, so an existing
+	// bundle object holds the same files.
+	existing := errors.Is(err, ErrObjectExists) && opts.SkipConflicts
+	if err != nil && !existing {
+		return nil, fmt.Errorf("upload bundle %s: %w", objectName, err)
+	}
+	// NOTE(joel): The bundle is compared with the local archive, whose
+	// members were checksummed while reading the files.
+	verified := !existing && ReadBackSampled(objectName, opts.ReadBack)
+	if verified {
+		if err := u.readBack(ctx, tmp.Name(), objectName, attrs.Generation, nil); err != nil {
+			return nil, fmt.Errorf("upload bundle %s: %w", objectName, err)
+		}
+	}
+
+	// NOTE(joel): The upload time is shared evenly for run statistics.
+	d := time.Since(start) / time.Duration(len(ufs))
+	for i := range ufs {
+		ufs[i].Path = objectName
+		ufs[i].Duration = d
+		ufs[i].Existing = existing
+		ufs[i].Verified = verified
+		if !existing {
+			ufs[i].Hold, ufs[i].RetainUntil = opts.Hold, attrs.RetainUntil
+		}
+		ufs[i].Generation, ufs[i].Metageneration = attrs.Generation, attrs.Metageneration
+	}
+	return ufs, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// protect adds the hold and retention of opts to the options of an object
+// written now.
+func protect(put PutOptions, opts UploadOptions) PutOptions {
+	put.TemporaryHold = opts.Hold == app.HoldTemporary
+	put.EventBasedHold = opts.Hold == app.HoldEventBased
+	if opts.Retention.Period > 0 {
+		put.RetainUntil = time.Now().Add(opts.Retention.Period)
+		put.RetentionLocked = opts.Retention.Locked
+	}
+	return put
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// addToBundle appends a file, read paced by nice, to a tar archive and
+// returns the SHA256 of its content. Files that changed size since they were
+// listed fail.
+func addToBundle(ctx context.Context, tw *tar.Writer, f bundleFile, nice *NiceIO) (string, error) {
+	r, err := openLocal(ctx, f.path, nice)
+	if err != nil {
+		return "", fmt.Errorf("open file: %w", err)
+	}
+	defer r.Close()
+
+	hdr := &tar.Header{
+		Name:    f.name,
+		Mode:    int64(f.fi.Mode().Perm()),
+		Size:    f.fi.Size(),
+		ModTime: f.fi.ModTime(),
+		Format:  tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tw, h), r)
+	if err != nil {
+		return "", err
+	}
+	if n != hdr.Size {
+		return "", fmt.Errorf("size changed from %d to %d bytes", hdr.Size, n)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// uploadMarker uploads an empty EmptyMarkerName object into the prefix of
+// folder and returns its metadata.
+func (u *GCSUploader) uploadMarker(folder string, opts UploadOptions) (UploadedFile, error) {
+	objectName := ObjectName(MakePrefixGetter(opts.Prefix, opts.FolderName, opts.Version)(folder), EmptyMarkerName, opts)
+	uf := UploadedFile{
+		Name:     EmptyMarkerName,
+		Path:     objectName,
+		Checksum: fmt.Sprintf("%x", sha256.Sum256(nil)),
+	}
+	if u.store == nil {
+		return uf, fmt.Errorf("uploader client not initialized")
 	}
-	if len(tasks) == 0 {
-		return []UploadedFile{}, nil
+	ctx, cancel := context.WithTimeout(u.ctx, 2*time.Minute)
+	defer cancel()
+	metadata := map[string]string{MetadataSHA256: uf.Checksum}
+	maps.Copy(metadata, opts.Metadata)
+	attrs, err := u.store.Put(ctx, objectName, strings.NewReader(""), protect(PutOptions{
+		ContentType:   "application/octet-stream",
+		Metadata:      metadata,
+		CreateOnly:    opts.CreateOnly,
+		PredefinedACL: opts.ObjectACLs.For(EmptyMarkerName),
+	}, opts))
+	if err != nil {
+		// NOTE(joel): All markers are empty, so an existing one is as good.
+		if errors.Is(err, ErrObjectExists) && opts.SkipConflicts {
+			uf.Existing = true
+			return uf, nil
+		}
+		return uf, fmt.Errorf("upload empty marker %s: %w", objectName, err)
 	}
-	if err := app.RunParallel(u.ctx, u.Concurrency, tasks); err != nil {
+	uf.Generation, uf.Metageneration = attrs.Generation, attrs.Metageneration
+	uf.Hold, uf.RetainUntil = opts.Hold, attrs.RetainUntil
+	return uf, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ListObjects implements Lister.
+func (u *GCSUploader) ListObjects(prefix string) (map[string]string, error) {
+	objs, err := u.listPrefix(prefix)
+	if err != nil {
 		return nil, err
 	}
-	return meta, nil
+	sums := make(map[string]string, len(objs))
+	for name, obj := range objs {
+		sums[name] = obj.checksum
+	}
+	return sums, nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// uploadObject uploads a single file to GCS as the given object name.
-// It uses a per-file timeout derived from the provided context.
-func uploadObject(ctx context.Context, bucket *storage.BucketHandle, localPath, objectName string) error {
-	f, err := os.Open(localPath)
+// remoteObject is an existing object found by listPrefix.
+type remoteObject struct {
+	checksum       string
+	generation     int64
+	metageneration int64
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// listPrefix lists all objects below prefix with a single List call and
+// returns the MetadataSHA256 and version of each object by name. Objects
+// without MetadataSHA256 have an empty checksum.
+func (u *GCSUploader) listPrefix(prefix string) (map[string]remoteObject, error) {
+	if u.store == nil {
+		return nil, fmt.Errorf("uploader client not initialized")
+	}
+	ctx, cancel := context.WithTimeout(u.ctx, 2*time.Minute)
+	defer cancel()
+	list, err := u.store.List(ctx, prefix)
 	if err != nil {
-		return fmt.Errorf("open file: %w", err)
+		return nil, fmt.Errorf("list %s: %w", prefix, err)
+	}
+	objs := make(map[string]remoteObject, len(list))
+	for _, attrs := range list {
+		objs[attrs.Name] = remoteObject{
+			checksum:       attrs.Metadata[MetadataSHA256],
+			generation:     attrs.Generation,
+			metageneration: attrs.Metageneration,
+		}
+	}
+	return objs, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// uploadObject uploads a single file to store as the given object name with
+// the metadata, ACL and precondition of opts and a content type by
+// contentType. If compress is set, the content is stored gzip compressed with
+// `Content-Encoding: gzip` (GCS transparently decompresses it on download).
+// With opts.CreateOnly, the upload fails with ErrObjectExists (and the
+// attributes of the existing object, if known) if the object already exists.
+// It uses a per-file timeout derived from the provided context and returns the
+// attributes of the written object. The file is read paced by nice, if set;
+// the timeout is extended by the time pacing takes.
+func uploadObject(ctx context.Context, store Storage, localPath, objectName string, opts PutOptions, contentTypes map[string]string, compress bool, nice *NiceIO) (ObjectAttrs, error) {
+	if store == nil {
+		return ObjectAttrs{}, fmt.Errorf("uploader client not initialized")
+	}
+	f, err := openLocal(ctx, localPath, nice)
+	if err != nil {
+		return ObjectAttrs{}, fmt.Errorf("open file: %w", err)
 	}
 	defer f.Close()
 
-	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	timeout := 2 * time.Minute
+	if fi, err := f.Stat(); err == nil {
+		timeout += nice.readTime(fi.Size())
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
+	f.ctx = ctx
 
-	obj := bucket.Object(objectName)
-	w := obj.NewWriter(ctx)
-
-	w.ContentType = detectContentType(localPath)
-	if _, err := io.Copy(w, f); err != nil {
-		return fmt.Errorf("copy to gcs %s: %w", objectName, err)
+	if opts.ContentType, err = contentType(f, localPath, contentTypes); err != nil {
+		return ObjectAttrs{}, err
 	}
-	if err := w.Close(); err != nil {
-		return fmt.Errorf("finalize object %s: %w", objectName, err)
+	var r io.Reader = f
+	if compress {
+		// NOTE(joel): Compress while streaming; closing the read end stops the
+		// compressor if Put returns early.
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			zw := gzip.NewWriter(pw)
+			_, err := io.Copy(zw, f)
+			if err == nil {
+				err = zw.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		r = pr
+		opts.ContentEncoding = "gzip"
 	}
-	return nil
+	return store.Put(ctx, objectName, r, opts)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// makePrefixGetter returns a closure that caches computed object prefixes for
+// MakePrefixGetter returns a closure that caches computed object prefixes for
 // directories. Given a base objectPrefix (possibly empty) and a directory path
 // d, it produces:
 //
 //	`objectPrefix/<basename(d)>`
 //
-// or just `<basename(d)>` if objectPrefix is empty. Results are memoized per
-// directory string.
-func makePrefixGetter(objectPrefix string) func(string) string {
+// or just `<basename(d)>` if objectPrefix is empty. If folderName is set it
+// replaces `<basename(d)>` (e.g. a normalized folder name); a version is
+// appended as `<basename(d)>/<version>`. Results are memoized per directory
+// string.
+func MakePrefixGetter(objectPrefix, folderName, version string) func(string) string {
 	cache := make(map[string]string, 1)
 	return func(dir string) string {
 		if p, ok := cache[dir]; ok {
 			return p
 		}
 		base := filepath.Base(dir)
+		if folderName != "" {
+			base = folderName
+		}
+		if version != "" {
+			base += "/" + version
+		}
 		if objectPrefix != "" {
 			p := strings.TrimSuffix(objectPrefix, "/") + "/" + base
 			cache[dir] = p
@@ -214,6 +901,52 @@ func makePrefixGetter(objectPrefix string) func(string) string {
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// fileMetadata returns the custom object metadata describing the file fi: its
+// modification time and, if ownership is set, its permission bits and owner.
+func fileMetadata(fi os.FileInfo, ownership bool) map[string]string {
+	md := map[string]string{MetadataModTime: fi.ModTime().UTC().Format(time.RFC3339Nano)}
+	if !ownership {
+		return md
+	}
+	md[MetadataMode] = fmt.Sprintf("%04o", fi.Mode().Perm())
+	if uid, gid, ok := fileOwner(fi); ok {
+		md[MetadataUID] = strconv.FormatUint(uint64(uid), 10)
+		md[MetadataGID] = strconv.FormatUint(uint64(gid), 10)
+	}
+	return md
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// contentType returns the content type of the file f at path: the one mapped
+// to its extension in types, else the built-in one of detectContentType, else
+// the one sniffed from its first 512 bytes by http.DetectContentType. f is
+// rewound after sniffing.
+func contentType(f io.ReadSeeker, path string, types map[string]string) (string, error) {
+	if t, ok := types[strings.ToLower(filepath.Ext(path))]; ok {
+		return t, nil
+	}
+	if t := detectContentType(path); t != "application/octet-stream" {
+		return t, nil
+	}
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("sniff content type: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("sniff content type: %w", err)
+	}
+	// NOTE(joel): Empty files have nothing to sniff; DetectContentType would
+	// call them text.
+	if n == 0 {
+		return "application/octet-stream", nil
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 // detectContentType is a minimal heuristic; extend as needed.
 func detectContentType(path string) string {
 	lower := strings.ToLower(filepath.Ext(path))
@@ -281,13 +1014,15 @@ func detectContentType(path string) string {
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// getChecksum computes the SHA256 checksum of the given file and returns it
-// as a hex string.
-func getChecksum(path string) (string, error) {
-	f, err := os.Open(path)
+// getChecksum computes the SHA256 checksum of the given file, read paced by
+// nice (which may be nil), and returns it as a hex string.
+func getChecksum(ctx context.Context, path string, nice *NiceIO) (string, error) {
+	f, err := openLocal(ctx, path, nice)
 	if err != nil {
 		return "", fmt.Errorf("checksum open file: %w", err)
 	}
+	// NOTE(joel): The file is usually uploaded right after; keep it cached.
+	f.keepCached = true
 	defer f.Close()
 
 	h := sha256.New()
@@ -1,15 +1,29 @@
 package uploader
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"local-file-sync/internal/app"
 	"local-file-sync/internal/scanner"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
 )
 
 // Helper functions to satisfy errcheck and reduce repetition
@@ -38,16 +52,107 @@ func mustSymlink(t *testing.T, oldname, newname string) {
 	}
 }
 
+// testStore is an in-memory Storage. put and list, if set, are called before
+// writing and instead of listing, e.g. to inject failures. The next
+// corrupt[name] reads of an object return it with its first byte flipped.
+type testStore struct {
+	mu      sync.Mutex
+	objects map[string]ObjectAttrs
+	content map[string][]byte
+	// types holds the content type of the written objects by name.
+	types map[string]string
+	// acls holds the predefined ACL of the written objects by name.
+	acls map[string]string
+	// holds holds the holds of the written objects by name.
+	holds map[string][2]bool
+	// names holds the names of the written objects in order.
+	names   []string
+	put     func(name string, content []byte) error
+	list    func(prefix string) ([]ObjectAttrs, error)
+	corrupt map[string]int
+}
+
+func newTestStore() *testStore {
+	return &testStore{objects: map[string]ObjectAttrs{}, content: map[string][]byte{}, types: map[string]string{}, acls: map[string]string{}, holds: map[string][2]bool{}, names: []string{}}
+}
+
+func (s *testStore) Put(_ context.Context, name string, r io.Reader, opts PutOptions) (ObjectAttrs, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return ObjectAttrs{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.put != nil {
+		if err := s.put(name, b); err != nil {
+			return ObjectAttrs{}, err
+		}
+	}
+	if existing, ok := s.objects[name]; ok && opts.CreateOnly {
+		return existing, ErrObjectExists
+	}
+	attrs := ObjectAttrs{
+		Name:            name,
+		Metadata:        opts.Metadata,
+		ContentEncoding: opts.ContentEncoding,
+		Generation:      int64(len(s.names) + 1),
+		Metageneration:  1,
+		RetainUntil:     opts.RetainUntil,
+	}
+	s.objects[name] = attrs
+	s.holds[name] = [2]bool{opts.TemporaryHold, opts.EventBasedHold}
+	s.content[name] = b
+	s.types[name] = opts.ContentType
+	s.acls[name] = opts.PredefinedACL
+	s.names = append(s.names, name)
+	return attrs, nil
+}
+
+func (s *testStore) List(_ context.Context, prefix string) ([]ObjectAttrs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.list != nil {
+		return s.list(prefix)
+	}
+	var objs []ObjectAttrs
+	for name, attrs := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			objs = append(objs, attrs)
+		}
+	}
+	return objs, nil
+}
+
+func (s *testStore) Get(_ context.Context, name string, generation int64) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attrs, ok := s.objects[name]
+	if !ok || (generation > 0 && generation != attrs.Generation) {
+		return nil, fmt.Errorf("object %s not found", name)
+	}
+	b := bytes.Clone(s.content[name])
+	if s.corrupt[name] > 0 && len(b) > 0 {
+		s.corrupt[name]--
+		b[0] ^= 0xff
+	}
+	if attrs.ContentEncoding == "gzip" {
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return zr, nil
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *testStore) Close() error { return nil }
+
 // Consolidated uploader tests
 func newTestUploader(t *testing.T) (*GCSUploader, *[]string) {
 	t.Helper()
-	uploaded := []string{}
-	u := &GCSUploader{Bucket: "test-bucket", ctx: context.Background()}
-	u.fileUploadHook = func(_, objectName string) error {
-		uploaded = append(uploaded, objectName)
-		return nil
-	}
-	return u, &uploaded
+	store := newTestStore()
+	u := NewStorageUploader(context.Background(), "test-bucket", store, 0)
+	return u, &store.names
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -172,12 +277,53 @@ func TestDetectContentType(t *testing.T) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// TestUploadObject_ContentType verifies mapped extensions win over the
+// built-in types, unknown extensions are sniffed, and the sniffed content is
+// uploaded in full.
+func TestUploadObject_ContentType(t *testing.T) {
+	dir := t.TempDir()
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("x", 600)
+	files := map[string]string{
+		"scan.dat":   png,
+		"notes":      "plain text",
+		"empty.bin":  "",
+		"study.dcm":  "DICM",
+		"report.pdf": "not really a pdf",
+	}
+	types := map[string]string{".dcm": "application/dicom", ".pdf": "application/x-custom"}
+	want := map[string]string{
+		"scan.dat":   "image/png",
+		"notes":      "text/plain; charset=utf-8",
+		"empty.bin":  "application/octet-stream",
+		"study.dcm":  "application/dicom",
+		"report.pdf": "application/x-custom",
+	}
+	store := newTestStore()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, err := uploadObject(context.Background(), store, p, name, PutOptions{}, types, false, nil); err != nil {
+			t.Fatalf("upload %s: %v", name, err)
+		}
+		if got := store.types[name]; got != want[name] {
+			t.Errorf("%s: expected %s, got %s", name, want[name], got)
+		}
+		if got := string(store.content[name]); got != content {
+			t.Errorf("%s: expected content of %d bytes, got %d", name, len(content), len(got))
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 // TestMakePrefixGetter verifies prefix generation and caching.
 func TestMakePrefixGetter(t *testing.T) {
 	dir := t.TempDir()
 	sub := filepath.Join(dir, "sub")
 	mustMkdir(t, sub)
-	g := makePrefixGetter("parent")
+	g := MakePrefixGetter("parent", "", "")
 	p1 := g(sub)
 	p2 := g(sub)
 	if p1 != p2 {
@@ -186,10 +332,18 @@ func TestMakePrefixGetter(t *testing.T) {
 	if want := "parent/" + filepath.Base(sub); p1 != want {
 		t.Fatalf("unexpected %s", p1)
 	}
-	g2 := makePrefixGetter("")
+	g2 := MakePrefixGetter("", "", "")
 	if got := g2(sub); got != filepath.Base(sub) {
 		t.Fatalf("want base got %s", got)
 	}
+	g3 := MakePrefixGetter("parent/", "RENAMED", "")
+	if got := g3(sub); got != "parent/RENAMED" {
+		t.Fatalf("want folder name override got %s", got)
+	}
+	g4 := MakePrefixGetter("parent", "", "v2")
+	if got := g4(sub); got != "parent/sub/v2" {
+		t.Fatalf("want version below folder got %s", got)
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -237,8 +391,8 @@ func TestUploadListedEntries_NoBucketError(t *testing.T) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// TestUploadListedEntries_NoClientNoHook verifies error when no client or hook.
-func TestUploadListedEntries_NoClientNoHook(t *testing.T) {
+// TestUploadListedEntries_NoStorage verifies error when no storage is set.
+func TestUploadListedEntries_NoStorage(t *testing.T) {
 	u := &GCSUploader{Bucket: "b"}
 	entries := []scanner.FileEntry{{Name: "a.txt", Path: "/nonexistent"}}
 	if _, err := u.UploadListedEntries(entries, "p"); err == nil {
@@ -286,14 +440,15 @@ func TestUploadListedEntries_MissingFileIgnores(t *testing.T) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// TestUploadListedEntries_HookError verifies error from hook is propagated.
-func TestUploadListedEntries_HookError(t *testing.T) {
+// TestUploadListedEntries_StorageError verifies errors of the storage are
+// propagated.
+func TestUploadListedEntries_StorageError(t *testing.T) {
 	dir := t.TempDir()
 	p := filepath.Join(dir, "a.txt")
 	mustWrite(t, p, []byte("x"))
-	u := &GCSUploader{Bucket: "b", ctx: context.Background()}
+	u, _ := newTestUploader(t)
 	sentinel := errors.New("boom")
-	u.fileUploadHook = func(_, _ string) error { return sentinel }
+	u.store.(*testStore).put = func(string, []byte) error { return sentinel }
 	entries := []scanner.FileEntry{{Name: "a.txt", Path: p}}
 	if _, err := u.UploadListedEntries(entries, ""); !errors.Is(err, sentinel) {
 		t.Fatalf("expected sentinel error")
@@ -352,10 +507,776 @@ func TestUploadListedEntries_EmptyEntries(t *testing.T) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// TestUploader_CloseNil verifies Close is no-op when client is nil.
+// TestUploader_CloseNil verifies Close is no-op without storage.
 func TestUploader_CloseNil(t *testing.T) {
 	u := &GCSUploader{Bucket: "b"}
 	if err := u.Close(); err != nil {
 		t.Fatalf("close: %v", err)
 	}
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_Result verifies the FolderResult reports uploaded files in
+// sorted order along with skipped entries.
+func TestUploadFolder_Result(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(t, filepath.Join(dir, "b.txt"), []byte("bb"))
+	mustWrite(t, filepath.Join(dir, "a.txt"), []byte("a"))
+	mustWrite(t, filepath.Join(dir, "ORDER1.RDY"), []byte(""))
+	u, _ := newTestUploader(t)
+	m := scanner.Match{
+		ReadyFile: filepath.Join(filepath.Dir(dir), "ORDER1.RDY"),
+		Folder:    dir,
+		FolderEntries: []scanner.FileEntry{
+			{Name: "b.txt", Path: filepath.Join(dir, "b.txt")},
+			{Name: "a.txt", Path: filepath.Join(dir, "a.txt")},
+			{Name: "ORDER1.RDY", Path: filepath.Join(dir, "ORDER1.RDY")},
+		},
+	}
+	res := u.UploadFolder(m, UploadOptions{})
+	if res.Failed() {
+		t.Fatalf("unexpected failure: %v", res.Err())
+	}
+	if res.Folder != dir || res.ReadyFile != m.ReadyFile {
+		t.Fatalf("result not attributed to match: %+v", res)
+	}
+	if len(res.Uploaded) != 2 || res.Uploaded[0].Name != "a.txt" || res.Uploaded[1].Name != "b.txt" {
+		t.Fatalf("unexpected uploaded files %+v", res.Uploaded)
+	}
+	if len(res.Skipped) != 1 || res.Skipped[0] != "ORDER1.RDY" {
+		t.Fatalf("unexpected skipped %v", res.Skipped)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_Error verifies upload errors are recorded in the result.
+func TestUploadFolder_Error(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "a.txt")
+	mustWrite(t, p, []byte("x"))
+	u, _ := newTestUploader(t)
+	sentinel := errors.New("boom")
+	u.store.(*testStore).put = func(string, []byte) error { return sentinel }
+	res := u.UploadFolder(scanner.Match{Folder: dir, FolderEntries: []scanner.FileEntry{{Name: "a.txt", Path: p}}}, UploadOptions{})
+	if !res.Failed() || !errors.Is(res.Err(), sentinel) {
+		t.Fatalf("expected sentinel error in result, got %v", res.Err())
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_FileFailurePolicy verifies a failed file is retried (and
+// the retry counted) with FileRetry and stops the remaining files with
+// CancelOnFileFailure.
+func TestUploadFolder_FileFailurePolicy(t *testing.T) {
+	dir := t.TempDir()
+	var entries []scanner.FileEntry
+	for _, n := range []string{"a.txt", "b.txt", "c.txt"} {
+		mustWrite(t, filepath.Join(dir, n), []byte("x"))
+		entries = append(entries, scanner.FileEntry{Name: n, Path: filepath.Join(dir, n)})
+	}
+	m := scanner.Match{Folder: dir, FolderEntries: entries}
+	sentinel := errors.New("boom")
+	newUploader := func(failures int) (*GCSUploader, *[]string) {
+		u, uploaded := newTestUploader(t)
+		u.Concurrency = 1
+		u.store.(*testStore).put = func(name string, _ []byte) error {
+			if path.Base(name) == "a.txt" && failures > 0 {
+				failures--
+				return sentinel
+			}
+			return nil
+		}
+		return u, uploaded
+	}
+
+	u, uploaded := newUploader(1)
+	noSleep := func(context.Context, time.Duration) error { return nil }
+	res := u.UploadFolder(m, UploadOptions{FileRetry: Backoff{Retries: 1, sleep: noSleep}})
+	if res.Failed() || len(*uploaded) != 3 {
+		t.Fatalf("expected retried upload to succeed, got %v %v", *uploaded, res.Err())
+	}
+	if res.Retries != 1 {
+		t.Fatalf("expected 1 retry, got %d", res.Retries)
+	}
+
+	u, uploaded = newUploader(1)
+	res = u.UploadFolder(m, UploadOptions{CancelOnFileFailure: true})
+	if !errors.Is(res.Err(), sentinel) || !errors.Is(res.Err(), errFolderCanceled) {
+		t.Fatalf("expected canceled folder, got %v", res.Err())
+	}
+	if !strings.Contains(res.Err().Error(), "a.txt: "+errFolderCanceled.Error()) {
+		t.Fatalf("expected the failed file to be named, got %v", res.Err())
+	}
+	if len(*uploaded) != 0 || len(res.FailedFiles) != 1 {
+		t.Fatalf("expected remaining files canceled, got %v failed %v", *uploaded, res.FailedFiles)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_Deadline verifies files aren't started once the folder
+// deadline passed and the folder fails with ErrFolderDeadline.
+func TestUploadFolder_Deadline(t *testing.T) {
+	dir := t.TempDir()
+	var entries []scanner.FileEntry
+	for _, n := range []string{"a.txt", "b.txt", "c.txt"} {
+		mustWrite(t, filepath.Join(dir, n), []byte("x"))
+		entries = append(entries, scanner.FileEntry{Name: n, Path: filepath.Join(dir, n)})
+	}
+	m := scanner.Match{Folder: dir, FolderEntries: entries}
+	u, uploaded := newTestUploader(t)
+	u.Concurrency = 1
+	u.store.(*testStore).put = func(string, []byte) error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}
+
+	res := u.UploadFolder(m, UploadOptions{Deadline: 10 * time.Millisecond})
+	if !errors.Is(res.Err(), ErrFolderDeadline) {
+		t.Fatalf("expected deadline error, got %v", res.Err())
+	}
+	if len(*uploaded) != 1 || len(res.Uploaded) != 1 {
+		t.Fatalf("expected only the file in flight uploaded, got %v", *uploaded)
+	}
+
+	res = u.UploadFolder(m, UploadOptions{Deadline: time.Minute})
+	if res.Failed() {
+		t.Fatalf("expected folder within deadline to succeed, got %v", res.Err())
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_CreateOnly verifies create-only uploads of existing objects
+// are recorded as existing with SkipConflicts and fail without retries
+// otherwise.
+func TestUploadFolder_CreateOnly(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "a.txt")
+	mustWrite(t, p, []byte("x"))
+	m := scanner.Match{Folder: dir, FolderEntries: []scanner.FileEntry{{Name: "a.txt", Path: p}}}
+	u, _ := newTestUploader(t)
+	store := u.store.(*testStore)
+	name := filepath.Base(dir) + "/a.txt"
+	store.objects[name] = ObjectAttrs{Name: name, Metadata: map[string]string{MetadataSHA256: "theirs"}, Generation: 7}
+	attempts := 0
+	store.put = func(string, []byte) error {
+		attempts++
+		return nil
+	}
+
+	res := u.UploadFolder(m, UploadOptions{CreateOnly: true, SkipConflicts: true})
+	if res.Failed() || len(res.Uploaded) != 1 || !res.Uploaded[0].Existing {
+		t.Fatalf("expected existing object recorded, got %+v %v", res.Uploaded, res.Err())
+	}
+	if f := res.Uploaded[0]; f.Checksum != "theirs" || f.Generation != 7 {
+		t.Fatalf("expected the existing object's attributes recorded, got %+v", f)
+	}
+
+	attempts = 0
+	noSleep := func(context.Context, time.Duration) error { return nil }
+	res = u.UploadFolder(m, UploadOptions{CreateOnly: true, FileRetry: Backoff{Retries: 3, sleep: noSleep}})
+	if !errors.Is(res.Err(), ErrObjectExists) || len(res.FailedFiles) != 1 {
+		t.Fatalf("expected conflict, got %v", res.Err())
+	}
+	if attempts != 1 {
+		t.Fatalf("expected conflict not to be retried, got %d attempts", attempts)
+	}
+
+	if !isPreconditionFailed(fmt.Errorf("close: %w", &googleapi.Error{Code: 412})) || isPreconditionFailed(&googleapi.Error{Code: 503}) {
+		t.Fatalf("unexpected precondition detection")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_NormalizeUnicode verifies object names are converted to NFC
+// when requested.
+func TestUploadFolder_NormalizeUnicode(t *testing.T) {
+	dir := t.TempDir()
+	nfd := "cafe\u0301.txt"
+	mustWrite(t, filepath.Join(dir, nfd), []byte("x"))
+	u, uploaded := newTestUploader(t)
+	m := scanner.Match{Folder: dir, FolderEntries: []scanner.FileEntry{{Name: nfd, Path: filepath.Join(dir, nfd)}}}
+	res := u.UploadFolder(m, UploadOptions{FolderName: "F", NormalizeUnicode: true})
+	if res.Failed() {
+		t.Fatalf("upload: %v", res.Err())
+	}
+	if len(*uploaded) != 1 || (*uploaded)[0] != "F/caf\u00e9.txt" {
+		t.Fatalf("expected NFC object name, got %q", *uploaded)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_FollowSymlinks verifies symlinked files are uploaded with
+// their target content when enabled, while directory links, dangling links and
+// loops are skipped.
+func TestUploadFolder_FollowSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on windows")
+	}
+	staging := t.TempDir()
+	mustWrite(t, filepath.Join(staging, "target.txt"), []byte("content"))
+	dir := t.TempDir()
+	mustSymlink(t, filepath.Join(staging, "target.txt"), filepath.Join(dir, "link.txt"))
+	mustSymlink(t, staging, filepath.Join(dir, "dirlink"))
+	mustSymlink(t, filepath.Join(staging, "missing"), filepath.Join(dir, "dangling"))
+	mustSymlink(t, filepath.Join(dir, "loop2"), filepath.Join(dir, "loop1"))
+	mustSymlink(t, filepath.Join(dir, "loop1"), filepath.Join(dir, "loop2"))
+
+	var entries []scanner.FileEntry
+	for _, n := range []string{"dangling", "dirlink", "link.txt", "loop1", "loop2"} {
+		entries = append(entries, scanner.FileEntry{Name: n, Path: filepath.Join(dir, n)})
+	}
+	m := scanner.Match{Folder: dir, FolderEntries: entries}
+
+	u, uploaded := newTestUploader(t)
+	res := u.UploadFolder(m, UploadOptions{})
+	if len(*uploaded) != 0 || len(res.Skipped) != 5 {
+		t.Fatalf("expected all symlinks skipped by default, got %v", *uploaded)
+	}
+
+	u, uploaded = newTestUploader(t)
+	res = u.UploadFolder(m, UploadOptions{FollowSymlinks: true})
+	if res.Failed() {
+		t.Fatalf("unexpected failure: %v", res.Err())
+	}
+	if len(*uploaded) != 1 || !strings.HasSuffix((*uploaded)[0], "/link.txt") {
+		t.Fatalf("expected only link.txt uploaded, got %v", *uploaded)
+	}
+	if res.Uploaded[0].Size != int64(len("content")) {
+		t.Fatalf("expected target size, got %d", res.Uploaded[0].Size)
+	}
+	if len(res.Skipped) != 4 {
+		t.Fatalf("expected 4 skipped entries, got %v", res.Skipped)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_DedupeHardlinks verifies hard-linked files are uploaded
+// once and recorded as links of the first entry.
+func TestUploadFolder_DedupeHardlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hard link detection not supported on windows")
+	}
+	dir := t.TempDir()
+	mustWrite(t, filepath.Join(dir, "a.txt"), []byte("same"))
+	if err := os.Link(filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+	mustWrite(t, filepath.Join(dir, "c.txt"), []byte("other"))
+	m := scanner.Match{Folder: dir}
+	for _, n := range []string{"a.txt", "b.txt", "c.txt"} {
+		m.FolderEntries = append(m.FolderEntries, scanner.FileEntry{Name: n, Path: filepath.Join(dir, n)})
+	}
+
+	u, uploaded := newTestUploader(t)
+	if res := u.UploadFolder(m, UploadOptions{}); len(*uploaded) != 3 || len(res.Uploaded) != 3 {
+		t.Fatalf("expected all files uploaded without dedupe, got %v", *uploaded)
+	}
+
+	u, uploaded = newTestUploader(t)
+	res := u.UploadFolder(m, UploadOptions{DedupeHardlinks: true})
+	if res.Failed() {
+		t.Fatalf("unexpected failure: %v", res.Err())
+	}
+	if len(*uploaded) != 2 {
+		t.Fatalf("expected 2 uploads, got %v", *uploaded)
+	}
+	if len(res.Uploaded) != 3 {
+		t.Fatalf("expected 3 recorded files, got %+v", res.Uploaded)
+	}
+	link := res.Uploaded[1]
+	if link.Name != "b.txt" || link.LinkOf != "a.txt" || link.Path != res.Uploaded[0].Path || link.Checksum != res.Uploaded[0].Checksum {
+		t.Fatalf("unexpected link record %+v", link)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_CompressSparse verifies sparse files are stored gzip
+// compressed and marked as gzip encoded when compression is enabled.
+func TestUploadFolder_CompressSparse(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "sparse.img")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := f.Truncate(8 << 20); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	f.Close()
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if !isSparse(fi) {
+		t.Skip("filesystem doesn't create sparse files")
+	}
+	m := scanner.Match{Folder: dir, FolderEntries: []scanner.FileEntry{{Name: "sparse.img", Path: p}}}
+
+	u, _ := newTestUploader(t)
+	if res := u.UploadFolder(m, UploadOptions{}); res.Uploaded[0].ContentEncoding != "" {
+		t.Fatalf("expected no encoding without -compress-sparse, got %+v", res.Uploaded[0])
+	}
+	u, _ = newTestUploader(t)
+	res := u.UploadFolder(m, UploadOptions{CompressSparse: true})
+	if res.Failed() || res.Uploaded[0].ContentEncoding != "gzip" {
+		t.Fatalf("expected gzip encoding, got %+v err=%v", res.Uploaded, res.Err())
+	}
+	store := u.store.(*testStore)
+	name := res.Uploaded[0].Path
+	if store.objects[name].ContentEncoding != "gzip" {
+		t.Fatalf("expected object stored with gzip encoding, got %+v", store.objects[name])
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(store.content[name]))
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil || len(b) != 8<<20 {
+		t.Fatalf("expected the file content compressed, got %d bytes err=%v", len(b), err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_FileMetadata verifies objects carry the modification time
+// of their file, and its mode and owner only with FileOwnership.
+func TestUploadFolder_FileMetadata(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "a.txt")
+	mustWrite(t, p, []byte("a"))
+	mtime := time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.FixedZone("CET", 3600))
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if err := os.Chmod(p, 0o640); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	m := scanner.Match{Folder: dir, FolderEntries: []scanner.FileEntry{{Name: "a.txt", Path: p}}}
+
+	u, _ := newTestUploader(t)
+	res := u.UploadFolder(m, UploadOptions{FolderName: "F", Metadata: map[string]string{"agent": "a1"}})
+	if res.Failed() {
+		t.Fatalf("upload: %v", res.Err())
+	}
+	md := u.store.(*testStore).objects["F/a.txt"].Metadata
+	if md[MetadataModTime] != "2024-03-01T11:30:00.123456789Z" || md["agent"] != "a1" {
+		t.Fatalf("unexpected metadata %v", md)
+	}
+	if _, ok := md[MetadataMode]; ok {
+		t.Fatalf("expected no mode without FileOwnership, got %v", md)
+	}
+
+	u, _ = newTestUploader(t)
+	if res := u.UploadFolder(m, UploadOptions{FolderName: "F", FileOwnership: true}); res.Failed() {
+		t.Fatalf("upload: %v", res.Err())
+	}
+	md = u.store.(*testStore).objects["F/a.txt"].Metadata
+	if md[MetadataMode] != "0640" {
+		t.Fatalf("expected mode 0640, got %v", md)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if _, _, ok := fileOwner(fi); ok && (md[MetadataUID] != strconv.Itoa(os.Getuid()) || md[MetadataGID] == "") {
+		t.Fatalf("expected owner recorded, got %v", md)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_ObjectACLs verifies objects are written with the predefined
+// ACL of the first rule matching their file name, and without one otherwise.
+func TestUploadFolder_ObjectACLs(t *testing.T) {
+	dir := t.TempDir()
+	var entries []scanner.FileEntry
+	for _, name := range []string{"photo.jpg", "report.pdf", "notes.txt"} {
+		mustWrite(t, filepath.Join(dir, name), []byte(name))
+		entries = append(entries, scanner.FileEntry{Name: name, Path: filepath.Join(dir, name)})
+	}
+	u, _ := newTestUploader(t)
+	acls := app.ObjectACLs{{ACL: "publicRead", Pattern: "*.jpg"}, {ACL: "private", Pattern: "*.pdf"}}
+	res := u.UploadFolder(scanner.Match{Folder: dir, FolderEntries: entries}, UploadOptions{FolderName: "F", ObjectACLs: acls})
+	if res.Failed() {
+		t.Fatalf("upload: %v", res.Err())
+	}
+	got := u.store.(*testStore).acls
+	want := map[string]string{"F/photo.jpg": "publicRead", "F/report.pdf": "private", "F/notes.txt": ""}
+	if !maps.Equal(got, want) {
+		t.Fatalf("expected ACLs %v, got %v", want, got)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_HoldsAndRetention verifies holds and retention are set on
+// files, bundles and empty markers and recorded, and that writes rejected by
+// a retained object fail without retries.
+func TestUploadFolder_HoldsAndRetention(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(t, filepath.Join(dir, "big.bin"), bytes.Repeat([]byte("x"), 100))
+	mustWrite(t, filepath.Join(dir, "small.txt"), []byte("s"))
+	m := scanner.Match{Folder: dir, FolderEntries: []scanner.FileEntry{
+		{Name: "big.bin", Path: filepath.Join(dir, "big.bin")},
+		{Name: "small.txt", Path: filepath.Join(dir, "small.txt")},
+	}}
+	opts := UploadOptions{
+		FolderName:       "F",
+		BundleSmallFiles: 10,
+		Hold:             app.HoldEventBased,
+		Retention:        app.ObjectRetention{Period: 24 * time.Hour, Locked: true},
+	}
+	u, _ := newTestUploader(t)
+	store := u.store.(*testStore)
+	before := time.Now()
+	res := u.UploadFolder(m, opts)
+	if res.Failed() || len(res.Uploaded) != 2 {
+		t.Fatalf("upload: %+v %v", res.Uploaded, res.Err())
+	}
+	for _, f := range res.Uploaded {
+		if f.Hold != app.HoldEventBased || f.RetainUntil.Before(before.Add(24*time.Hour)) {
+			t.Fatalf("expected %s held and retained for a day, got %q %s", f.Name, f.Hold, f.RetainUntil)
+		}
+		if h := store.holds[f.Path]; h != [2]bool{false, true} {
+			t.Fatalf("expected an event-based hold on %s, got %v", f.Path, h)
+		}
+	}
+
+	empty := scanner.Match{Folder: t.TempDir()}
+	res = u.UploadFolder(empty, UploadOptions{FolderName: "E", EmptyMarker: true, Hold: app.HoldTemporary})
+	if res.Failed() || store.holds["E/"+EmptyMarkerName] != [2]bool{true, false} {
+		t.Fatalf("expected a temporary hold on the empty marker, got %v %v", store.holds, res.Err())
+	}
+
+	attempts := 0
+	store.put = func(name string, _ []byte) error {
+		attempts++
+		return classify(&googleapi.Error{Code: 403, Message: "Object '" + name + "' is under active Event-Based hold and cannot be deleted, overwritten or archived until hold is removed."})
+	}
+	noSleep := func(context.Context, time.Duration) error { return nil }
+	res = u.UploadFolder(m, UploadOptions{FolderName: "F", FileRetry: Backoff{Retries: 3, sleep: noSleep}})
+	if !errors.Is(res.Err(), ErrRetention) || attempts != 2 {
+		t.Fatalf("expected 2 unretried retention failures, got %d attempts, %v", attempts, res.Err())
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_StreamedEntries verifies folders scanned with a page size
+// are uploaded by streaming their entries from disk.
+func TestUploadFolder_StreamedEntries(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "ORDER1")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	mustWrite(t, filepath.Join(root, "ORDER1.RDY"), nil)
+	for i := range 7 {
+		mustWrite(t, filepath.Join(dir, fmt.Sprintf("f%d.txt", i)), []byte("x"))
+	}
+	matches, err := scanner.Scan(root, scanner.Options{PageSize: 2})
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("scan: %v %+v", err, matches)
+	}
+
+	u, uploaded := newTestUploader(t)
+	res := u.UploadFolder(matches[0], UploadOptions{})
+	if res.Failed() {
+		t.Fatalf("unexpected failure: %v", res.Err())
+	}
+	if len(*uploaded) != 7 || len(res.Uploaded) != 7 || res.Uploaded[0].Name != "f0.txt" {
+		t.Fatalf("expected 7 sorted uploads, got %+v", res.Uploaded)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_StrictSnapshot verifies files changed or removed since the
+// scan are uploaded as they are (or skipped) by default and fail with
+// ErrSnapshotChanged with StrictSnapshot, also if they change during upload.
+func TestUploadFolder_StrictSnapshot(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "ORDER1")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	mustWrite(t, filepath.Join(root, "ORDER1.RDY"), nil)
+	for _, n := range []string{"a.txt", "b.txt", "c.txt"} {
+		mustWrite(t, filepath.Join(dir, n), []byte("x"))
+	}
+	matches, err := scanner.Scan(root, scanner.Options{})
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("scan: %v %+v", err, matches)
+	}
+	mustWrite(t, filepath.Join(dir, "b.txt"), []byte("longer"))
+	if err := os.Remove(filepath.Join(dir, "c.txt")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	u, uploaded := newTestUploader(t)
+	res := u.UploadFolder(matches[0], UploadOptions{})
+	if res.Failed() || len(*uploaded) != 2 || !slices.Equal(res.Skipped, []string{"c.txt"}) {
+		t.Fatalf("expected lenient upload, got %v skipped %v err %v", *uploaded, res.Skipped, res.Err())
+	}
+
+	u, uploaded = newTestUploader(t)
+	res = u.UploadFolder(matches[0], UploadOptions{StrictSnapshot: true})
+	if !errors.Is(res.Err(), ErrSnapshotChanged) || !slices.Equal(res.FailedFiles, []string{"b.txt", "c.txt"}) {
+		t.Fatalf("expected changed files to fail, got %v %v", res.FailedFiles, res.Err())
+	}
+	if !slices.Equal(*uploaded, []string{"ORDER1/a.txt"}) {
+		t.Fatalf("expected unchanged file uploaded, got %v", *uploaded)
+	}
+
+	u, _ = newTestUploader(t)
+	u.store.(*testStore).put = func(name string, _ []byte) error {
+		if path.Base(name) == "a.txt" {
+			mustWrite(t, filepath.Join(dir, "a.txt"), []byte("appended"))
+		}
+		return nil
+	}
+	res = u.UploadFolder(matches[0], UploadOptions{StrictSnapshot: true})
+	if !errors.Is(res.Err(), ErrSnapshotChanged) || !strings.Contains(res.Err().Error(), "during upload") || !slices.Contains(res.FailedFiles, "a.txt") {
+		t.Fatalf("expected file changed during upload to fail, got %v %v", res.FailedFiles, res.Err())
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_SkipExisting verifies the destination prefix is listed once
+// and only files with a matching SHA256 are skipped.
+func TestUploadFolder_SkipExisting(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ORDER1")
+	mustMkdir(t, dir)
+	m := scanner.Match{Folder: dir}
+	for _, n := range []string{"same.txt", "changed.txt", "new.txt"} {
+		mustWrite(t, filepath.Join(dir, n), []byte(n))
+		m.FolderEntries = append(m.FolderEntries, scanner.FileEntry{Name: n, Path: filepath.Join(dir, n)})
+	}
+	sum, err := getChecksum(context.Background(), filepath.Join(dir, "same.txt"), nil)
+	if err != nil {
+		t.Fatalf("checksum: %v", err)
+	}
+
+	u, uploaded := newTestUploader(t)
+	store := u.store.(*testStore)
+	var listed []string
+	store.list = func(prefix string) ([]ObjectAttrs, error) {
+		listed = append(listed, prefix)
+		return []ObjectAttrs{
+			{Name: "ORDER1/same.txt", Metadata: map[string]string{MetadataSHA256: sum}},
+			{Name: "ORDER1/changed.txt", Metadata: map[string]string{MetadataSHA256: "stale"}},
+		}, nil
+	}
+	res := u.UploadFolder(m, UploadOptions{SkipExisting: true})
+	if res.Failed() {
+		t.Fatalf("unexpected failure: %v", res.Err())
+	}
+	if len(listed) != 1 || listed[0] != "ORDER1/" {
+		t.Fatalf("expected a single listing of ORDER1/, got %v", listed)
+	}
+	sort.Strings(*uploaded)
+	if strings.Join(*uploaded, ",") != "ORDER1/changed.txt,ORDER1/new.txt" {
+		t.Fatalf("unexpected uploads %v", *uploaded)
+	}
+	if len(res.Uploaded) != 3 || !res.Uploaded[2].Existing || res.Uploaded[2].Name != "same.txt" {
+		t.Fatalf("expected same.txt recorded as existing, got %+v", res.Uploaded)
+	}
+	if res.Bytes() != int64(len("changed.txt")+len("new.txt")) {
+		t.Fatalf("expected existing file not counted, got %d bytes", res.Bytes())
+	}
+
+	store.list = func(string) ([]ObjectAttrs, error) { return nil, errors.New("denied") }
+	if res := u.UploadFolder(m, UploadOptions{SkipExisting: true}); !res.Failed() {
+		t.Fatalf("expected listing error to fail the folder")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_PartialFailure verifies failed files don't stop the others
+// and that files done by an earlier run are not uploaded again.
+func TestUploadFolder_PartialFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ORDER1")
+	mustMkdir(t, dir)
+	m := scanner.Match{Folder: dir}
+	for _, n := range []string{"a.txt", "b.txt", "c.txt"} {
+		mustWrite(t, filepath.Join(dir, n), []byte(n))
+		m.FolderEntries = append(m.FolderEntries, scanner.FileEntry{Name: n, Path: filepath.Join(dir, n)})
+	}
+
+	u, uploaded := newTestUploader(t)
+	u.store.(*testStore).put = func(name string, _ []byte) error {
+		if path.Base(name) == "b.txt" {
+			return errors.New("boom")
+		}
+		return nil
+	}
+	res := u.UploadFolder(m, UploadOptions{})
+	if !res.Failed() || len(res.FailedFiles) != 1 || res.FailedFiles[0] != "b.txt" {
+		t.Fatalf("expected b.txt to fail, got %v %v", res.FailedFiles, res.Err())
+	}
+	if len(res.Uploaded) != 2 || len(*uploaded) != 2 {
+		t.Fatalf("expected the other files uploaded, got %+v", res.Uploaded)
+	}
+
+	done := make(map[string]UploadedFile)
+	for _, f := range res.Uploaded {
+		done[f.Name] = f
+	}
+	u, uploaded = newTestUploader(t)
+	res = u.UploadFolder(m, UploadOptions{Done: done})
+	if res.Failed() {
+		t.Fatalf("unexpected failure: %v", res.Err())
+	}
+	if len(*uploaded) != 1 || (*uploaded)[0] != "ORDER1/b.txt" {
+		t.Fatalf("expected only the failed file uploaded, got %v", *uploaded)
+	}
+	if len(res.Uploaded) != 3 || !res.Uploaded[0].Existing || res.Uploaded[1].Existing {
+		t.Fatalf("unexpected uploaded files %+v", res.Uploaded)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_EmptyMarker verifies a marker object is uploaded for empty
+// folders only.
+func TestUploadFolder_EmptyMarker(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ORDER1")
+	mustMkdir(t, dir)
+	u, uploaded := newTestUploader(t)
+	res := u.UploadFolder(scanner.Match{Folder: dir}, UploadOptions{EmptyMarker: true, Prefix: "in"})
+	if res.Failed() {
+		t.Fatalf("unexpected failure: %v", res.Err())
+	}
+	if len(*uploaded) != 1 || (*uploaded)[0] != "in/ORDER1/"+EmptyMarkerName {
+		t.Fatalf("expected marker upload, got %v", *uploaded)
+	}
+	if len(res.Uploaded) != 1 || res.Uploaded[0].Name != EmptyMarkerName {
+		t.Fatalf("expected marker recorded, got %+v", res.Uploaded)
+	}
+
+	p := filepath.Join(dir, "a.txt")
+	mustWrite(t, p, []byte("a"))
+	u, uploaded = newTestUploader(t)
+	res = u.UploadFolder(scanner.Match{Folder: dir, FolderEntries: []scanner.FileEntry{{Name: "a.txt", Path: p}}}, UploadOptions{EmptyMarker: true})
+	if res.Failed() || len(*uploaded) != 1 || (*uploaded)[0] != "ORDER1/a.txt" {
+		t.Fatalf("expected no marker for non-empty folder, got %v %v", *uploaded, res.Err())
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestUploadFolder_BundleSmallFiles verifies small files are uploaded as
+// members of a tar bundle while larger files are uploaded individually.
+func TestUploadFolder_BundleSmallFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ORDER1")
+	mustMkdir(t, dir)
+	m := scanner.Match{Folder: dir}
+	for name, content := range map[string]string{"a.txt": "aa", "b.txt": "bbb", "big.bin": "0123456789"} {
+		p := filepath.Join(dir, name)
+		mustWrite(t, p, []byte(content))
+		m.FolderEntries = append(m.FolderEntries, scanner.FileEntry{Name: name, Path: p})
+	}
+
+	u, _ := newTestUploader(t)
+	store := u.store.(*testStore)
+	res := u.UploadFolder(m, UploadOptions{BundleSmallFiles: 5})
+	if res.Failed() {
+		t.Fatalf("unexpected failure: %v", res.Err())
+	}
+	members := map[string]map[string]string{}
+	for name, content := range store.content {
+		if !strings.HasSuffix(name, ".tar") {
+			members[name] = nil
+			continue
+		}
+		members[name] = map[string]string{}
+		tr := tar.NewReader(bytes.NewReader(content))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("read bundle %s: %v", name, err)
+			}
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("read bundle %s: %v", name, err)
+			}
+			members[name][hdr.Name] = string(b)
+		}
+	}
+	if len(members) != 2 {
+		t.Fatalf("expected one bundle and one object, got %v", members)
+	}
+	if _, ok := members["ORDER1/big.bin"]; !ok {
+		t.Fatalf("expected big.bin uploaded individually, got %v", members)
+	}
+	var bundle string
+	for _, f := range res.Uploaded {
+		if f.Name == "big.bin" {
+			if f.Bundled {
+				t.Fatalf("expected big.bin not bundled")
+			}
+			continue
+		}
+		if !f.Bundled || !strings.HasPrefix(f.Path, "ORDER1/.lfs-bundle-") || f.Checksum == "" {
+			t.Fatalf("expected %s bundled, got %+v", f.Name, f)
+		}
+		bundle = f.Path
+	}
+	if got := members[bundle]; got["a.txt"] != "aa" || got["b.txt"] != "bbb" || len(got) != 2 {
+		t.Fatalf("unexpected bundle members %v", got)
+	}
+
+	// NOTE(joel): A failing bundle fails all of its files.
+	u, _ = newTestUploader(t)
+	u.store.(*testStore).put = func(name string, _ []byte) error {
+		if strings.HasSuffix(name, ".tar") {
+			return errors.New("boom")
+		}
+		return nil
+	}
+	res = u.UploadFolder(m, UploadOptions{BundleSmallFiles: 5})
+	if strings.Join(res.FailedFiles, ",") != "a.txt,b.txt" || len(res.Uploaded) != 1 {
+		t.Fatalf("expected bundled files failed, got failed=%v uploaded=%+v", res.FailedFiles, res.Uploaded)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestObjectNames verifies the expected object names of a folder, leaving
+// out bundled files.
+func TestObjectNames(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ORDER1")
+	mustMkdir(t, dir)
+	m := scanner.Match{Folder: dir}
+	for name, content := range map[string]string{"a.txt": "aa", "big.bin": "0123456789", "X.RDY": ""} {
+		p := filepath.Join(dir, name)
+		mustWrite(t, p, []byte(content))
+		m.FolderEntries = append(m.FolderEntries, scanner.FileEntry{Name: name, Path: p})
+	}
+
+	prefix, names, err := ObjectNames(m, UploadOptions{Prefix: "in/", FolderName: "order1", BundleSmallFiles: 5})
+	if err != nil {
+		t.Fatalf("ObjectNames: %v", err)
+	}
+	if prefix != "in/order1" || len(names) != 1 || names["big.bin"] != "in/order1/big.bin" {
+		t.Fatalf("unexpected prefix %q names %v", prefix, names)
+	}
+
+	if _, names, _ := ObjectNames(m, UploadOptions{}); len(names) != 2 || names["a.txt"] != "ORDER1/a.txt" {
+		t.Fatalf("unexpected names %v", names)
+	}
+}
@@ -0,0 +1,187 @@
+package uploader
+
+import (
+	"bufio"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IndexEntry is a folder record written to Firestore as remembered by the
+// local RecordIndex.
+type IndexEntry struct {
+	Collection string `json:"collection"`
+	ID         string `json:"id"`
+	FolderPath string `json:"folderPath"`
+	// Checksum is the RecordChecksum of the written record.
+	Checksum  string    `json:"checksum"`
+	Files     int       `json:"files"`
+	RunID     string    `json:"runId,omitempty"`
+	WrittenAt time.Time `json:"writtenAt"`
+}
+
+// RecordIndex is a local index of the folder records written to Firestore,
+// stored as JSON lines, so they can be listed offline and checked against the
+// server later (see RecordReader).
+type RecordIndex struct {
+	Path    string
+	mu      sync.Mutex
+	entries map[string]IndexEntry
+}
+
+// RecordReader is implemented by record writers that can read folder records
+// back. ok is false if no document with the ID exists.
+type RecordReader interface {
+	ReadFolderRecord(collection, id string) (rec FolderRecord, ok bool, err error)
+}
+
+// IndexedWriter is a RecordWriter adding every folder record it writes to
+// Index.
+type IndexedWriter struct {
+	RecordWriter
+	Index *RecordIndex
+}
+
+// NOTE(joel): Compile-time check that Firestore can read its records back.
+var _ RecordReader = (*Firestore)(nil)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// OpenRecordIndex loads the index stored at path. A missing file is an empty
+// index; it is created on the first Save.
+func OpenRecordIndex(path string) (*RecordIndex, error) {
+	x := &RecordIndex{Path: path, entries: make(map[string]IndexEntry)}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return x, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open record index: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64<<20)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var e IndexEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("decode record index: %w", err)
+		}
+		x.entries[e.Collection+"/"+e.ID] = e
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read record index: %w", err)
+	}
+	return x, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Add remembers rec as written to collection at time t, replacing an earlier
+// entry of the same document.
+func (x *RecordIndex) Add(collection string, rec FolderRecord, t time.Time) {
+	e := IndexEntry{
+		Collection: collection,
+		ID:         rec.DocumentID(),
+		FolderPath: rec.FolderPath,
+		Checksum:   RecordChecksum(rec),
+		Files:      len(rec.Files),
+		RunID:      rec.RunID,
+		WrittenAt:  t.UTC(),
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.entries[collection+"/"+e.ID] = e
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Entries returns all entries ordered by collection and folder path.
+func (x *RecordIndex) Entries() []IndexEntry {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	entries := make([]IndexEntry, 0, len(x.entries))
+	for _, e := range x.entries {
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b IndexEntry) int {
+		return cmp.Or(cmp.Compare(a.Collection, b.Collection), cmp.Compare(a.FolderPath, b.FolderPath), cmp.Compare(a.ID, b.ID))
+	})
+	return entries
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Save atomically writes the index to Path.
+func (x *RecordIndex) Save() error {
+	entries := x.Entries()
+	tmp, err := os.CreateTemp(filepath.Dir(x.Path), filepath.Base(x.Path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create record index: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return fmt.Errorf("write record index: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write record index: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write record index: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), x.Path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("replace record index: %w", err)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// WriteFolderRecord writes rec with the wrapped writer and adds it to the
+// index once written.
+func (w IndexedWriter) WriteFolderRecord(collection string, rec FolderRecord) error {
+	if err := w.RecordWriter.WriteFolderRecord(collection, rec); err != nil {
+		return err
+	}
+	w.Index.Add(collection, rec, time.Now())
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// RecordChecksum returns the hex SHA256 of the content of rec: its folder path
+// and the name, size, checksum and object path of its files. Timestamps are left out, so
+// the checksum of a record read back from Firestore (which truncates them)
+// matches the one written.
+func RecordChecksum(rec FolderRecord) string {
+	files := slices.Clone(rec.Files)
+	slices.SortFunc(files, func(a, b UploadedFile) int { return cmp.Compare(a.Name, b.Name) })
+	h := sha256.New()
+	h.Write([]byte(rec.FolderPath + "\n"))
+	for _, f := range files {
+		h.Write([]byte(f.Name + "\t" + strconv.FormatInt(f.Size, 10) + "\t" + f.Checksum + "\t" + f.Path + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,82 @@
+package uploader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRecordIndex verifies records written through an IndexedWriter are
+// remembered, saved and loaded again.
+func TestRecordIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	index, err := OpenRecordIndex(path)
+	if err != nil {
+		t.Fatalf("OpenRecordIndex: %v", err)
+	}
+	if len(index.Entries()) != 0 {
+		t.Fatalf("expected empty index")
+	}
+
+	var written []string
+	w := IndexedWriter{
+		RecordWriter: recordWriterFunc(func(_ string, rec FolderRecord) error {
+			written = append(written, rec.FolderPath)
+			return nil
+		}),
+		Index: index,
+	}
+	files := []UploadedFile{{Name: "a.txt", Size: 1, Checksum: "x", Path: "A/a.txt"}}
+	for _, rec := range []FolderRecord{
+		{FolderPath: "B", Files: files, ID: "b"},
+		{FolderPath: "A", Files: files},
+		{FolderPath: "B", RunID: "r2", ID: "b"},
+	} {
+		if err := w.WriteFolderRecord("col", rec); err != nil {
+			t.Fatalf("WriteFolderRecord: %v", err)
+		}
+	}
+	if len(written) != 3 {
+		t.Fatalf("expected writes to pass through, got %v", written)
+	}
+	if err := index.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	loaded, err := OpenRecordIndex(path)
+	if err != nil {
+		t.Fatalf("OpenRecordIndex: %v", err)
+	}
+	entries := loaded.Entries()
+	if len(entries) != 2 || entries[0].FolderPath != "A" || entries[0].ID != DocumentID("A") || entries[0].Files != 1 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	if e := entries[1]; e.ID != "b" || e.RunID != "r2" || e.Checksum != RecordChecksum(FolderRecord{FolderPath: "B"}) {
+		t.Fatalf("expected the later record of B, got %+v", e)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := OpenRecordIndex(path); err == nil {
+		t.Fatalf("expected error for corrupt index")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestRecordChecksum verifies the checksum ignores timestamps and file order
+// but covers the file content.
+func TestRecordChecksum(t *testing.T) {
+	a := UploadedFile{Name: "a", Size: 1, Checksum: "x"}
+	b := UploadedFile{Name: "b", Size: 2, Checksum: "y"}
+	sum := RecordChecksum(FolderRecord{FolderPath: "F", Files: []UploadedFile{a, b}, UploadedAt: time.Now()})
+	if got := RecordChecksum(FolderRecord{FolderPath: "F", Files: []UploadedFile{b, a}}); got != sum {
+		t.Fatalf("expected checksum independent of order and time")
+	}
+	b.Checksum = "z"
+	if got := RecordChecksum(FolderRecord{FolderPath: "F", Files: []UploadedFile{a, b}}); got == sum {
+		t.Fatalf("expected changed file to change the checksum")
+	}
+}
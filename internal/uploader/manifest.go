@@ -0,0 +1,83 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+
+	"local-file-sync/internal/scanner"
+)
+
+// ManifestName is the name of the object holding the FolderRecord of a folder
+// in its object prefix (see ManifestWriter), so consumers that only read the
+// bucket get the manifest without Firestore access.
+const ManifestName = "__metadata.json"
+
+// ManifestWriter is implemented by uploaders that can write the manifest of an
+// uploaded folder next to its objects.
+type ManifestWriter interface {
+	WriteManifest(m scanner.Match, rec FolderRecord, opts UploadOptions) error
+}
+
+// NOTE(joel): Compile-time checks that the uploaders write manifests.
+var (
+	_ ManifestWriter = (*GCSUploader)(nil)
+	_ ManifestWriter = (*Multi)(nil)
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// WriteManifest implements ManifestWriter. The record is written as indented
+// JSON to `<prefix>/__metadata.json` with the metadata, ACL, hold and
+// retention of the folder's objects. An existing manifest, e.g. of an earlier
+// delivery, is overwritten.
+func (u *GCSUploader) WriteManifest(m scanner.Match, rec FolderRecord, opts UploadOptions) error {
+	if u.store == nil {
+		return fmt.Errorf("uploader client not initialized")
+	}
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode manifest: %w", err)
+	}
+	name := FolderPrefix(m.Folder, opts) + "/" + ManifestName
+	ctx, cancel := context.WithTimeout(u.ctx, 2*time.Minute)
+	defer cancel()
+	metadata := map[string]string{MetadataSHA256: fmt.Sprintf("%x", sha256.Sum256(b))}
+	maps.Copy(metadata, opts.Metadata)
+	put := protect(PutOptions{
+		ContentType:   "application/json",
+		Metadata:      metadata,
+		PredefinedACL: opts.ObjectACLs.For(ManifestName),
+	}, opts)
+	if _, err := u.store.Put(ctx, name, bytes.NewReader(b), put); err != nil {
+		return fmt.Errorf("write manifest %s: %w", name, err)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// WriteManifest implements ManifestWriter and writes the manifest to every
+// destination that supports it; mirrors get the same record as the primary.
+func (u *Multi) WriteManifest(m scanner.Match, rec FolderRecord, opts UploadOptions) error {
+	var errs []error
+	for i, t := range u.Targets {
+		w, ok := t.Uploader.(ManifestWriter)
+		if !ok {
+			continue
+		}
+		o := opts
+		if i > 0 {
+			o = mirrorOptions(opts, t.Prefix)
+		}
+		if err := w.WriteManifest(m, rec, o); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
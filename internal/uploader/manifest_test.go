@@ -0,0 +1,55 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/scanner"
+)
+
+// TestWriteManifest verifies the folder record is written as JSON into the
+// folder prefix of every destination, with the hold of the folder's objects,
+// and that failures name the destination.
+func TestWriteManifest(t *testing.T) {
+	m := scanner.Match{Folder: "/data/ORDER1"}
+	rec := FolderRecord{
+		FolderPath: "ORDER1",
+		UploadedAt: time.Date(2025, 9, 30, 12, 0, 0, 0, time.UTC),
+		Files:      []UploadedFile{{Name: "a.txt", Size: 1, Checksum: "abc", Path: "in/ORDER1/a.txt"}},
+		RunID:      "run-1",
+	}
+	primary, mirror := newTestStore(), newTestStore()
+	u := &Multi{Targets: []Target{
+		{Name: "gs://new", Uploader: NewStorageUploader(context.Background(), "new", primary, 1)},
+		{Name: "gs://old/copy", Uploader: NewStorageUploader(context.Background(), "old", mirror, 1), Prefix: "copy"},
+	}}
+	opts := UploadOptions{Prefix: "in", Hold: app.HoldTemporary}
+	if err := u.WriteManifest(m, rec, opts); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+
+	var got FolderRecord
+	if err := json.Unmarshal(primary.content["in/ORDER1/"+ManifestName], &got); err != nil {
+		t.Fatalf("decode manifest: %v", err)
+	}
+	if got.FolderPath != "ORDER1" || got.RunID != "run-1" || len(got.Files) != 1 || got.Files[0].Path != "in/ORDER1/a.txt" {
+		t.Fatalf("unexpected manifest %+v", got)
+	}
+	if primary.types["in/ORDER1/"+ManifestName] != "application/json" || !primary.holds["in/ORDER1/"+ManifestName][0] {
+		t.Fatalf("expected a held JSON object, got %q %v", primary.types["in/ORDER1/"+ManifestName], primary.holds)
+	}
+	if _, ok := mirror.content["copy/in/ORDER1/"+ManifestName]; !ok {
+		t.Fatalf("expected the manifest on the mirror, got %v", mirror.names)
+	}
+
+	mirror.put = func(string, []byte) error { return errors.New("mirror down") }
+	err := u.WriteManifest(m, rec, opts)
+	if err == nil || !strings.Contains(err.Error(), "gs://old/copy: write manifest") {
+		t.Fatalf("expected the mirror to fail, got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"local-file-sync/internal/scanner"
+)
+
+// Target is one destination of a Multi uploader.
+type Target struct {
+	// Name identifies the destination in errors and results, e.g. its URL.
+	Name     string
+	Uploader Uploader
+	// Prefix is prepended to the object names of mirrors, so they hold the
+	// objects of the primary below it. It is ignored for the primary.
+	Prefix string
+}
+
+// DestinationResult is the outcome of uploading a folder to one destination
+// of a Multi uploader.
+type DestinationResult struct {
+	Name string
+	// Uploaded is the number of files uploaded (or found existing).
+	Uploaded int
+	// Bytes is the number of bytes uploaded (see FolderResult.Bytes).
+	Bytes       int64
+	FailedFiles []string
+	// Retries is the number of file upload retries (see FolderResult.Retries).
+	Retries  int
+	Err      error
+	Duration time.Duration
+}
+
+// Multi uploads every folder to several destinations at once, e.g. the old
+// and the new bucket during a migration, or a bucket and a local mirror. The
+// first target is the primary: the merged FolderResult carries its objects
+// (which the Firestore record refers to), but a file only counts as uploaded
+// once every destination has it. Files missing on any destination are failed,
+// so the retry of the folder uploads them again to all destinations; files
+// done everywhere are skipped on all of them (UploadOptions.Done).
+type Multi struct {
+	Targets []Target
+}
+
+// NOTE(joel): Compile-time checks that Multi can replace a single uploader.
+var (
+	_ Uploader = (*Multi)(nil)
+	_ Lister   = (*Multi)(nil)
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// UploadFolder implements Uploader. The destinations are uploaded to
+// concurrently; the per-destination outcome is in FolderResult.Destinations.
+func (u *Multi) UploadFolder(m scanner.Match, opts UploadOptions) FolderResult {
+	start := time.Now()
+	results := make([]FolderResult, len(u.Targets))
+	var wg sync.WaitGroup
+	for i, t := range u.Targets {
+		o := opts
+		if i > 0 {
+			o = mirrorOptions(opts, t.Prefix)
+		}
+		wg.Go(func() {
+			results[i] = t.Uploader.UploadFolder(m, o)
+		})
+	}
+	wg.Wait()
+
+	res := results[0]
+	res.Uploaded = slices.Clone(res.Uploaded)
+	res.FailedFiles = slices.Clone(res.FailedFiles)
+	res.Errors = slices.Clone(res.Errors)
+	for i, r := range results {
+		if i > 0 {
+			res.Retries += r.Retries
+		}
+		t := u.Targets[i]
+		res.Destinations = append(res.Destinations, DestinationResult{
+			Name:        t.Name,
+			Uploaded:    len(r.Uploaded),
+			Bytes:       r.Bytes(),
+			FailedFiles: r.FailedFiles,
+			Retries:     r.Retries,
+			Err:         r.Err(),
+			Duration:    r.Duration,
+		})
+		if i == 0 {
+			continue
+		}
+		if err := r.Err(); err != nil {
+			res.Errors = append(res.Errors, fmt.Errorf("%s: %w", t.Name, err))
+		}
+		done := make(map[string]bool, len(r.Uploaded))
+		for _, f := range r.Uploaded {
+			done[f.Name] = true
+		}
+		res.Uploaded = slices.DeleteFunc(res.Uploaded, func(f UploadedFile) bool {
+			if done[f.Name] {
+				return false
+			}
+			if !slices.Contains(res.FailedFiles, f.Name) {
+				res.FailedFiles = append(res.FailedFiles, f.Name)
+			}
+			return true
+		})
+	}
+	res.Duration = time.Since(start)
+	return res
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ListObjects implements Lister with the objects of the primary, if it can
+// list them.
+func (u *Multi) ListObjects(prefix string) (map[string]string, error) {
+	l, ok := u.Targets[0].Uploader.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("%s: listing not supported", u.Targets[0].Name)
+	}
+	return l.ListObjects(prefix)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Close implements Uploader and closes all destinations.
+func (u *Multi) Close() error {
+	var errs []error
+	for _, t := range u.Targets {
+		if err := t.Uploader.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// mirrorOptions returns the upload options of a mirror with prefix: its
+// object names and those of the files done by an earlier run are placed below
+// prefix.
+func mirrorOptions(opts UploadOptions, prefix string) UploadOptions {
+	if prefix == "" {
+		return opts
+	}
+	opts.Prefix = path.Join(prefix, opts.Prefix)
+	if opts.Done != nil {
+		done := make(map[string]UploadedFile, len(opts.Done))
+		for name, f := range opts.Done {
+			f.Path = path.Join(prefix, f.Path)
+			done[name] = f
+		}
+		opts.Done = done
+	}
+	return opts
+}
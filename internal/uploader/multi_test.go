@@ -0,0 +1,63 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"local-file-sync/internal/scanner"
+)
+
+// TestMulti_UploadFolder verifies folders are uploaded to every destination,
+// mirrors below their prefix, and that files missing on any destination are
+// failed and uploaded again to it by the retry.
+func TestMulti_UploadFolder(t *testing.T) {
+	dir := t.TempDir()
+	var entries []scanner.FileEntry
+	for _, name := range []string{"a.txt", "b.txt"} {
+		mustWrite(t, filepath.Join(dir, name), []byte(name))
+		entries = append(entries, scanner.FileEntry{Name: name, Path: filepath.Join(dir, name)})
+	}
+	m := scanner.Match{Folder: dir, FolderEntries: entries}
+	primary, mirror := newTestStore(), newTestStore()
+	failB := true
+	mirror.put = func(name string, _ []byte) error {
+		if failB && name == "copy/F/b.txt" {
+			return errors.New("mirror down")
+		}
+		return nil
+	}
+	u := &Multi{Targets: []Target{
+		{Name: "gs://new", Uploader: NewStorageUploader(context.Background(), "new", primary, 2)},
+		{Name: "gs://old/copy", Uploader: NewStorageUploader(context.Background(), "old", mirror, 2), Prefix: "copy"},
+	}}
+
+	res := u.UploadFolder(m, UploadOptions{FolderName: "F"})
+	if !res.Failed() || !slices.Equal(res.FailedFiles, []string{"b.txt"}) {
+		t.Fatalf("expected b.txt failed, got %v err=%v", res.FailedFiles, res.Err())
+	}
+	if len(res.Uploaded) != 1 || res.Uploaded[0].Path != "F/a.txt" {
+		t.Fatalf("expected only a.txt uploaded with its primary object, got %+v", res.Uploaded)
+	}
+	if len(res.Destinations) != 2 || res.Destinations[0].Err != nil || res.Destinations[0].Uploaded != 2 ||
+		res.Destinations[1].Err == nil || !slices.Equal(res.Destinations[1].FailedFiles, []string{"b.txt"}) {
+		t.Fatalf("unexpected destination results %+v", res.Destinations)
+	}
+
+	// NOTE(joel): The retry skips a.txt everywhere and uploads b.txt again.
+	failB = false
+	done := map[string]UploadedFile{"a.txt": res.Uploaded[0]}
+	primary.names, mirror.names = nil, nil
+	res = u.UploadFolder(m, UploadOptions{FolderName: "F", Done: done})
+	if res.Failed() || len(res.Uploaded) != 2 {
+		t.Fatalf("expected retry to succeed, got %+v err=%v", res.Uploaded, res.Err())
+	}
+	if !slices.Equal(primary.names, []string{"F/b.txt"}) || !slices.Equal(mirror.names, []string{"copy/F/b.txt"}) {
+		t.Fatalf("expected only b.txt uploaded again, got %v and %v", primary.names, mirror.names)
+	}
+	if err := u.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package uploader
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// niceChunk caps the bytes read at once with NiceIO, so concurrent uploads
+// take turns instead of one large read using up a second of budget.
+const niceChunk = 64 << 10
+
+// NiceIO paces the reads of local files for uploads, so the agent doesn't
+// starve a producer writing to the same disk: reads of all uploads share a
+// budget of Rate bytes per second, and files are read with hints to the
+// kernel to read ahead sequentially and drop the uploaded data from the page
+// cache afterwards (Linux only). A nil *NiceIO reads at full speed.
+type NiceIO struct {
+	// Rate is the maximum read throughput in bytes per second; 0 only
+	// applies the hints.
+	Rate int64
+
+	mu sync.Mutex
+	// next is the time the next read may start at.
+	next time.Time
+	// NOTE(joel): sleep is a test hook; defaults to waiting on a timer.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// wait blocks until n more bytes may be read, or ctx is done. The first read
+// starts right away; later ones are spaced by the time the earlier ones take
+// at Rate.
+func (n *NiceIO) wait(ctx context.Context, bytes int) error {
+	if n == nil || n.Rate <= 0 || bytes <= 0 {
+		return nil
+	}
+	n.mu.Lock()
+	now := time.Now()
+	if n.next.Before(now) {
+		n.next = now
+	}
+	at := n.next
+	n.next = n.next.Add(n.readTime(int64(bytes)))
+	sleep := n.sleep
+	n.mu.Unlock()
+	if sleep == nil {
+		sleep = sleepCtx
+	}
+	if d := at.Sub(now); d > 0 {
+		return sleep(ctx, d)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// readTime returns how long reading size bytes takes at Rate, at least.
+func (n *NiceIO) readTime(size int64) time.Duration {
+	if n == nil || n.Rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(size) / float64(n.Rate) * float64(time.Second))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// localFile is a local file opened for upload (see openLocal).
+type localFile struct {
+	*os.File
+	ctx  context.Context
+	nice *NiceIO
+	// keepCached skips dropping the data from the page cache on Close, e.g.
+	// after computing the checksum of a file that is uploaded next.
+	keepCached bool
+}
+
+// openLocal opens the file at path for reading by an upload paced by nice
+// (which may be nil).
+func openLocal(ctx context.Context, path string, nice *NiceIO) (*localFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if nice != nil {
+		adviseSequential(f)
+	}
+	return &localFile{File: f, ctx: ctx, nice: nice}, nil
+}
+
+// Read implements io.Reader, waiting for the budget of NiceIO after each
+// read.
+func (f *localFile) Read(b []byte) (int, error) {
+	if f.nice == nil {
+		return f.File.Read(b)
+	}
+	if len(b) > niceChunk {
+		b = b[:niceChunk]
+	}
+	n, err := f.File.Read(b)
+	if werr := f.nice.wait(f.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// WriteTo hides the io.WriterTo of *os.File with NiceIO, so io.Copy reads
+// through Read.
+func (f *localFile) WriteTo(w io.Writer) (int64, error) {
+	if f.nice == nil {
+		return f.File.WriteTo(w)
+	}
+	return io.Copy(w, struct{ io.Reader }{f})
+}
+
+// Close closes the file; with NiceIO, its data is dropped from the page cache
+// first unless keepCached is set.
+func (f *localFile) Close() error {
+	if f.nice != nil && !f.keepCached {
+		adviseDontNeed(f.File)
+	}
+	return f.File.Close()
+}
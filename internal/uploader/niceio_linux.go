@@ -0,0 +1,24 @@
+//go:build linux
+
+package uploader
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// adviseSequential hints the kernel that f is read sequentially, so it reads
+// ahead further. Failures are ignored; the hint is best effort.
+func adviseSequential(f *os.File) {
+	_ = unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_SEQUENTIAL)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// adviseDontNeed hints the kernel that the data of f won't be read again, so
+// the uploaded files don't push the producer's data out of the page cache.
+// Failures are ignored; the hint is best effort.
+func adviseDontNeed(f *os.File) {
+	_ = unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package uploader
+
+import "os"
+
+// adviseSequential is not supported on this platform.
+func adviseSequential(f *os.File) {}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// adviseDontNeed is not supported on this platform.
+func adviseDontNeed(f *os.File) {}
@@ -0,0 +1,72 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestNiceIO_Pacing verifies that reads through NiceIO are chunked and spaced
+// by the time they take at Rate, and that a nil NiceIO reads at full speed.
+func TestNiceIO_Pacing(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 3*niceChunk+niceChunk/2)
+	path := filepath.Join(t.TempDir(), "f.bin")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var waits []time.Duration
+	nice := &NiceIO{Rate: niceChunk}
+	nice.sleep = func(_ context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	f, err := openLocal(context.Background(), path, nice)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	// NOTE(joel): Large buffers, so the reads are capped at niceChunk.
+	var got bytes.Buffer
+	buf := make([]byte, 1<<20)
+	if _, err := io.CopyBuffer(struct{ io.Writer }{&got}, struct{ io.Reader }{f}, buf); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("expected %d bytes, got %d", len(data), got.Len())
+	}
+	// NOTE(joel): The first chunk is read right away, the others wait for
+	// about 1s, 2s and 3s (the sleep hook doesn't pass time).
+	if len(waits) != 3 {
+		t.Fatalf("expected 3 waits, got %v", waits)
+	}
+	for i, d := range waits {
+		want := time.Duration(i+1) * time.Second
+		if d > want || d < want-100*time.Millisecond {
+			t.Fatalf("expected wait %d of about %s, got %s", i, want, d)
+		}
+	}
+	if d := nice.readTime(int64(len(data))); d != 3500*time.Millisecond {
+		t.Fatalf("expected read time 3.5s, got %s", d)
+	}
+
+	var unpaced *NiceIO
+	if err := unpaced.wait(context.Background(), len(data)); err != nil || unpaced.readTime(1<<30) != 0 {
+		t.Fatalf("expected nil NiceIO not to wait")
+	}
+	f, err = openLocal(context.Background(), path, nil)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+	got.Reset()
+	if _, err := io.Copy(&got, f); err != nil || !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("expected unpaced copy, got %d bytes, err=%v", got.Len(), err)
+	}
+}
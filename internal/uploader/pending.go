@@ -0,0 +1,151 @@
+package uploader
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// PendingRecord is a folder record whose write failed even after retries. It
+// is queued locally and written on a later run.
+type PendingRecord struct {
+	Collection string       `json:"collection"`
+	Record     FolderRecord `json:"record"`
+}
+
+// Pending is a local queue of folder records stored as JSON lines.
+type Pending struct {
+	Path string
+	mu   sync.Mutex
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewPending returns the queue stored at path. The file is created on the
+// first Add.
+func NewPending(path string) *Pending {
+	return &Pending{Path: path}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Add appends a record to the queue and syncs it to disk.
+func (p *Pending) Add(collection string, rec FolderRecord) error {
+	b, err := json.Marshal(PendingRecord{Collection: collection, Record: rec})
+	if err != nil {
+		return fmt.Errorf("encode pending record: %w", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, err := os.OpenFile(p.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open pending records: %w", err)
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("write pending records: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync pending records: %w", err)
+	}
+	return f.Close()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Flush writes all queued records with w in queue order. Records that fail
+// again stay queued; the file is removed once the queue is empty. It returns
+// the number of records written and the joined write errors.
+func (p *Pending) Flush(w RecordWriter) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	queued, err := p.read()
+	if err != nil || len(queued) == 0 {
+		return 0, err
+	}
+
+	var remaining []PendingRecord
+	var errs []error
+	for _, pr := range queued {
+		if err := w.WriteFolderRecord(pr.Collection, pr.Record); err != nil {
+			remaining = append(remaining, pr)
+			errs = append(errs, fmt.Errorf("%s: %w", pr.Record.FolderPath, err))
+		}
+	}
+	if err := p.replace(remaining); err != nil {
+		errs = append(errs, err)
+	}
+	return len(queued) - len(remaining), errors.Join(errs...)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// read returns all queued records. A missing file is an empty queue.
+func (p *Pending) read() ([]PendingRecord, error) {
+	f, err := os.Open(p.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open pending records: %w", err)
+	}
+	defer f.Close()
+
+	var queued []PendingRecord
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64<<20)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var pr PendingRecord
+		if err := json.Unmarshal(sc.Bytes(), &pr); err != nil {
+			return nil, fmt.Errorf("decode pending records: %w", err)
+		}
+		queued = append(queued, pr)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read pending records: %w", err)
+	}
+	return queued, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// replace atomically replaces the queue with records, removing the file if
+// there are none.
+func (p *Pending) replace(records []PendingRecord) error {
+	if len(records) == 0 {
+		if err := os.Remove(p.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("remove pending records: %w", err)
+		}
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p.Path), filepath.Base(p.Path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create pending records: %w", err)
+	}
+	enc := json.NewEncoder(tmp)
+	for _, pr := range records {
+		if err := enc.Encode(pr); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return fmt.Errorf("write pending records: %w", err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write pending records: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), p.Path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("replace pending records: %w", err)
+	}
+	return nil
+}
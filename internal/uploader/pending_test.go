@@ -0,0 +1,81 @@
+package uploader
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordWriterFunc adapts a function to RecordWriter for tests.
+type recordWriterFunc func(collection string, rec FolderRecord) error
+
+func (f recordWriterFunc) WriteFolderRecord(collection string, rec FolderRecord) error {
+	return f(collection, rec)
+}
+
+func (recordWriterFunc) WriteBatchRecord(string, BatchRecord) error {
+	return errors.New("not supported")
+}
+
+func (recordWriterFunc) ClaimFolder(string, FolderClaim) (FolderClaim, bool, error) {
+	return FolderClaim{}, false, errors.New("not supported")
+}
+
+func (recordWriterFunc) CompleteClaim(string, FolderClaim) error { return errors.New("not supported") }
+
+func (recordWriterFunc) ReleaseClaim(string, FolderClaim) error { return errors.New("not supported") }
+
+func (recordWriterFunc) AcquireLease(string, Lease) (Lease, bool, error) {
+	return Lease{}, false, errors.New("not supported")
+}
+
+func (recordWriterFunc) RenewLease(string, Lease) error { return errors.New("not supported") }
+
+func (recordWriterFunc) ReleaseLease(string, Lease) error { return errors.New("not supported") }
+
+func (recordWriterFunc) Close() error { return nil }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestPending_Flush verifies queued records are written in order, failures
+// stay queued and the file is removed once empty.
+func TestPending_Flush(t *testing.T) {
+	p := NewPending(filepath.Join(t.TempDir(), "pending.jsonl"))
+	if n, err := p.Flush(nil); n != 0 || err != nil {
+		t.Fatalf("expected empty queue without file, got %d %v", n, err)
+	}
+	for _, folder := range []string{"A", "B", "C"} {
+		rec := FolderRecord{FolderPath: folder, UploadedAt: time.Unix(1, 0).UTC(), Files: []UploadedFile{{Name: "f", Size: 1}}}
+		if err := p.Add("col", rec); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	var written []string
+	n, err := p.Flush(recordWriterFunc(func(collection string, rec FolderRecord) error {
+		if rec.FolderPath == "B" {
+			return errors.New("unavailable")
+		}
+		if collection != "col" || len(rec.Files) != 1 {
+			t.Errorf("unexpected record %s %+v", collection, rec)
+		}
+		written = append(written, rec.FolderPath)
+		return nil
+	}))
+	if n != 2 || err == nil || len(written) != 2 || written[0] != "A" || written[1] != "C" {
+		t.Fatalf("expected A and C written and an error for B, got %d %v %v", n, err, written)
+	}
+
+	n, err = p.Flush(recordWriterFunc(func(_ string, rec FolderRecord) error {
+		written = append(written, rec.FolderPath)
+		return nil
+	}))
+	if n != 1 || err != nil || written[2] != "B" {
+		t.Fatalf("expected B flushed, got %d %v %v", n, err, written)
+	}
+	if _, err := os.Stat(p.Path); !os.IsNotExist(err) {
+		t.Fatalf("expected pending file removed, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"local-file-sync/internal/scanner"
+)
+
+// TestUploadFolder_ReadBack verifies that uploaded objects and bundles are
+// read back and compared with the local files, and that mismatches fail the
+// file unless a retry uploads it intact.
+func TestUploadFolder_ReadBack(t *testing.T) {
+	dir := t.TempDir()
+	big := bytes.Repeat([]byte("0123456789"), 10_000)
+	mustWrite(t, filepath.Join(dir, "big.bin"), big)
+	mustWrite(t, filepath.Join(dir, "small.txt"), []byte("s"))
+	m := scanner.Match{Folder: dir, FolderEntries: []scanner.FileEntry{
+		{Name: "big.bin", Path: filepath.Join(dir, "big.bin")},
+		{Name: "small.txt", Path: filepath.Join(dir, "small.txt")},
+	}}
+	opts := UploadOptions{ReadBack: 1, BundleSmallFiles: 10}
+	object := filepath.Base(dir) + "/big.bin"
+
+	u, _ := newTestUploader(t)
+	res := u.UploadFolder(m, opts)
+	if res.Failed() || len(res.Uploaded) != 2 {
+		t.Fatalf("expected 2 uploaded files, got %+v %v", res.Uploaded, res.Err())
+	}
+	for _, f := range res.Uploaded {
+		if !f.Verified {
+			t.Fatalf("expected %s to be verified", f.Name)
+		}
+	}
+
+	u, _ = newTestUploader(t)
+	u.store.(*testStore).corrupt = map[string]int{object: 1}
+	res = u.UploadFolder(m, opts)
+	if !errors.Is(res.Err(), ErrReadBackMismatch) || len(res.FailedFiles) != 1 || res.FailedFiles[0] != "big.bin" {
+		t.Fatalf("expected big.bin to fail read-back, got %v %v", res.FailedFiles, res.Err())
+	}
+	if !strings.Contains(res.Err().Error(), "at byte 0") {
+		t.Fatalf("expected the offset of the mismatch, got %v", res.Err())
+	}
+
+	u, _ = newTestUploader(t)
+	u.store.(*testStore).corrupt = map[string]int{object: 1}
+	noSleep := func(context.Context, time.Duration) error { return nil }
+	retry := opts
+	retry.FileRetry = Backoff{Retries: 1, sleep: noSleep}
+	res = u.UploadFolder(m, retry)
+	if res.Failed() || res.Retries != 1 {
+		t.Fatalf("expected the retry to upload big.bin intact, got %d retries, %v", res.Retries, res.Err())
+	}
+
+	u, _ = newTestUploader(t)
+	u.store.(*testStore).corrupt = map[string]int{object: 1}
+	res = u.UploadFolder(m, UploadOptions{})
+	if res.Failed() || res.Uploaded[0].Verified {
+		t.Fatalf("expected no read-back without ReadBack, got %+v %v", res.Uploaded, res.Err())
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestReadBackSampled verifies the share of sampled object names and that the
+// sample is stable.
+func TestReadBackSampled(t *testing.T) {
+	sampled := 0
+	for i := range 10_000 {
+		name := fmt.Sprintf("folder/file-%d.bin", i)
+		if ReadBackSampled(name, 0.1) {
+			sampled++
+		}
+		if ReadBackSampled(name, 0.1) != ReadBackSampled(name, 0.1) {
+			t.Fatalf("expected a stable sample for %s", name)
+		}
+	}
+	if sampled < 800 || sampled > 1200 {
+		t.Fatalf("expected about 1000 sampled names, got %d", sampled)
+	}
+	if ReadBackSampled("a", 0) || !ReadBackSampled("a", 1) {
+		t.Fatalf("expected none at rate 0 and all at rate 1")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestFirstDifference verifies the offset of the first differing byte across
+// block boundaries and for contents of different length.
+func TestFirstDifference(t *testing.T) {
+	a := bytes.Repeat([]byte("x"), 2*readBackBuffer+10)
+	changed := bytes.Clone(a)
+	changed[readBackBuffer+3] = 'y'
+	tests := []struct {
+		local, remote []byte
+		want          int64
+	}{
+		{a, a, -1},
+		{nil, nil, -1},
+		{a, changed, readBackBuffer + 3},
+		{a, a[:readBackBuffer], readBackBuffer},
+		{a[:5], a, 5},
+	}
+	for i, tt := range tests {
+		got, err := firstDifference(bytes.NewReader(tt.local), bytes.NewReader(tt.remote))
+		if err != nil || got != tt.want {
+			t.Fatalf("case %d: expected %d, got %d (%v)", i, tt.want, got, err)
+		}
+	}
+}
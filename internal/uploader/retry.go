@@ -0,0 +1,78 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// maxBackoff caps the delay between two attempts.
+const maxBackoff = 30 * time.Second
+
+// Backoff configures retries of transiently failing operations. The delay
+// before retry n (starting at 1) is Initial*2^(n-1), capped at 30s, plus up to
+// 20% random jitter so concurrent writers don't retry in lockstep. The zero
+// value doesn't retry.
+type Backoff struct {
+	// Retries is the number of attempts after the first one.
+	Retries int
+	Initial time.Duration
+	// NOTE(joel): sleep is a test hook; defaults to waiting on a timer.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Do runs fn until it succeeds, the retries are exhausted or ctx is done. The
+// last error is returned, annotated with the number of attempts if fn was
+// retried.
+func (b Backoff) Do(ctx context.Context, fn func() error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	sleep := b.sleep
+	if sleep == nil {
+		sleep = sleepCtx
+	}
+	delay := b.Initial
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt >= b.Retries {
+			break
+		}
+		// NOTE(joel): Retrying a create-only upload of an existing object, a
+		// request to a requester pays bucket without billing project or a write
+		// rejected by a hold or retention can't succeed.
+		if errors.Is(err, ErrObjectExists) || errors.Is(err, ErrRequesterPays) || errors.Is(err, ErrRetention) {
+			return err
+		}
+		d := delay + time.Duration(rand.Int64N(int64(delay)/5+1))
+		if serr := sleep(ctx, d); serr != nil {
+			return fmt.Errorf("%w (retry aborted: %v)", err, serr)
+		}
+		delay = min(delay*2, maxBackoff)
+	}
+	if b.Retries > 0 {
+		return fmt.Errorf("%w (after %d attempts)", err, b.Retries+1)
+	}
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// sleepCtx waits for d or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,95 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// TestBackoff_Do verifies retries with growing delays until success or the
+// retries are exhausted.
+func TestBackoff_Do(t *testing.T) {
+	var delays []time.Duration
+	b := Backoff{Retries: 3, Initial: 100 * time.Millisecond}
+	b.sleep = func(_ context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+
+	calls := 0
+	err := b.Do(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 || len(delays) != 2 {
+		t.Fatalf("expected success on 3rd attempt, got err=%v calls=%d delays=%v", err, calls, delays)
+	}
+	if delays[0] < 100*time.Millisecond || delays[0] > 120*time.Millisecond || delays[1] < 200*time.Millisecond {
+		t.Fatalf("unexpected delays %v", delays)
+	}
+
+	boom := errors.New("boom")
+	calls = 0
+	err = b.Do(context.Background(), func() error { calls++; return boom })
+	if !errors.Is(err, boom) || calls != 4 || !strings.Contains(err.Error(), "after 4 attempts") {
+		t.Fatalf("expected boom after 4 attempts, got %v (%d calls)", err, calls)
+	}
+
+	calls = 0
+	if err := (Backoff{}).Do(context.Background(), func() error { calls++; return boom }); err != boom || calls != 1 {
+		t.Fatalf("expected zero value not to retry, got %v (%d calls)", err, calls)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestBackoff_Canceled verifies retries stop when the context is done.
+func TestBackoff_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls := 0
+	err := Backoff{Retries: 5, Initial: time.Hour}.Do(ctx, func() error { calls++; return errors.New("boom") })
+	if err == nil || calls != 1 || !strings.Contains(err.Error(), "retry aborted") {
+		t.Fatalf("expected abort after first attempt, got %v (%d calls)", err, calls)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestClassify verifies that rejected requests to requester pays buckets
+// and writes rejected by holds or retention are recognized, and that they
+// aren't retried.
+func TestClassify(t *testing.T) {
+	rejected := &googleapi.Error{Code: 400, Message: "Bucket is a requester pays bucket but no user project provided."}
+	err := requesterPays(rejected)
+	if !errors.Is(err, ErrRequesterPays) || !errors.Is(err, rejected) {
+		t.Fatalf("expected requester pays error, got %v", err)
+	}
+	other := &googleapi.Error{Code: 400, Message: "Invalid argument."}
+	if err := requesterPays(other); errors.Is(err, ErrRequesterPays) {
+		t.Fatalf("expected other errors unchanged, got %v", err)
+	}
+	retained := &googleapi.Error{Code: 403, Message: "Object 'F/a.txt' is subject to bucket's retention policy or object retention and cannot be deleted or overwritten until 2031-01-01T00:00:00Z."}
+	if err := classify(retained); !errors.Is(err, ErrRetention) || errors.Is(err, ErrRequesterPays) {
+		t.Fatalf("expected retention error, got %v", err)
+	}
+	if err := classify(rejected); !errors.Is(err, ErrRequesterPays) || errors.Is(err, ErrRetention) {
+		t.Fatalf("expected requester pays error, got %v", err)
+	}
+	if err := classify(other); errors.Is(err, ErrRetention) || errors.Is(err, ErrRequesterPays) {
+		t.Fatalf("expected other errors unchanged, got %v", err)
+	}
+
+	calls := 0
+	b := Backoff{Retries: 3, sleep: func(context.Context, time.Duration) error { return nil }}
+	if err := b.Do(context.Background(), func() error { calls++; return requesterPays(rejected) }); !errors.Is(err, ErrRequesterPays) || calls != 1 {
+		t.Fatalf("expected no retries, got %v (%d calls)", err, calls)
+	}
+}
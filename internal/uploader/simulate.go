@@ -0,0 +1,51 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+)
+
+// ErrSimulatedFailure is returned by operations failed on purpose via
+// -simulate-failures. Callers can detect it with errors.Is.
+var ErrSimulatedFailure = errors.New("simulated failure")
+
+// faultInjector randomly fails operations at a configured rate (0..1). A nil
+// injector never fails.
+type faultInjector struct {
+	rate float64
+	rnd  *rand.Rand
+	mu   sync.Mutex
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// newFaultInjector returns an injector for the given rate, or nil if rate is
+// not positive.
+func newFaultInjector(rate float64, rnd *rand.Rand) *faultInjector {
+	if rate <= 0 {
+		return nil
+	}
+	if rnd == nil {
+		rnd = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	}
+	return &faultInjector{rate: rate, rnd: rnd}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// maybeFail returns a wrapped ErrSimulatedFailure for the named operation
+// with probability rate.
+func (f *faultInjector) maybeFail(op string) error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	hit := f.rnd.Float64() < f.rate
+	f.mu.Unlock()
+	if hit {
+		return fmt.Errorf("%s: %w", op, ErrSimulatedFailure)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"path/filepath"
+	"testing"
+
+	"local-file-sync/internal/scanner"
+)
+
+// TestFaultInjector_Rates verifies the boundary rates and nil safety.
+func TestFaultInjector_Rates(t *testing.T) {
+	if newFaultInjector(0, nil) != nil {
+		t.Fatalf("expected nil injector for zero rate")
+	}
+	var nilInj *faultInjector
+	if err := nilInj.maybeFail("op"); err != nil {
+		t.Fatalf("nil injector must never fail")
+	}
+	always := newFaultInjector(1, rand.New(rand.NewPCG(1, 2)))
+	for range 10 {
+		if err := always.maybeFail("op"); !errors.Is(err, ErrSimulatedFailure) {
+			t.Fatalf("expected simulated failure, got %v", err)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestSimulateFailures_Upload verifies injected failures surface as upload
+// errors without calling the real upload.
+func TestSimulateFailures_Upload(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "a.txt")
+	mustWrite(t, p, []byte("x"))
+	u, uploaded := newTestUploader(t)
+	u.SimulateFailures(1)
+	res := u.UploadFolder(scanner.Match{Folder: dir, FolderEntries: []scanner.FileEntry{{Name: "a.txt", Path: p}}}, UploadOptions{})
+	if !errors.Is(res.Err(), ErrSimulatedFailure) {
+		t.Fatalf("expected simulated failure, got %v", res.Err())
+	}
+	if len(*uploaded) != 0 {
+		t.Fatalf("expected no real uploads, got %v", *uploaded)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestSimulateFailures_Firestore verifies injected failures on record writes.
+func TestSimulateFailures_Firestore(t *testing.T) {
+	docs := newTestDocs()
+	fs := NewDocumentRecordWriter(context.Background(), docs)
+	fs.SimulateFailures(1)
+	if err := fs.WriteFolderRecord("col", FolderRecord{FolderPath: "p"}); !errors.Is(err, ErrSimulatedFailure) {
+		t.Fatalf("expected simulated failure, got %v", err)
+	}
+	if docs.count("col") != 0 {
+		t.Fatalf("expected no real writes")
+	}
+}
@@ -0,0 +1,285 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"local-file-sync/internal/app"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// Storage is the object store GCSUploader writes to. NewGCS uses a Google
+// Cloud Storage bucket; tests and alternative transports provide their own
+// implementation to NewStorageUploader.
+type Storage interface {
+	// Put stores the content read from r as object name and returns the
+	// attributes of the written object. With opts.CreateOnly it fails with
+	// ErrObjectExists if the object exists already, returning the attributes
+	// of the existing object if known.
+	Put(ctx context.Context, name string, r io.Reader, opts PutOptions) (ObjectAttrs, error)
+	// List returns the objects whose name starts with prefix.
+	List(ctx context.Context, prefix string) ([]ObjectAttrs, error)
+	// Get returns a reader of the content of object name in the given
+	// generation (the live one if 0). Gzip encoded objects are read
+	// decompressed.
+	Get(ctx context.Context, name string, generation int64) (io.ReadCloser, error)
+	Close() error
+}
+
+// PutOptions describe an object written with Storage.Put.
+type PutOptions struct {
+	ContentType string
+	// ContentEncoding is "gzip" if the content is gzip compressed.
+	ContentEncoding string
+	Metadata        map[string]string
+	// CreateOnly writes the object only if it doesn't exist yet.
+	CreateOnly bool
+	// PredefinedACL, if set, is the predefined ACL of the JSON API (e.g.
+	// "publicRead") applied to the object; GCS rejects it for buckets with
+	// uniform bucket-level access.
+	PredefinedACL string
+	// TemporaryHold and EventBasedHold place holds on the object.
+	TemporaryHold  bool
+	EventBasedHold bool
+	// RetainUntil, if set, retains the object until then, in locked mode if
+	// RetentionLocked is set; object retention must be enabled on the bucket.
+	RetainUntil     time.Time
+	RetentionLocked bool
+}
+
+// ObjectAttrs are the attributes of a stored object.
+type ObjectAttrs struct {
+	Name            string
+	Metadata        map[string]string
+	ContentEncoding string
+	// Generation and Metageneration identify the version of the object; zero
+	// if the store doesn't version objects.
+	Generation     int64
+	Metageneration int64
+	// RetainUntil is the time the object is retained until by its own
+	// retention or the retention policy of the bucket; zero if it isn't.
+	RetainUntil time.Time
+}
+
+// ClientOptions configure the transport of the storage client created by
+// NewGCS.
+type ClientOptions struct {
+	// API is app.GCSAPIJSON (the default if empty) or app.GCSAPIGRPC.
+	API string
+	// Proxy, if set, is the URL of the HTTP proxy JSON API requests are sent
+	// through instead of the one from the environment (HTTPS_PROXY).
+	Proxy string
+	// UserAgent, if set, replaces the client library's user agent.
+	UserAgent string
+	// BillingProject, if set, is the project billed for the requests (the
+	// user project), which requester pays buckets require.
+	BillingProject string
+}
+
+// ErrRetention is returned for writes GCS rejected because of a hold or
+// retention, e.g. overwriting a held or retained object, or setting object
+// retention on a bucket that doesn't enable it.
+var ErrRetention = errors.New("rejected by object hold or retention")
+
+// ErrRequesterPays is returned for requests to a requester pays bucket that
+// GCS rejected for lack of a billing project (see
+// ClientOptions.BillingProject).
+var ErrRequesterPays = errors.New("bucket is requester pays and requires a billing project")
+
+// gcsStorage implements Storage with a Google Cloud Storage bucket.
+type gcsStorage struct {
+	client *storage.Client
+	bucket *storage.BucketHandle
+}
+
+// NOTE(joel): Compile-time check that the bucket adapter satisfies the
+// interface.
+var _ Storage = (*gcsStorage)(nil)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// newStorageClient creates a storage client for the API, proxy and user agent
+// of opts.
+func newStorageClient(ctx context.Context, opts ClientOptions) (*storage.Client, error) {
+	var copts []option.ClientOption
+	if opts.UserAgent != "" {
+		copts = append(copts, option.WithUserAgent(opts.UserAgent))
+	}
+	if opts.API == app.GCSAPIGRPC {
+		return storage.NewGRPCClient(ctx, copts...)
+	}
+	if opts.Proxy != "" {
+		proxy, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("parse proxy: %w", err)
+		}
+		// NOTE(joel): A custom HTTP client replaces the authenticated one of the
+		// library, so the proxied transport is wrapped with authentication (and
+		// the user agent) here.
+		base := http.DefaultTransport.(*http.Transport).Clone()
+		base.Proxy = http.ProxyURL(proxy)
+		trans, err := htransport.NewTransport(ctx, base, append(copts, option.WithScopes(storage.ScopeFullControl))...)
+		if err != nil {
+			return nil, fmt.Errorf("create proxy transport: %w", err)
+		}
+		copts = append(copts, option.WithHTTPClient(&http.Client{Transport: trans}))
+	}
+	return storage.NewClient(ctx, copts...)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Put implements Storage.
+func (s *gcsStorage) Put(ctx context.Context, name string, r io.Reader, opts PutOptions) (ObjectAttrs, error) {
+	obj := s.bucket.Object(name)
+	target := obj
+	if opts.CreateOnly {
+		// NOTE(joel): Equivalent to ifGenerationMatch=0.
+		target = obj.If(storage.Conditions{DoesNotExist: true})
+	}
+	w := target.NewWriter(ctx)
+	w.ContentType = opts.ContentType
+	w.ContentEncoding = opts.ContentEncoding
+	w.Metadata = opts.Metadata
+	w.PredefinedACL = opts.PredefinedACL
+	w.TemporaryHold = opts.TemporaryHold
+	w.EventBasedHold = opts.EventBasedHold
+	if !opts.RetainUntil.IsZero() {
+		mode := "Unlocked"
+		if opts.RetentionLocked {
+			mode = "Locked"
+		}
+		w.Retention = &storage.ObjectRetention{Mode: mode, RetainUntil: opts.RetainUntil}
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return ObjectAttrs{}, fmt.Errorf("copy to gcs %s: %w", name, classify(err))
+	}
+	if err := w.Close(); err != nil {
+		if opts.CreateOnly && isPreconditionFailed(err) {
+			// NOTE(joel): The attributes tell the caller what it ran into;
+			// failing to read them doesn't change the outcome.
+			attrs, _ := obj.Attrs(ctx)
+			return objectAttrs(attrs), fmt.Errorf("finalize object %s: %w", name, ErrObjectExists)
+		}
+		return ObjectAttrs{}, fmt.Errorf("finalize object %s: %w", name, classify(err))
+	}
+	// NOTE(joel): Attrs is set once Close succeeded.
+	return objectAttrs(w.Attrs()), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// List implements Storage. Only the attributes used by the uploader are
+// requested.
+func (s *gcsStorage) List(ctx context.Context, prefix string) ([]ObjectAttrs, error) {
+	q := &storage.Query{Prefix: prefix}
+	if err := q.SetAttrSelection([]string{"Name", "Metadata", "Generation", "Metageneration"}); err != nil {
+		return nil, err
+	}
+	var objs []ObjectAttrs
+	it := s.bucket.Objects(ctx, q)
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return objs, nil
+		}
+		if err != nil {
+			return nil, requesterPays(err)
+		}
+		objs = append(objs, objectAttrs(attrs))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Get implements Storage. Gzip encoded objects are decompressed by the client
+// (decompressive transcoding).
+func (s *gcsStorage) Get(ctx context.Context, name string, generation int64) (io.ReadCloser, error) {
+	obj := s.bucket.Object(name)
+	if generation > 0 {
+		obj = obj.Generation(generation)
+	}
+	r, err := obj.NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read object %s: %w", name, requesterPays(err))
+	}
+	return r, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Close implements Storage.
+func (s *gcsStorage) Close() error {
+	return s.client.Close()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// objectAttrs converts GCS object attributes; nil yields the zero value.
+func objectAttrs(attrs *storage.ObjectAttrs) ObjectAttrs {
+	if attrs == nil {
+		return ObjectAttrs{}
+	}
+	o := ObjectAttrs{
+		Name:            attrs.Name,
+		Metadata:        attrs.Metadata,
+		ContentEncoding: attrs.ContentEncoding,
+		Generation:      attrs.Generation,
+		Metageneration:  attrs.Metageneration,
+		RetainUntil:     attrs.RetentionExpirationTime,
+	}
+	if attrs.Retention != nil && attrs.Retention.RetainUntil.After(o.RetainUntil) {
+		o.RetainUntil = attrs.Retention.RetainUntil
+	}
+	return o
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// requesterPays marks err with ErrRequesterPays if GCS rejected the request
+// because the bucket is requester pays and no billing project was set. The
+// error carries no dedicated code (HTTP 400 via JSON, InvalidArgument via
+// gRPC), so its message is matched.
+func requesterPays(err error) error {
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "requester pays") || strings.Contains(msg, "user project") {
+		return fmt.Errorf("%w: %w", ErrRequesterPays, err)
+	}
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// classify marks a failed write with ErrRequesterPays or ErrRetention. Like
+// requester pays, holds and retention are only told apart by the message
+// (HTTP 403 or 400, PermissionDenied or FailedPrecondition via gRPC).
+func classify(err error) error {
+	if err = requesterPays(err); errors.Is(err, ErrRequesterPays) {
+		return err
+	}
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "retention") || strings.Contains(msg, " hold") {
+		return fmt.Errorf("%w: %w", ErrRetention, err)
+	}
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// isPreconditionFailed reports whether err is a failed request precondition
+// (HTTP 412), e.g. a create-only write of an existing object.
+func isPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
@@ -0,0 +1,283 @@
+package uploader
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/scanner"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Uploader uploads the immediate files of matched folders to a destination.
+// GCSUploader is the production implementation; see the fakes package for an
+// in-memory implementation usable in tests.
+type Uploader interface {
+	UploadFolder(m scanner.Match, opts UploadOptions) FolderResult
+	Close() error
+}
+
+// UploadOptions control how the objects of an uploaded folder are named:
+//
+//	`<Prefix>/<FolderName>/<filename>`
+type UploadOptions struct {
+	// Prefix is prepended to all object names; empty means none.
+	Prefix string
+	// FolderName replaces basename(folder) in object names if set.
+	FolderName string
+	// NormalizeUnicode converts object names to Unicode NFC form.
+	NormalizeUnicode bool
+	// Metadata is set as custom metadata on every uploaded object.
+	Metadata map[string]string
+	// FollowSymlinks uploads the content of symlinked files instead of
+	// skipping them.
+	FollowSymlinks bool
+	// DedupeHardlinks uploads hard-linked files of a folder only once and
+	// records the other names as links (see UploadedFile.LinkOf).
+	DedupeHardlinks bool
+	// CompressSparse stores sparse files gzip compressed.
+	CompressSparse bool
+	// NiceIO, if set, paces the reads of local files (-nice-io); it is
+	// shared by all folders of a run.
+	NiceIO *NiceIO
+	// ReadBack is the fraction (0 to 1) of uploaded objects that are read
+	// back from the destination and compared byte for byte with the local
+	// content (see ReadBackSampled). A mismatch fails the file with
+	// ErrReadBackMismatch. Existing objects, hard links and empty markers are
+	// not read back.
+	ReadBack float64
+	// SkipExisting lists the destination prefix once per folder and skips
+	// files whose object already exists with the same SHA256 (recorded in the
+	// MetadataSHA256 object metadata on upload).
+	SkipExisting bool
+	// Done holds files (by entry name) uploaded by an earlier run that failed
+	// part way. Entries with the same size and modification time aren't
+	// uploaded again; their metadata is reused.
+	Done map[string]UploadedFile
+	// EmptyMarker uploads an empty EmptyMarkerName object into the folder
+	// prefix if the folder has no uploadable files, so consumers see the folder
+	// arrived empty.
+	EmptyMarker bool
+	// BundleSmallFiles, if > 0, uploads files smaller than this many bytes
+	// as members of tar bundle objects instead of one object each, cutting
+	// per-object overhead for folders of many tiny files (see
+	// UploadedFile.Bundled).
+	BundleSmallFiles int64
+	// FileRetry retries failed file (and bundle) uploads before giving up on
+	// them; the zero value doesn't retry.
+	FileRetry Backoff
+	// CancelOnFileFailure stops uploading the remaining files of the folder
+	// once a file failed (after its retries). By default the other files are
+	// uploaded best effort, so a retry only needs the failed ones.
+	CancelOnFileFailure bool
+	// CreateOnly uploads with a does-not-exist precondition (ifGenerationMatch
+	// 0), so an object written meanwhile, e.g. by another agent, is never
+	// overwritten. The file fails with ErrObjectExists instead, unless
+	// SkipConflicts is set.
+	CreateOnly bool
+	// SkipConflicts records files whose create-only upload found an existing
+	// object with that object (UploadedFile.Existing) instead of failing them.
+	SkipConflicts bool
+	// Version, if set, is a path segment placed between the folder and its
+	// files (`<folder>/<version>/<file>`), so a re-upload doesn't overwrite
+	// an earlier delivery.
+	Version string
+	// Deadline, if > 0, bounds the upload of the folder: once it passed,
+	// uploads in flight are canceled, the remaining files are not started and
+	// the folder fails with ErrFolderDeadline. Files uploaded until then are
+	// reported as usual.
+	Deadline time.Duration
+	// StrictSnapshot fails regular files that vanished or whose size or
+	// modification time differ from their listing (scanner.FileEntry), checked
+	// before and after their upload, with ErrSnapshotChanged. Otherwise they
+	// are uploaded with their current content and vanished files skipped.
+	StrictSnapshot bool
+	// ContentTypes maps lower case file extensions (with dot) to content
+	// types, taking precedence over the built-in ones (see contentType).
+	ContentTypes map[string]string
+	// FileOwnership additionally records the permission bits and, where the
+	// platform exposes them, the owning user and group ID of each file as
+	// object metadata (MetadataMode, MetadataUID, MetadataGID).
+	FileOwnership bool
+	// ObjectACLs assign predefined ACLs to the objects by file name (bundles
+	// and empty markers by their object name); objects without a matching
+	// rule get the bucket default.
+	ObjectACLs app.ObjectACLs
+	// Hold, if set, is the hold (app.HoldTemporary or app.HoldEventBased)
+	// placed on every object written, bundles and empty markers included.
+	Hold string
+	// Retention, if set, retains every object written for its period after
+	// the upload.
+	Retention app.ObjectRetention
+}
+
+// MetadataSHA256 is the custom metadata key holding the hex SHA256 of the
+// uploaded file content.
+const MetadataSHA256 = "sha256"
+
+// MetadataModTime is the custom metadata key holding the modification time of
+// the uploaded file in RFC 3339 format with nanoseconds (UTC), so restores can
+// reconstruct it.
+const MetadataModTime = "mtime"
+
+// MetadataMode, MetadataUID and MetadataGID are the custom metadata keys
+// holding the octal permission bits and the numeric owner of the uploaded file
+// (see UploadOptions.FileOwnership).
+const (
+	MetadataMode = "mode"
+	MetadataUID  = "uid"
+	MetadataGID  = "gid"
+)
+
+// EmptyMarkerName is the name of the object uploaded for empty folders (see
+// UploadOptions.EmptyMarker).
+const EmptyMarkerName = ".lfs-empty"
+
+// MetadataBundle is the custom metadata key marking bundle objects (see
+// UploadOptions.BundleSmallFiles); its value is the archive format, "tar".
+const MetadataBundle = "bundle"
+
+// RecordWriter persists one metadata record per uploaded folder and arbitrates
+// folder claims and run leases between agents. Firestore is the production implementation;
+// see the fakes package for an in-memory implementation usable in tests.
+type RecordWriter interface {
+	WriteFolderRecord(collection string, rec FolderRecord) error
+	WriteBatchRecord(collection string, rec BatchRecord) error
+	ClaimFolder(collection string, claim FolderClaim) (FolderClaim, bool, error)
+	CompleteClaim(collection string, claim FolderClaim) error
+	ReleaseClaim(collection string, claim FolderClaim) error
+	AcquireLease(collection string, lease Lease) (Lease, bool, error)
+	RenewLease(collection string, lease Lease) error
+	ReleaseLease(collection string, lease Lease) error
+	Close() error
+}
+
+// Lister is implemented by uploaders that can list destination objects. It
+// returns the MetadataSHA256 of every object below prefix by name (empty for
+// objects without it).
+type Lister interface {
+	ListObjects(prefix string) (map[string]string, error)
+}
+
+// NOTE(joel): Compile-time checks that the production types satisfy the
+// interfaces.
+var (
+	_ Uploader     = (*GCSUploader)(nil)
+	_ Lister       = (*GCSUploader)(nil)
+	_ RecordWriter = (*Firestore)(nil)
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Uploadable reports whether a folder entry should be uploaded and returns its
+// file info if so. Missing files, directories and *.RDY files are not
+// uploadable. Symlinks are skipped unless followSymlinks is set, in which case
+// the info of the target is returned; links to directories, dangling links and
+// symlink loops are skipped.
+func Uploadable(fe scanner.FileEntry, followSymlinks bool) (os.FileInfo, bool) {
+	// NOTE(joel): Guard against empty paths. This should not happen in
+	// practice since we control the FileEntry creation, but be defensive.
+	if fe.Path == "" {
+		return nil, false
+	}
+	if strings.HasSuffix(strings.ToUpper(fe.Name), ".RDY") {
+		return nil, false
+	}
+	fi, err := os.Lstat(fe.Path)
+	if err != nil {
+		return nil, false
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if !followSymlinks {
+			return nil, false
+		}
+		// NOTE(joel): Stat resolves the whole link chain and fails with ELOOP
+		// on cycles, which protects us from symlink loops.
+		if fi, err = os.Stat(fe.Path); err != nil {
+			return nil, false
+		}
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, false
+	}
+	return fi, true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// FolderPrefix returns the destination prefix the objects of folder are
+// stored below with opts (without trailing slash).
+func FolderPrefix(folder string, opts UploadOptions) string {
+	prefix := MakePrefixGetter(opts.Prefix, opts.FolderName, opts.Version)(folder)
+	if opts.NormalizeUnicode {
+		prefix = norm.NFC.String(prefix)
+	}
+	return prefix
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ObjectName returns the name of the object the folder entry name (relative
+// to its folder) is stored under below prefix (see MakePrefixGetter) with
+// opts.
+func ObjectName(prefix, name string, opts UploadOptions) string {
+	objectName := prefix + "/" + filepath.ToSlash(name)
+	if opts.NormalizeUnicode {
+		objectName = norm.NFC.String(objectName)
+	}
+	return objectName
+}
+
+// DoneFile returns the file opts.Done records for the folder entry name,
+// marked Existing, if it can be recorded as is instead of uploaded again: it
+// hasn't changed since (fi) and was uploaded to the same destination as
+// objectName (see UploadOptions.Version).
+func DoneFile(name, objectName string, fi os.FileInfo, opts UploadOptions) (UploadedFile, bool) {
+	done, ok := opts.Done[name]
+	if !ok || done.Size != fi.Size() || !done.ModTime.Equal(fi.ModTime()) || path.Dir(done.Path) != path.Dir(objectName) {
+		return UploadedFile{}, false
+	}
+	done.Existing = true
+	return done, true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ObjectNames returns the destination prefix of a matched folder and the
+// object name each of its uploadable files is stored under with opts, by
+// entry name. Files stored as bundle members (see
+// UploadOptions.BundleSmallFiles) or recorded as hard links of another entry
+// have no object of their own and are left out.
+func ObjectNames(m scanner.Match, opts UploadOptions) (string, map[string]string, error) {
+	prefix := FolderPrefix(m.Folder, opts)
+	names := make(map[string]string)
+	primaries := make(map[[2]uint64]bool)
+	for fe, err := range m.Entries() {
+		if err != nil {
+			return "", nil, fmt.Errorf("list entries: %w", err)
+		}
+		fi, ok := Uploadable(fe, opts.FollowSymlinks)
+		if !ok {
+			continue
+		}
+		if opts.DedupeHardlinks {
+			if id, ok := fileID(fi); ok {
+				if primaries[id] {
+					continue
+				}
+				primaries[id] = true
+			}
+		}
+		compress := opts.CompressSparse && isSparse(fi)
+		if opts.BundleSmallFiles > 0 && fi.Size() < opts.BundleSmallFiles && !compress {
+			continue
+		}
+		names[fe.Name] = ObjectName(prefix, fe.Name, opts)
+	}
+	return prefix, names, nil
+}
@@ -0,0 +1,586 @@
+// Package fakes provides in-memory implementations of the uploader interfaces
+// (lfs.Uploader, lfs.RecordWriter) so the upload pipeline can be exercised
+// without cloud access, by this module's tests as well as by embedders.
+package fakes
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"local-file-sync/internal/scanner"
+	"local-file-sync/internal/uploader"
+)
+
+// GCS is an in-memory uploader.Uploader. Uploaded file contents are kept in
+// Objects keyed by object name. Every write assigns the object a new, increasing
+// generation (metageneration 1) like GCS does.
+type GCS struct {
+	// Err, if set, is returned as the upload error for every folder.
+	Err error
+	// FailFolders lists folder paths whose uploads fail with Err (or a generic
+	// error if Err is nil). If empty, Err applies to all folders.
+	FailFolders map[string]bool
+	// FailFiles lists local file paths whose uploads fail while the other
+	// files of the folder succeed.
+	FailFiles map[string]bool
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	metadata map[string]map[string]string
+	// generations holds the generation of each object; generation is the
+	// last one assigned.
+	generations map[string]int64
+	generation  int64
+	closed      bool
+}
+
+// NOTE(joel): Compile-time checks that the fakes satisfy the interfaces.
+var (
+	_ uploader.Uploader       = (*GCS)(nil)
+	_ uploader.Lister         = (*GCS)(nil)
+	_ uploader.ManifestWriter = (*GCS)(nil)
+	_ uploader.RecordWriter   = (*Firestore)(nil)
+	_ uploader.RecordReader   = (*Firestore)(nil)
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewGCS returns an empty in-memory uploader.
+func NewGCS() *GCS {
+	return &GCS{
+		objects:     make(map[string][]byte),
+		metadata:    make(map[string]map[string]string),
+		generations: make(map[string]int64),
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// UploadFolder copies the uploadable entries of m into memory using the same
+// object naming and filtering rules as the GCS uploader. Hard link
+// deduplication, sparse file compression, small file bundling, the file
+// failure policy and folder deadlines are not simulated; objects sampled for
+// read-back (UploadOptions.ReadBack) are always verified.
+func (g *GCS) UploadFolder(m scanner.Match, opts uploader.UploadOptions) uploader.FolderResult {
+	start := time.Now()
+	res := uploader.FolderResult{ReadyFile: m.ReadyFile, Folder: m.Folder}
+	if err := g.failure(m.Folder); err != nil {
+		res.Errors = append(res.Errors, err)
+		res.Duration = time.Since(start)
+		return res
+	}
+
+	getPrefix := uploader.MakePrefixGetter(opts.Prefix, opts.FolderName, opts.Version)
+	res.Uploaded = []uploader.UploadedFile{}
+	for fe, err := range m.Entries() {
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Errorf("list entries: %w", err))
+			break
+		}
+		fi, ok := uploader.Uploadable(fe, opts.FollowSymlinks)
+		if !ok {
+			res.Skipped = append(res.Skipped, fe.Name)
+			continue
+		}
+		name := uploader.ObjectName(getPrefix(filepath.Dir(fe.Path)), fe.Name, opts)
+		if done, ok := uploader.DoneFile(fe.Name, name, fi, opts); ok {
+			res.Uploaded = append(res.Uploaded, done)
+			continue
+		}
+		b, err := os.ReadFile(fe.Path)
+		if err == nil && g.FailFiles[fe.Path] {
+			err = fmt.Errorf("simulated failure")
+		}
+		if err != nil {
+			res.FailedFiles = append(res.FailedFiles, fe.Name)
+			res.Errors = append(res.Errors, fmt.Errorf("upload %s: %w", fe.Name, err))
+			continue
+		}
+		checksum := fmt.Sprintf("%x", sha256.Sum256(b))
+		g.mu.Lock()
+		existing := opts.SkipExisting && g.metadata[name][uploader.MetadataSHA256] == checksum
+		if _, ok := g.objects[name]; ok && opts.CreateOnly && !existing {
+			if !opts.SkipConflicts {
+				g.mu.Unlock()
+				res.FailedFiles = append(res.FailedFiles, fe.Name)
+				res.Errors = append(res.Errors, fmt.Errorf("upload %s: %w", fe.Name, uploader.ErrObjectExists))
+				continue
+			}
+			existing = true
+			checksum = g.metadata[name][uploader.MetadataSHA256]
+		}
+		if !existing {
+			md := map[string]string{uploader.MetadataSHA256: checksum}
+			maps.Copy(md, opts.Metadata)
+			g.objects[name] = b
+			g.metadata[name] = md
+			g.generation++
+			g.generations[name] = g.generation
+		}
+		generation := g.generations[name]
+		g.mu.Unlock()
+		var hold string
+		var retainUntil time.Time
+		if !existing {
+			hold = opts.Hold
+			if opts.Retention.Period > 0 {
+				retainUntil = time.Now().Add(opts.Retention.Period)
+			}
+		}
+		res.Uploaded = append(res.Uploaded, uploader.UploadedFile{
+			Name:           fe.Name,
+			Size:           fi.Size(),
+			Checksum:       checksum,
+			Path:           name,
+			ModTime:        fi.ModTime(),
+			Existing:       existing,
+			Verified:       !existing && uploader.ReadBackSampled(name, opts.ReadBack),
+			Hold:           hold,
+			RetainUntil:    retainUntil,
+			Generation:     generation,
+			Metageneration: 1,
+		})
+	}
+	if opts.EmptyMarker && len(res.Uploaded) == 0 && len(res.Errors) == 0 {
+		name := uploader.ObjectName(getPrefix(m.Folder), uploader.EmptyMarkerName, opts)
+		checksum := fmt.Sprintf("%x", sha256.Sum256(nil))
+		md := map[string]string{uploader.MetadataSHA256: checksum}
+		maps.Copy(md, opts.Metadata)
+		g.mu.Lock()
+		g.objects[name] = []byte{}
+		g.metadata[name] = md
+		g.generation++
+		g.generations[name] = g.generation
+		generation := g.generation
+		g.mu.Unlock()
+		res.Uploaded = append(res.Uploaded, uploader.UploadedFile{
+			Name:           uploader.EmptyMarkerName,
+			Checksum:       checksum,
+			Path:           name,
+			Generation:     generation,
+			Metageneration: 1,
+		})
+	}
+	sort.Slice(res.Uploaded, func(i, j int) bool { return res.Uploaded[i].Path < res.Uploaded[j].Path })
+	res.Duration = time.Since(start)
+	return res
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// WriteManifest implements uploader.ManifestWriter and stores the record as
+// JSON in the folder prefix. It fails with Err for the folders UploadFolder
+// fails.
+func (g *GCS) WriteManifest(m scanner.Match, rec uploader.FolderRecord, opts uploader.UploadOptions) error {
+	if err := g.failure(m.Folder); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := uploader.FolderPrefix(m.Folder, opts) + "/" + uploader.ManifestName
+	md := map[string]string{uploader.MetadataSHA256: fmt.Sprintf("%x", sha256.Sum256(b))}
+	maps.Copy(md, opts.Metadata)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.objects[name] = b
+	g.metadata[name] = md
+	g.generation++
+	g.generations[name] = g.generation
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Object returns the stored contents of an object and whether it exists.
+func (g *GCS) Object(name string) ([]byte, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b, ok := g.objects[name]
+	return b, ok
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ObjectMetadata returns the custom metadata stored with an object.
+func (g *GCS) ObjectMetadata(name string) map[string]string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.metadata[name]
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ObjectNames returns the sorted names of all stored objects.
+func (g *GCS) ObjectNames() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	names := make([]string, 0, len(g.objects))
+	for n := range g.objects {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ListObjects implements uploader.Lister.
+func (g *GCS) ListObjects(prefix string) (map[string]string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	objs := make(map[string]string)
+	for name := range g.objects {
+		if strings.HasPrefix(name, prefix) {
+			objs[name] = g.metadata[name][uploader.MetadataSHA256]
+		}
+	}
+	return objs, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// DeleteObject removes an object, e.g. to simulate objects deleted out of
+// band.
+func (g *GCS) DeleteObject(name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.objects, name)
+	delete(g.metadata, name)
+	delete(g.generations, name)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Generation returns the generation of an object, 0 if it doesn't exist.
+func (g *GCS) Generation(name string) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.generations[name]
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Close marks the fake as closed.
+func (g *GCS) Close() error {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Closed reports whether Close was called.
+func (g *GCS) Closed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.closed
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// failure returns the configured error for folder, if any.
+func (g *GCS) failure(folder string) error {
+	if g.Err == nil && len(g.FailFolders) == 0 {
+		return nil
+	}
+	if len(g.FailFolders) > 0 && !g.FailFolders[folder] {
+		return nil
+	}
+	if g.Err != nil {
+		return g.Err
+	}
+	return fmt.Errorf("fake upload failure: %s", folder)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Firestore is an in-memory uploader.RecordWriter. Records are stored per
+// collection under the same document IDs the real implementation uses.
+type Firestore struct {
+	// Err, if set, is returned by every WriteFolderRecord, WriteBatchRecord,
+	// claim and lease call.
+	Err error
+
+	mu      sync.Mutex
+	docs    map[string]map[string]uploader.FolderRecord
+	claims  map[string]map[string]uploader.FolderClaim
+	batches map[string][]uploader.BatchRecord
+	leases  map[string]map[string]uploader.Lease
+	closed  bool
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewFirestore returns an empty in-memory record writer.
+func NewFirestore() *Firestore {
+	return &Firestore{
+		docs:    make(map[string]map[string]uploader.FolderRecord),
+		claims:  make(map[string]map[string]uploader.FolderClaim),
+		batches: make(map[string][]uploader.BatchRecord),
+		leases:  make(map[string]map[string]uploader.Lease),
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// WriteFolderRecord stores rec in collection, overwriting any existing record
+// with the same document ID.
+func (f *Firestore) WriteFolderRecord(collection string, rec uploader.FolderRecord) error {
+	if collection == "" {
+		return fmt.Errorf("collection required")
+	}
+	if f.Err != nil {
+		return f.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.docs[collection] == nil {
+		f.docs[collection] = make(map[string]uploader.FolderRecord)
+	}
+	f.docs[collection][rec.DocumentID()] = rec
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// WriteBatchRecord appends rec to the batch records of collection.
+func (f *Firestore) WriteBatchRecord(collection string, rec uploader.BatchRecord) error {
+	if collection == "" {
+		return fmt.Errorf("collection required")
+	}
+	if f.Err != nil {
+		return f.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batches[collection] = append(f.batches[collection], rec)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ClaimFolder stores claim in collection unless another agent holds an
+// uploaded or unexpired claim with the same document ID, and returns the
+// winning claim.
+func (f *Firestore) ClaimFolder(collection string, claim uploader.FolderClaim) (uploader.FolderClaim, bool, error) {
+	if collection == "" {
+		return uploader.FolderClaim{}, false, fmt.Errorf("collection required")
+	}
+	if f.Err != nil {
+		return uploader.FolderClaim{}, false, f.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.claims[collection] == nil {
+		f.claims[collection] = make(map[string]uploader.FolderClaim)
+	}
+	id := claim.DocumentID()
+	winner, ok := f.claims[collection][id]
+	if !ok || winner.Agent == claim.Agent || winner.Expired(claim.ClaimedAt) {
+		f.claims[collection][id] = claim
+		winner = claim
+	}
+	return winner, winner.Agent == claim.Agent, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// CompleteClaim marks a claim held by claim.Agent as uploaded.
+func (f *Firestore) CompleteClaim(collection string, claim uploader.FolderClaim) error {
+	if f.Err != nil {
+		return f.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := claim.DocumentID()
+	if cur, ok := f.claims[collection][id]; ok && cur.Agent == claim.Agent {
+		cur.Status = uploader.ClaimStatusUploaded
+		f.claims[collection][id] = cur
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ReleaseClaim deletes a claim held by claim.Agent whose folder wasn't
+// uploaded.
+func (f *Firestore) ReleaseClaim(collection string, claim uploader.FolderClaim) error {
+	if f.Err != nil {
+		return f.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := claim.DocumentID()
+	if cur, ok := f.claims[collection][id]; ok && cur.Agent == claim.Agent && !cur.Uploaded() {
+		delete(f.claims[collection], id)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Claim returns the stored claim for a folder path in collection, stored
+// under the default (hashed) document ID.
+func (f *Firestore) Claim(collection, folderPath string) (uploader.FolderClaim, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	claim, ok := f.claims[collection][uploader.DocumentID(folderPath)]
+	return claim, ok
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// AcquireLease stores lease in collection unless another run holds an
+// unexpired lease for the same key, and returns the current holder.
+func (f *Firestore) AcquireLease(collection string, lease uploader.Lease) (uploader.Lease, bool, error) {
+	if collection == "" {
+		return uploader.Lease{}, false, fmt.Errorf("collection required")
+	}
+	if f.Err != nil {
+		return uploader.Lease{}, false, f.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.leases[collection] == nil {
+		f.leases[collection] = make(map[string]uploader.Lease)
+	}
+	id := uploader.DocumentID(lease.Key)
+	cur, ok := f.leases[collection][id]
+	if ok && cur.RunID != lease.RunID && !cur.ExpiresAt.Before(lease.AcquiredAt) {
+		return cur, false, nil
+	}
+	f.leases[collection][id] = lease
+	return lease, true, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// RenewLease replaces a lease held by lease.RunID or returns
+// uploader.ErrLeaseLost.
+func (f *Firestore) RenewLease(collection string, lease uploader.Lease) error {
+	if f.Err != nil {
+		return f.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := uploader.DocumentID(lease.Key)
+	if cur, ok := f.leases[collection][id]; !ok || cur.RunID != lease.RunID {
+		return uploader.ErrLeaseLost
+	}
+	f.leases[collection][id] = lease
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ReleaseLease deletes a lease if lease.RunID still holds it.
+func (f *Firestore) ReleaseLease(collection string, lease uploader.Lease) error {
+	if f.Err != nil {
+		return f.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := uploader.DocumentID(lease.Key)
+	if cur, ok := f.leases[collection][id]; ok && cur.RunID == lease.RunID {
+		delete(f.leases[collection], id)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Lease returns the stored lease for key in collection.
+func (f *Firestore) Lease(collection, key string) (uploader.Lease, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lease, ok := f.leases[collection][uploader.DocumentID(key)]
+	return lease, ok
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ReadFolderRecord returns the stored record with document ID id in
+// collection.
+func (f *Firestore) ReadFolderRecord(collection, id string) (uploader.FolderRecord, bool, error) {
+	if f.Err != nil {
+		return uploader.FolderRecord{}, false, f.Err
+	}
+	rec, ok := f.Document(collection, id)
+	return rec, ok, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Document returns the stored record with document ID id in collection.
+func (f *Firestore) Document(collection, id string) (uploader.FolderRecord, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rec, ok := f.docs[collection][id]
+	return rec, ok
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// DeleteDocument removes the record with document ID id from collection,
+// e.g. to simulate a document deleted server-side.
+func (f *Firestore) DeleteDocument(collection, id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.docs[collection], id)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Record returns the stored record for a folder path in collection, stored
+// under the default (hashed) document ID.
+func (f *Firestore) Record(collection, folderPath string) (uploader.FolderRecord, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rec, ok := f.docs[collection][uploader.DocumentID(folderPath)]
+	return rec, ok
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Records returns all records in collection sorted by folder path.
+func (f *Firestore) Records(collection string) []uploader.FolderRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	recs := make([]uploader.FolderRecord, 0, len(f.docs[collection]))
+	for _, r := range f.docs[collection] {
+		recs = append(recs, r)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].FolderPath < recs[j].FolderPath })
+	return recs
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// BatchRecords returns the batch records written to collection in order.
+func (f *Firestore) BatchRecords(collection string) []uploader.BatchRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.batches[collection])
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Close marks the fake as closed.
+func (f *Firestore) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+	return nil
+}
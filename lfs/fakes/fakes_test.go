@@ -0,0 +1,210 @@
+package fakes
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"local-file-sync/internal/scanner"
+	"local-file-sync/internal/uploader"
+)
+
+// TestGCS_UploadFolder verifies files are stored under the expected object
+// names and non-uploadable entries are skipped.
+func TestGCS_UploadFolder(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ORDER1")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("data"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatalf("mkdir sub: %v", err)
+	}
+	g := NewGCS()
+	res := g.UploadFolder(scanner.Match{
+		Folder: dir,
+		FolderEntries: []scanner.FileEntry{
+			{Name: "a.txt", Path: filepath.Join(dir, "a.txt")},
+			{Name: "sub", Path: filepath.Join(dir, "sub")},
+		},
+	}, uploader.UploadOptions{Prefix: "pref"})
+	if res.Failed() {
+		t.Fatalf("unexpected failure: %v", res.Err())
+	}
+	if b, ok := g.Object("pref/ORDER1/a.txt"); !ok || string(b) != "data" {
+		t.Fatalf("object not stored: %v", g.ObjectNames())
+	}
+	if len(res.Uploaded) != 1 || len(res.Skipped) != 1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestGCS_SkipExisting verifies unchanged objects are skipped and recorded as
+// existing with their generation, and changed ones get a new generation.
+func TestGCS_SkipExisting(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ORDER1")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	p := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(p, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	m := scanner.Match{Folder: dir, FolderEntries: []scanner.FileEntry{{Name: "a.txt", Path: p}}}
+	opts := uploader.UploadOptions{SkipExisting: true}
+
+	g := NewGCS()
+	if res := g.UploadFolder(m, opts); res.Failed() || res.Uploaded[0].Existing {
+		t.Fatalf("expected first upload, got %+v", res)
+	}
+	if g.ObjectMetadata("ORDER1/a.txt")[uploader.MetadataSHA256] == "" {
+		t.Fatalf("expected sha256 metadata")
+	}
+	first := g.Generation("ORDER1/a.txt")
+	if res := g.UploadFolder(m, opts); !res.Uploaded[0].Existing || res.Uploaded[0].Generation != first {
+		t.Fatalf("expected unchanged object to be skipped, got %+v", res)
+	}
+	if err := os.WriteFile(p, []byte("changed"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if res := g.UploadFolder(m, opts); res.Uploaded[0].Existing || res.Uploaded[0].Generation <= first {
+		t.Fatalf("expected changed file to be uploaded, got %+v", res)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestGCS_CreateOnly verifies create-only uploads keep existing objects and
+// fail or skip the file depending on SkipConflicts.
+func TestGCS_CreateOnly(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ORDER1")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	p := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(p, []byte("first"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	m := scanner.Match{Folder: dir, FolderEntries: []scanner.FileEntry{{Name: "a.txt", Path: p}}}
+	g := NewGCS()
+	if res := g.UploadFolder(m, uploader.UploadOptions{CreateOnly: true}); res.Failed() {
+		t.Fatalf("unexpected failure: %v", res.Err())
+	}
+	if err := os.WriteFile(p, []byte("second"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if res := g.UploadFolder(m, uploader.UploadOptions{CreateOnly: true}); !errors.Is(res.Err(), uploader.ErrObjectExists) {
+		t.Fatalf("expected conflict, got %v", res.Err())
+	}
+	res := g.UploadFolder(m, uploader.UploadOptions{CreateOnly: true, SkipConflicts: true})
+	if res.Failed() || !res.Uploaded[0].Existing {
+		t.Fatalf("expected existing object kept, got %+v", res)
+	}
+	if b, _ := g.Object("ORDER1/a.txt"); string(b) != "first" {
+		t.Fatalf("expected object not overwritten, got %q", b)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestGCS_FailFolders verifies failures can be targeted at specific folders.
+func TestGCS_FailFolders(t *testing.T) {
+	sentinel := errors.New("boom")
+	g := NewGCS()
+	g.Err = sentinel
+	g.FailFolders = map[string]bool{"/bad": true}
+	if res := g.UploadFolder(scanner.Match{Folder: "/bad"}, uploader.UploadOptions{}); !errors.Is(res.Err(), sentinel) {
+		t.Fatalf("expected sentinel for /bad, got %v", res.Err())
+	}
+	if res := g.UploadFolder(scanner.Match{Folder: "/good"}, uploader.UploadOptions{}); res.Failed() {
+		t.Fatalf("unexpected failure for /good: %v", res.Err())
+	}
+	if err := g.Close(); err != nil || !g.Closed() {
+		t.Fatalf("close not recorded")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestFirestore_Records verifies records are stored per collection and
+// overwritten for the same folder path.
+func TestFirestore_Records(t *testing.T) {
+	f := NewFirestore()
+	if err := f.WriteFolderRecord("", uploader.FolderRecord{}); err == nil {
+		t.Fatalf("expected error for empty collection")
+	}
+	for _, n := range []int{1, 2} {
+		rec := uploader.FolderRecord{FolderPath: "a", Files: make([]uploader.UploadedFile, n)}
+		if err := f.WriteFolderRecord("col", rec); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := f.WriteFolderRecord("col", uploader.FolderRecord{FolderPath: "b"}); err != nil {
+		t.Fatalf("write b: %v", err)
+	}
+	recs := f.Records("col")
+	if len(recs) != 2 || recs[0].FolderPath != "a" || len(recs[0].Files) != 2 {
+		t.Fatalf("unexpected records %+v", recs)
+	}
+	if _, ok := f.Record("other", "a"); ok {
+		t.Fatalf("record leaked across collections")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestFirestore_ClaimFolder verifies only the first agent wins a claim and the
+// winner may claim again.
+func TestFirestore_ClaimFolder(t *testing.T) {
+	f := NewFirestore()
+	if _, won, err := f.ClaimFolder("claims", uploader.FolderClaim{FolderPath: "a", Agent: "x"}); err != nil || !won {
+		t.Fatalf("expected x to win: won=%v err=%v", won, err)
+	}
+	winner, won, err := f.ClaimFolder("claims", uploader.FolderClaim{FolderPath: "a", Agent: "y"})
+	if err != nil || won || winner.Agent != "x" {
+		t.Fatalf("expected y to lose to x: winner=%+v won=%v err=%v", winner, won, err)
+	}
+	if _, won, _ := f.ClaimFolder("claims", uploader.FolderClaim{FolderPath: "a", Agent: "x"}); !won {
+		t.Fatalf("expected x to keep its claim")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TestFirestore_ClaimStatus verifies released claims are deleted, expired ones
+// taken over and completed ones kept.
+func TestFirestore_ClaimStatus(t *testing.T) {
+	f := NewFirestore()
+	now := time.Now()
+	pending := uploader.FolderClaim{FolderPath: "a", Agent: "x", ClaimedAt: now, Status: uploader.ClaimStatusClaimed, ExpiresAt: now.Add(time.Hour)}
+	if _, won, err := f.ClaimFolder("claims", pending); err != nil || !won {
+		t.Fatalf("expected x to win: won=%v err=%v", won, err)
+	}
+	if err := f.ReleaseClaim("claims", pending); err != nil {
+		t.Fatalf("ReleaseClaim: %v", err)
+	}
+	if _, ok := f.Claim("claims", "a"); ok {
+		t.Fatalf("expected claim released")
+	}
+
+	if _, won, _ := f.ClaimFolder("claims", pending); !won {
+		t.Fatalf("expected x to claim again")
+	}
+	late := uploader.FolderClaim{FolderPath: "a", Agent: "y", ClaimedAt: now.Add(2 * time.Hour)}
+	if winner, won, _ := f.ClaimFolder("claims", late); !won || winner.Agent != "y" {
+		t.Fatalf("expected y to take over expired claim, got %+v", winner)
+	}
+	if err := f.CompleteClaim("claims", late); err != nil {
+		t.Fatalf("CompleteClaim: %v", err)
+	}
+	pending.ClaimedAt = now.Add(48 * time.Hour)
+	if winner, won, _ := f.ClaimFolder("claims", pending); won || !winner.Uploaded() {
+		t.Fatalf("expected completed claim of y kept, got %+v", winner)
+	}
+}
@@ -0,0 +1,84 @@
+// Package lfs exposes local-file-sync to code outside this module: Run
+// embeds a run, e.g. in a supervisor, and the interfaces let it plug in its
+// own destinations and record stores, such as the in-memory implementations of
+// the fakes package in tests. The types are aliases of the internal ones, so
+// values pass through unchanged.
+package lfs
+
+import (
+	"context"
+
+	"local-file-sync/internal/scanner"
+	"local-file-sync/internal/uploader"
+)
+
+// Uploader uploads the immediate files of matched folders to a destination.
+type Uploader = uploader.Uploader
+
+// RecordWriter persists folder records and arbitrates folder claims and run
+// leases between agents.
+type RecordWriter = uploader.RecordWriter
+
+// RecordReader is implemented by record writers that can read folder records
+// back.
+type RecordReader = uploader.RecordReader
+
+// ManifestWriter is implemented by uploaders that can write folder manifests
+// (see -folder-manifest).
+type ManifestWriter = uploader.ManifestWriter
+
+// Lister is implemented by uploaders that can list destination objects.
+type Lister = uploader.Lister
+
+// Storage is the object store the GCS uploader writes to (see
+// NewStorageUploader).
+type Storage = uploader.Storage
+
+// Documents is the document store the Firestore record writer keeps its
+// documents in (see NewDocumentRecordWriter).
+type Documents = uploader.Documents
+
+// DocumentTx reads and writes documents within a Documents transaction.
+type DocumentTx = uploader.DocumentTx
+
+// Types passed to and returned by the interfaces above.
+type (
+	Match         = scanner.Match
+	FileEntry     = scanner.FileEntry
+	UploadOptions = uploader.UploadOptions
+	FolderResult  = uploader.FolderResult
+	UploadedFile  = uploader.UploadedFile
+	FolderRecord  = uploader.FolderRecord
+	FolderClaim   = uploader.FolderClaim
+	BatchRecord   = uploader.BatchRecord
+	Lease         = uploader.Lease
+	PutOptions    = uploader.PutOptions
+	ObjectAttrs   = uploader.ObjectAttrs
+	Backoff       = uploader.Backoff
+)
+
+// Errors returned by the interfaces above.
+var (
+	// ErrObjectExists is returned by create-only writes of existing objects.
+	ErrObjectExists = uploader.ErrObjectExists
+	// ErrLeaseLost is returned by RecordWriter.RenewLease if the lease was
+	// taken over.
+	ErrLeaseLost = uploader.ErrLeaseLost
+)
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewStorageUploader returns the GCS uploader writing to store instead of a
+// Google Cloud Storage bucket (if ctx is nil, Background is used).
+func NewStorageUploader(ctx context.Context, bucket string, store Storage, concurrency int) Uploader {
+	return uploader.NewStorageUploader(ctx, bucket, store, concurrency)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewDocumentRecordWriter returns the Firestore record writer keeping its
+// documents in docs instead of a Cloud Firestore database (if ctx is nil,
+// Background is used).
+func NewDocumentRecordWriter(ctx context.Context, docs Documents) RecordWriter {
+	return uploader.NewDocumentRecordWriter(ctx, docs)
+}
@@ -0,0 +1,52 @@
+package lfs
+
+import (
+	"context"
+
+	"local-file-sync/internal/app"
+	"local-file-sync/internal/pipeline"
+)
+
+// Config configures a run like the command line flags do.
+type Config = app.Config
+
+// Env is the clock and filesystem a run, its lock and its state go through
+// (see Config.Env).
+type Env = app.Env
+
+// Clock, ClockFunc and FileSystem make up an Env.
+type (
+	Clock      = app.Clock
+	ClockFunc  = app.ClockFunc
+	FileSystem = app.FileSystem
+)
+
+// Options configure a run started with Run.
+type Options = pipeline.Options
+
+// Report describes the outcome of a run.
+type Report = pipeline.Report
+
+// ErrFoldersFailed is wrapped by the error Run returns if at least one folder
+// failed; the report is complete nonetheless.
+var ErrFoldersFailed = pipeline.ErrFoldersFailed
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ParseFlags defines and parses the command line flags of local-file-sync
+// into a Config, e.g. for a supervisor binary accepting the same flags.
+func ParseFlags() (*Config, error) {
+	return app.ParseFlags()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Run executes a single run (scan, filter, upload, record and state save) as
+// the command line tool does without a command, e.g. from a supervisor that
+// runs syncs periodically in a long-lived server. Canceling ctx stops
+// starting further folder uploads; folders not started fail and are retried by
+// the next run. If folders failed, the error wraps ErrFoldersFailed. Run
+// executes a single wave; run again while Report.Deferred is set to continue.
+func Run(ctx context.Context, opts Options) (Report, error) {
+	return pipeline.Run(ctx, opts)
+}
@@ -0,0 +1,54 @@
+package lfs_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"local-file-sync/lfs"
+	"local-file-sync/lfs/fakes"
+)
+
+// TestRun verifies a run can be embedded through the public package with the
+// in-memory fakes.
+func TestRun(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "ORDER1.RDY"), nil, 0o644); err != nil {
+		t.Fatalf("write rdy: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "ORDER1"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "ORDER1", "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	cfg := &lfs.Config{
+		RootDir:             root,
+		StateFile:           filepath.Join(root, "state.json"),
+		LockFile:            filepath.Join(root, "lock"),
+		GCSBucket:           "bucket",
+		FirestoreCollection: "uploads",
+		Logger:              log.New(io.Discard, "", 0),
+		Stdout:              os.Stdout,
+	}
+	var u lfs.Uploader = fakes.NewGCS()
+	var w lfs.RecordWriter = fakes.NewFirestore()
+
+	rep, err := lfs.Run(context.Background(), lfs.Options{Config: cfg, Uploader: u, RecordWriter: w})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rep.Emitted != 1 || rep.Failed != 0 {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	if got := u.(*fakes.GCS).ObjectNames(); !slices.Equal(got, []string{"ORDER1/a.txt"}) {
+		t.Fatalf("unexpected objects %v", got)
+	}
+	if _, ok := w.(*fakes.Firestore).Record("uploads", "ORDER1"); !ok {
+		t.Fatalf("expected a folder record")
+	}
+}